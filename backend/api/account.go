@@ -4,9 +4,9 @@ import (
 	"backend/db"
 	"backend/types"
 	"backend/util"
-	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -64,12 +64,7 @@ Retrieve account information
 func (s *Server) HandleAccountGET(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(SessionKey).(*Session)
 
-	var userInfo types.User
-	usersCollection := db.GetCollection("users")
-	err := usersCollection.FindOne(context.Background(), bson.M{
-		"_id": session.Store["userid"],
-	}).Decode(&userInfo)
-
+	userInfo, err := s.Store.Users.FindByID(session.UserID())
 	if err != nil {
 		http.Error(
 			w,
@@ -117,18 +112,29 @@ func (s *Server) HandleAccountPUT(w http.ResponseWriter, r *http.Request) {
 
 	session := r.Context().Value(SessionKey).(*Session)
 
-	usersCollection := db.GetCollection("users")
-	_, err := usersCollection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": session.Store["userid"]},
-		bson.M{"$set": changes},
-	)
-
+	err := s.Store.Users.Update(session.UserID(), changes)
 	if err != nil {
 		http.Error(w, "Failed to update account information", http.StatusInternalServerError)
 		return
 	}
 
+	// a new email address has to be verified again
+	if changes.NewEmail != "" {
+		err = s.Store.Users.Update(session.UserID(), bson.M{"emailVerified": false})
+		if err != nil {
+			http.Error(w, "Failed to update account information", http.StatusInternalServerError)
+			return
+		}
+
+		user, err := s.Store.Users.FindByID(session.UserID())
+		if err == nil {
+			err = s.sendVerificationEmail(user)
+		}
+		if err != nil {
+			log.Printf("Failed to send verification email to %s: %s\n", session.UserID().Hex(), err.Error())
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("success"))
 }
@@ -137,23 +143,12 @@ func (s *Server) HandleAccountPUT(w http.ResponseWriter, r *http.Request) {
 func (s *Server) HandleAddressGET(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(SessionKey).(*Session)
 
-	shippingAddrColl := db.GetCollection("shippingAddresses")
-	cursor, err := shippingAddrColl.Find(
-		context.Background(),
-		bson.M{"userid": session.Store["userid"]},
-	)
+	documents, err := s.Store.Addresses.FindByUser(session.UserID())
 	if err != nil {
 		http.Error(w, "Failed to fetch shipping addresses", http.StatusInternalServerError)
 		return
 	}
 
-	var documents []types.ShippingAddress
-	err = cursor.All(context.Background(), &documents)
-	if err != nil {
-		http.Error(w, "Failed to cursor.All", http.StatusInternalServerError)
-		return
-	}
-
 	json, err := json.Marshal(documents)
 	if err != nil {
 		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
@@ -164,18 +159,6 @@ func (s *Server) HandleAddressGET(w http.ResponseWriter, r *http.Request) {
 	w.Write(json)
 }
 
-func removeDefaultAddress(userID primitive.ObjectID) error {
-	addressesCollection := db.GetCollection("shippingAddresses")
-
-	_, err := addressesCollection.UpdateOne(
-		context.Background(),
-		bson.M{"userid": userID, "default": true},
-		bson.M{"$set": bson.M{"default": false}},
-	)
-
-	return err
-}
-
 // Used to create a new address
 func (s *Server) HandleAddressPOST(w http.ResponseWriter, r *http.Request) {
 	var address types.ShippingAddress
@@ -188,23 +171,21 @@ func (s *Server) HandleAddressPOST(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(SessionKey).(*Session)
 
 	// set userID before updatting users document
-	address.UserID = session.Store["userid"].(primitive.ObjectID)
-
-	addressesCollection := db.GetCollection("shippingAddresses")
+	address.UserID = session.UserID()
 
 	/*
 		allow the newly added address to override old default address as the
 		new default address if default = true
 	*/
 	if address.Default {
-		err = removeDefaultAddress(address.UserID)
+		err = s.Store.Addresses.ClearDefault(address.UserID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
-	_, err = addressesCollection.InsertOne(context.Background(), address)
+	_, err = s.Store.Addresses.Insert(address)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -235,7 +216,6 @@ func (s *Server) HandleAddressPUT(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	addressesCollection := db.GetCollection("shippingAddresses")
 	session := r.Context().Value(SessionKey).(*Session)
 
 	/*
@@ -243,28 +223,25 @@ func (s *Server) HandleAddressPUT(w http.ResponseWriter, r *http.Request) {
 		new default address if default = true
 	*/
 	if changes.Changes.NewDefault {
-		err = removeDefaultAddress(session.Store["userid"].(primitive.ObjectID))
+		err = s.Store.Addresses.ClearDefault(session.UserID())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
-	res, err := addressesCollection.UpdateByID(
-		context.Background(),
-		addressID,
-		bson.M{"$set": changes.Changes},
-	)
-	if err != nil {
-		http.Error(w, "Failed to update record", http.StatusInternalServerError)
-		return
-	}
-	if res.MatchedCount == 0 {
+	err = s.Store.Addresses.Update(addressID, changes.Changes)
+	if err == db.ErrNotFound {
 		http.Error(
 			w,
 			"Document with provided addressID does not exist",
 			http.StatusBadRequest,
 		)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update record", http.StatusInternalServerError)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -283,17 +260,13 @@ func (s *Server) HandleAddressDELETE(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	shippingAddrColl := db.GetCollection("shippingAddresses")
-	res, err := shippingAddrColl.DeleteOne(
-		context.Background(),
-		bson.M{"_id": objID, "userid": session.Store["userid"]},
-	)
-	if err != nil {
-		http.Error(w, "Failed to delete document", http.StatusInternalServerError)
+	err = s.Store.Addresses.Delete(objID, session.UserID())
+	if err == db.ErrNotFound {
+		http.Error(w, "Could not find document with ID", http.StatusBadRequest)
 		return
 	}
-	if res.DeletedCount == 0 {
-		http.Error(w, "Could not find document with ID", http.StatusBadRequest)
+	if err != nil {
+		http.Error(w, "Failed to delete document", http.StatusInternalServerError)
 		return
 	}
 
@@ -306,23 +279,12 @@ func (s *Server) HandleAddressDELETE(w http.ResponseWriter, r *http.Request) {
 func (s *Server) HandlePurchaseHistory(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(SessionKey).(*Session)
 
-	receiptsCollection := db.GetCollection("receipts")
-	cursor, err := receiptsCollection.Find(
-		context.Background(),
-		bson.M{"userid": session.Store["userid"]},
-	)
+	receipts, err := s.Store.Receipts.FindByUser(session.UserID())
 	if err != nil {
 		http.Error(w, "Failed to fetch purchase history", http.StatusInternalServerError)
 		return
 	}
 
-	var receipts []Receipt
-	err = cursor.All(context.Background(), &receipts)
-	if err != nil {
-		http.Error(w, "Failed to cursor.All", http.StatusInternalServerError)
-		return
-	}
-
 	json, err := json.Marshal(receipts)
 	if err != nil {
 		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
@@ -334,7 +296,9 @@ func (s *Server) HandlePurchaseHistory(w http.ResponseWriter, r *http.Request) {
 }
 
 /*
-Returns a specified purchase history item to the client
+Returns a specified purchase history item to the client, with a sub-order
+for each seller it has items from, and each sub-order's status and when it
+moved to each status it has had
 */
 func (s *Server) HandlePurchaseHistoryItem(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(SessionKey).(*Session)
@@ -346,16 +310,10 @@ func (s *Server) HandlePurchaseHistoryItem(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	receipsCollection := db.GetCollection("receipts")
-
 	// find specified order
-	var order Receipt
-	res := receipsCollection.FindOne(
-		context.Background(),
-		bson.M{"_id": orderID, "userid": session.Store["userid"]},
-	).Decode(&order)
-	if res != nil {
-		http.Error(w, res.Error(), http.StatusBadRequest)
+	order, err := s.Store.Receipts.FindByID(orderID, session.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -375,23 +333,12 @@ Returns all of the user's furniture listings they've listed for sale
 func (s *Server) HandleGETUserFurnitureListings(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(SessionKey).(*Session)
 
-	listingsCollection := db.GetCollection("listings")
-	cursor, err := listingsCollection.Find(
-		context.Background(),
-		bson.M{"userid": session.Store["userid"]},
-	)
+	listings, err := s.Store.Listings.FindByUser(session.UserID())
 	if err != nil {
 		http.Error(w, "Failed to fetch user's furniture listings", http.StatusInternalServerError)
 		return
 	}
 
-	var listings []types.FurnitureListing
-	err = cursor.All(context.Background(), &listings)
-	if err != nil {
-		http.Error(w, "Failed to cursor.All listings cursor", http.StatusInternalServerError)
-		return
-	}
-
 	json, err := json.Marshal(listings)
 	if err != nil {
 		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
@@ -409,14 +356,11 @@ Subscribes the user to receive email updates for every furniture listing posted
 func (s *Server) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(SessionKey).(*Session)
 
-	usersCollection := db.GetCollection("users")
-
-	res, err := usersCollection.UpdateByID(
-		context.Background(),
-		session.Store["userid"],
-		bson.M{"$set": bson.M{"subscribed": true}},
+	err := s.Store.Users.Update(
+		session.UserID(),
+		bson.M{"subscribed": true},
 	)
-	if res.MatchedCount == 0 {
+	if err == db.ErrNotFound {
 		http.Error(w, "No document was found with the userID", http.StatusInternalServerError)
 		return
 	}
@@ -435,14 +379,11 @@ Unsubscribes the user to cease email updates
 func (s *Server) HandleUnsubscribe(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value(SessionKey).(*Session)
 
-	usersCollection := db.GetCollection("users")
-
-	res, err := usersCollection.UpdateByID(
-		context.Background(),
-		session.Store["userid"],
-		bson.M{"$set": bson.M{"subscribed": false}},
+	err := s.Store.Users.Update(
+		session.UserID(),
+		bson.M{"subscribed": false},
 	)
-	if res.MatchedCount == 0 {
+	if err == db.ErrNotFound {
 		http.Error(w, "No document was found with the userID", http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	ErrSessionsFetch  = "Failed to fetch sessions"
+	ErrSessionsRevoke = "Failed to log out of sessions"
+	ErrNoSuchSession  = "Could not find a session with that ID"
+)
+
+/*
+What the client is shown about one of the devices they're logged in on.
+ID is the session's PublicID, since the SessionID itself is the credential
+in the cookie
+*/
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"userAgent"`
+	IPAddress string    `json:"ipAddress"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Current   bool      `json:"current"` // true for the session that made the request
+}
+
+func newSessionInfo(session *Session, current *Session) SessionInfo {
+	snapshot := session.snapshot()
+	return SessionInfo{
+		ID:        snapshot.PublicID(),
+		Device:    snapshot.Device,
+		UserAgent: snapshot.UserAgent,
+		IPAddress: snapshot.IPAddress,
+		CreatedAt: snapshot.CreatedAt,
+		LastSeen:  snapshot.LastSeen,
+		Current:   snapshot.SessionID == current.SessionID,
+	}
+}
+
+/*
+Lists every device the user is logged in on, with the most
+recently active first
+*/
+func (s *Server) HandleSessionsGET(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	sessions, err := GetSessionManager().GetUserSessions(session.UserID())
+	if err != nil {
+		http.Error(w, ErrSessionsFetch, http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, userSession := range sessions {
+		infos = append(infos, newSessionInfo(userSession, session))
+	}
+
+	jsonData, err := json.Marshal(infos)
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Logs one of the user's devices out, by the session ID returned from
+GET /account/sessions. Only the user's own sessions can be revoked;
+revoking the current session also clears the client's cookie
+*/
+func (s *Server) HandleSessionDELETE(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+	publicID := r.PathValue("id")
+
+	sessionManager := GetSessionManager()
+	sessions, err := sessionManager.GetUserSessions(session.UserID())
+	if err != nil {
+		http.Error(w, ErrSessionsFetch, http.StatusInternalServerError)
+		return
+	}
+
+	for _, userSession := range sessions {
+		if userSession.PublicID() != publicID {
+			continue
+		}
+
+		sessionManager.DeleteSession(userSession.SessionID)
+		if userSession.SessionID == session.SessionID {
+			clearSessionCookie(w)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("success"))
+		return
+	}
+
+	http.Error(w, ErrNoSuchSession, http.StatusNotFound)
+}
+
+// Logs the user out everywhere, including the device that made the request
+func (s *Server) HandleSessionsDELETE(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	err := GetSessionManager().DeleteUserSessions(session.UserID())
+	if err != nil {
+		http.Error(w, ErrSessionsRevoke, http.StatusInternalServerError)
+		return
+	}
+
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"backend/db"
+	"backend/types"
+	"backend/util"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ErrInvalidRoles    = "Roles must be one or more of: buyer, seller, admin"
+	ErrRemoveOwnAdmin  = "You can't remove the admin role from your own account"
+	ErrUserNotFound    = "Could not find a user with that ID"
+	ErrRolesSaveFailed = "Failed to update roles"
+)
+
+// Sent to PUT /admin/users/{userID}/roles
+type RolesUpdate struct {
+	Roles []types.Role `json:"roles"`
+}
+
+/*
+Replaces the roles of the user with <userID>. Only admins can call this.
+
+The new roles are also written into every session the user already has,
+so they take effect without the user logging in again
+*/
+func (s *Server) HandleSetUserRoles(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	userID, err := primitive.ObjectIDFromHex(r.PathValue("userID"))
+	if err != nil {
+		http.Error(w, primitive.ErrInvalidHex.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var update RolesUpdate
+	if err := util.ReadJSONReq[RolesUpdate](r, &update); err != nil {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+
+	if len(update.Roles) == 0 {
+		http.Error(w, ErrInvalidRoles, http.StatusBadRequest)
+		return
+	}
+
+	isAdmin := false
+	for _, role := range update.Roles {
+		if !role.IsValid() {
+			http.Error(w, ErrInvalidRoles, http.StatusBadRequest)
+			return
+		}
+		isAdmin = isAdmin || role == types.RoleAdmin
+	}
+
+	// otherwise the last admin could lock everyone out of the admin endpoints
+	if userID == session.UserID() && !isAdmin {
+		http.Error(w, ErrRemoveOwnAdmin, http.StatusBadRequest)
+		return
+	}
+
+	err = s.Store.Users.Update(userID, bson.M{"roles": update.Roles})
+	if err == db.ErrNotFound {
+		http.Error(w, ErrUserNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, ErrRolesSaveFailed, http.StatusInternalServerError)
+		return
+	}
+
+	err = GetSessionManager().SetUserSessionValue(userID, "roles", update.Roles)
+	if err != nil {
+		log.Printf("Failed to update the sessions of %s: %s\n", userID.Hex(), err.Error())
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
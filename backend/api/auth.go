@@ -1,16 +1,15 @@
 package api
 
 import (
-	"backend/db"
 	"backend/types"
 	"backend/util"
 	"context"
-	"fmt"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 const (
@@ -21,6 +20,8 @@ const (
 	ErrSignupSave       = "Failed to save user account" // New account failed to save into DB
 	ErrPasswordMismatch = "Passwords do not match"
 	ErrBlankFields      = "One or more fields are blank!"
+	ErrForbidden        = "You do not have permission to do that"
+	ErrTooManyLogins    = "Too many failed login attempts; try again later"
 )
 
 func arePasswordsSame(signupInfo types.User) bool {
@@ -61,39 +62,25 @@ func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usernameUnique := db.CheckFieldUniqueness("username", signupInfo.Username)
+	usernameUnique := s.Store.Users.IsFieldUnique("username", signupInfo.Username)
 	if !usernameUnique { // username not unique
 		http.Error(w, ErrUsernameTaken, http.StatusConflict)
 		return
 	}
 
-	emailUnique := db.CheckFieldUniqueness("email", signupInfo.Email)
+	emailUnique := s.Store.Users.IsFieldUnique("email", signupInfo.Email)
 	if !emailUnique { // email not unique
 		http.Error(w, ErrEmailTaken, http.StatusConflict)
 		return
 	}
 
 	signupInfo.Subscribed = false
+	signupInfo.EmailVerified = false // set by GET /verify_email
+	signupInfo.TOTPEnabled = false   // turned on through /account/2fa
+	signupInfo.Roles = types.DEFAULT_ROLES
 
 	//set balance to 0
-	balance, err := primitive.ParseDecimal128("0")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	signupInfo.Balance = balance
-
-	// create new session before saving info to database
-	sessionManager := GetSessionManager()
-	session, err := sessionManager.CreateSession(SessionTemplate{SessionID: ""})
-	if err != nil {
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
-		return
-	}
-	signupInfo.SessionID = session.SessionID
-
-	// delete session since we don't want to store the session in memory yet
-	sessionManager.DeleteSession(session.SessionID)
+	signupInfo.Balance = types.NewMoney(0, types.DEFAULT_CURRENCY)
 
 	// hash password
 	hashedPassword, err := util.HashPassword(signupInfo.Password)
@@ -104,12 +91,20 @@ func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 	signupInfo.Password = hashedPassword
 
 	// insert signupInfo into DB
-	_, err = db.InsertIntoUsersCollection(signupInfo)
+	signupInfo.UserID, err = s.Store.Users.Insert(signupInfo)
 	if err != nil {
 		http.Error(w, ErrSignupSave, http.StatusInternalServerError)
 		return
 	}
 
+	/*
+		The account is saved either way, so if the email can't be sent
+		the user can ask for another one with POST /verify_email/resend
+	*/
+	if err = s.sendVerificationEmail(signupInfo); err != nil {
+		log.Printf("Failed to send verification email to %s: %s\n", signupInfo.UserID.Hex(), err.Error())
+	}
+
 	/*
 		On the frontend, the client should be redirected to the login page
 	*/
@@ -128,82 +123,88 @@ func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// find document by username, since each username is constrained to be unique
-	var userResult types.User
-	usersCollection := db.GetCollection("users")
-	res := usersCollection.FindOne(context.Background(), bson.M{
-		"username": loginInfo.Username,
-	})
+	ip := clientIP(r)
+	if wait := s.Limiter.RetryAfter(loginInfo.Username, ip); wait > 0 {
+		tooManyLogins(w, wait)
+		return
+	}
 
-	if res.Err() != nil {
-		http.Error(w, ErrInvalidLogin, http.StatusUnauthorized)
+	// find document by username, since each username is constrained to be unique
+	userResult, err := s.Store.Users.FindByUsername(loginInfo.Username)
+	if err == nil {
+		// compare passwords
+		err = util.CheckPassword(loginInfo.Password, userResult.Password)
+	}
+	if err != nil {
+		s.loginFailed(w, loginInfo.Username, ip)
 		return
 	}
 
-	if err = res.Decode(&userResult); err != nil {
-		http.Error(w, ErrInvalidLogin, http.StatusUnauthorized)
+	// the password alone isn't enough, so ask for the code before logging in
+	if userResult.TOTPEnabled {
+		s.sendTwoFactorChallenge(w, userResult)
 		return
 	}
 
-	// compare passwords
-	err = util.CheckPassword(loginInfo.Password, userResult.Password)
-	if err != nil {
-		http.Error(w, ErrInvalidLogin, http.StatusUnauthorized)
+	s.startSession(w, r, userResult)
+}
+
+/*
+Records a failed login as <username> and responds with 401, or with 429
+if that failure locked the account or IP out. Unknown usernames are counted
+the same way, so the response doesn't reveal which usernames exist
+*/
+func (s *Server) loginFailed(w http.ResponseWriter, username, ip string) {
+	failures := s.Limiter.RecordFailure(username, ip)
+
+	if failures == LOGIN_UNLOCK_EMAIL_AFTER {
+		s.sendUnlockEmail(username)
+	}
+
+	if wait := s.Limiter.RetryAfter(username, ip); wait > 0 {
+		tooManyLogins(w, wait)
 		return
 	}
+	http.Error(w, ErrInvalidLogin, http.StatusUnauthorized)
+}
 
-	// save appropriate session data to session store
-	sessionManager := GetSessionManager()
-	sessionExpired := sessionManager.IsSessionExpired(r)
+// Responds with 429 and tells the client how many seconds to wait in Retry-After
+func tooManyLogins(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, ErrTooManyLogins, http.StatusTooManyRequests)
+}
 
-	var session *Session
+/*
+Logs <user> in on the device that sent the request by creating a
+new session and setting its cookie on the response.
 
-	if sessionExpired {
-		// generate a new sessionID
-		session, err = sessionManager.CreateSession(SessionTemplate{SessionID: ""})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+Every login gets its own session, so the user can stay logged
+in on several devices at once and log each of them out separately
+*/
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user types.User) {
+	s.Limiter.RecordSuccess(user.Username)
 
-		_, err = usersCollection.UpdateByID(
-			context.Background(),
-			userResult.UserID,
-			bson.M{"$set": bson.M{"sessionid": session.SessionID}},
-		)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		fmt.Println("New session created:", session.SessionID)
-
-		// generate cookie
-		expiration := time.Now().Add(CookieExpiration * time.Minute)
-		cookie := http.Cookie{
-			Name:     SESSIONID_COOKIE_NAME,
-			Value:    session.SessionID,
-			Path:     "http://127.0.0.1:1573",
-			Expires:  expiration,
-			HttpOnly: true,
-			Secure:   true,
-			SameSite: http.SameSiteNoneMode,
-		}
+	sessionManager := GetSessionManager()
 
-		http.SetCookie(w, &cookie)
-	} else {
-		// Client has sessionID cookie already stored in DB and it's not expired
-		session, err = sessionManager.CreateSession(SessionTemplate{
-			SessionID: userResult.SessionID,
-		})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		fmt.Println("Existing session found:", userResult.SessionID)
+	// the session values are set before the session is stored, so no request can see it half filled
+	session, err := sessionManager.CreateSession(SessionTemplate{
+		SessionID: "",
+		Values: SessionValues{
+			"username": user.Username,
+			"userid":   user.UserID,
+			"roles":    user.GetRoles(),
+		},
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	session.Store["username"] = userResult.Username
-	session.Store["userid"] = userResult.UserID
+	// generate cookie
+	setSessionCookie(w, session)
 
 	w.Write([]byte("success"))
 }
@@ -215,6 +216,31 @@ func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	sessionManager := GetSessionManager()
 	sessionManager.DeleteSession(session.SessionID)
 
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+/*
+Sets the sessionID cookie on the response so that it expires
+at the same time as the session does on the server
+*/
+func setSessionCookie(w http.ResponseWriter, session *Session) {
+	cookie := http.Cookie{
+		Name:     SESSIONID_COOKIE_NAME,
+		Value:    session.SessionID,
+		Path:     "http://127.0.0.1:1573",
+		Expires:  session.Expiration(),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	}
+
+	http.SetCookie(w, &cookie)
+}
+
+// Tells the client to delete its sessionID cookie
+func clearSessionCookie(w http.ResponseWriter) {
 	cookie := http.Cookie{
 		Name:     SESSIONID_COOKIE_NAME,
 		Value:    "",
@@ -226,8 +252,18 @@ func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	http.SetCookie(w, &cookie)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("success"))
+}
+
+/*
+Returns the address of the client that sent the request,
+without the port that RemoteAddr includes
+*/
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 type CtxSessionKey string
@@ -241,7 +277,10 @@ their sessionID cookie and validating that their session exists.
 
 If it does exist, the <next> handler will be called with the session
 attached to the request context, with the key name of <SessionKey>.
-Otherwise, a 401 status code will be returned
+Otherwise, a 401 status code will be returned.
+
+Since the session is renewed on every authenticated request, the
+cookie is sent again with the new expiration
 */
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -253,8 +292,40 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		setSessionCookie(w, session)
+
 		ctx := context.WithValue(r.Context(), SessionKey, session)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
+
+/*
+Returns a middleware that only lets users with at least one of <roles>
+through to the <next> handler, and returns a 403 status code to everyone else.
+
+The roles are read from the session attached by AuthMiddleware, so
+AuthMiddleware must come after it in Server.Use:
+
+	s.Use("GET /admin/...", handler, RequireRole(types.RoleAdmin), AuthMiddleware)
+*/
+func RequireRole(roles ...types.Role) MiddlewareFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			session, ok := r.Context().Value(SessionKey).(*Session)
+			if !ok {
+				http.Error(w, ErrUnauthorized, http.StatusUnauthorized)
+				return
+			}
+
+			for _, role := range roles {
+				if session.HasRole(role) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			http.Error(w, ErrForbidden, http.StatusForbidden)
+		}
+	}
+}
@@ -4,17 +4,16 @@ import (
 	"backend/db"
 	"backend/types"
 	"backend/util"
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/stripe/stripe-go/v76"
-	stripeSession "github.com/stripe/stripe-go/v76/checkout/session"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -26,24 +25,38 @@ import (
 - Server saves appropriate data
 */
 
-// User gets 95% of their profits; platform gets the other 5%
-const REVENUE_SPLIT float64 = 0.95
-
 const (
-	ErrCheckoutSession = "Error creating checkout session"
+	ErrCheckoutSession   = "Error creating checkout session"
+	ErrCheckoutEmptyCart = "Shopping cart is empty"
+	ErrCheckoutNotFound  = "Checkout not found"
+	ErrCheckoutComplete  = "Checkout has already been paid"
+	ErrListingHeld       = "Furniture listing is being checked out by another buyer"
+	ErrCheckoutCurrency  = "Shopping cart has listings in different currencies, or not in the currency given"
+
+	ErrWebhookSignature     = "Webhook signature is missing, invalid or too old"
+	ErrWebhookNotConfigured = "Webhook signing secret is not configured"
 )
 
-type PaymentInfo struct {
-	PaymentMethod string  `json:"paymentMethod"`
-	Amount        float32 `json:"amount"`
-	Currency      string  `json:"currency"`
-}
+// the providers' event payloads are well under this
+const MAX_WEBHOOK_BODY_SIZE = 64 << 10
+
+/*
+How long a buyer has to pay once they start a checkout. Stripe doesn't
+let a checkout session expire any sooner than 30 minutes
+*/
+const CHECKOUT_DURATION = 30 * time.Minute
+
+/*
+How much longer the listings stay held than the checkout is open, so a
+payment made right before the checkout expires can still be completed
+before anyone else can check the listings out
+*/
+const CHECKOUT_HOLD_GRACE = 5 * time.Minute
 
-type ShippingAddress struct {
-	State   string `bson:"state" json:"state"`
-	City    string `bson:"city" json:"city"`
-	Street  string `bson:"street" json:"street"`
-	ZipCode string `bson:"zipCode" json:"zipCode"`
+type PaymentInfo struct {
+	PaymentMethod string      `json:"paymentMethod"`
+	Amount        types.Money `json:"amount"`
+	Currency      string      `json:"currency"` // the cart's currency, like "usd"; optional
 }
 
 type CheckoutInfo struct {
@@ -52,29 +65,11 @@ type CheckoutInfo struct {
 	// ShippingAddress ShippingAddress `json:"shippingAddress"`
 }
 
-type ProductItem struct {
-	// ID of the furniture listing
-	ListingID primitive.ObjectID `bson:"listingid" json:"listingId"`
-	// ID of the user who posted the furniture listing; the seller
-	SellerID primitive.ObjectID `bson:"sellerid" json:"sellerId"`
-}
-
-type Receipt struct {
-	OrderID           primitive.ObjectID `bson:"_id,omitempty" json:"orderId"` // generated by mongo
-	ShippingAddress   ShippingAddress    `bson:"shippingAddress" json:"shippingAddress"`
-	PaymentMethod     string             `bson:"paymentMethod" json:"paymentMethod"`
-	TotalCost         float32            `bson:"totalCost" json:"totalCost"`
-	Items             []ProductItem      `bson:"items" json:"items"`
-	UserID            primitive.ObjectID `bson:"userid" json:"userId"` // ID of buyer
-	DatePurchased     time.Time          `bson:"datePurchased" json:"datePurchased"`
-	EstimatedDelivery time.Time          `bson:"estimatedDelivery" json:"estimatedDelivery"`
-}
-
 /*
-Creates a checkout session from Stripe's API, which redirects the client
-to Stripe's hosted page to collect their payment infomation
+Creates a checkout with the payment provider, which redirects the client
+to the provider's hosted page, like Stripe's, to collect their payment infomation
 
-Stripe servers will then process the payment once the client submits the form
+The provider will then process the payment once the client submits the form
 */
 func (s *Server) HandleCheckout(w http.ResponseWriter, r *http.Request) {
 	var input CheckoutInfo
@@ -93,235 +88,488 @@ func (s *Server) HandleCheckout(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		listingIDsToRetrieve = append(listingIDsToRetrieve, objID)
+		// each listing is one of a kind, so it can only be bought once
+		if !slices.Contains(listingIDsToRetrieve, objID) {
+			listingIDsToRetrieve = append(listingIDsToRetrieve, objID)
+		}
+	}
+	if len(listingIDsToRetrieve) == 0 {
+		http.Error(w, ErrCheckoutEmptyCart, http.StatusBadRequest)
+		return
 	}
-	listingsCollection := db.GetCollection("listings")
-	filter := bson.M{"_id": bson.M{"$in": listingIDsToRetrieve}}
-	cursor, err := listingsCollection.Find(context.Background(), filter)
+
+	furnitures, err := s.Store.Listings.FindByIDs(listingIDsToRetrieve)
 	if err != nil {
 		http.Error(w, "Error getting listings", http.StatusBadGateway)
 		return
 	}
+	if len(furnitures) != len(listingIDsToRetrieve) {
+		http.Error(w, ErrListingNotFound, http.StatusNotFound)
+		return
+	}
 
-	// extract documents from cursor into an array
-	var furnitures []types.FurnitureListing
-	for cursor.Next(context.Background()) {
-		var furnitureListing types.FurnitureListing
-		if err := cursor.Decode(&furnitureListing); err != nil {
-			log.Printf("Error decoding document: %v", err)
-			continue
+	/*
+		Checked here so most carts that can't be bought are turned away before
+		a checkout session is created. Hold checks again once it exists
+	*/
+	now := time.Now()
+	for _, furniture := range furnitures {
+		if furniture.Bought {
+			http.Error(w, ErrListingSold, http.StatusConflict)
+			return
+		}
+		if furniture.IsHeld(now) {
+			http.Error(w, ErrListingHeld, http.StatusConflict)
+			return
 		}
-		furnitures = append(furnitures, furnitureListing)
 	}
 
-	if err := cursor.Err(); err != nil {
-		http.Error(w, "Error fetching furnitures", http.StatusBadRequest)
+	// the buyer is charged in the currency the listings are priced in, so it must be the same for all of them
+	currency := furnitures[0].Cost.Currency
+	if input.Payment.Currency != "" && !strings.EqualFold(input.Payment.Currency, string(currency)) {
+		http.Error(w, ErrCheckoutCurrency, http.StatusBadRequest)
 		return
 	}
+	for _, furniture := range furnitures {
+		if furniture.Cost.Currency != currency {
+			http.Error(w, ErrCheckoutCurrency, http.StatusBadRequest)
+			return
+		}
+	}
 
-	/*-------------STRIPE-------------*/
-
-	stripe.Key = os.Getenv("STRIPE_TEST_KEY")
+	session := r.Context().Value(SessionKey).(*Session)
 
-	// create Stripe checkout session
-	var lineItems []*stripe.CheckoutSessionLineItemParams
+	var items []CheckoutItem
+	costs := make(map[primitive.ObjectID]types.Money, len(furnitures))
 	for _, furniture := range furnitures {
-		productData := &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-			Name:        &furniture.Title,
-			Description: &furniture.Description,
+		costs[furniture.ListingID] = furniture.Cost
+		items = append(items, CheckoutItem{
+			Name:        furniture.Title,
+			Description: furniture.Description,
+			Amount:      furniture.Cost,
 			Metadata: map[string]string{
-				"Material":  string(furniture.Type),
-				"Condition": string(furniture.Material),
+				"Type":      string(furniture.Type),
+				"Material":  string(furniture.Material),
 				"Style":     string(furniture.Style),
 				"ListingID": furniture.ListingID.Hex(),
 			},
-		}
-
-		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
-			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-				Currency:          stripe.String(input.Payment.Currency),
-				ProductData:       productData,
-				UnitAmountDecimal: stripe.Float64(furniture.Cost * 100),
-			},
-			Quantity: stripe.Int64(1),
 		})
 	}
 
-	session := r.Context().Value(SessionKey).(*Session)
-
-	shoppingCartJSONData, err := json.Marshal(input.ShoppingCart)
+	/*
+		Each listing only once, so the webhook never tries to sell one twice,
+		with what it's charged for, so the webhook can still refund a listing
+		that's gone by the time the buyer pays
+	*/
+	var cart []string
+	var prices []types.Money
+	for _, listingID := range listingIDsToRetrieve {
+		cart = append(cart, listingID.Hex())
+		prices = append(prices, costs[listingID])
+	}
+	shoppingCartJSONData, err := json.Marshal(cart)
 	if err != nil {
 		http.Error(w, "Failed to encode listingIDs into JSON", http.StatusBadRequest)
 		return
 	}
+	pricesJSONData, err := json.Marshal(prices)
+	if err != nil {
+		http.Error(w, "Failed to encode prices into JSON", http.StatusBadRequest)
+		return
+	}
 
-	params := &stripe.CheckoutSessionParams{
-		LineItems:  lineItems,
-		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL: stripe.String("http://127.0.0.1:5173/checkout_success"), // frontend page
-		CancelURL:  stripe.String("http://127.0.0.1:5173/checkout_cancel"),  // frontend page
+	checkout, err := s.Payments.CreateCheckout(CheckoutParams{
+		Items:      items,
+		SuccessURL: "http://127.0.0.1:5173/checkout_success", // frontend page
+		// the provider fills in the checkout's ID, so the frontend can cancel it with POST /checkout/{sessionID}/cancel
+		CancelURL: "http://127.0.0.1:5173/checkout_cancel?session_id=" + CHECKOUT_ID_PLACEHOLDER,
+		ExpiresAt: now.Add(CHECKOUT_DURATION),
 
 		/*
-			This is how we're passing the sessionID; we will access this in the webhook
-			handler so we can authenticate the user and fulfill the order by saving
-			necessary information associated with the client, like receipts and stuff
+			The webhook fulfills the order for the buyer named here, since they may
+			have logged out by the time they pay. The session ID is a credential, so
+			it's never sent to the provider
 		*/
 		Metadata: map[string]string{
-			"sessionID":     session.SessionID,
-			"userID":        session.Store["userid"].(primitive.ObjectID).Hex(),
+			"userID":        session.UserID().Hex(),
 			"listingIDs":    string(shoppingCartJSONData),
+			"prices":        string(pricesJSONData),
 			"paymentMethod": input.Payment.PaymentMethod,
-			// "shippingAddress": string(shippingAddressJSONData),
-		},
-		ShippingAddressCollection: &stripe.CheckoutSessionShippingAddressCollectionParams{
-			AllowedCountries: stripe.StringSlice([]string{"US"}),
 		},
-	}
-
-	checkoutSession, err := stripeSession.New(params)
+	})
 	if err != nil {
 		http.Error(w, ErrCheckoutSession, http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Println("Checkout session link:", checkoutSession.URL) // printing for testing purposes
+	/*
+		Reserve the listings for this checkout, so another buyer can't pay for them
+		too. If another checkout held one of them first, this one is expired
+		before the client ever gets its URL
+	*/
+	hold := types.ListingHold{
+		HoldID:    checkout.ID,
+		UserID:    session.UserID(),
+		ExpiresAt: now.Add(CHECKOUT_DURATION + CHECKOUT_HOLD_GRACE),
+	}
+	if err := s.Store.Listings.Hold(listingIDsToRetrieve, hold, now); err != nil {
+		s.expireCheckout(checkout.ID)
+		if err == db.ErrListingUnavailable {
+			http.Error(w, ErrListingHeld, http.StatusConflict)
+			return
+		}
+		http.Error(w, ErrCheckoutSession, http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(checkoutSession.URL))
-	// http.Redirect(w, r, checkoutSession.URL, http.StatusSeeOther)
+	w.Write([]byte(checkout.URL))
+	// http.Redirect(w, r, checkout.URL, http.StatusSeeOther)
+}
+
+// Expires a checkout that hasn't been paid, so it can't be paid anymore
+func (s *Server) expireCheckout(checkoutID string) {
+	if err := s.Payments.ExpireCheckout(checkoutID); err != nil {
+		log.Printf("Failed to expire checkout %s: %s\n", checkoutID, err.Error())
+	}
 }
 
 /*
-Calculates the actual amount received by the platform after Stripe's processing
-fee of 2.9% + 30 cents for each successful transaction
+Cancels one of the client's checkouts that hasn't been paid, and releases
+the listings it held so other buyers can check them out right away,
+instead of once the checkout expires. The frontend calls this when the
+buyer leaves the payment page through its back link.
+
+200 - the checkout was canceled
+404 - there is no checkout with that ID, or it belongs to someone else
+409 - the checkout has already been paid
 */
-func afterStripeFee(amountPaid float64) float64 {
-	return amountPaid - (amountPaid * 0.029) + 0.30
+func (s *Server) HandleCheckoutCancel(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+	checkoutID := r.PathValue("sessionID")
+
+	checkout, err := s.Payments.GetCheckout(checkoutID)
+	if err != nil || checkout.Metadata["userID"] != session.UserID().Hex() {
+		http.Error(w, ErrCheckoutNotFound, http.StatusNotFound)
+		return
+	}
+
+	switch checkout.Status {
+	case CheckoutComplete:
+		http.Error(w, ErrCheckoutComplete, http.StatusConflict)
+		return
+	case CheckoutOpen:
+		// the checkout has to be expired before the listings are released, or it could still be paid
+		if err := s.Payments.ExpireCheckout(checkoutID); err != nil {
+			http.Error(w, "Failed to cancel checkout", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, err := s.Store.Listings.ReleaseHold(checkoutID, session.UserID()); err != nil {
+		http.Error(w, "Failed to release listings", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
 }
 
 /*
-Processes webhook requests from Stripe's API.
+Processes webhook requests from the payment provider.
 
-When something interesting--an event--happens in Stripe, Stripe's server
-sends a webhook request to your endpoint, sending data of the event
+When something interesting--an event--happens to a checkout, the provider's
+server sends a webhook request to your endpoint, sending data of the event
 
 This handler is used to update the user's account after a successful
-checkout and returns necessary information to the client, like their receipt
+checkout and returns necessary information to the client, like their receipt.
+
+Only requests the provider verifies as its own are accepted, and each event
+is applied once, however many times it's delivered.
+
+200 - the event was applied, or had already been
+400 - the request isn't from the provider, or its signature is too old
+500 - the event couldn't be applied, so the provider will deliver it again later
 */
-func (s *Server) HandleStripeWebhook(w http.ResponseWriter, r *http.Request) {
-	// extract the Stripe Event obj from the request body
-	var event stripe.Event
-	if err := util.ReadJSONReq[stripe.Event](r, &event); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse webhook body json: %v\n", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
+func (s *Server) HandlePaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_WEBHOOK_BODY_SIZE))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
 
-	fmt.Println(event.Type)
+	event, err := s.Payments.ParseWebhook(payload, r.Header)
+	if errors.Is(err, ErrNoWebhookSecret) {
+		log.Println("STRIPE_WEBHOOK_SECRET is not set, so webhook requests can't be verified")
+		http.Error(w, ErrWebhookNotConfigured, http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("Rejected webhook request: %s\n", err.Error())
+		http.Error(w, ErrWebhookSignature, http.StatusBadRequest)
+		return
+	}
+
+	err = s.receivePaymentEvent(event)
+	if err == db.ErrEventProcessed {
+		// the provider only needs to know the event was received, so it stops retrying
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("already processed"))
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to process event", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+/*
+Applies a verified event, unless it already has been, in which case
+db.ErrEventProcessed is returned. It's only recorded as applied after it
+was, so an event that failed, or whose server stopped part way through it,
+is applied when it's delivered again. Applying an event again changes
+nothing it already did, so deliveries at the same time can both apply it
+*/
+func (s *Server) receivePaymentEvent(event *PaymentEvent) error {
+	processed, err := s.Store.Events.IsProcessed(event.ID)
+	if err != nil {
+		return err
+	}
+	if processed {
+		return db.ErrEventProcessed
+	}
+
+	if err := s.applyPaymentEvent(event); err != nil {
+		log.Printf("Failed to apply event %s: %s\n", event.ID, err.Error())
+		return err
+	}
+
+	err = s.Store.Events.Record(types.ProcessedEvent{
+		EventID:     event.ID,
+		Type:        string(event.Type),
+		ProcessedAt: time.Now(),
+	})
+	if err == db.ErrEventProcessed {
+		// another delivery applied it at the same time
+		return nil
+	}
+	return err
+}
+
+// Applies a verified event that hasn't been applied before
+func (s *Server) applyPaymentEvent(event *PaymentEvent) error {
+	checkout := event.Checkout
 
 	switch event.Type {
-	case stripe.EventTypeCheckoutSessionCompleted:
-		var checkoutSession stripe.CheckoutSession
-		err := json.Unmarshal(event.Data.Raw, &checkoutSession)
+	case PaymentCompleted:
+		metadata := checkout.Metadata
+
+		// the buyer, who doesn't have to still be logged in
+		userID, err := primitive.ObjectIDFromHex(metadata["userID"])
 		if err != nil {
-			log.Printf("Error parsing webhook JSON: %v\n", err.Error())
-			return
+			return fmt.Errorf("checkout %s doesn't name its buyer: %w", checkout.ID, err)
 		}
-
-		metadata := checkoutSession.Metadata
-		var shippingAddrInfo *stripe.Address = checkoutSession.ShippingDetails.Address
-
-		sessionManager := GetSessionManager()
-		session, sessionExists := sessionManager.GetSession(metadata["sessionID"])
-		if !sessionExists {
-			log.Println("Cannot find sessionID given metadata")
-			return
+		if _, err := s.Store.Users.FindByID(userID); err != nil {
+			return fmt.Errorf("failed to find the buyer of checkout %s: %w", checkout.ID, err)
 		}
 
-		fmt.Printf("Session of user: %s\n", session.SessionID)
-		fmt.Println("Amount paid:", checkoutSession.AmountTotal/100)
-
 		/*----------------------Receipts, update balances, etc------------------------*/
 
-		var shippingAddress ShippingAddress = ShippingAddress{
-			State:   shippingAddrInfo.State,
-			City:    shippingAddrInfo.City,
-			Street:  shippingAddrInfo.Line1,
-			ZipCode: shippingAddrInfo.PostalCode,
+		now := time.Now()
+		orderReceipt := types.Receipt{
+			SubOrders:       []types.SubOrder{},
+			TotalCost:       checkout.AmountTotal,
+			DatePurchased:   now,
+			PaymentMethod:   metadata["paymentMethod"],
+			UserID:          userID,
+			ShippingAddress: checkout.ShippingAddress,
+			CheckoutID:      checkout.ID,
 		}
+		// the index of each seller's sub-order in the receipt, and the listings this checkout bought
+		subOrders := make(map[primitive.ObjectID]int)
+		sold := make(map[primitive.ObjectID]bool)
 
-		userID, _ := primitive.ObjectIDFromHex(metadata["userID"])
+		var cart []string
+		if err := json.Unmarshal([]byte(metadata["listingIDs"]), &cart); err != nil {
+			return fmt.Errorf("failed to decode listingIDs from JSON: %w", err)
+		}
+		var listingIDs []primitive.ObjectID
+		for _, id := range cart {
+			listingID, _ := primitive.ObjectIDFromHex(id)
+			listingIDs = append(listingIDs, listingID)
+		}
 
-		orderReceipt := Receipt{
-			Items:             []ProductItem{},
-			TotalCost:         float32(checkoutSession.AmountTotal) / 100,
-			DatePurchased:     time.Now(),
-			EstimatedDelivery: time.Now().AddDate(0, 1, 0), // defaulting to 1 month estimated delivery for testing
-			PaymentMethod:     metadata["paymentMethod"],
-			UserID:            userID,
-			ShippingAddress:   shippingAddress,
+		/*
+			What the checkout charged for each listing, saved when it started.
+			Checkouts started before that was saved charged what their listings
+			still cost, since listings can't be edited while they're held
+		*/
+		var charged []types.Money
+		if data, exists := metadata["prices"]; exists {
+			if err := json.Unmarshal([]byte(data), &charged); err != nil || len(charged) != len(listingIDs) {
+				return fmt.Errorf("checkout %s doesn't have a price for each of its listings", checkout.ID)
+			}
 		}
 
-		var listingIDs []string
-		if err := json.Unmarshal([]byte(metadata["listingIDs"]), &listingIDs); err != nil {
-			log.Println("Failed to decode listingIDs from JSON")
-			return
+		listings, err := s.Store.Listings.FindByIDs(listingIDs)
+		if err != nil {
+			return fmt.Errorf("failed to get the listings of checkout %s: %w", checkout.ID, err)
+		}
+		listingsByID := make(map[primitive.ObjectID]types.FurnitureListing, len(listings))
+		for _, listing := range listings {
+			listingsByID[listing.ListingID] = listing
 		}
 
-		// use listingIDs to update each seller's data
-		for _, id := range listingIDs {
-			var furnitureListing types.FurnitureListing
-			listingID, _ := primitive.ObjectIDFromHex(id)
-			listingsCollection := db.GetCollection("listings")
-			_ = listingsCollection.FindOne(context.Background(), bson.M{"_id": listingID}).Decode(&furnitureListing)
-
-			// update the seller's virtual balance
-			var seller types.User
-			usersCollection := db.GetCollection("users")
-			_ = usersCollection.FindOne(
-				context.Background(),
-				bson.M{"_id": furnitureListing.UserID},
-			).Decode(&seller)
-
-			/*-----------TODO: Don't forget to mark listing as "bought": true-------------*/
-			/*---------------------Leave it as false for testing, though------------------*/
-			listingsCollection.UpdateByID(
-				context.Background(),
-				listingID,
-				bson.M{"$set": bson.M{"bought": true}},
-			)
-			/*-------------------------------2/4/2024-------------------------------------*/
-
-			amountReceivedByPlatform := afterStripeFee(float64(checkoutSession.AmountTotal / 100))
-			amountReceivedByUser := amountReceivedByPlatform * REVENUE_SPLIT
-			seller.UpdateBalance(amountReceivedByUser)
-
-			// save user's updated balance into database
-			res, err := usersCollection.UpdateOne(
-				context.Background(),
-				bson.M{"_id": seller.UserID},
-				bson.M{"$set": bson.M{"balance": seller.Balance}},
-			)
-			if err != nil {
-				log.Printf("Could not update user's %v balance: %s\n", res.UpsertedID, err.Error())
-				return
+		prices := make([]types.Money, len(listingIDs))
+		var pricesTotal types.Money
+		for i, listingID := range listingIDs {
+			listing, found := listingsByID[listingID]
+			switch {
+			case charged != nil:
+				prices[i] = charged[i]
+			case found:
+				prices[i] = listing.Cost
+			default:
+				return fmt.Errorf("listing %s of checkout %s is gone, and what it was charged for isn't known", listingID.Hex(), checkout.ID)
 			}
+			pricesTotal = pricesTotal.Add(prices[i])
+		}
+		if pricesTotal != checkout.AmountTotal {
+			log.Printf("Checkout %s charged %s for listings that cost %s\n", checkout.ID, checkout.AmountTotal, pricesTotal)
+		}
+		splits := SplitItems(prices, checkout.AmountTotal)
+
+		// what the buyer paid waits in clearing until it's passed on to the sellers or refunded
+		err = s.postEntry(types.JournalEntry{
+			Key:        entryKey(checkout.ID, types.EntryPayment, primitive.NilObjectID),
+			Type:       types.EntryPayment,
+			From:       types.AccountBuyers,
+			To:         types.AccountClearing,
+			Amount:     checkout.AmountTotal,
+			CheckoutID: checkout.ID,
+		})
+		if err != nil {
+			return err
+		}
 
-			// add each item to receipt
-			orderReceipt.Items = append(orderReceipt.Items, ProductItem{
+		for i, listingID := range listingIDs {
+			/*
+				Only the checkout that holds the listing can buy it, and only once, so
+				a checkout that lost its hold credits nobody and is refunded instead. A
+				listing this checkout already bought, before the event failed part way,
+				is still sold to it
+			*/
+			err := s.Store.Listings.SellHeld(listingID, checkout.ID)
+			if err == db.ErrNotFound {
+				// the processor keeps its fee on refunded payments, and no seller pays it
+				err := s.postEntry(types.JournalEntry{
+					Key:        entryKey(checkout.ID, types.EntryProcessorFee, listingID),
+					Type:       types.EntryProcessorFee,
+					From:       types.AccountPlatformRevenue,
+					To:         types.AccountProcessorFees,
+					Amount:     splits[i].ProcessingFee,
+					CheckoutID: checkout.ID,
+					ListingID:  listingID,
+				})
+				if err != nil {
+					return err
+				}
+				s.refundListing(checkout.ID, listingID, prices[i])
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to sell listing %s: %w", listingID.Hex(), err)
+			}
+			sold[listingID] = true
+
+			// add each item to its seller's sub-order, who gives the estimated delivery once they ship it
+			sellerID := listingsByID[listingID].UserID
+			j, exists := subOrders[sellerID]
+			if !exists {
+				j = len(orderReceipt.SubOrders)
+				subOrders[sellerID] = j
+				orderReceipt.SubOrders = append(orderReceipt.SubOrders, types.SubOrder{
+					SubOrderID:    primitive.NewObjectID(),
+					SellerID:      sellerID,
+					Items:         []types.ProductItem{},
+					Status:        types.OrderPaid,
+					StatusHistory: []types.OrderStatusChange{{Status: types.OrderPaid, At: now}},
+				})
+			}
+			subOrder := &orderReceipt.SubOrders[j]
+			subOrder.Items = append(subOrder.Items, types.ProductItem{
 				ListingID: listingID,
-				SellerID:  seller.UserID,
+				SellerID:  sellerID,
+				Price:     prices[i],
+				Payout:    splits[i].Payout,
 			})
+			subOrder.Subtotal = subOrder.Subtotal.Add(prices[i])
 		}
 
-		// save receipt into database
-		receiptsCollection := db.GetCollection("receipts")
-		_, err = receiptsCollection.InsertOne(context.Background(), orderReceipt)
-		if err != nil {
-			log.Println("Failed to insert receipt into database:", err.Error())
-			return
+		if len(orderReceipt.SubOrders) == 0 {
+			return nil
 		}
 
+		/*
+			Save the receipt before crediting the sellers, so an event applied again
+			after a failure finds the receipt it already saved and doesn't save a
+			second one
+		*/
+		if err := s.Store.Receipts.InsertForCheckout(orderReceipt); err != nil {
+			return fmt.Errorf("failed to insert receipt into database: %w", err)
+		}
+
+		// each seller is only paid for their own listing
+		for i, listingID := range listingIDs {
+			if !sold[listingID] {
+				continue
+			}
+			sellerID := listingsByID[listingID].UserID
+			if err := s.postSale(checkout.ID, listingID, sellerID, prices[i], splits[i]); err != nil {
+				return fmt.Errorf("failed to pay the seller of listing %s: %w", listingID.Hex(), err)
+			}
+		}
+
+	/*
+		The buyer didn't pay in time, canceled, or their payment was declined,
+		so other buyers can check the listings out again
+	*/
+	case PaymentExpired, PaymentFailed:
+		userID, _ := primitive.ObjectIDFromHex(checkout.Metadata["userID"])
+		if _, err := s.Store.Listings.ReleaseHold(checkout.ID, userID); err != nil {
+			return fmt.Errorf("failed to release the listings of checkout %s: %w", checkout.ID, err)
+		}
 	}
 
+	return nil
+}
+
+/*
+Gives the buyer back the <amount> they paid for a listing their
+checkout couldn't buy, because its hold ran out before they paid, and
+posts the refund to the ledger
+*/
+func (s *Server) refundListing(checkoutID string, listingID primitive.ObjectID, amount types.Money) {
+	key := entryKey(checkoutID, types.EntryRefund, listingID)
+	if err := s.Payments.Refund(checkoutID, amount, key); err != nil {
+		log.Printf("Failed to refund listing %s of checkout %s, refund it by hand: %s\n", listingID.Hex(), checkoutID, err.Error())
+		return
+	}
+	log.Printf("Refunded listing %s of checkout %s, which it didn't hold anymore\n", listingID.Hex(), checkoutID)
+
+	err := s.postEntry(types.JournalEntry{
+		Key:        key,
+		Type:       types.EntryRefund,
+		From:       types.AccountClearing,
+		To:         types.AccountBuyers,
+		Amount:     amount,
+		CheckoutID: checkoutID,
+		ListingID:  listingID,
+	})
+	if err != nil {
+		log.Printf("Failed to post the refund of listing %s of checkout %s to the ledger: %s\n", listingID.Hex(), checkoutID, err.Error())
+	}
 }
@@ -1,7 +1,6 @@
 package api
 
 import (
-	"backend/db"
 	"backend/types"
 	"fmt"
 	"net/smtp"
@@ -20,30 +19,52 @@ const senderEmail string = "antiqfurn.project@gmail.com"
 
 var senderPassword string = os.Getenv("ANTIQ_FURN_PASS")
 
+/*
+Sends emails on behalf of the server. Swap it out on the Server
+to keep tests from sending real emails
+*/
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// Sends emails from senderEmail through the gmail SMTP server
+type SMTPMailer struct{}
+
+func (SMTPMailer) Send(to string, subject string, body string) error {
+	// authenticate and connect to SMTP server for gmail
+	auth := smtp.PlainAuth("", senderEmail, senderPassword, smtpHost)
+
+	msg := []byte("To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n\r\n" +
+		body,
+	)
+
+	return smtp.SendMail(
+		smtpHost+":"+smtpPort,
+		auth,
+		senderEmail,
+		[]string{to},
+		msg,
+	)
+}
+
 func sendEmail(
 	c chan ChannelData,
 	wg *sync.WaitGroup,
 	subscriber types.User,
-	auth smtp.Auth,
+	mailer Mailer,
 	listing types.FurnitureListing,
 ) {
 	defer wg.Done()
 
 	linkToListing := fmt.Sprintf("127.0.0.1:5173/market/%s", listing.ListingID.Hex())
 
-	msg := []byte("To: " + subscriber.Email + "\r\n" +
-		"Subject: New Furniture Listing" + "\r\n\r\n" +
-		"A new furniture listng has been posted for the " + listing.Title +
-		" a price of " + fmt.Sprintf("%.2f", listing.Cost) +
-		fmt.Sprintf(". Click here to go to the listing: %s", linkToListing),
-	)
-
-	err := smtp.SendMail(
-		smtpHost+":"+smtpPort,
-		auth,
-		senderEmail,
-		[]string{subscriber.Email},
-		msg,
+	err := mailer.Send(
+		subscriber.Email,
+		"New Furniture Listing",
+		"A new furniture listng has been posted for the "+listing.Title+
+			" a price of "+listing.Cost.String()+
+			fmt.Sprintf(". Click here to go to the listing: %s", linkToListing),
 	)
 
 	data := ChannelData{
@@ -67,15 +88,12 @@ func emailResults(c chan ChannelData) {
 /*
 Sends an email update to all subscribed users of the recently listed furniture listing
 */
-func SendNewListingNotificationEmail(listing types.FurnitureListing) error {
-	subscribers, err := db.GetSubscribers()
+func (s *Server) SendNewListingNotificationEmail(listing types.FurnitureListing) error {
+	subscribers, err := s.Store.Users.GetSubscribers()
 	if err != nil {
 		return err
 	}
 
-	// authenticate and connect to SMTP server for gmail
-	auth := smtp.PlainAuth("", senderEmail, senderPassword, smtpHost)
-
 	var wg sync.WaitGroup
 	c := make(chan ChannelData)
 
@@ -84,7 +102,7 @@ func SendNewListingNotificationEmail(listing types.FurnitureListing) error {
 		fmt.Printf("Subscriber #%d: %s\n", i+1, subscriber.UserID.Hex())
 
 		wg.Add(1)
-		go sendEmail(c, &wg, subscriber, auth, listing) // send each email asynchronously
+		go sendEmail(c, &wg, subscriber, s.Mailer, listing) // send each email asynchronously
 	}
 
 	wg.Wait()
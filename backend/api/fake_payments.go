@@ -0,0 +1,333 @@
+package api
+
+import (
+	"backend/types"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrPaymentCheckoutClosed = errors.New("checkout has already been paid or has expired")
+
+// Where the buyer of every fake checkout is shipping to
+var FAKE_SHIPPING_ADDRESS = types.ReceiptAddress{
+	State:   "RI",
+	City:    "Providence",
+	Street:  "105 Wizard Avenue",
+	ZipCode: "02907",
+}
+
+/*
+Takes payments without a payment processor, for tests and for running
+offline. Nothing is ever charged: a checkout is paid, declined or left to
+expire by calling SimulateCompleted, SimulateFailed or SimulateExpired,
+which return the event that Stripe would report in a webhook request.
+
+The server serves a page for each checkout at /fake_checkout/{checkoutID}
+with a button for each of those, which is the URL the buyer is sent to
+*/
+type FakePaymentProvider struct {
+	mu        sync.Mutex
+	baseURL   string
+	checkouts map[string]*fakeCheckout
+	events    map[string]PaymentEvent // every event it has reported, by ID
+}
+
+type fakeCheckout struct {
+	Checkout
+	params     CheckoutParams
+	refunds    []types.Money
+	refundKeys map[string]bool
+}
+
+// Creates a provider whose checkout pages are served by the server at <baseURL>
+func NewFakePaymentProvider(baseURL string) *FakePaymentProvider {
+	return &FakePaymentProvider{
+		baseURL:   baseURL,
+		checkouts: make(map[string]*fakeCheckout),
+		events:    make(map[string]PaymentEvent),
+	}
+}
+
+func (f *FakePaymentProvider) CreateCheckout(params CheckoutParams) (*Checkout, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkoutID := "cs_fake_" + primitive.NewObjectID().Hex()
+	checkout := &fakeCheckout{
+		Checkout: Checkout{
+			ID:       checkoutID,
+			URL:      f.baseURL + "/fake_checkout/" + checkoutID,
+			Status:   CheckoutOpen,
+			Metadata: params.Metadata,
+		},
+		params:     params,
+		refundKeys: make(map[string]bool),
+	}
+	for _, item := range params.Items {
+		checkout.AmountTotal = checkout.AmountTotal.Add(item.Amount)
+	}
+	f.checkouts[checkoutID] = checkout
+
+	c := checkout.Checkout
+	return &c, nil
+}
+
+func (f *FakePaymentProvider) GetCheckout(checkoutID string) (*Checkout, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkout, exists := f.checkouts[checkoutID]
+	if !exists {
+		return nil, ErrPaymentCheckoutNotFound
+	}
+	c := checkout.Checkout
+	return &c, nil
+}
+
+/*
+Unlike Stripe, no event is reported for a checkout expired this way, since
+the server already knows about it
+*/
+func (f *FakePaymentProvider) ExpireCheckout(checkoutID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkout, exists := f.checkouts[checkoutID]
+	if !exists {
+		return ErrPaymentCheckoutNotFound
+	}
+	if checkout.Status != CheckoutOpen {
+		return ErrPaymentCheckoutClosed
+	}
+	checkout.Status = CheckoutExpired
+	return nil
+}
+
+// the body of a fake webhook request, which only names the event
+type fakeWebhookPayload struct {
+	ID   string           `json:"id"`
+	Type PaymentEventType `json:"type"`
+}
+
+/*
+Only accepts requests for events it reported, so the event is never read
+from the payload itself
+*/
+func (f *FakePaymentProvider) ParseWebhook(payload []byte, header http.Header) (*PaymentEvent, error) {
+	var body fakeWebhookPayload
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, ErrInvalidWebhook
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	event, exists := f.events[body.ID]
+	if !exists {
+		return nil, ErrInvalidWebhook
+	}
+	return &event, nil
+}
+
+func (f *FakePaymentProvider) Refund(checkoutID string, amount types.Money, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkout, exists := f.checkouts[checkoutID]
+	if !exists {
+		return ErrPaymentCheckoutNotFound
+	}
+	if checkout.refundKeys[key] {
+		return nil
+	}
+
+	var refunded types.Money
+	for _, refund := range checkout.refunds {
+		refunded = refunded.Add(refund)
+	}
+	if checkout.Status != CheckoutComplete || amount.Amount <= 0 || amount.Currency != checkout.AmountTotal.Currency ||
+		refunded.Add(amount).Cmp(checkout.AmountTotal) > 0 {
+		return ErrPaymentNotRefundable
+	}
+	checkout.refunds = append(checkout.refunds, amount)
+	checkout.refundKeys[key] = true
+	return nil
+}
+
+// Returns the amounts that were refunded from the checkout with <checkoutID>, oldest first
+func (f *FakePaymentProvider) Refunds(checkoutID string) []types.Money {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if checkout, exists := f.checkouts[checkoutID]; exists {
+		return append([]types.Money(nil), checkout.refunds...)
+	}
+	return nil
+}
+
+// The buyer paid, and is shipping to FAKE_SHIPPING_ADDRESS
+func (f *FakePaymentProvider) SimulateCompleted(checkoutID string) (*PaymentEvent, error) {
+	return f.simulate(checkoutID, PaymentCompleted, CheckoutComplete)
+}
+
+// The buyer didn't pay before the checkout expired
+func (f *FakePaymentProvider) SimulateExpired(checkoutID string) (*PaymentEvent, error) {
+	return f.simulate(checkoutID, PaymentExpired, CheckoutExpired)
+}
+
+// The buyer's payment was declined, so the checkout can't be paid anymore
+func (f *FakePaymentProvider) SimulateFailed(checkoutID string) (*PaymentEvent, error) {
+	return f.simulate(checkoutID, PaymentFailed, CheckoutExpired)
+}
+
+/*
+Ends an open checkout with <status>, and returns the new event of
+<eventType> that reports it
+*/
+func (f *FakePaymentProvider) simulate(checkoutID string, eventType PaymentEventType, status CheckoutStatus) (*PaymentEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkout, exists := f.checkouts[checkoutID]
+	if !exists {
+		return nil, ErrPaymentCheckoutNotFound
+	}
+	if checkout.Status != CheckoutOpen {
+		return nil, ErrPaymentCheckoutClosed
+	}
+
+	checkout.Status = status
+	if status == CheckoutComplete {
+		checkout.ShippingAddress = FAKE_SHIPPING_ADDRESS
+	}
+
+	event := PaymentEvent{
+		ID:       "evt_fake_" + primitive.NewObjectID().Hex(),
+		Type:     eventType,
+		Checkout: checkout.Checkout,
+	}
+	f.events[event.ID] = event
+	return &event, nil
+}
+
+// Returns the webhook request that reports <event>, the same way every time it's called
+func (f *FakePaymentProvider) WebhookRequest(event *PaymentEvent) *http.Request {
+	payload, _ := json.Marshal(fakeWebhookPayload{ID: event.ID, Type: event.Type})
+
+	r, _ := http.NewRequest("POST", f.baseURL+"/checkout_webhook", bytes.NewReader(payload))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// Returns where the buyer is sent once the checkout with <checkoutID> has ended
+func (f *FakePaymentProvider) returnURL(checkoutID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkout := f.checkouts[checkoutID]
+	if checkout.Status == CheckoutComplete {
+		return checkout.params.SuccessURL
+	}
+	return strings.ReplaceAll(checkout.params.CancelURL, CHECKOUT_ID_PLACEHOLDER, checkoutID)
+}
+
+var fakeCheckoutPage = template.Must(template.New("fake_checkout").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Fake checkout</title></head>
+<body>
+	<h1>Fake checkout</h1>
+	<p>Nothing is charged. Pick what happens to this payment.</p>
+	<ul>
+		{{range .Items}}<li>{{.Name}}: {{.Amount}}</li>{{end}}
+	</ul>
+	<form method="POST" action="/fake_checkout/{{.ID}}/complete"><button>Pay</button></form>
+	<form method="POST" action="/fake_checkout/{{.ID}}/fail"><button>Decline payment</button></form>
+	<form method="POST" action="/fake_checkout/{{.ID}}/expire"><button>Let it expire</button></form>
+</body>
+</html>
+`))
+
+/*
+Serves the page of a fake checkout, where the buyer picks whether their
+payment goes through. Only served when the server uses a FakePaymentProvider
+
+200 - the checkout's page
+404 - the checkout doesn't exist, or has ended
+*/
+func (s *Server) HandleFakeCheckoutGET(w http.ResponseWriter, r *http.Request) {
+	fake, ok := s.Payments.(*FakePaymentProvider)
+	if !ok {
+		http.Error(w, ErrCheckoutNotFound, http.StatusNotFound)
+		return
+	}
+
+	checkoutID := r.PathValue("checkoutID")
+	fake.mu.Lock()
+	checkout, exists := fake.checkouts[checkoutID]
+	open := exists && checkout.Status == CheckoutOpen
+	var items []CheckoutItem
+	if open {
+		items = checkout.params.Items
+	}
+	fake.mu.Unlock()
+	if !open {
+		http.Error(w, ErrCheckoutNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	err := fakeCheckoutPage.Execute(w, map[string]any{"ID": checkoutID, "Items": items})
+	if err != nil {
+		log.Printf("Failed to render fake checkout %s: %s\n", checkoutID, err.Error())
+	}
+}
+
+/*
+Ends a fake checkout the way its page's button says to, applies the event
+like a webhook request would, and sends the buyer back to the frontend.
+{outcome} is one of complete, fail or expire
+
+303 - the checkout ended, and the buyer is sent to the success or cancel page
+400 - the outcome is not one of those
+404 - the checkout doesn't exist, or has already ended
+500 - the event couldn't be applied
+*/
+func (s *Server) HandleFakeCheckoutPOST(w http.ResponseWriter, r *http.Request) {
+	fake, ok := s.Payments.(*FakePaymentProvider)
+	if !ok {
+		http.Error(w, ErrCheckoutNotFound, http.StatusNotFound)
+		return
+	}
+
+	simulate := map[string]func(string) (*PaymentEvent, error){
+		"complete": fake.SimulateCompleted,
+		"fail":     fake.SimulateFailed,
+		"expire":   fake.SimulateExpired,
+	}[r.PathValue("outcome")]
+	if simulate == nil {
+		http.Error(w, "Outcome must be complete, fail or expire", http.StatusBadRequest)
+		return
+	}
+
+	checkoutID := r.PathValue("checkoutID")
+	event, err := simulate(checkoutID)
+	if err != nil {
+		http.Error(w, ErrCheckoutNotFound, http.StatusNotFound)
+		return
+	}
+
+	if err := s.receivePaymentEvent(event); err != nil {
+		http.Error(w, "Failed to process event", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fake.returnURL(checkoutID), http.StatusSeeOther)
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"backend/types"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrPayoutSettled = errors.New("payout has already been paid or has failed")
+
+/*
+Pays out without a payout processor, for tests and for running offline.
+Nothing is ever sent to a bank: a payout stays pending until it's settled
+by calling SimulatePaid or SimulateFailed, which return the event that a
+real provider would report in a webhook request
+*/
+type FakePayoutProvider struct {
+	mu           sync.Mutex
+	baseURL      string
+	destinations map[string]BankAccount
+	payouts      map[string]*Payout
+	byKey        map[string]string      // the ID of the payout created with each idempotency key
+	events       map[string]PayoutEvent // every event it has reported, by ID
+}
+
+// Creates a provider whose webhook requests are sent to the server at <baseURL>
+func NewFakePayoutProvider(baseURL string) *FakePayoutProvider {
+	return &FakePayoutProvider{
+		baseURL:      baseURL,
+		destinations: make(map[string]BankAccount),
+		payouts:      make(map[string]*Payout),
+		byKey:        make(map[string]string),
+		events:       make(map[string]PayoutEvent),
+	}
+}
+
+func (f *FakePayoutProvider) RegisterDestination(account BankAccount) (types.PayoutDestination, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	destinationID := "ba_fake_" + primitive.NewObjectID().Hex()
+	f.destinations[destinationID] = account
+
+	return types.PayoutDestination{
+		ProviderID:    destinationID,
+		AccountHolder: account.AccountHolder,
+		Last4:         account.AccountNumber[len(account.AccountNumber)-4:],
+		RegisteredAt:  time.Now(),
+	}, nil
+}
+
+func (f *FakePayoutProvider) CreatePayout(params PayoutParams) (*Payout, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if payoutID, exists := f.byKey[params.IdempotencyKey]; exists {
+		p := *f.payouts[payoutID]
+		return &p, nil
+	}
+	if _, exists := f.destinations[params.DestinationID]; !exists {
+		return nil, ErrPayoutDestinationNotFound
+	}
+
+	payout := &Payout{
+		ID:       "po_fake_" + primitive.NewObjectID().Hex(),
+		Status:   PayoutPending,
+		Amount:   params.Amount,
+		Metadata: params.Metadata,
+	}
+	f.payouts[payout.ID] = payout
+	if params.IdempotencyKey != "" {
+		f.byKey[params.IdempotencyKey] = payout.ID
+	}
+
+	p := *payout
+	return &p, nil
+}
+
+/*
+Only accepts requests for events it reported, so the event is never read
+from the payload itself
+*/
+func (f *FakePayoutProvider) ParseWebhook(payload []byte, header http.Header) (*PayoutEvent, error) {
+	var body struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, ErrInvalidWebhook
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	event, exists := f.events[body.ID]
+	if !exists {
+		return nil, ErrInvalidWebhook
+	}
+	return &event, nil
+}
+
+// Returns every payout that was created, in no particular order
+func (f *FakePayoutProvider) Payouts() []Payout {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var payouts []Payout
+	for _, payout := range f.payouts {
+		payouts = append(payouts, *payout)
+	}
+	return payouts
+}
+
+// The payout reached the seller's bank
+func (f *FakePayoutProvider) SimulatePaid(payoutID string) (*PayoutEvent, error) {
+	return f.simulate(payoutID, PayoutPaidEvent, PayoutPaid, "")
+}
+
+/*
+The seller's bank returned the payout with <reason>. Like a real bank, it
+can do that even after the payout was reported as paid
+*/
+func (f *FakePayoutProvider) SimulateFailed(payoutID string, reason string) (*PayoutEvent, error) {
+	return f.simulate(payoutID, PayoutFailedEvent, PayoutFailed, reason)
+}
+
+/*
+Settles a payout with <status>, and returns the new event of <eventType>
+that reports it
+*/
+func (f *FakePayoutProvider) simulate(payoutID string, eventType PayoutEventType, status PayoutStatus, reason string) (*PayoutEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	payout, exists := f.payouts[payoutID]
+	if !exists {
+		return nil, ErrPayoutNotFound
+	}
+	if payout.Status == PayoutFailed || payout.Status == status {
+		return nil, ErrPayoutSettled
+	}
+
+	payout.Status = status
+	payout.FailureReason = reason
+
+	event := PayoutEvent{
+		ID:     "evt_fake_" + primitive.NewObjectID().Hex(),
+		Type:   eventType,
+		Payout: *payout,
+	}
+	f.events[event.ID] = event
+	return &event, nil
+}
+
+// Returns the webhook request that reports <event>, the same way every time it's called
+func (f *FakePayoutProvider) WebhookRequest(event *PayoutEvent) *http.Request {
+	payload, _ := json.Marshal(map[string]any{"id": event.ID, "type": event.Type})
+
+	r, _ := http.NewRequest("POST", f.baseURL+"/payout_webhook", bytes.NewReader(payload))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
@@ -3,22 +3,20 @@ package api
 import (
 	"backend/db"
 	"backend/types"
-
-	// "backend/util"
-	"context"
+	"backend/util"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
 	"net/http"
+	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
 	ErrListFormNoCondition       = "Furniture condition not provided"
 	ErrListFormNoCost            = "Furniture cost not provided"
+	ErrListFormInvalidCost       = "Furniture cost must be more than 0 " + string(types.DEFAULT_CURRENCY)
 	ErrListFormNoDescription     = "Furniture description not provided"
 	ErrListFormNoImages          = "Furniture images not provided"
 	ErrListFormNoMaterial        = "Furniture material not provided"
@@ -26,20 +24,48 @@ const (
 	ErrListFormNoTitle           = "Furniture title not provided"
 	ErrListFormNoType            = "Furniture type not provided"
 	ErrListFormEveryFieldMissing = "Every field is missing"
+
+	ErrListFormTooManyImages   = "Too many furniture images provided"
+	ErrListFormImageTooLarge   = "Furniture image file is too large"
+	ErrListFormImageType       = "Furniture image must be a JPEG, PNG or WebP"
+	ErrListFormImageDimensions = "Furniture image dimensions are too small or too large"
+	ErrListFormUploadTooLarge  = "Furniture images are too large altogether"
+
+	ErrListingNotFound  = "Furniture listing with provided listingID not found"
+	ErrNotListingOwner  = "You can only change your own furniture listings"
+	ErrListingSold      = "Furniture listing has already been bought"
+	ErrListingNoChanges = "Empty fields; no listing changes provided"
 )
 
 const NUMBER_OF_LIST_FORM_FIELDS = 8 // removed images
 // const NUMBER_OF_LIST_FORM_FIELDS = 7
 
+// A problem with one of the files uploaded as furniture_images
+type ImageFormError struct {
+	Index    int    `json:"index"` // position of the file in the form, starting at 0
+	Filename string `json:"filename"`
+	Error    string `json:"error"` // one of the ErrListFormImage errors
+}
+
 type ListFormErrors struct {
-	FormErrors []string `json:"formErrors"`
-	length     int8
+	FormErrors  []string         `json:"formErrors"`
+	ImageErrors []ImageFormError `json:"imageErrors,omitempty"`
+	length      int8
 }
 
+/*
+Returns the form errors as a JSON array. If any images were rejected,
+it returns the whole ListFormErrors as a JSON object instead, so the
+client can tell which files to fix
+*/
 func (l ListFormErrors) Error() string {
 	if l.length == NUMBER_OF_LIST_FORM_FIELDS {
 		return ErrListFormEveryFieldMissing
 	}
+	if len(l.ImageErrors) > 0 {
+		jsonData, _ := json.Marshal(l)
+		return string(jsonData)
+	}
 	jsonData, _ := json.Marshal(l.FormErrors)
 	return string(jsonData)
 }
@@ -50,7 +76,9 @@ FurnitureListing form is empty or not provided
 
 Calling .Error() on the error will return a string of the array
 of each error in alphabetical order, where <ErrListFormNoCondition>
-is the first, <ErrListFormNoCost> second, and so on.
+is the first, <ErrListFormNoCost> second, and so on. A cost that's
+negative or not in types.DEFAULT_CURRENCY is <ErrListFormInvalidCost>
+in the place of <ErrListFormNoCost>.
 
 If every field is missing, then .Error() will return <ErrListFormEveryFieldMissing>
 */
@@ -61,18 +89,24 @@ func ValidateListFormFields(listing types.FurnitureListing) error {
 		formErrs = append(formErrs, ErrListFormNoCondition)
 		length++
 	}
-	if listing.Cost == 0 {
+	if listing.Cost.IsZero() {
 		formErrs = append(formErrs, ErrListFormNoCost)
 		length++
+	} else if listing.Cost.IsNegative() || listing.Cost.Currency != types.DEFAULT_CURRENCY {
+		// buyers pay and sellers are paid in DEFAULT_CURRENCY, so every listing is priced in it
+		formErrs = append(formErrs, ErrListFormInvalidCost)
 	}
 	if listing.Description == "" {
 		formErrs = append(formErrs, ErrListFormNoDescription)
 		length++
 	}
-	if len(listing.Images) == 0 {
+	if len(listing.ImageIDs) == 0 && len(listing.Uploads) == 0 {
 		formErrs = append(formErrs, ErrListFormNoImages)
 		length++
 	}
+	if len(listing.Uploads) > MAX_LISTING_IMAGES {
+		formErrs = append(formErrs, ErrListFormTooManyImages)
+	}
 	if listing.Material == "" {
 		formErrs = append(formErrs, ErrListFormNoMaterial)
 		length++
@@ -90,7 +124,7 @@ func ValidateListFormFields(listing types.FurnitureListing) error {
 		length++
 	}
 
-	if length == 0 {
+	if len(formErrs) == 0 {
 		return nil
 	}
 	return ListFormErrors{
@@ -99,6 +133,162 @@ func ValidateListFormFields(listing types.FurnitureListing) error {
 	}
 }
 
+/*
+Represents a seller's changes to one of their listings. Only the
+fields that are provided are changed, so they are pointers to tell
+a field that was left out apart from one that was sent empty
+*/
+type ListingUpdate struct {
+	Title       *string                   `bson:"title,omitempty" json:"title"`
+	Description *string                   `bson:"description,omitempty" json:"description"`
+	Cost        *types.Money              `bson:"cost,omitempty" json:"cost"`
+	Type        *types.FurnitureType      `bson:"type,omitempty" json:"type"`
+	Style       *types.FurnitureStyle     `bson:"style,omitempty" json:"style"`
+	Condition   *types.FurnitureCondition `bson:"condition,omitempty" json:"condition"`
+	Material    *types.FurnitureMaterial  `bson:"material,omitempty" json:"material"`
+}
+
+func (l ListingUpdate) IsEmpty() bool {
+	return l.Title == nil &&
+		l.Description == nil &&
+		l.Cost == nil &&
+		l.Type == nil &&
+		l.Style == nil &&
+		l.Condition == nil &&
+		l.Material == nil
+}
+
+// Returns a copy of <listing> with the provided changes applied
+func (l ListingUpdate) applyTo(listing types.FurnitureListing) types.FurnitureListing {
+	if l.Title != nil {
+		listing.Title = *l.Title
+	}
+	if l.Description != nil {
+		listing.Description = *l.Description
+	}
+	if l.Cost != nil {
+		listing.Cost = *l.Cost
+	}
+	if l.Type != nil {
+		listing.Type = *l.Type
+	}
+	if l.Style != nil {
+		listing.Style = *l.Style
+	}
+	if l.Condition != nil {
+		listing.Condition = *l.Condition
+	}
+	if l.Material != nil {
+		listing.Material = *l.Material
+	}
+	return listing
+}
+
+/*
+Finds the listing with the ID in the request URL and makes sure the
+logged in user is allowed to change it. If they aren't, an error
+response is written and false is returned
+*/
+func (s *Server) findOwnListing(w http.ResponseWriter, r *http.Request) (types.FurnitureListing, bool) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	listingID, err := primitive.ObjectIDFromHex(r.PathValue("listingID"))
+	if err != nil {
+		http.Error(w, primitive.ErrInvalidHex.Error(), http.StatusBadRequest)
+		return types.FurnitureListing{}, false
+	}
+
+	listing, err := s.Store.Listings.FindByID(listingID)
+	if err == db.ErrNotFound {
+		http.Error(w, ErrListingNotFound, http.StatusNotFound)
+		return listing, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return listing, false
+	}
+
+	if listing.UserID != session.UserID() {
+		http.Error(w, ErrNotListingOwner, http.StatusForbidden)
+		return listing, false
+	}
+	if listing.Bought {
+		http.Error(w, ErrListingSold, http.StatusConflict)
+		return listing, false
+	}
+	if listing.IsHeld(time.Now()) {
+		http.Error(w, ErrListingHeld, http.StatusConflict)
+		return listing, false
+	}
+
+	return listing, true
+}
+
+/*
+Lets a seller change the details of one of their listings, as long as
+it hasn't been bought and isn't being checked out. The listing after the changes must pass the same
+checks as a new listing
+*/
+func (s *Server) HandleListingPUT(w http.ResponseWriter, r *http.Request) {
+	var changes ListingUpdate
+	if err := util.ReadJSONReq[ListingUpdate](r, &changes); err != nil {
+		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	if changes.IsEmpty() {
+		http.Error(w, ErrListingNoChanges, http.StatusBadRequest)
+		return
+	}
+
+	listing, ok := s.findOwnListing(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ValidateListFormFields(changes.applyTo(listing)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the listing could have been bought since it was read, so the store checks again
+	err := s.Store.Listings.UpdateUnsold(listing.ListingID, listing.UserID, changes)
+	if err == db.ErrNotFound {
+		http.Error(w, ErrListingSold, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update listing", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+// Lets a seller withdraw one of their listings, as long as it hasn't been bought and isn't being checked out
+func (s *Server) HandleListingDELETE(w http.ResponseWriter, r *http.Request) {
+	listing, ok := s.findOwnListing(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.Store.Listings.DeleteUnsold(listing.ListingID, listing.UserID)
+	if err == db.ErrNotFound {
+		http.Error(w, ErrListingSold, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete listing", http.StatusInternalServerError)
+		return
+	}
+
+	s.deleteImages(listing.ImageIDs)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
 /*
 This endpoint processes a new furniture listing request
 
@@ -112,7 +302,13 @@ TODO: MUST CHANGE TO ACCEPT FILE UPLOAD FOR IMAGES (MULTIPART) 2/3
 */
 func (s *Server) HandleListFurniture(w http.ResponseWriter, r *http.Request) {
 	// Parse form
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_LISTING_REQUEST_SIZE)
 	err := r.ParseMultipartForm(10 << 20)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, ErrListFormUploadTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error()+" --> err1", http.StatusBadRequest)
 		return
@@ -131,6 +327,9 @@ func (s *Server) HandleListFurniture(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// only the uploaded files become the listing's images, never IDs sent in the JSON
+	newListing.ImageIDs = nil
+
 	// get images
 	files := r.MultipartForm.File["furniture_images"]
 	for _, file := range files {
@@ -150,35 +349,45 @@ func (s *Server) HandleListFurniture(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// add image data to newListing
-		newListing.Images = append(newListing.Images, fileData)
+		newListing.Uploads = append(newListing.Uploads, fileData)
 	}
 
-	// validate form inputs
+	// validate form inputs, then make sure every file is an image we accept
 	err = ValidateListFormFields(newListing)
-	if err != nil {
+	uploads, imageErrs := sanitizeListingImages(files, newListing.Uploads)
+	if err = withImageErrors(err, imageErrs); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	newListing.Uploads = uploads
 
 	// add userID to newListing
 	session := r.Context().Value(SessionKey).(*Session)
-	newListing.UserID = session.Store["userid"].(primitive.ObjectID)
+	newListing.UserID = session.UserID()
 	newListing.Bought = false
 
+	// save the images first, so the listing can be saved with their IDs
+	for _, upload := range newListing.Uploads {
+		imageID, err := db.SaveImageWithVariants(s.Store.Images, upload)
+		if err != nil {
+			s.deleteImages(newListing.ImageIDs)
+			http.Error(w, "Failed to save images", http.StatusInternalServerError)
+			return
+		}
+		newListing.ImageIDs = append(newListing.ImageIDs, imageID)
+	}
+
 	// save new listing in database
-	listingsCollection := db.GetCollection("listings")
-	result, err := listingsCollection.InsertOne(context.Background(), newListing)
+	insertedId, err := s.Store.Listings.Insert(newListing)
 	if err != nil {
+		s.deleteImages(newListing.ImageIDs)
 		http.Error(w, "Failed to insert listing into database", http.StatusConflict)
 		return
 	}
-
-	// insertedID is of type primitive.ObjectID, which is type [12]byte
-	insertedId := result.InsertedID.(primitive.ObjectID)
 	newListing.ListingID = insertedId
 
 	// send an email of the new listing to all subscribers
-	go SendNewListingNotificationEmail(newListing)
+	go s.SendNewListingNotificationEmail(newListing)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(insertedId.Hex()))
@@ -196,17 +405,15 @@ func (s *Server) HandleGetFurniture(w http.ResponseWriter, r *http.Request) {
 	// listingid param might not be set; check for that 1/26
 	id := r.PathValue("listingID")
 
-	res, err := db.FindByIDInListingsCollection(id)
+	var listing types.FurnitureListing
+	listingID, err := primitive.ObjectIDFromHex(id)
+	if err == nil {
+		listing, err = s.Store.Listings.FindByID(listingID)
+	}
 	if err != nil {
-		http.Error(
-			w,
-			"Furniture listing with provided listingID not found",
-			http.StatusBadRequest,
-		)
+		http.Error(w, ErrListingNotFound, http.StatusBadRequest)
 		return
 	}
-	var listing types.FurnitureListing
-	res.Decode(&listing)
 
 	json, err := json.Marshal(listing)
 	if err != nil {
@@ -220,40 +427,59 @@ func (s *Server) HandleGetFurniture(w http.ResponseWriter, r *http.Request) {
 }
 
 /*
-This endpoint handler gets all the listed furnitures and returns
-it back to client in response
-
-- Note: Wouldn't it be bad to return EVERY single document in the listings
-collection at the same time for each request?
+Returns one page of the furniture listings on the market, filtered
+and sorted by the query parameters that parseListingQuery reads.
+Listings that have been bought are left out unless asked for.
 
-For now, this endpoint returns every single document in the listings collection
-at the same time for each request
+200 - a ListingsPage, which has an empty listings array if nothing matches
+400 - a query parameter is invalid
 */
 func (s *Server) HandleGetFurnitures(w http.ResponseWriter, r *http.Request) {
-	collection := db.GetCollection("listings")
-	cursor, err := collection.Find(context.Background(), bson.D{})
+	query, err := parseListingQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := s.queryListingsPage(query)
 	if err != nil {
 		http.Error(w, "Error getting listings", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.Background())
 
-	var listings []types.FurnitureListing
-	for cursor.Next(context.Background()) {
-		var listing types.FurnitureListing
-		if err := cursor.Decode(&listing); err != nil {
-			log.Printf("Error decoding document: %v", err)
-			continue
-		}
-		listings = append(listings, listing)
+	jsonData, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Error encoding response data into JSON", http.StatusInternalServerError)
+		return
 	}
 
-	if err := cursor.Err(); err != nil {
-		http.Error(w, "Error iterating over furniture listings", http.StatusInternalServerError)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Returns how many market listings there are for each type, style, condition,
+material and price bucket, so the market filter can show counts next to its
+options. It takes the same filters as GET /get_furnitures, and each facet
+is counted with every filter except its own, as db.ListingFacets describes.
+
+200 - a db.ListingFacets
+400 - a query parameter is invalid
+*/
+func (s *Server) HandleGetFurnitureFacets(w http.ResponseWriter, r *http.Request) {
+	query, err := parseListingFilters(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	jsonData, err := json.Marshal(listings)
+	facets, err := s.Store.Listings.Facets(query)
+	if err != nil {
+		http.Error(w, "Error counting listings", http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(facets)
 	if err != nil {
 		http.Error(w, "Error encoding response data into JSON", http.StatusInternalServerError)
 		return
@@ -267,16 +493,7 @@ func (s *Server) HandleGetFurnitures(w http.ResponseWriter, r *http.Request) {
 Returns the JSON data of the most recently posted furniture listing
 */
 func (s *Server) HandleGetMostRecentListing(w http.ResponseWriter, r *http.Request) {
-	var listing types.FurnitureListing
-	listingsCollection := db.GetCollection("listings")
-
-	options := options.FindOne().SetSort(map[string]int{"_id": -1})
-
-	err := listingsCollection.FindOne(
-		context.Background(),
-		bson.M{},
-		options,
-	).Decode(&listing)
+	listing, err := s.Store.Listings.FindMostRecent()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
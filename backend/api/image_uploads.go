@@ -0,0 +1,101 @@
+package api
+
+import (
+	"backend/util"
+	"mime/multipart"
+	"slices"
+)
+
+const (
+	MAX_LISTING_IMAGES      = 10
+	MAX_IMAGE_SIZE          = 5 << 20  // 5 MB per image
+	MAX_LISTING_UPLOAD_SIZE = 25 << 20 // 25 MB for all of a listing's images together
+
+	// the images plus some room for the listing's JSON and the multipart boundaries
+	MAX_LISTING_REQUEST_SIZE = MAX_LISTING_UPLOAD_SIZE + 1<<20
+
+	MIN_IMAGE_SIDE   = 200 // pixels; smaller than the thumbnail isn't worth showing
+	MAX_IMAGE_SIDE   = 8000
+	MAX_IMAGE_PIXELS = 40_000_000 // so a small file can't decode into a huge image
+)
+
+/*
+Checks each of the <uploads> read from <files> and returns the ones
+that are accepted with their metadata stripped, along with an error for
+each one that isn't
+*/
+func sanitizeListingImages(files []*multipart.FileHeader, uploads [][]byte) ([][]byte, []ImageFormError) {
+	var sanitized [][]byte
+	var imageErrs []ImageFormError
+	for i, upload := range uploads {
+		data, errMsg := sanitizeListingImage(upload)
+		if errMsg != "" {
+			imageErrs = append(imageErrs, ImageFormError{
+				Index:    i,
+				Filename: files[i].Filename,
+				Error:    errMsg,
+			})
+			continue
+		}
+		sanitized = append(sanitized, data)
+	}
+	return sanitized, imageErrs
+}
+
+/*
+Returns <data> without its metadata if it's a JPEG, PNG or WebP within
+the size and dimension limits. Otherwise, returns which ErrListFormImage
+error it failed with.
+
+The format is sniffed from the file's signature and then has to match
+what the header decodes as, so the file's name and Content-Type are
+never trusted
+*/
+func sanitizeListingImage(data []byte) ([]byte, string) {
+	if len(data) > MAX_IMAGE_SIZE {
+		return nil, ErrListFormImageTooLarge
+	}
+
+	format := util.SniffImageFormat(data)
+	if format == "" {
+		return nil, ErrListFormImageType
+	}
+
+	config, decodedFormat, err := util.DecodeImageConfig(data)
+	if err != nil || decodedFormat != format {
+		return nil, ErrListFormImageType
+	}
+
+	width, height := config.Width, config.Height
+	if min(width, height) < MIN_IMAGE_SIDE ||
+		max(width, height) > MAX_IMAGE_SIDE ||
+		width*height > MAX_IMAGE_PIXELS {
+		return nil, ErrListFormImageDimensions
+	}
+
+	stripped, err := util.StripImageMetadata(data, format)
+	if err != nil {
+		return nil, ErrListFormImageType
+	}
+	return stripped, ""
+}
+
+/*
+Adds <imageErrs> to the ListFormErrors returned by ValidateListFormFields,
+or to a new one if <err> is nil. Each kind of image error is listed once in
+FormErrors, and ImageErrors says which files had it
+*/
+func withImageErrors(err error, imageErrs []ImageFormError) error {
+	if len(imageErrs) == 0 {
+		return err
+	}
+
+	formErrs, _ := err.(ListFormErrors)
+	for _, imageErr := range imageErrs {
+		if !slices.Contains(formErrs.FormErrors, imageErr.Error) {
+			formErrs.FormErrors = append(formErrs.FormErrors, imageErr.Error)
+		}
+	}
+	formErrs.ImageErrors = imageErrs
+	return formErrs
+}
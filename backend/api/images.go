@@ -0,0 +1,83 @@
+package api
+
+import (
+	"backend/db"
+	"backend/types"
+	"bytes"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ErrImageNotFound    = "Image not found"
+	ErrInvalidImageSize = "Image size must be thumbnail, medium, large or original"
+)
+
+/*
+Images never change once they're saved, since editing a listing's photos
+saves new images with new IDs, so clients can cache them for good
+*/
+const IMAGE_CACHE_CONTROL = "public, max-age=31536000, immutable"
+
+/*
+Serves a listing image by its ID with its Content-Type. The ETag is the
+hash of the image, so a client that sends it back in If-None-Match gets
+a 304 without the image being sent again.
+
+The "size" query parameter picks a resized variant, like ?size=thumbnail.
+Images that are already smaller than the size asked for are served at
+their original size
+*/
+func (s *Server) HandleGetImage(w http.ResponseWriter, r *http.Request) {
+	imageID, err := primitive.ObjectIDFromHex(r.PathValue("imageID"))
+	if err != nil {
+		http.Error(w, primitive.ErrInvalidHex.Error(), http.StatusBadRequest)
+		return
+	}
+
+	size := types.ImageSize(r.URL.Query().Get("size"))
+	if size == "" {
+		size = types.ImageOriginal
+	}
+	if !size.IsValid() {
+		http.Error(w, ErrInvalidImageSize, http.StatusBadRequest)
+		return
+	}
+
+	var image types.Image
+	if size != types.ImageOriginal {
+		image, err = s.Store.Images.GetVariant(imageID, size)
+	}
+	if size == types.ImageOriginal || err == db.ErrNotFound {
+		image, err = s.Store.Images.Get(imageID)
+	}
+	if err == db.ErrNotFound {
+		http.Error(w, ErrImageNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", image.ContentType)
+	w.Header().Set("ETag", `"`+image.Hash+`"`)
+	w.Header().Set("Cache-Control", IMAGE_CACHE_CONTROL)
+
+	// handles If-None-Match, If-Modified-Since and Range requests
+	http.ServeContent(w, r, "", image.UploadedAt, bytes.NewReader(image.Data))
+}
+
+/*
+Deletes the images with <imageIDs> from the image store. Failures are only
+logged, since a leftover image doesn't affect anything but storage
+*/
+func (s *Server) deleteImages(imageIDs []primitive.ObjectID) {
+	for _, imageID := range imageIDs {
+		if err := s.Store.Images.Delete(imageID); err != nil && err != db.ErrNotFound {
+			log.Printf("Failed to delete image %s: %s\n", imageID.Hex(), err.Error())
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"backend/db"
+	"backend/types"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Returns the key of the entry of <entryType> for a checkout, or for one of
+its listings if <listingID> isn't the zero value, which is the same every
+time the checkout's event is applied
+*/
+func entryKey(checkoutID string, entryType types.JournalEntryType, listingID primitive.ObjectID) string {
+	if listingID.IsZero() {
+		return fmt.Sprintf("%s/%s", checkoutID, entryType)
+	}
+	return fmt.Sprintf("%s/%s/%s", checkoutID, entryType, listingID.Hex())
+}
+
+/*
+Posts <entry> to the ledger, and moves its amount between the balances of
+the sellers whose accounts it's from or to. An entry with a negative amount
+is posted the other way around, and one with no amount isn't posted.
+
+An entry that was already posted isn't posted again, so an event that failed
+part way can be applied again. Its balances are still updated, in case they
+failed to be the first time, but under the entry's key, so an entry is only
+added to a balance once however many times it's posted
+*/
+func (s *Server) postEntry(entry types.JournalEntry) error {
+	if entry.Amount.IsZero() {
+		return nil
+	}
+	if entry.Amount.IsNegative() {
+		entry.From, entry.To = entry.To, entry.From
+		entry.Amount.Amount = -entry.Amount.Amount
+	}
+	entry.PostedAt = time.Now()
+
+	_, err := s.Store.Ledger.Insert(entry)
+	if err != nil && err != db.ErrEntryPosted {
+		return fmt.Errorf("failed to post %s entry %s: %w", entry.Type, entry.Key, err)
+	}
+
+	for _, account := range []types.LedgerAccount{entry.From, entry.To} {
+		sellerID, isSeller := account.SellerID()
+		if !isSeller {
+			continue
+		}
+		if err := s.Store.Users.AddToBalance(sellerID, entry.AmountFor(account), entry.Key); err != nil {
+			return fmt.Errorf("failed to update the balance of seller %s: %w", sellerID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+/*
+Posts the sale of the listing with <listingID> to the seller with
+<sellerID>: its whole <price> goes to the seller, who then pays their
+share of the processing fee and the platform's fee out of it, which leaves
+the payout of <split> in their balance
+*/
+func (s *Server) postSale(checkoutID string, listingID, sellerID primitive.ObjectID, price types.Money, split ItemSplit) error {
+	seller := types.SellerAccount(sellerID)
+	entries := []types.JournalEntry{
+		{Type: types.EntrySale, From: types.AccountClearing, To: seller, Amount: price},
+		{Type: types.EntryProcessorFee, From: seller, To: types.AccountProcessorFees, Amount: split.ProcessingFee},
+		{Type: types.EntryPlatformFee, From: seller, To: types.AccountPlatformRevenue, Amount: split.PlatformFee},
+	}
+
+	for _, entry := range entries {
+		entry.Key = entryKey(checkoutID, entry.Type, listingID)
+		entry.CheckoutID = checkoutID
+		entry.ListingID = listingID
+		if err := s.postEntry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+One entry of a seller's balance, as GET /account/balance/transactions
+returns it. Amount is negative when it took money out of the balance
+*/
+type BalanceTransaction struct {
+	TransactionID string                 `json:"transactionId"`
+	Type          types.JournalEntryType `json:"type"`
+	Amount        types.Money            `json:"amount"`
+	CheckoutID    string                 `json:"checkoutId,omitempty"`
+	ListingID     string                 `json:"listingId,omitempty"`
+	PostedAt      time.Time              `json:"postedAt"`
+}
+
+/*
+A page of a seller's balance history. NextCursor is passed back as the
+cursor query parameter to get the next page, and is left out on the last page
+*/
+type BalanceTransactionsPage struct {
+	Balance      types.Money          `json:"balance"`
+	Transactions []BalanceTransaction `json:"transactions"`
+	NextCursor   string               `json:"nextCursor,omitempty"`
+}
+
+/*
+Returns the user's balance and every sale, fee, refund and payout that
+changed it, newest first. Reads the query parameters:
+
+	limit    page size, DEFAULT_PAGE_SIZE by default and MAX_PAGE_SIZE at most
+	cursor   the nextCursor of the previous page
+
+200 - the balance and a page of its transactions
+400 - the limit or cursor is invalid
+401 - not logged in
+500 - the ledger couldn't be read
+*/
+func (s *Server) HandleBalanceTransactions(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	limit, err := parseLimit(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var after primitive.ObjectID
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		if after, err = primitive.ObjectIDFromHex(cursor); err != nil {
+			http.Error(w, ErrInvalidCursor, http.StatusBadRequest)
+			return
+		}
+	}
+
+	user, err := s.Store.Users.FindByID(session.UserID())
+	if err != nil {
+		http.Error(w, "Failed to fetch account", http.StatusInternalServerError)
+		return
+	}
+
+	// one more than the page size, to tell whether there is a next page
+	account := types.SellerAccount(user.UserID)
+	entries, err := s.Store.Ledger.FindByAccount(account, after, limit+1)
+	if err != nil {
+		http.Error(w, "Failed to fetch balance transactions", http.StatusInternalServerError)
+		return
+	}
+
+	page := BalanceTransactionsPage{Balance: user.Balance, Transactions: []BalanceTransaction{}}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		page.NextCursor = entries[limit-1].EntryID.Hex()
+	}
+	for _, entry := range entries {
+		transaction := BalanceTransaction{
+			TransactionID: entry.EntryID.Hex(),
+			Type:          entry.Type,
+			Amount:        entry.AmountFor(account),
+			CheckoutID:    entry.CheckoutID,
+			PostedAt:      entry.PostedAt,
+		}
+		if !entry.ListingID.IsZero() {
+			transaction.ListingID = entry.ListingID.Hex()
+		}
+		page.Transactions = append(page.Transactions, transaction)
+	}
+
+	jsonData, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"backend/db"
+	"backend/types"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ErrInvalidPriceRange = "min_price and max_price must be non-negative numbers, and min_price can't be more than max_price"
+	ErrInvalidBought     = "bought must be true, false or any"
+	ErrInvalidSort       = "sort must be newest, oldest, price_asc or price_desc"
+	ErrInvalidLimit      = "limit must be a whole number from 1 to 100"
+	ErrInvalidCursor     = "cursor is invalid or belongs to a different sort"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+)
+
+/*
+A page of market listings. NextCursor is passed back as the cursor
+query parameter to get the next page, and is left out on the last page
+*/
+type ListingsPage struct {
+	Listings   []types.FurnitureListing `json:"listings"`
+	NextCursor string                   `json:"nextCursor,omitempty"`
+}
+
+/*
+Reads the market filters, sort and page from the query parameters. On top
+of the filters that parseListingFilters reads, it reads:
+
+	sort     newest (default), oldest, price_asc or price_desc
+	limit    page size, DEFAULT_PAGE_SIZE by default and MAX_PAGE_SIZE at most
+	cursor   the nextCursor of the previous page
+
+The error is one of the ErrInvalid messages above
+*/
+func parseListingQuery(values url.Values) (db.ListingQuery, error) {
+	query, err := parseListingFilters(values)
+	if err != nil {
+		return query, err
+	}
+
+	query.Sort = db.SortNewest
+	if sort := values.Get("sort"); sort != "" {
+		query.Sort = db.ListingSort(sort)
+		if !query.Sort.IsValid() {
+			return query, errors.New(ErrInvalidSort)
+		}
+	}
+
+	if query.Limit, err = parseLimit(values); err != nil {
+		return query, err
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := decodeListingCursor(cursor, query.Sort)
+		if err != nil {
+			return query, err
+		}
+		query.After = &after
+	}
+
+	return query, nil
+}
+
+/*
+Reads the filters that the market and search share from the query parameters:
+
+	type, style, condition, material   any number of values, repeated or comma separated
+	min_price, max_price               inclusive price range
+	bought                             true, false or any; false by default, so sold listings are hidden
+*/
+func parseListingFilters(values url.Values) (db.ListingQuery, error) {
+	query := db.ListingQuery{
+		Types:      queryEnum[types.FurnitureType](values, "type"),
+		Styles:     queryEnum[types.FurnitureStyle](values, "style"),
+		Conditions: queryEnum[types.FurnitureCondition](values, "condition"),
+		Materials:  queryEnum[types.FurnitureMaterial](values, "material"),
+	}
+
+	var err error
+	if query.MinCost, err = queryPrice(values, "min_price"); err != nil {
+		return query, err
+	}
+	if query.MaxCost, err = queryPrice(values, "max_price"); err != nil {
+		return query, err
+	}
+	if query.MinCost != nil && query.MaxCost != nil && query.MinCost.Cmp(*query.MaxCost) > 0 {
+		return query, errors.New(ErrInvalidPriceRange)
+	}
+
+	bought := false
+	query.Bought = &bought
+	switch values.Get("bought") {
+	case "", "false":
+	case "true":
+		bought = true
+	case "any":
+		query.Bought = nil
+	default:
+		return query, errors.New(ErrInvalidBought)
+	}
+
+	return query, nil
+}
+
+// Reads the page size from the limit query parameter, or returns DEFAULT_PAGE_SIZE
+func parseLimit(values url.Values) (int, error) {
+	limit := values.Get("limit")
+	if limit == "" {
+		return DEFAULT_PAGE_SIZE, nil
+	}
+
+	pageSize, err := strconv.Atoi(limit)
+	if err != nil || pageSize < 1 || pageSize > MAX_PAGE_SIZE {
+		return 0, errors.New(ErrInvalidLimit)
+	}
+	return pageSize, nil
+}
+
+/*
+Returns every value of the query parameter <key>, whether the parameter
+is repeated (?type=Bed&type=Desk) or comma separated (?type=Bed,Desk)
+*/
+func queryEnum[T ~string](values url.Values, key string) []T {
+	var enums []T
+	for _, value := range values[key] {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				enums = append(enums, T(part))
+			}
+		}
+	}
+	return enums
+}
+
+// Reads a price in dollars, like 125.50. Returns nil if the query parameter <key> isn't provided
+func queryPrice(values url.Values, key string) (*types.Money, error) {
+	value := values.Get(key)
+	if value == "" {
+		return nil, nil
+	}
+
+	price, err := types.ParseMoney(value, types.DEFAULT_CURRENCY)
+	if err != nil || price.IsNegative() {
+		return nil, errors.New(ErrInvalidPriceRange)
+	}
+	return &price, nil
+}
+
+// what a cursor holds before it's encoded
+type listingCursor struct {
+	Sort      db.ListingSort `json:"sort"`
+	Cost      types.Money    `json:"cost"`
+	ListingID string         `json:"id"`
+}
+
+/*
+Returns the cursor for the page after <last>. Cursors are opaque to clients,
+but aren't secret, since all they hold is the position of a public listing
+*/
+func encodeListingCursor(last types.FurnitureListing, sort db.ListingSort) string {
+	position := db.CursorAfter(last)
+	jsonData, _ := json.Marshal(listingCursor{
+		Sort:      sort,
+		Cost:      position.Cost,
+		ListingID: position.ListingID.Hex(),
+	})
+	return base64.RawURLEncoding.EncodeToString(jsonData)
+}
+
+/*
+Decodes a cursor from encodeListingCursor. A cursor can only be used with
+the sort it was made for, since its position means nothing in another order
+*/
+func decodeListingCursor(cursor string, sort db.ListingSort) (db.ListingCursor, error) {
+	errInvalid := errors.New(ErrInvalidCursor)
+
+	jsonData, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return db.ListingCursor{}, errInvalid
+	}
+
+	var decoded listingCursor
+	if err := json.Unmarshal(jsonData, &decoded); err != nil || decoded.Sort != sort {
+		return db.ListingCursor{}, errInvalid
+	}
+
+	listingID, err := primitive.ObjectIDFromHex(decoded.ListingID)
+	if err != nil {
+		return db.ListingCursor{}, errInvalid
+	}
+	return db.ListingCursor{Cost: decoded.Cost, ListingID: listingID}, nil
+}
+
+/*
+Runs <query> for one page of listings. One more listing than the page
+size is fetched to tell whether there is a next page without a count
+*/
+func (s *Server) queryListingsPage(query db.ListingQuery) (ListingsPage, error) {
+	pageSize := query.Limit
+	query.Limit++
+
+	listings, err := s.Store.Listings.Query(query)
+	if err != nil {
+		return ListingsPage{}, err
+	}
+
+	page := ListingsPage{Listings: listings}
+	if len(listings) > pageSize {
+		page.Listings = listings[:pageSize]
+		page.NextCursor = encodeListingCursor(page.Listings[pageSize-1], query.Sort)
+	}
+	if page.Listings == nil {
+		page.Listings = []types.FurnitureListing{}
+	}
+	return page, nil
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+How failed logins for one account or one IP address are throttled.
+The first FreeAttempts failures are not delayed; after that every
+failure locks the account or IP out for twice as long as the last one,
+starting at BaseDelay and never longer than MaxDelay
+*/
+type LoginLimitPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+}
+
+var (
+	ACCOUNT_LOGIN_POLICY = LoginLimitPolicy{FreeAttempts: 5, BaseDelay: time.Second, MaxDelay: 15 * time.Minute}
+
+	// an IP can be shared by many users, like an office or a school, so it's given more room
+	IP_LOGIN_POLICY = LoginLimitPolicy{FreeAttempts: 20, BaseDelay: time.Second, MaxDelay: 15 * time.Minute}
+)
+
+// failures are forgotten once there hasn't been one for this long
+const LOGIN_FAILURE_WINDOW = time.Hour
+
+// once an account has failed this many times, its owner is emailed a link to unlock it
+const LOGIN_UNLOCK_EMAIL_AFTER = 10
+
+// the limiter drops forgotten entries when it tracks more keys than this
+const loginLimiterSweepSize = 10000
+
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+/*
+Tracks failed logins per account and per IP address in process memory.
+It's shared by every login request, so its state is guarded by mu
+*/
+type LoginLimiter struct {
+	mu       sync.Mutex
+	accounts map[string]*loginAttempts
+	ips      map[string]*loginAttempts
+
+	// used instead of time.Now so tests can control time
+	now func() time.Time
+}
+
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		accounts: make(map[string]*loginAttempts),
+		ips:      make(map[string]*loginAttempts),
+		now:      time.Now,
+	}
+}
+
+// Replaces the clock used for lockouts; pass time.Now to restore it
+func (l *LoginLimiter) SetClock(now func() time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.now = now
+}
+
+/*
+Returns the time on the limiter's clock, which the unlock and login
+challenge tokens it hands out also expire by
+*/
+func (l *LoginLimiter) Now() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.now()
+}
+
+/*
+Returns how long the client has to wait before trying to log in as
+<username> from <ip> again, or 0 if it can try right away
+*/
+func (l *LoginLimiter) RetryAfter(username, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	wait := lockedFor(l.accounts[username], now)
+	if ipWait := lockedFor(l.ips[ip], now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+/*
+Records a failed login as <username> from <ip> and returns how many
+times in a row the account has failed
+*/
+func (l *LoginLimiter) RecordFailure(username, ip string) (accountFailures int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.accounts)+len(l.ips) > loginLimiterSweepSize {
+		sweep(l.accounts, now)
+		sweep(l.ips, now)
+	}
+
+	account := recordFailure(l.accounts, username, ACCOUNT_LOGIN_POLICY, now)
+	recordFailure(l.ips, ip, IP_LOGIN_POLICY, now)
+
+	return account.failures
+}
+
+/*
+Forgets the failed logins of <username> after they log in. The IP's
+failures are kept, or someone could keep guessing other accounts' passwords
+by logging into their own account in between
+*/
+func (l *LoginLimiter) RecordSuccess(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.accounts, username)
+}
+
+// Lifts the lockout on <username>, like RecordSuccess
+func (l *LoginLimiter) Unlock(username string) {
+	l.RecordSuccess(username)
+}
+
+func recordFailure(entries map[string]*loginAttempts, key string, policy LoginLimitPolicy, now time.Time) *loginAttempts {
+	entry, exists := entries[key]
+	if !exists || now.Sub(entry.lastFailure) >= LOGIN_FAILURE_WINDOW {
+		entry = &loginAttempts{}
+		entries[key] = entry
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+
+	if entry.failures > policy.FreeAttempts {
+		delay := policy.MaxDelay
+		if shift := entry.failures - policy.FreeAttempts - 1; shift < 32 {
+			delay = min(policy.BaseDelay<<shift, policy.MaxDelay)
+		}
+		entry.lockedUntil = now.Add(delay)
+	}
+
+	return entry
+}
+
+func lockedFor(entry *loginAttempts, now time.Time) time.Duration {
+	if entry == nil || !now.Before(entry.lockedUntil) {
+		return 0
+	}
+	return entry.lockedUntil.Sub(now)
+}
+
+// deletes the entries that are no longer locked and whose failures have been forgotten
+func sweep(entries map[string]*loginAttempts, now time.Time) {
+	for key, entry := range entries {
+		if now.Sub(entry.lastFailure) >= LOGIN_FAILURE_WINDOW && !now.Before(entry.lockedUntil) {
+			delete(entries, key)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"backend/db"
+	"backend/types"
+	"backend/util"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ErrOrderNotFound      = "Order not found"
+	ErrInvalidOrderStatus = "Status must be one of: paid, preparing, shipped, delivered, cancelled, refunded"
+	ErrOrderTransition    = "Order can't move from its current status to that one"
+	ErrRefundFailed       = "The buyer couldn't be refunded, so the order wasn't changed"
+	ErrOrderNotRefundable = "Order was paid before its checkout was kept, so the buyer can't be refunded through the site"
+)
+
+// Sent to PUT /account/sales/{subOrderID}/status
+type OrderStatusUpdate struct {
+	Status types.OrderStatus `json:"status"`
+
+	// only saved when the sub-order is shipped, and both optional
+	TrackingNumber    string    `json:"trackingNumber"`
+	EstimatedDelivery time.Time `json:"estimatedDelivery"`
+}
+
+/*
+Returns the user's sub-orders of the orders they sold listings in, so
+they know what to prepare and ship. The other sellers' sub-orders of the
+same orders aren't included
+
+200 - the sales
+401 - not logged in
+403 - not a seller
+500 - the database failed
+*/
+func (s *Server) HandleSalesGET(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	orders, err := s.Store.Receipts.FindBySeller(session.UserID())
+	if err != nil {
+		http.Error(w, "Failed to fetch sales", http.StatusInternalServerError)
+		return
+	}
+
+	sales := []types.Sale{}
+	for _, order := range orders {
+		for _, subOrder := range order.SubOrders {
+			if subOrder.SellerID == session.UserID() {
+				sale, _ := order.Sale(subOrder.SubOrderID)
+				sales = append(sales, sale)
+			}
+		}
+	}
+
+	jsonData, err := json.Marshal(sales)
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Moves a sub-order the user sold to the status in the body, if it can move
+there from its status. Shipping it saves the tracking number and estimated
+delivery, and cancelling or refunding it gives the buyer their money back
+for its listings and takes them out of the seller's balance first, so it
+only moves once they're refunded. The other sub-orders of the same order
+aren't changed
+
+200 - the sale with its new status
+400 - the sub-order ID or status is invalid
+401 - not logged in
+403 - not a seller
+404 - the user doesn't have a sub-order with the ID
+409 - the sub-order can't move to the status, or it's paid through a checkout that wasn't kept and can't be refunded
+502 - the buyer couldn't be refunded, so it didn't move and can be sent again
+500 - the database failed
+*/
+func (s *Server) HandleSaleStatusPUT(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	subOrderID, err := primitive.ObjectIDFromHex(r.PathValue("subOrderID"))
+	if err != nil {
+		http.Error(w, primitive.ErrInvalidHex.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var update OrderStatusUpdate
+	if err := util.ReadJSONReq[OrderStatusUpdate](r, &update); err != nil {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+	if !update.Status.IsValid() {
+		http.Error(w, ErrInvalidOrderStatus, http.StatusBadRequest)
+		return
+	}
+
+	order, err := s.Store.Receipts.FindSale(subOrderID, session.UserID())
+	if err == db.ErrNotFound {
+		http.Error(w, ErrOrderNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	sale, _ := order.Sale(subOrderID)
+	if !sale.Status.CanMoveTo(update.Status) {
+		http.Error(w, ErrOrderTransition, http.StatusConflict)
+		return
+	}
+
+	changes := bson.M{}
+	if update.Status == types.OrderShipped {
+		changes["trackingNumber"] = strings.TrimSpace(update.TrackingNumber)
+		changes["estimatedDelivery"] = update.EstimatedDelivery
+	}
+
+	if update.Status == types.OrderCancelled || update.Status == types.OrderRefunded {
+		if order.CheckoutID == "" {
+			http.Error(w, ErrOrderNotRefundable, http.StatusConflict)
+			return
+		}
+		if err := s.refundSale(order.CheckoutID, sale); err != nil {
+			log.Printf("Failed to refund sub-order %s of order %s: %s\n", sale.SubOrderID.Hex(), sale.OrderID.Hex(), err.Error())
+			http.Error(w, ErrRefundFailed, http.StatusBadGateway)
+			return
+		}
+	}
+
+	/*
+		Checked again as it's updated, in case it moved since it was read. If
+		it did after it was refunded, the refund stays, and sending this again
+		once it can move doesn't refund it twice
+	*/
+	change := types.OrderStatusChange{Status: update.Status, At: time.Now()}
+	err = s.Store.Receipts.UpdateStatus(subOrderID, session.UserID(), sale.Status, change, changes)
+	if err == db.ErrNotFound {
+		http.Error(w, ErrOrderTransition, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+
+	order, err = s.Store.Receipts.FindSale(subOrderID, session.UserID())
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	sale, _ = order.Sale(subOrderID)
+
+	jsonData, err := json.Marshal(sale)
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Gives the buyer back what they paid for the listings of <sale>, out of
+the checkout with <checkoutID>, and takes each sale back out of the
+seller's balance. The platform gives back its fee and covers the
+processor's, which isn't refunded, so the seller ends up where they were
+before the sale.
+
+The refund and its entries are keyed by the sub-order, so calling it again
+for a sale that was already refunded, like when moving it failed, gives
+back and takes out nothing more
+*/
+func (s *Server) refundSale(checkoutID string, sale types.Sale) error {
+	if checkoutID == "" {
+		return fmt.Errorf("order %s doesn't have its checkout", sale.OrderID.Hex())
+	}
+	key := fmt.Sprintf("%s/%s/%s", checkoutID, types.EntryRefund, sale.SubOrderID.Hex())
+	if err := s.Payments.Refund(checkoutID, sale.Subtotal, key); err != nil {
+		return fmt.Errorf("failed to refund %s: %w", sale.Subtotal, err)
+	}
+
+	seller := types.SellerAccount(sale.SellerID)
+	for _, item := range sale.Items {
+		entries := []types.JournalEntry{
+			{Type: types.EntryRefund, From: seller, To: types.AccountBuyers, Amount: item.Price},
+			{Type: types.EntryFeeRefund, From: types.AccountPlatformRevenue, To: seller, Amount: item.Price.Sub(item.Payout)},
+		}
+
+		for _, entry := range entries {
+			entry.Key = entryKey(checkoutID, entry.Type, item.ListingID)
+			entry.CheckoutID = checkoutID
+			entry.ListingID = item.ListingID
+			if err := s.postEntry(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
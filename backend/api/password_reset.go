@@ -0,0 +1,171 @@
+package api
+
+import (
+	"backend/db"
+	"backend/types"
+	"backend/util"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	ErrInvalidResetToken = "Password reset link is invalid or has expired"
+	ErrPasswordReset     = "Failed to reset password"
+)
+
+// how long the link in a password reset email stays valid
+const PASSWORD_RESET_TTL = time.Hour
+
+// Sent to POST /password/forgot
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// Sent to POST /password/reset with the token from the reset email
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"password"`
+	ConfirmPass string `json:"confirm"`
+}
+
+// Only the hash of a reset token is stored, so a leaked database can't be used to reset passwords
+func hashResetToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+Emails a link to reset the password to the user with the provided email.
+
+The response is the same whether or not an account uses the email, so
+this endpoint can't be used to find out who has an account. Requesting
+a new link makes the links sent before it stop working
+*/
+func (s *Server) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := util.ReadJSONReq[ForgotPasswordRequest](r, &req); err != nil {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" {
+		http.Error(w, ErrBlankFields, http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.Store.Users.FindByEmail(req.Email)
+	if err == db.ErrNotFound {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("success"))
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 32 random bytes, so the token can't be guessed
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		http.Error(w, "Failed to generate reset token", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	if err = s.Store.PasswordResets.DeleteByUser(user.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = s.Store.PasswordResets.Insert(types.PasswordReset{
+		TokenHash: hashResetToken(token),
+		UserID:    user.UserID,
+		ExpiresAt: time.Now().Add(PASSWORD_RESET_TTL),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	link := fmt.Sprintf("http://127.0.0.1:5173/reset_password?token=%s", url.QueryEscape(token))
+
+	err = s.Mailer.Send(
+		user.Email,
+		"Reset your password",
+		"We received a request to reset the password for "+user.Username+". "+
+			fmt.Sprintf("Click here to choose a new password: %s", link)+
+			fmt.Sprintf("\r\n\r\nThis link expires in %d minutes. ", int(PASSWORD_RESET_TTL.Minutes()))+
+			"If you didn't ask to reset your password, you can ignore this email.",
+	)
+	if err != nil {
+		log.Printf("Failed to send password reset email to %s: %s\n", user.UserID.Hex(), err.Error())
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+/*
+Sets a new password using the token from the reset email. Each token
+can only be used once, and every session of the user is logged out
+once the password is changed
+*/
+func (s *Server) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := util.ReadJSONReq[ResetPasswordRequest](r, &req); err != nil {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" || req.NewPassword == "" || req.ConfirmPass == "" {
+		http.Error(w, ErrBlankFields, http.StatusBadRequest)
+		return
+	}
+
+	if req.NewPassword != req.ConfirmPass {
+		http.Error(w, ErrPasswordMismatch, http.StatusBadRequest)
+		return
+	}
+
+	reset, err := s.Store.PasswordResets.Consume(hashResetToken(req.Token), time.Now())
+	if err == db.ErrNotFound {
+		http.Error(w, ErrInvalidResetToken, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, ErrPasswordReset, http.StatusInternalServerError)
+		return
+	}
+
+	hashedPassword, err := util.HashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	err = s.Store.Users.Update(reset.UserID, bson.M{"password": hashedPassword})
+	if err != nil {
+		http.Error(w, ErrPasswordReset, http.StatusInternalServerError)
+		return
+	}
+
+	// whoever knew the old password could still be logged in somewhere
+	if err = GetSessionManager().DeleteUserSessions(reset.UserID); err != nil {
+		log.Printf("Failed to log out sessions of %s: %s\n", reset.UserID.Hex(), err.Error())
+	}
+	if err = s.Store.PasswordResets.DeleteByUser(reset.UserID); err != nil {
+		log.Printf("Failed to delete password resets of %s: %s\n", reset.UserID.Hex(), err.Error())
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"backend/types"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+Takes the buyers' payments on behalf of the server. Swap it out on the
+Server to check out without a payment processor, like in tests or when
+running offline
+*/
+type PaymentProvider interface {
+	// Starts a checkout where the buyer pays for <params.Items> at the returned Checkout's URL
+	CreateCheckout(params CheckoutParams) (*Checkout, error)
+	// Returns the checkout with <checkoutID>, or ErrPaymentCheckoutNotFound
+	GetCheckout(checkoutID string) (*Checkout, error)
+	// Ends a checkout that hasn't been paid, so it can't be paid anymore
+	ExpireCheckout(checkoutID string) error
+	/*
+		Verifies that a webhook request with <payload> and <header> was sent by
+		the provider, and returns the event it reports
+	*/
+	ParseWebhook(payload []byte, header http.Header) (*PaymentEvent, error)
+	/*
+		Gives <amount> of a paid checkout back to the buyer. Refunding again
+		with the same <key> returns without giving anything back twice
+	*/
+	Refund(checkoutID string, amount types.Money, key string) error
+}
+
+var (
+	ErrPaymentCheckoutNotFound = errors.New("checkout not found")
+	ErrPaymentNotRefundable    = errors.New("checkout hasn't been paid, or the refund is more than what's left of its payment")
+	ErrNoWebhookSecret         = errors.New("webhook signing secret is not configured")
+	ErrInvalidWebhook          = errors.New("webhook request wasn't sent by the payment provider")
+)
+
+// Put in CheckoutParams.CancelURL, the providers replace it with the checkout's ID
+const CHECKOUT_ID_PLACEHOLDER = "{CHECKOUT_SESSION_ID}"
+
+// One listing being paid for in a checkout
+type CheckoutItem struct {
+	Name        string
+	Description string
+	Amount      types.Money
+	Metadata    map[string]string
+}
+
+// Every item of a checkout must be in the same currency, which the buyer is charged in
+type CheckoutParams struct {
+	Items      []CheckoutItem
+	SuccessURL string // where the buyer is sent once they've paid
+	CancelURL  string // where the buyer is sent if they leave without paying
+	ExpiresAt  time.Time
+
+	// returned with the checkout and its events, so they can be tied back to the buyer and cart
+	Metadata map[string]string
+}
+
+type CheckoutStatus string
+
+const (
+	CheckoutOpen     CheckoutStatus = "open"
+	CheckoutComplete CheckoutStatus = "complete"
+	CheckoutExpired  CheckoutStatus = "expired"
+)
+
+type Checkout struct {
+	ID              string
+	URL             string // where the buyer pays
+	Status          CheckoutStatus
+	AmountTotal     types.Money
+	Metadata        map[string]string
+	ShippingAddress types.ReceiptAddress
+}
+
+type PaymentEventType string
+
+/*
+The events the server acts on. Providers report any other events with
+their own type, and they're acknowledged without doing anything
+*/
+const (
+	PaymentCompleted PaymentEventType = "payment.completed"
+	PaymentExpired   PaymentEventType = "payment.expired" // the buyer didn't pay in time, or canceled
+	PaymentFailed    PaymentEventType = "payment.failed"  // the buyer's payment was declined after they submitted it
+)
+
+// Something that happened to a checkout, which a provider reports in a webhook request
+type PaymentEvent struct {
+	ID       string // unique to the event, however many times it's delivered
+	Type     PaymentEventType
+	Checkout Checkout
+}
+
+/*
+Returns the provider named by the ANTIQ_FURN_PAYMENTS env variable. It's
+Stripe by default, or a FakePaymentProvider serving its checkout pages
+from the server at <port> if it's set to "fake"
+*/
+func loadPaymentProvider(port string) PaymentProvider {
+	switch provider := os.Getenv("ANTIQ_FURN_PAYMENTS"); provider {
+	case "", "stripe":
+		return NewStripeProvider(os.Getenv("STRIPE_TEST_KEY"), os.Getenv("STRIPE_WEBHOOK_SECRET"), loadWebhookTolerance())
+	case "fake":
+		return NewFakePaymentProvider(fmt.Sprintf("http://localhost%s", port))
+	default:
+		log.Fatalf("ANTIQ_FURN_PAYMENTS must be stripe or fake, got: %q\n", provider)
+		return nil
+	}
+}
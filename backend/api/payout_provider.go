@@ -0,0 +1,107 @@
+package api
+
+import (
+	"backend/types"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+/*
+Pays sellers' withdrawals out to their bank accounts on behalf of the
+server. Swap it out on the Server to pay out without a payout processor,
+like in tests or when running offline
+*/
+type PayoutProvider interface {
+	/*
+		Registers the bank account in <account> to pay out to, and returns it
+		the way it's saved on the seller, with the provider's ID for it
+	*/
+	RegisterDestination(account BankAccount) (types.PayoutDestination, error)
+	/*
+		Starts paying <params.Amount> out to <params.DestinationID>. Creating a
+		payout again with the same IdempotencyKey returns the payout that was
+		already created instead of paying twice
+	*/
+	CreatePayout(params PayoutParams) (*Payout, error)
+	/*
+		Verifies that a webhook request with <payload> and <header> was sent by
+		the provider, and returns the event it reports
+	*/
+	ParseWebhook(payload []byte, header http.Header) (*PayoutEvent, error)
+}
+
+/*
+Returns the provider named by the ANTIQ_FURN_PAYOUTS env variable. No
+payout processor is integrated yet, so it's nil unless it's set to "fake",
+which returns a FakePayoutProvider that sends its webhook requests to the
+server at <port>. Withdrawals are turned off while it's nil
+*/
+func loadPayoutProvider(port string) PayoutProvider {
+	switch provider := os.Getenv("ANTIQ_FURN_PAYOUTS"); provider {
+	case "":
+		return nil
+	case "fake":
+		return NewFakePayoutProvider(fmt.Sprintf("http://localhost%s", port))
+	default:
+		log.Fatalf("ANTIQ_FURN_PAYOUTS must be fake or unset, got: %q\n", provider)
+		return nil
+	}
+}
+
+var (
+	ErrPayoutDestinationNotFound = errors.New("payout destination not found")
+	ErrPayoutNotFound            = errors.New("payout not found")
+)
+
+// The bank account a seller registers for their withdrawals, sent to PUT /account/payout_destination
+type BankAccount struct {
+	AccountHolder string `json:"accountHolder"`
+	RoutingNumber string `json:"routingNumber"`
+	AccountNumber string `json:"accountNumber"`
+}
+
+type PayoutParams struct {
+	DestinationID  string // the ProviderID of the seller's types.PayoutDestination
+	Amount         types.Money
+	IdempotencyKey string
+
+	// returned with the payout and its events, so they can be tied back to the withdrawal
+	Metadata map[string]string
+}
+
+type PayoutStatus string
+
+const (
+	PayoutPending PayoutStatus = "pending" // on its way to the bank
+	PayoutPaid    PayoutStatus = "paid"
+	PayoutFailed  PayoutStatus = "failed" // the bank returned it, so it was never paid
+)
+
+type Payout struct {
+	ID            string
+	Status        PayoutStatus
+	Amount        types.Money
+	FailureReason string // why it failed, when it did
+	Metadata      map[string]string
+}
+
+type PayoutEventType string
+
+/*
+The events the server acts on. Providers report any other events with
+their own type, and they're acknowledged without doing anything
+*/
+const (
+	PayoutPaidEvent   PayoutEventType = "payout.paid"
+	PayoutFailedEvent PayoutEventType = "payout.failed" // even one that was reported as paid before
+)
+
+// Something that happened to a payout, which a provider reports in a webhook request
+type PayoutEvent struct {
+	ID     string // unique to the event, however many times it's delivered
+	Type   PayoutEventType
+	Payout Payout
+}
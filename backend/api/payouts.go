@@ -0,0 +1,69 @@
+package api
+
+import "backend/types"
+
+/*
+Stripe's processing fee for each successful transaction, which is
+2.9% of the amount charged plus 30 cents
+*/
+const (
+	PROCESSING_FEE_PER_MILLE   int64 = 29
+	PROCESSING_FEE_FIXED_CENTS int64 = 30
+)
+
+// Sellers get 95% of what their items bring in after fees; the platform gets the other 5%
+const SELLER_SHARE_PERCENT int64 = 95
+
+// Returns the processing fee of charging <amount>, rounded to the nearest minor unit
+func ProcessingFee(amount types.Money) types.Money {
+	fee := amount.MulRatio(PROCESSING_FEE_PER_MILLE, 1000, types.RoundHalfUp)
+	return fee.Add(types.NewMoney(PROCESSING_FEE_FIXED_CENTS, amount.Currency))
+}
+
+// How the price of one item of a checkout is split between the processor, the platform and the seller
+type ItemSplit struct {
+	ProcessingFee types.Money // the item's share of the checkout's processing fee
+	PlatformFee   types.Money // negative when the processing fee is more than the price, and the platform covers the rest
+	Payout        types.Money // what the seller is paid, which is never negative
+}
+
+/*
+Returns how the price of each item of a checkout is split, when the items
+have <prices> and the checkout charged <amountCharged>. Each split adds up
+to the item's price.
+
+The processing fee of the whole checkout is split across its items by
+price, so the shares add up to the fee exactly and a cheap item never pays
+for an expensive one. Each seller then gets SELLER_SHARE_PERCENT of what's
+left of their item's price, rounded down, and the platform keeps the rest
+*/
+func SplitItems(prices []types.Money, amountCharged types.Money) []ItemSplit {
+	weights := make([]int64, len(prices))
+	for i, price := range prices {
+		weights[i] = price.Amount
+	}
+	feeShares := ProcessingFee(amountCharged).Allocate(weights)
+
+	splits := make([]ItemSplit, len(prices))
+	for i, price := range prices {
+		payout := price.Sub(feeShares[i]).MulRatio(SELLER_SHARE_PERCENT, 100, types.RoundDown)
+		if payout.IsNegative() {
+			payout.Amount = 0
+		}
+		splits[i] = ItemSplit{
+			ProcessingFee: feeShares[i],
+			PlatformFee:   price.Sub(feeShares[i]).Sub(payout),
+			Payout:        payout,
+		}
+	}
+	return splits
+}
+
+// Returns what the seller of each item of a checkout is paid, the same as SplitItems
+func ItemPayouts(prices []types.Money, amountCharged types.Money) []types.Money {
+	payouts := make([]types.Money, len(prices))
+	for i, split := range SplitItems(prices, amountCharged) {
+		payouts[i] = split.Payout
+	}
+	return payouts
+}
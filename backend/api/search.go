@@ -0,0 +1,159 @@
+package api
+
+import (
+	"backend/search"
+	"backend/types"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	ErrSearchNoQuery      = "Search query not provided"
+	ErrSearchQueryTooLong = "Search query is too long"
+)
+
+const MAX_SEARCH_QUERY_LENGTH = 200
+
+/*
+The most listings a search ranks. The database's text search picks the
+most relevant of the listings that match, so a search costs the same
+however many listings there are
+*/
+const MAX_SEARCH_CANDIDATES = 500
+
+// A listing that matched a search, with the words that matched highlighted
+type SearchResult struct {
+	Listing types.FurnitureListing `json:"listing"`
+	Score   float64                `json:"score"`
+	Title   string                 `json:"title"`   // HTML escaped, with matches wrapped in <mark>
+	Snippet string                 `json:"snippet"` // part of the description, highlighted the same way
+}
+
+/*
+A page of search results, most relevant first. NextCursor is passed back
+as the cursor query parameter to get the next page
+*/
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	Total      int            `json:"total"` // how many listings matched, on every page together, up to MAX_SEARCH_CANDIDATES
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+/*
+Searches the titles and descriptions of the market's listings for the
+words in the q query parameter, like GET /search?q=tiger+maple+highboy.
+
+Words match other forms of the same word ("tables" finds "table"), and
+antique furniture names match their synonyms ("nightstand" finds
+"bedside table"). The database's text search picks up to
+MAX_SEARCH_CANDIDATES of the listings that match, which are ranked with
+BM25, and it takes the same filters and limit as GET /get_furnitures.
+
+200 - a SearchPage, which has no results if nothing matches
+400 - q is missing or a query parameter is invalid
+*/
+func (s *Server) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	q := strings.TrimSpace(values.Get("q"))
+	if q == "" {
+		http.Error(w, ErrSearchNoQuery, http.StatusBadRequest)
+		return
+	}
+	if len(q) > MAX_SEARCH_QUERY_LENGTH {
+		http.Error(w, ErrSearchQueryTooLong, http.StatusBadRequest)
+		return
+	}
+
+	filters, err := parseListingFilters(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimit(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset := 0
+	if cursor := values.Get("cursor"); cursor != "" {
+		if offset, err = decodeSearchCursor(cursor, q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the database narrows the listings down to the most relevant that match the filters, then those are ranked
+	listings := []types.FurnitureListing{}
+	if words := search.Words(q); len(words) > 0 {
+		listings, err = s.Store.Listings.Search(filters, words, MAX_SEARCH_CANDIDATES)
+		if err != nil {
+			http.Error(w, "Error getting listings", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	docs := make([]search.Document, len(listings))
+	for i, listing := range listings {
+		docs[i] = search.Document{Title: listing.Title, Description: listing.Description}
+	}
+	ranked := search.Rank(q, docs)
+
+	page := SearchPage{Results: []SearchResult{}, Total: len(ranked)}
+	end := min(offset+limit, len(ranked))
+	for _, result := range ranked[min(offset, end):end] {
+		page.Results = append(page.Results, SearchResult{
+			Listing: listings[result.Index],
+			Score:   result.Score,
+			Title:   result.Title,
+			Snippet: result.Snippet,
+		})
+	}
+	if end < len(ranked) {
+		page.NextCursor = encodeSearchCursor(q, end)
+	}
+
+	jsonData, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Error encoding response data into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// what a search cursor holds before it's encoded
+type searchCursor struct {
+	Query  string `json:"q"`
+	Offset int    `json:"offset"`
+}
+
+/*
+Search results are ranked again on every request, so the cursor is how
+many results were already sent. Listings posted in between can shift the
+results, which is fine for browsing
+*/
+func encodeSearchCursor(q string, offset int) string {
+	jsonData, _ := json.Marshal(searchCursor{Query: q, Offset: offset})
+	return base64.RawURLEncoding.EncodeToString(jsonData)
+}
+
+// A cursor can only be used with the search it came from
+func decodeSearchCursor(cursor string, q string) (int, error) {
+	errInvalid := errors.New(ErrInvalidCursor)
+
+	jsonData, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalid
+	}
+
+	var decoded searchCursor
+	if err := json.Unmarshal(jsonData, &decoded); err != nil || decoded.Query != q || decoded.Offset < 0 {
+		return 0, errInvalid
+	}
+	return decoded.Offset, nil
+}
@@ -1,15 +1,19 @@
 package api
 
 import (
+	"backend/db"
+	"backend/types"
 	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/rs/cors"
-	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
 )
 
 type MiddlewareFunc func(http.HandlerFunc) http.HandlerFunc
@@ -21,20 +25,73 @@ const (
 type Server struct {
 	Port       string
 	Mux        *http.ServeMux
+	Store      *db.Store // repositories used by the handlers to read and save data
+	Mailer     Mailer    // sends the emails, like the email verification links
+	Payments   PaymentProvider
+	Payouts    PayoutProvider // pays sellers' withdrawals out to their bank accounts, or nil if there's none
+	Limiter    *LoginLimiter
 	httpServer *http.Server
+
+	// key used to sign the tokens sent in emails, like the email verification links
+	TokenSecret []byte
 }
 
-func NewServer(port string) *Server {
+/*
+Creates a server that listens on <port> and reads and writes all
+of its data through <store>. Pass db.NewMongoStore() to use the real
+database, or db.NewMemoryStore() to run without one
+*/
+func NewServer(port string, store *db.Store) *Server {
 	m := http.NewServeMux()
 	s := &http.Server{
 		Addr:    port,
 		Handler: m,
 	}
 	return &Server{
-		Port:       port,
-		Mux:        m,
-		httpServer: s,
+		Port:        port,
+		Mux:         m,
+		Store:       store,
+		Mailer:      SMTPMailer{},
+		Payments:    loadPaymentProvider(port),
+		Payouts:     loadPayoutProvider(port),
+		Limiter:     NewLoginLimiter(),
+		httpServer:  s,
+		TokenSecret: loadTokenSecret(),
+	}
+}
+
+/*
+Reads the token signing key from the ANTIQ_FURN_TOKEN_SECRET env variable.
+If it's not set, a random key is used, so any tokens that were sent out
+stop working when the server restarts
+*/
+func loadTokenSecret() []byte {
+	if secret := os.Getenv("ANTIQ_FURN_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal("Failed to generate token secret:", err)
+	}
+	return secret
+}
+
+/*
+Reads the webhook signature tolerance from the STRIPE_WEBHOOK_TOLERANCE env
+variable, as a duration like "5m", or returns Stripe's default of 5 minutes
+*/
+func loadWebhookTolerance() time.Duration {
+	value := os.Getenv("STRIPE_WEBHOOK_TOLERANCE")
+	if value == "" {
+		return webhook.DefaultTolerance
 	}
+
+	tolerance, err := time.ParseDuration(value)
+	if err != nil || tolerance <= 0 {
+		log.Fatalf("STRIPE_WEBHOOK_TOLERANCE must be a positive duration like 5m, got: %q\n", value)
+	}
+	return tolerance
 }
 
 func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
@@ -49,15 +106,26 @@ Starts the server to begin listening for requests
 func (s *Server) Start() {
 	s.Mux.HandleFunc("/", s.HandleRoot)
 	s.Use("POST /login", s.HandleLogin, logEndpointHit)
+	s.Use("POST /login/2fa", s.HandleLoginTwoFactor, logEndpointHit)
 	s.Use("POST /signup", s.HandleSignup, logEndpointHit)
 	s.Use("POST /logout", s.HandleLogout, AuthMiddleware, logEndpointHit)
-	s.Use("POST /subscribe", s.HandleSubscribe, AuthMiddleware, logEndpointHit)
+	s.Use("POST /subscribe", s.HandleSubscribe, s.RequireVerifiedEmail, AuthMiddleware, logEndpointHit)
 	s.Use("POST /unsubscribe", s.HandleUnsubscribe, AuthMiddleware, logEndpointHit)
+	s.Use("GET /verify_email", s.HandleVerifyEmail, logEndpointHit)
+	s.Use("POST /verify_email/resend", s.HandleResendVerificationEmail, AuthMiddleware, logEndpointHit)
+	s.Use("POST /password/forgot", s.HandleForgotPassword, logEndpointHit)
+	s.Use("POST /password/reset", s.HandleResetPassword, logEndpointHit)
+	s.Use("GET /unlock_account", s.HandleUnlockAccount, logEndpointHit)
 
-	s.Use("POST /list_furniture", s.HandleListFurniture, AuthMiddleware, logEndpointHit)
+	s.Use("POST /list_furniture", s.HandleListFurniture, s.RequireVerifiedEmail, RequireRole(types.RoleSeller), AuthMiddleware, logEndpointHit)
 	s.Use("GET /get_furnitures", s.HandleGetFurnitures, logEndpointHit)
+	s.Use("GET /get_furnitures/facets", s.HandleGetFurnitureFacets, logEndpointHit)
+	s.Use("GET /search", s.HandleSearch, logEndpointHit)
 	s.Use("GET /get_furniture/{listingID}", s.HandleGetFurniture, logEndpointHit)
 	s.Use("GET /recent_listing", s.HandleGetMostRecentListing, logEndpointHit)
+	s.Use("PUT /listings/{listingID}", s.HandleListingPUT, AuthMiddleware, logEndpointHit)
+	s.Use("DELETE /listings/{listingID}", s.HandleListingDELETE, AuthMiddleware, logEndpointHit)
+	s.Use("GET /images/{imageID}", s.HandleGetImage, logEndpointHit)
 
 	s.Use("GET /account", s.HandleAccountGET, AuthMiddleware, logEndpointHit)
 	s.Use("PUT /account", s.HandleAccountPUT, AuthMiddleware, logEndpointHit)
@@ -68,35 +136,59 @@ func (s *Server) Start() {
 	s.Use("GET /account/purchase_history", s.HandlePurchaseHistory, AuthMiddleware, logEndpointHit)
 	s.Use("GET /account/purchase_history/{orderID}", s.HandlePurchaseHistoryItem, AuthMiddleware, logEndpointHit)
 	s.Use("GET /account/furniture_listings", s.HandleGETUserFurnitureListings, AuthMiddleware, logEndpointHit)
-
-	s.Use("POST /checkout", s.HandleCheckout, AuthMiddleware, logEndpointHit)
+	s.Use("GET /account/sales", s.HandleSalesGET, RequireRole(types.RoleSeller), AuthMiddleware, logEndpointHit)
+	s.Use("PUT /account/sales/{subOrderID}/status", s.HandleSaleStatusPUT, RequireRole(types.RoleSeller), AuthMiddleware, logEndpointHit)
+	s.Use("GET /account/balance/transactions", s.HandleBalanceTransactions, AuthMiddleware, logEndpointHit)
+	s.Use("PUT /account/payout_destination", s.HandlePayoutDestinationPUT, s.RequirePayouts, RequireRole(types.RoleSeller), AuthMiddleware, logEndpointHit)
+	s.Use("GET /account/withdrawals", s.HandleWithdrawalsGET, AuthMiddleware, logEndpointHit)
+	s.Use("POST /account/withdrawals", s.HandleWithdrawalsPOST, s.RequirePayouts, RequireRole(types.RoleSeller), AuthMiddleware, logEndpointHit)
+	s.Use("GET /account/sessions", s.HandleSessionsGET, AuthMiddleware, logEndpointHit)
+	s.Use("DELETE /account/sessions", s.HandleSessionsDELETE, AuthMiddleware, logEndpointHit)
+	s.Use("DELETE /account/sessions/{id}", s.HandleSessionDELETE, AuthMiddleware, logEndpointHit)
+	s.Use("POST /account/2fa/setup", s.HandleTwoFactorSetup, AuthMiddleware, logEndpointHit)
+	s.Use("POST /account/2fa/confirm", s.HandleTwoFactorConfirm, AuthMiddleware, logEndpointHit)
+	s.Use("POST /account/2fa/disable", s.HandleTwoFactorDisable, AuthMiddleware, logEndpointHit)
+
+	s.Use("POST /checkout", s.HandleCheckout, RequireRole(types.RoleBuyer), AuthMiddleware, logEndpointHit)
+	s.Use("POST /checkout/{sessionID}/cancel", s.HandleCheckoutCancel, AuthMiddleware, logEndpointHit)
+
+	s.Use("PUT /admin/users/{userID}/roles", s.HandleSetUserRoles, RequireRole(types.RoleAdmin), AuthMiddleware, logEndpointHit)
+	s.Use("GET /admin/withdrawals", s.HandleAdminWithdrawalsGET, RequireRole(types.RoleAdmin), AuthMiddleware, logEndpointHit)
+	s.Use("POST /admin/withdrawals/{withdrawalID}/approve", s.HandleWithdrawalApprove, s.RequirePayouts, RequireRole(types.RoleAdmin), AuthMiddleware, logEndpointHit)
+	s.Use("POST /admin/withdrawals/{withdrawalID}/reject", s.HandleWithdrawalReject, RequireRole(types.RoleAdmin), AuthMiddleware, logEndpointHit)
 
 	// handle auth in the handler bc cookies aren't sent when Stripe sends the webhook
-	s.Use("POST /checkout_webhook", s.HandleStripeWebhook, logEndpointHit)
-
-	/*----------STRIPE-----------*/
-
-	stripe.Key = os.Getenv("STRIPE_TEST_KEY")
-	webhookURL := fmt.Sprintf("http://localhost%s/checkout_webhook", s.Port)
-
-	/*
-		Since this project is not hosted on the internet, we don't have a public
-		URL. So, we need to add a local listener to watch for webhook requests
-
-		You need to have the stripe.exe directory added to your PATH env variables,
-		which you can do by installing the Stripe CLI, in order to execute this command
-	*/
-	command := exec.Command("stripe", "listen", "--forward-to", webhookURL)
-	err := command.Start()
-	if err != nil {
-		log.Fatal("Failed to execute stripe listen command")
+	s.Use("POST /checkout_webhook", s.HandlePaymentWebhook, logEndpointHit)
+	s.Use("POST /payout_webhook", s.HandlePayoutWebhook, s.RequirePayouts, logEndpointHit)
+
+	switch s.Payments.(type) {
+	case *StripeProvider:
+		webhookURL := fmt.Sprintf("http://localhost%s/checkout_webhook", s.Port)
+
+		/*
+			Since this project is not hosted on the internet, we don't have a public
+			URL. So, we need to add a local listener to watch for webhook requests
+
+			You need to have the stripe.exe directory added to your PATH env variables,
+			which you can do by installing the Stripe CLI, in order to execute this command
+		*/
+		command := exec.Command("stripe", "listen", "--forward-to", webhookURL)
+		err := command.Start()
+		if err != nil {
+			log.Fatal("Failed to execute stripe listen command")
+		}
+		log.Println("\x1b[34mConnected local webhook listener\x1b[0m")
+
+	// the buyer pays on these pages instead of Stripe's, so checkout works offline
+	case *FakePaymentProvider:
+		s.Use("GET /fake_checkout/{checkoutID}", s.HandleFakeCheckoutGET, logEndpointHit)
+		s.Use("POST /fake_checkout/{checkoutID}/{outcome}", s.HandleFakeCheckoutPOST, logEndpointHit)
+		log.Println("\x1b[34mUsing fake payments, nothing will be charged\x1b[0m")
 	}
-	log.Println("\x1b[34mConnected local webhook listener\x1b[0m")
-
-	/*---------------------------*/
 
-	// initialize SessionManager
-	GetSessionManager()
+	// initialize SessionManager and purge expired sessions every minute
+	stopReaper := GetSessionManager().StartReaper(time.Minute)
+	defer stopReaper()
 
 	log.Printf("\x1b[34mListening on port %s\x1b[0m\n", s.Port)
 
@@ -107,7 +199,7 @@ func (s *Server) Start() {
 		AllowCredentials: true,
 	})
 
-	err = http.ListenAndServe(s.Port, c.Handler(s.Mux))
+	err := http.ListenAndServe(s.Port, c.Handler(s.Mux))
 	if err != nil {
 		log.Fatal("Error starting server:", err)
 	}
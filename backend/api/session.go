@@ -1,31 +1,187 @@
 package api
 
 import (
-	"fmt"
+	"backend/types"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-type SessionStore map[string]any
+// values saved for a logged in client, like their userid and username
+type SessionValues map[string]any
 
 const ErrSessionAlreadyExists string = "Session already exists"
 
+// shown in place of the device when it can't be told from the User-Agent
+const UNKNOWN_DEVICE = "Unknown"
+
+/*
+A session is shared by every request the client makes at the same time,
+so its fields are guarded by mu. Set the values through SessionTemplate
+when creating the session, and read them with Get
+*/
 type Session struct {
-	SessionID string
-	Store     SessionStore
+	SessionID string        `bson:"_id"`
+	Store     SessionValues `bson:"store"`
+	ExpiresAt time.Time     `bson:"expiresAt"` // pushed back every time the client makes an authenticated request
+
+	// information about the device that logged in, shown in GET /account/sessions
+	UserAgent string    `bson:"userAgent"`
+	IPAddress string    `bson:"ipAddress"`
+	Device    string    `bson:"device"`
+	CreatedAt time.Time `bson:"createdAt"`
+	LastSeen  time.Time `bson:"lastSeen"`
+
+	mu sync.RWMutex
+}
+
+// Returns the session value saved under <key>, or nil if there isn't one
+func (s *Session) Get(key string) any {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.Store[key]
+}
+
+// Saves <value> under <key>; call SessionManager.SaveSession afterwards to persist it
+func (s *Session) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Store[key] = value
+}
+
+// Returns the ID of the user the session belongs to
+func (s *Session) UserID() primitive.ObjectID {
+	userID, _ := s.Get("userid").(primitive.ObjectID)
+	return userID
+}
+
+/*
+Returns the roles saved in the session when the user logged in. Sessions
+loaded from MongoDB hold them as a bson array, so both forms are handled
+*/
+func (s *Session) Roles() []types.Role {
+	switch roles := s.Get("roles").(type) {
+	case []types.Role:
+		return roles
+	case primitive.A:
+		converted := make([]types.Role, 0, len(roles))
+		for _, role := range roles {
+			if name, ok := role.(string); ok {
+				converted = append(converted, types.Role(name))
+			}
+		}
+		return converted
+	default:
+		return nil
+	}
 }
 
+// Returns true if the user the session belongs to has <role>
+func (s *Session) HasRole(role types.Role) bool {
+	for _, r := range s.Roles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns when the session expires unless it is renewed
+func (s *Session) Expiration() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.ExpiresAt
+}
+
+// Returns true if the session is no longer valid at <now>
+func (s *Session) IsExpired(now time.Time) bool {
+	return !now.Before(s.Expiration())
+}
+
+// Returns the last time the client made an authenticated request with this session
+func (s *Session) LastActivity() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.LastSeen
+}
+
+// records activity at <now> and pushes the expiration back to <expiresAt>
+func (s *Session) renew(now, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.LastSeen = now
+	s.ExpiresAt = expiresAt
+}
+
+/*
+Returns an identifier for the session that is safe to show to the client.
+The SessionID itself is a credential, so it's never sent back in a response
+*/
+func (s *Session) PublicID() string {
+	hash := sha256.Sum256([]byte(s.SessionID))
+	return hex.EncodeToString(hash[:8])
+}
+
+/*
+Returns a copy of the session that is safe to hand to code that reads
+the fields without locking, like the bson encoder
+*/
+func (s *Session) snapshot() *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values := make(SessionValues, len(s.Store))
+	for key, val := range s.Store {
+		values[key] = val
+	}
+
+	return &Session{
+		SessionID: s.SessionID,
+		Store:     values,
+		ExpiresAt: s.ExpiresAt,
+		UserAgent: s.UserAgent,
+		IPAddress: s.IPAddress,
+		Device:    s.Device,
+		CreatedAt: s.CreatedAt,
+		LastSeen:  s.LastSeen,
+	}
+}
+
+/*
+The SessionManager is used from every request goroutine, the reaper
+and the Stripe webhook at the same time. mu only guards the settings;
+the SessionStore implementations do their own locking
+*/
 type SessionManager struct {
-	// a map of all currently running sessions
-	Sessions map[string]*Session
+	mu    sync.RWMutex
+	store SessionStore
+
+	// how long a session stays valid after the client's last activity
+	ttl time.Duration
+
+	// used instead of time.Now so tests can control time
+	now func() time.Time
 }
 
 // used to create a new session with CreateSession()
 type SessionTemplate struct {
 	SessionID string
+	Values    SessionValues // initial session values, like the userid of who logged in
+	UserAgent string        // User-Agent header of the request that logged in
+	IPAddress string        // address of the client that logged in
 }
 
 type CreateSessionError struct {
@@ -51,7 +207,9 @@ manager can exist at a time
 func GetSessionManager() *SessionManager {
 	once.Do(func() {
 		instance = &SessionManager{
-			Sessions: make(map[string]*Session),
+			store: NewMemorySessionStore(),
+			ttl:   CookieExpiration * time.Minute,
+			now:   time.Now,
 		}
 	})
 
@@ -59,7 +217,56 @@ func GetSessionManager() *SessionManager {
 }
 
 /*
-Creates a new session and adds it to the map of currently running sessions.
+Replaces where sessions are kept. Sessions in the previous
+store are not carried over
+*/
+func (s *SessionManager) SetStore(store SessionStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store = store
+}
+
+// Sets how long a session stays valid after the client's last activity
+func (s *SessionManager) SetTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ttl = ttl
+}
+
+// Replaces the clock used to expire sessions; pass time.Now to restore it
+func (s *SessionManager) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.now = now
+}
+
+func (s *SessionManager) getStore() SessionStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store
+}
+
+// returns the expiration for a session that is created or renewed right now
+func (s *SessionManager) nextExpiration() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.now().Add(s.ttl)
+}
+
+func (s *SessionManager) currentTime() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.now()
+}
+
+/*
+Creates a new session that expires after the TTL and saves it into the session store.
 
 - Provide a template with an empty sessionID "" to generate a random sessionID with UUID
 
@@ -67,10 +274,11 @@ Creates a new session and adds it to the map of currently running sessions.
 This will error if another session with that ID already exists
 
 This method will return an error if an error occurs when generating a new sessionId
-or if a session is already found (account is already logged in).
+or if a session is already found (account is already logged in). Checking for an
+existing session and inserting the new one happens atomically in the session store,
+so two requests can't both create a session with the same ID
 */
 func (s *SessionManager) CreateSession(template SessionTemplate) (*Session, error) {
-	var session *Session
 	var id string
 	if template.SessionID == "" {
 		// generate sessionId
@@ -79,88 +287,199 @@ func (s *SessionManager) CreateSession(template SessionTemplate) (*Session, erro
 			return nil, err
 		}
 
-		// create new session
-		session = &Session{
-			SessionID: uuidID.String(),
-			Store:     make(map[string]any),
-		}
 		id = uuidID.String()
 	} else {
-		if _, exists := s.Sessions[template.SessionID]; exists {
-			return nil, CreateSessionError{
-				message: ErrSessionAlreadyExists,
-			}
-		}
-
-		session = &Session{
-			SessionID: template.SessionID,
-			Store:     make(map[string]any),
-		}
 		id = template.SessionID
 	}
 
-	// insert session into session manager
-	s.Sessions[id] = session
+	values := make(SessionValues, len(template.Values))
+	for key, val := range template.Values {
+		values[key] = val
+	}
+
+	// create new session
+	now := s.currentTime()
+	session := &Session{
+		SessionID: id,
+		Store:     values,
+		ExpiresAt: s.nextExpiration(),
+		UserAgent: template.UserAgent,
+		IPAddress: template.IPAddress,
+		Device:    describeDevice(template.UserAgent),
+		CreatedAt: now,
+		LastSeen:  now,
+	}
+
+	// insert session into session store
+	err := s.getStore().Create(session, now)
+	if err == ErrSessionExists {
+		return nil, CreateSessionError{
+			message: ErrSessionAlreadyExists,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	return session, nil
 }
 
+/*
+Persists changes made to the session's values. Call this after changing
+the values with session.Set, since a persistent SessionStore only holds a copy
+*/
+func (s *SessionManager) SaveSession(session *Session) error {
+	return s.getStore().Save(session)
+}
+
 /*
 Retrieves the session associated with the provided sessionID.
 
-If a session can be found with the provided sessionID, the session and true will be
-returned. If not, nil and false will be returned
+If a session can be found with the provided sessionID and it hasn't expired, the
+session and true will be returned. If not, nil and false will be returned.
+Expired sessions are deleted when they are found
 */
 func (s *SessionManager) GetSession(sessionId string) (*Session, bool) {
-	if session, sessionExists := s.Sessions[sessionId]; !sessionExists {
+	session, err := s.getStore().Get(sessionId)
+	if err != nil {
 		return nil, false
-	} else {
-		return session, true
 	}
+
+	if session.IsExpired(s.currentTime()) {
+		s.DeleteSession(sessionId)
+		return nil, false
+	}
+
+	return session, true
 }
 
 /*
-Deletes the session associated with the provided sessionID from the
-map of currently running sessions
+Pushes back the expiration of the session by the TTL, which is how
+a session stays alive for as long as the client stays active. Returns
+ErrSessionNotFound if the session was deleted since it was read
 */
-func (s *SessionManager) DeleteSession(sessionID string) {
-	delete(s.Sessions, sessionID)
+func (s *SessionManager) RenewSession(session *Session) error {
+	now, expiresAt := s.currentTime(), s.nextExpiration()
+	if err := s.getStore().Renew(session.SessionID, now, expiresAt); err != nil {
+		return err
+	}
+	session.renew(now, expiresAt)
+	return nil
 }
 
 /*
-Returns the sessionID string from the cookie in the request or ErrNoCookie
+Returns every session of the user that hasn't expired, with the most
+recently active first. Each one is a device the user is logged in on
 */
-func (s *SessionManager) GetSessionID(r *http.Request) (string, error) {
-	cookie, err := r.Cookie(SESSIONID_COOKIE_NAME)
+func (s *SessionManager) GetUserSessions(userID primitive.ObjectID) ([]*Session, error) {
+	sessions, err := s.getStore().ListByUser(userID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return cookie.Value, nil
+
+	now := s.currentTime()
+	active := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		if !session.IsExpired(now) {
+			active = append(active, session)
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].LastActivity().After(active[j].LastActivity())
+	})
+
+	return active, nil
 }
 
 /*
-Returns true if the sessionID cookie is expired or not found, else returns false
+Saves <value> under <key> in every session of the user, so changes to the
+account, like its roles, apply to the devices that are already logged in.
+Sessions deleted since they were listed, like ones the user just logged
+out of, are skipped rather than saved again
 */
-func (s *SessionManager) IsSessionExpired(r *http.Request) bool {
-	cookie, err := r.Cookie(SESSIONID_COOKIE_NAME)
+func (s *SessionManager) SetUserSessionValue(userID primitive.ObjectID, key string, value any) error {
+	sessions, err := s.GetUserSessions(userID)
 	if err != nil {
-		return true
+		return err
+	}
+
+	for _, session := range sessions {
+		err := s.getStore().SetValue(session.SessionID, key, value)
+		if err == ErrSessionNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	fmt.Println("cookie found:", cookie.Value)
+// Logs the user out of every device by deleting all of their sessions
+func (s *SessionManager) DeleteUserSessions(userID primitive.ObjectID) error {
+	return s.getStore().DeleteByUser(userID)
+}
 
-	if cookie.Expires.Before(time.Now()) {
-		return false
-	} else {
-		return true
+/*
+Deletes the session associated with the provided sessionID from the
+session store
+*/
+func (s *SessionManager) DeleteSession(sessionID string) {
+	if err := s.getStore().Delete(sessionID); err != nil {
+		log.Printf("Failed to delete session %s: %s\n", sessionID, err.Error())
 	}
 }
 
+/*
+Starts a goroutine that purges expired sessions from the session store
+every <interval>. Call the returned function to stop it
+*/
+func (s *SessionManager) StartReaper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				removed, err := s.getStore().DeleteExpired(s.currentTime())
+				if err != nil {
+					log.Println("Failed to purge expired sessions:", err.Error())
+				} else if removed > 0 {
+					log.Printf("Purged %d expired sessions\n", removed)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var stopOnce sync.Once
+	return func() {
+		stopOnce.Do(func() { close(done) })
+	}
+}
+
+/*
+Returns the sessionID string from the cookie in the request or ErrNoCookie
+*/
+func (s *SessionManager) GetSessionID(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(SESSIONID_COOKIE_NAME)
+	if err != nil {
+		return "", err
+	}
+	return cookie.Value, nil
+}
+
 /*
 Checks if the client is logged in.
 
 Reads sessionID from request cookie and returns the session and true if a session can be
 retrieved with the provided ID. If a session can't be found, then it will return nil and false.
+
+Being logged in counts as activity, so the session is renewed
 */
 func (s *SessionManager) IsLoggedIn(r *http.Request) (*Session, bool) {
 	sessionID, err := s.GetSessionID(r)
@@ -168,5 +487,64 @@ func (s *SessionManager) IsLoggedIn(r *http.Request) (*Session, bool) {
 		return nil, false
 	}
 
-	return s.GetSession(sessionID)
+	session, exists := s.GetSession(sessionID)
+	if !exists {
+		return nil, false
+	}
+
+	// it was revoked while this request was reading it
+	err = s.RenewSession(session)
+	if err == ErrSessionNotFound {
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to renew session %s: %s\n", sessionID, err.Error())
+	}
+
+	return session, true
+}
+
+/*
+Returns a short, human readable description of the device from its
+User-Agent header, like "Chrome on Windows" or "Safari on iPhone"
+*/
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return UNKNOWN_DEVICE
+	}
+
+	browser := UNKNOWN_DEVICE
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	platform := UNKNOWN_DEVICE
+	switch {
+	case strings.Contains(userAgent, "iPhone"):
+		platform = "iPhone"
+	case strings.Contains(userAgent, "iPad"):
+		platform = "iPad"
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	}
+
+	if browser == UNKNOWN_DEVICE && platform == UNKNOWN_DEVICE {
+		return UNKNOWN_DEVICE
+	}
+	return browser + " on " + platform
 }
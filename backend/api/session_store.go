@@ -0,0 +1,366 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExists   = errors.New("session already exists")
+)
+
+/*
+Where the SessionManager keeps its sessions. Swap the implementation
+with SessionManager.SetStore to choose between keeping sessions in
+process memory or persisting them so they survive a restart
+*/
+type SessionStore interface {
+	// Returns ErrSessionNotFound if there is no session with <sessionID>
+	Get(sessionID string) (*Session, error)
+
+	/*
+		Inserts a new session. Returns ErrSessionExists if a session with the same
+		SessionID that hasn't expired at <now> is already stored. The check and the
+		insert must happen atomically
+	*/
+	Create(session *Session, now time.Time) error
+
+	// Inserts the session or replaces the one with the same SessionID
+	Save(session *Session) error
+
+	/*
+		Sets only the expiration and last activity of the stored session, so
+		values changed since it was read aren't overwritten. Returns
+		ErrSessionNotFound without storing anything if the session was deleted,
+		so a revoked session isn't brought back by a request that was using it
+	*/
+	Renew(sessionID string, lastSeen, expiresAt time.Time) error
+
+	/*
+		Sets only the value under <key> of the stored session. Like Renew, returns
+		ErrSessionNotFound without storing anything if the session was deleted
+	*/
+	SetValue(sessionID string, key string, value any) error
+
+	Delete(sessionID string) error
+
+	// Removes every session that expired before <now> and returns how many were removed
+	DeleteExpired(now time.Time) (int, error)
+
+	// Returns every stored session whose "userid" value is <userID>, including expired ones
+	ListByUser(userID primitive.ObjectID) ([]*Session, error)
+
+	// Deletes every session whose "userid" value is <userID>
+	DeleteByUser(userID primitive.ObjectID) error
+}
+
+/*----------------------------memory----------------------------*/
+
+// number of independently locked partitions of the MemorySessionStore
+const SESSION_SHARD_COUNT = 32
+
+type sessionShard struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+/*
+Keeps sessions in process memory, so every session is lost when the
+server restarts. Sessions are stored by reference, so changes made to a
+*Session are visible to the next Get without calling Save.
+
+Sessions are spread across SESSION_SHARD_COUNT shards by a hash of their ID,
+each with its own lock, so requests for different sessions rarely wait on
+each other
+*/
+type MemorySessionStore struct {
+	shards [SESSION_SHARD_COUNT]*sessionShard
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	m := &MemorySessionStore{}
+	for i := range m.shards {
+		m.shards[i] = &sessionShard{
+			sessions: make(map[string]*Session),
+		}
+	}
+	return m
+}
+
+// returns the shard that the session with <sessionID> belongs to
+func (m *MemorySessionStore) shard(sessionID string) *sessionShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(sessionID))
+	return m.shards[hash.Sum32()%SESSION_SHARD_COUNT]
+}
+
+func (m *MemorySessionStore) Get(sessionID string) (*Session, error) {
+	shard := m.shard(sessionID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	session, exists := shard.sessions[sessionID]
+	if !exists {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (m *MemorySessionStore) Create(session *Session, now time.Time) error {
+	shard := m.shard(session.SessionID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if existing, exists := shard.sessions[session.SessionID]; exists && !existing.IsExpired(now) {
+		return ErrSessionExists
+	}
+	shard.sessions[session.SessionID] = session
+	return nil
+}
+
+func (m *MemorySessionStore) Save(session *Session) error {
+	shard := m.shard(session.SessionID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.sessions[session.SessionID] = session
+	return nil
+}
+
+func (m *MemorySessionStore) Renew(sessionID string, lastSeen, expiresAt time.Time) error {
+	shard := m.shard(sessionID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	session, exists := shard.sessions[sessionID]
+	if !exists {
+		return ErrSessionNotFound
+	}
+	session.renew(lastSeen, expiresAt)
+	return nil
+}
+
+func (m *MemorySessionStore) SetValue(sessionID string, key string, value any) error {
+	shard := m.shard(sessionID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	session, exists := shard.sessions[sessionID]
+	if !exists {
+		return ErrSessionNotFound
+	}
+	session.Set(key, value)
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(sessionID string) error {
+	shard := m.shard(sessionID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	delete(shard.sessions, sessionID)
+	return nil
+}
+
+// locks one shard at a time, so purging never blocks the whole store
+func (m *MemorySessionStore) DeleteExpired(now time.Time) (int, error) {
+	removed := 0
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for id, session := range shard.sessions {
+			if session.IsExpired(now) {
+				delete(shard.sessions, id)
+				removed++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return removed, nil
+}
+
+func (m *MemorySessionStore) ListByUser(userID primitive.ObjectID) ([]*Session, error) {
+	var sessions []*Session
+	for _, shard := range m.shards {
+		shard.mu.RLock()
+		for _, session := range shard.sessions {
+			if session.UserID() == userID {
+				sessions = append(sessions, session)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return sessions, nil
+}
+
+func (m *MemorySessionStore) DeleteByUser(userID primitive.ObjectID) error {
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for id, session := range shard.sessions {
+			if session.UserID() == userID {
+				delete(shard.sessions, id)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+/*----------------------------mongo-----------------------------*/
+
+/*
+Persists sessions in a MongoDB collection so they survive restarts.
+
+A TTL index on expiresAt lets MongoDB purge expired sessions on its own,
+but the SessionManager's reaper still calls DeleteExpired, since the
+TTL monitor only runs about once a minute
+*/
+type MongoSessionStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoSessionStore(collection *mongo.Collection) (*MongoSessionStore, error) {
+	_, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.M{"expiresAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			// used to find all of a user's sessions
+			Keys: bson.M{"store.userid": 1},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoSessionStore{collection: collection}, nil
+}
+
+func (m *MongoSessionStore) Get(sessionID string) (*Session, error) {
+	var session Session
+	err := m.collection.FindOne(
+		context.Background(),
+		bson.M{"_id": sessionID},
+	).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Store == nil {
+		session.Store = make(SessionValues)
+	}
+	return &session, nil
+}
+
+/*
+Only matches a stored session if it has expired, so when a live session
+with the same ID exists the upsert tries to insert a second document with
+that _id and fails with a duplicate key error
+*/
+func (m *MongoSessionStore) Create(session *Session, now time.Time) error {
+	snapshot := session.snapshot()
+	_, err := m.collection.UpdateOne(
+		context.Background(),
+		bson.M{"_id": snapshot.SessionID, "expiresAt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{
+			"store":     snapshot.Store,
+			"expiresAt": snapshot.ExpiresAt,
+			"userAgent": snapshot.UserAgent,
+			"ipAddress": snapshot.IPAddress,
+			"device":    snapshot.Device,
+			"createdAt": snapshot.CreatedAt,
+			"lastSeen":  snapshot.LastSeen,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrSessionExists
+	}
+	return err
+}
+
+func (m *MongoSessionStore) Save(session *Session) error {
+	_, err := m.collection.ReplaceOne(
+		context.Background(),
+		bson.M{"_id": session.SessionID},
+		session.snapshot(),
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (m *MongoSessionStore) Renew(sessionID string, lastSeen, expiresAt time.Time) error {
+	res, err := m.collection.UpdateOne(
+		context.Background(),
+		bson.M{"_id": sessionID},
+		bson.M{"$set": bson.M{"expiresAt": expiresAt, "lastSeen": lastSeen}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (m *MongoSessionStore) SetValue(sessionID string, key string, value any) error {
+	res, err := m.collection.UpdateOne(
+		context.Background(),
+		bson.M{"_id": sessionID},
+		bson.M{"$set": bson.M{"store." + key: value}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (m *MongoSessionStore) Delete(sessionID string) error {
+	_, err := m.collection.DeleteOne(context.Background(), bson.M{"_id": sessionID})
+	return err
+}
+
+func (m *MongoSessionStore) DeleteExpired(now time.Time) (int, error) {
+	res, err := m.collection.DeleteMany(
+		context.Background(),
+		bson.M{"expiresAt": bson.M{"$lt": now}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (m *MongoSessionStore) ListByUser(userID primitive.ObjectID) ([]*Session, error) {
+	cursor, err := m.collection.Find(context.Background(), bson.M{"store.userid": userID})
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*Session
+	if err = cursor.All(context.Background(), &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (m *MongoSessionStore) DeleteByUser(userID primitive.ObjectID) error {
+	_, err := m.collection.DeleteMany(context.Background(), bson.M{"store.userid": userID})
+	return err
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"backend/types"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/client"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+/*
+Takes payments through Stripe's hosted checkout pages. Stripe reports what
+happens to each checkout with webhook requests signed with WebhookSecret
+*/
+type StripeProvider struct {
+	client *client.API
+
+	// signing secret of the Stripe webhook endpoint, which proves a webhook request came from Stripe
+	WebhookSecret string
+	// how old a webhook request's signature can be before it's rejected as a replay
+	WebhookTolerance time.Duration
+}
+
+// Creates a provider that calls Stripe's API with <secretKey>
+func NewStripeProvider(secretKey string, webhookSecret string, webhookTolerance time.Duration) *StripeProvider {
+	sc := &client.API{}
+	sc.Init(secretKey, nil)
+	return &StripeProvider{
+		client:           sc,
+		WebhookSecret:    webhookSecret,
+		WebhookTolerance: webhookTolerance,
+	}
+}
+
+func (p *StripeProvider) CreateCheckout(params CheckoutParams) (*Checkout, error) {
+	var lineItems []*stripe.CheckoutSessionLineItemParams
+	for _, item := range params.Items {
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				// Stripe takes lowercase currency codes
+				Currency: stripe.String(strings.ToLower(string(item.Amount.Currency))),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+					Name:        stripe.String(item.Name),
+					Description: stripe.String(item.Description),
+					Metadata:    item.Metadata,
+				},
+				UnitAmount: stripe.Int64(item.Amount.Amount),
+			},
+			Quantity: stripe.Int64(1),
+		})
+	}
+
+	checkoutSession, err := p.client.CheckoutSessions.New(&stripe.CheckoutSessionParams{
+		LineItems:  lineItems,
+		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SuccessURL: stripe.String(params.SuccessURL),
+		// Stripe fills in CHECKOUT_ID_PLACEHOLDER itself
+		CancelURL: stripe.String(params.CancelURL),
+		ExpiresAt: stripe.Int64(params.ExpiresAt.Unix()),
+		Metadata:  params.Metadata,
+		ShippingAddressCollection: &stripe.CheckoutSessionShippingAddressCollectionParams{
+			AllowedCountries: stripe.StringSlice([]string{"US"}),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newStripeCheckout(checkoutSession), nil
+}
+
+func (p *StripeProvider) GetCheckout(checkoutID string) (*Checkout, error) {
+	checkoutSession, err := p.client.CheckoutSessions.Get(checkoutID, nil)
+	if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.HTTPStatusCode == http.StatusNotFound {
+		return nil, ErrPaymentCheckoutNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newStripeCheckout(checkoutSession), nil
+}
+
+// Stripe sends a checkout.session.expired event once the session is expired
+func (p *StripeProvider) ExpireCheckout(checkoutID string) error {
+	_, err := p.client.CheckoutSessions.Expire(checkoutID, nil)
+	return err
+}
+
+/*
+Only requests signed with WebhookSecret within WebhookTolerance are
+accepted. The event is parsed from the payload only after its signature
+is checked
+*/
+func (p *StripeProvider) ParseWebhook(payload []byte, header http.Header) (*PaymentEvent, error) {
+	if p.WebhookSecret == "" {
+		return nil, ErrNoWebhookSecret
+	}
+
+	event, err := webhook.ConstructEventWithOptions(payload, header.Get("Stripe-Signature"), p.WebhookSecret, webhook.ConstructEventOptions{
+		Tolerance: p.WebhookTolerance,
+		// the endpoint's API version is set in the Stripe dashboard, and the fields read here are the same in every version
+		IgnoreAPIVersionMismatch: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidWebhook, err)
+	}
+
+	paymentEvent := &PaymentEvent{ID: event.ID, Type: PaymentEventType(event.Type)}
+	if event.Data == nil || len(event.Data.Raw) == 0 {
+		return paymentEvent, nil
+	}
+
+	var checkoutSession stripe.CheckoutSession
+	if err := json.Unmarshal(event.Data.Raw, &checkoutSession); err != nil {
+		return nil, fmt.Errorf("error parsing checkout session: %w", err)
+	}
+	paymentEvent.Checkout = *newStripeCheckout(&checkoutSession)
+
+	switch event.Type {
+	case stripe.EventTypeCheckoutSessionCompleted:
+		/*
+			Payment methods like bank debits are still processing when the checkout
+			completes, and Stripe reports whether they went through in another event
+		*/
+		if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusUnpaid {
+			paymentEvent.Type = PaymentCompleted
+		}
+	case stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded:
+		paymentEvent.Type = PaymentCompleted
+	case stripe.EventTypeCheckoutSessionAsyncPaymentFailed:
+		paymentEvent.Type = PaymentFailed
+	case stripe.EventTypeCheckoutSessionExpired:
+		paymentEvent.Type = PaymentExpired
+	}
+	return paymentEvent, nil
+}
+
+// Refunds part of the payment intent the checkout session was paid with
+func (p *StripeProvider) Refund(checkoutID string, amount types.Money, key string) error {
+	checkoutSession, err := p.client.CheckoutSessions.Get(checkoutID, nil)
+	if err != nil {
+		return err
+	}
+	if checkoutSession.PaymentIntent == nil {
+		return ErrPaymentNotRefundable
+	}
+
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(checkoutSession.PaymentIntent.ID),
+		Amount:        stripe.Int64(amount.Amount),
+	}
+	params.SetIdempotencyKey(key)
+	_, err = p.client.Refunds.New(params)
+	return err
+}
+
+func newStripeCheckout(checkoutSession *stripe.CheckoutSession) *Checkout {
+	checkout := &Checkout{
+		ID:          checkoutSession.ID,
+		URL:         checkoutSession.URL,
+		Status:      CheckoutStatus(checkoutSession.Status),
+		AmountTotal: types.NewMoney(checkoutSession.AmountTotal, types.Currency(strings.ToUpper(string(checkoutSession.Currency)))),
+		Metadata:    checkoutSession.Metadata,
+	}
+	if checkoutSession.ShippingDetails != nil && checkoutSession.ShippingDetails.Address != nil {
+		address := checkoutSession.ShippingDetails.Address
+		checkout.ShippingAddress = types.ReceiptAddress{
+			State:   address.State,
+			City:    address.City,
+			Street:  address.Line1,
+			ZipCode: address.PostalCode,
+		}
+	}
+	return checkout
+}
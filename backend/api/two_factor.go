@@ -0,0 +1,366 @@
+package api
+
+import (
+	"backend/db"
+	"backend/types"
+	"backend/util"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ErrTwoFactorEnabled      = "Two-factor authentication is already enabled"
+	ErrTwoFactorNotEnabled   = "Two-factor authentication is not enabled"
+	ErrTwoFactorNotSetUp     = "Two-factor authentication setup has not been started"
+	ErrInvalidTwoFactorCode  = "Invalid two-factor code"
+	ErrInvalidLoginChallenge = "Login challenge is invalid or has expired"
+)
+
+// name the account is listed under in the user's authenticator app
+const TOTP_ISSUER = "Antique Furniture"
+
+// how many single use recovery codes the user gets when enabling 2FA
+const RECOVERY_CODE_COUNT = 10
+
+// how long the user has to enter their code after entering their password
+const LOGIN_CHALLENGE_TTL = 5 * time.Minute
+
+// prefix of the challenge token payload, so tokens signed for other purposes can't log anyone in
+const loginChallengePurpose = "login_2fa"
+
+// Response to POST /account/2fa/setup, for the user to add to their authenticator app
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth:// URI to show as a QR code
+}
+
+// A code from the authenticator app, or one of the recovery codes
+type TwoFactorCode struct {
+	Code string `json:"code"`
+}
+
+// Response to POST /account/2fa/confirm; the codes are only ever shown this once
+type RecoveryCodes struct {
+	Codes []string `json:"recoveryCodes"`
+}
+
+/*
+Response to POST /login when the user has 2FA enabled. The client sends the
+challenge back to POST /login/2fa along with the code to finish logging in
+*/
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	Challenge         string `json:"challenge"`
+}
+
+// Sent to POST /login/2fa
+type TwoFactorLogin struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// Sent to POST /account/2fa/disable; both are required so a stolen session can't turn 2FA off
+type DisableTwoFactor struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// Returns RECOVERY_CODE_COUNT random codes formatted like "abcde-fghij"
+func generateRecoveryCodes() ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	for i := range codes {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(random)[:10])
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+/*
+Checks <code> as either a code from the user's authenticator app or
+one of their recovery codes, and uses it up so it can't be used again.
+A code that's used by two requests at the same time is only accepted by
+one of them, since using it up is checked in the same operation
+*/
+func (s *Server) useSecondFactor(user types.User, code string) (ok bool, err error) {
+	if step, valid := util.ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); valid {
+		err := s.Store.Users.UseTOTPStep(user.UserID, step)
+		if err == db.ErrNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	code = strings.ToLower(strings.TrimSpace(code))
+	for _, hashed := range user.RecoveryCodes {
+		if util.CheckPassword(code, hashed) == nil {
+			err := s.Store.Users.UseRecoveryCode(user.UserID, hashed)
+			if err == db.ErrNotFound {
+				return false, nil
+			}
+			return err == nil, err
+		}
+	}
+
+	return false, nil
+}
+
+/*
+Generates a new TOTP secret for the logged in user. 2FA isn't turned
+on until the user proves their app has the secret with POST /account/2fa/confirm,
+so calling this again before confirming replaces the secret
+*/
+func (s *Server) HandleTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	user, err := s.Store.Users.FindByID(session.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if user.TOTPEnabled {
+		http.Error(w, ErrTwoFactorEnabled, http.StatusConflict)
+		return
+	}
+
+	secret, err := util.GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	err = s.Store.Users.Update(user.UserID, bson.M{"totpSecret": secret})
+	if err != nil {
+		http.Error(w, "Failed to update account information", http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(TwoFactorSetup{
+		Secret: secret,
+		URI:    util.TOTPProvisioningURI(TOTP_ISSUER, user.Username, secret),
+	})
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Turns 2FA on once the user enters a valid code from their app, and
+returns the recovery codes. Only bcrypt hashes of the codes are saved
+*/
+func (s *Server) HandleTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	var req TwoFactorCode
+	if err := util.ReadJSONReq[TwoFactorCode](r, &req); err != nil {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.Store.Users.FindByID(session.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if user.TOTPEnabled {
+		http.Error(w, ErrTwoFactorEnabled, http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, ErrTwoFactorNotSetUp, http.StatusBadRequest)
+		return
+	}
+
+	step, valid := util.ValidateTOTP(user.TOTPSecret, req.Code, time.Now(), 0)
+	if !valid {
+		http.Error(w, ErrInvalidTwoFactorCode, http.StatusBadRequest)
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	hashedCodes := make([]string, len(codes))
+	for i, code := range codes {
+		hashedCodes[i], err = util.HashPassword(code)
+		if err != nil {
+			http.Error(w, "Failed to hash recovery codes", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = s.Store.Users.Update(user.UserID, bson.M{
+		"totpEnabled":   true,
+		"totpLastStep":  step,
+		"recoveryCodes": hashedCodes,
+	})
+	if err != nil {
+		http.Error(w, "Failed to update account information", http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(RecoveryCodes{Codes: codes})
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+// Turns 2FA off after checking the user's password and a current code
+func (s *Server) HandleTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	var req DisableTwoFactor
+	if err := util.ReadJSONReq[DisableTwoFactor](r, &req); err != nil {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.Store.Users.FindByID(session.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		http.Error(w, ErrTwoFactorNotEnabled, http.StatusBadRequest)
+		return
+	}
+
+	if util.CheckPassword(req.Password, user.Password) != nil {
+		http.Error(w, ErrInvalidLogin, http.StatusUnauthorized)
+		return
+	}
+	valid, err := s.useSecondFactor(user, req.Code)
+	if err != nil {
+		http.Error(w, "Failed to update account information", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, ErrInvalidTwoFactorCode, http.StatusUnauthorized)
+		return
+	}
+
+	err = s.Store.Users.Update(user.UserID, bson.M{
+		"totpEnabled":   false,
+		"totpSecret":    "",
+		"totpLastStep":  0,
+		"recoveryCodes": []string{},
+	})
+	if err != nil {
+		http.Error(w, "Failed to update account information", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+/*
+Responds to a correct username and password with a challenge instead of a
+session. The challenge is a signed token naming the user, so nothing has to
+be stored until the second step succeeds
+*/
+func (s *Server) sendTwoFactorChallenge(w http.ResponseWriter, user types.User) {
+	challenge := util.SignToken(
+		s.TokenSecret,
+		loginChallengePurpose+":"+user.UserID.Hex(),
+		s.Limiter.Now().Add(LOGIN_CHALLENGE_TTL),
+	)
+
+	jsonData, err := json.Marshal(TwoFactorChallenge{
+		TwoFactorRequired: true,
+		Challenge:         challenge,
+	})
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(jsonData)
+}
+
+/*
+Second step of logging in for users with 2FA enabled. Takes the challenge
+from POST /login and a code from the authenticator app or a recovery code
+*/
+func (s *Server) HandleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req TwoFactorLogin
+	if err := util.ReadJSONReq[TwoFactorLogin](r, &req); err != nil {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+
+	payload, err := util.VerifyToken(s.TokenSecret, req.Challenge, s.Limiter.Now())
+	if err != nil {
+		http.Error(w, ErrInvalidLoginChallenge, http.StatusUnauthorized)
+		return
+	}
+
+	purpose, hexID, found := strings.Cut(payload, ":")
+	if !found || purpose != loginChallengePurpose {
+		http.Error(w, ErrInvalidLoginChallenge, http.StatusUnauthorized)
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		http.Error(w, ErrInvalidLoginChallenge, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := s.Store.Users.FindByID(userID)
+	if err != nil || !user.TOTPEnabled {
+		http.Error(w, ErrInvalidLoginChallenge, http.StatusUnauthorized)
+		return
+	}
+
+	// a 6 digit code is much easier to guess than a password, so failures count against the account too
+	ip := clientIP(r)
+	if wait := s.Limiter.RetryAfter(user.Username, ip); wait > 0 {
+		tooManyLogins(w, wait)
+		return
+	}
+
+	valid, err := s.useSecondFactor(user, req.Code)
+	if err != nil {
+		log.Printf("Failed to use up the 2FA code of %s: %s\n", user.UserID.Hex(), err.Error())
+		http.Error(w, "Failed to update account information", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		s.Limiter.RecordFailure(user.Username, ip)
+		http.Error(w, ErrInvalidTwoFactorCode, http.StatusUnauthorized)
+		return
+	}
+
+	s.startSession(w, r, user)
+}
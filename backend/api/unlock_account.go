@@ -0,0 +1,81 @@
+package api
+
+import (
+	"backend/util"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const ErrInvalidUnlockToken = "Unlock link is invalid or has expired"
+
+// how long the link in an unlock email stays valid
+const UNLOCK_ACCOUNT_TTL = time.Hour
+
+// prefix of the token payload, so tokens signed for other purposes can't unlock accounts
+const unlockAccountPurpose = "unlock_account"
+
+/*
+Emails the owner of <username> that someone keeps failing to log in,
+with a link to GET /unlock_account in case it was them. Nothing is sent
+if no account has that username
+*/
+func (s *Server) sendUnlockEmail(username string) {
+	user, err := s.Store.Users.FindByUsername(username)
+	if err != nil {
+		return
+	}
+
+	payload := unlockAccountPurpose + ":" + user.UserID.Hex()
+	token := util.SignToken(s.TokenSecret, payload, s.Limiter.Now().Add(UNLOCK_ACCOUNT_TTL))
+
+	link := fmt.Sprintf("http://127.0.0.1%s/unlock_account?token=%s", s.Port, url.QueryEscape(token))
+
+	err = s.Mailer.Send(
+		user.Email,
+		"Your account has been locked",
+		"There have been too many failed attempts to log in as "+user.Username+
+			", so logging in has been paused for a while. "+
+			fmt.Sprintf("If it was you, click here to unlock your account: %s", link)+
+			"\r\n\r\nIf it wasn't you, consider resetting your password.",
+	)
+	if err != nil {
+		log.Printf("Failed to send unlock email to %s: %s\n", user.UserID.Hex(), err.Error())
+	}
+}
+
+// Lifts the login lockout on an account using the token from the unlock email
+func (s *Server) HandleUnlockAccount(w http.ResponseWriter, r *http.Request) {
+	payload, err := util.VerifyToken(s.TokenSecret, r.URL.Query().Get("token"), s.Limiter.Now())
+	if err != nil {
+		http.Error(w, ErrInvalidUnlockToken, http.StatusBadRequest)
+		return
+	}
+
+	purpose, hexID, found := strings.Cut(payload, ":")
+	if !found || purpose != unlockAccountPurpose {
+		http.Error(w, ErrInvalidUnlockToken, http.StatusBadRequest)
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		http.Error(w, ErrInvalidUnlockToken, http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.Store.Users.FindByID(userID)
+	if err != nil {
+		http.Error(w, ErrInvalidUnlockToken, http.StatusBadRequest)
+		return
+	}
+
+	s.Limiter.Unlock(user.Username)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"backend/db"
+	"backend/types"
+	"backend/util"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ErrEmailNotVerified          = "You must verify your email address first"
+	ErrEmailAlreadyVerified      = "Email address is already verified"
+	ErrInvalidVerificationToken  = "Verification link is invalid"
+	ErrExpiredVerificationToken  = "Verification link has expired"
+	ErrVerificationEmailNotSent  = "Failed to send verification email"
+	ErrVerificationEmailOutdated = "Verification link is for an email address that is no longer on the account"
+)
+
+// how long the link in a verification email stays valid
+const EMAIL_VERIFICATION_TTL = 24 * time.Hour
+
+// prefix of the token payload, so tokens signed for other purposes can't be used to verify emails
+const verifyEmailPurpose = "verify_email"
+
+/*
+Emails <user> a link to GET /verify_email. The token in the link is
+tied to the user's current email, so changing the email again makes
+any earlier links invalid
+*/
+func (s *Server) sendVerificationEmail(user types.User) error {
+	payload := strings.Join([]string{verifyEmailPurpose, user.UserID.Hex(), user.Email}, ":")
+	token := util.SignToken(s.TokenSecret, payload, time.Now().Add(EMAIL_VERIFICATION_TTL))
+
+	link := fmt.Sprintf("http://127.0.0.1%s/verify_email?token=%s", s.Port, url.QueryEscape(token))
+
+	return s.Mailer.Send(
+		user.Email,
+		"Verify your email address",
+		"Welcome to Antique Furniture, "+user.Username+"! "+
+			fmt.Sprintf("Click here to verify your email address: %s", link)+
+			fmt.Sprintf("\r\n\r\nThis link expires in %d hours.", int(EMAIL_VERIFICATION_TTL.Hours())),
+	)
+}
+
+/*
+Marks the user's email as verified using the token from the verification
+email. The client doesn't need to be logged in, since the link is usually
+opened from the email
+*/
+func (s *Server) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	payload, err := util.VerifyToken(s.TokenSecret, r.URL.Query().Get("token"), time.Now())
+	if err == util.ErrTokenExpired {
+		http.Error(w, ErrExpiredVerificationToken, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, ErrInvalidVerificationToken, http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.SplitN(payload, ":", 3)
+	if len(parts) != 3 || parts[0] != verifyEmailPurpose {
+		http.Error(w, ErrInvalidVerificationToken, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(parts[1])
+	if err != nil {
+		http.Error(w, ErrInvalidVerificationToken, http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.Store.Users.FindByID(userID)
+	if err == db.ErrNotFound {
+		http.Error(w, ErrInvalidVerificationToken, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if user.Email != parts[2] {
+		http.Error(w, ErrVerificationEmailOutdated, http.StatusBadRequest)
+		return
+	}
+
+	err = s.Store.Users.Update(userID, bson.M{"emailVerified": true})
+	if err != nil {
+		http.Error(w, "Failed to update account information", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+// Sends the logged in user a new verification email, in case the last one was lost or expired
+func (s *Server) HandleResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	user, err := s.Store.Users.FindByID(session.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if user.EmailVerified {
+		http.Error(w, ErrEmailAlreadyVerified, http.StatusConflict)
+		return
+	}
+
+	if err = s.sendVerificationEmail(user); err != nil {
+		log.Printf("Failed to send verification email to %s: %s\n", user.UserID.Hex(), err.Error())
+		http.Error(w, ErrVerificationEmailNotSent, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+/*
+This middleware only lets users with a verified email address through
+to the <next> handler, and returns a 403 status code to everyone else.
+
+It reads the session attached by AuthMiddleware, so AuthMiddleware
+must come after it in Server.Use
+*/
+func (s *Server) RequireVerifiedEmail(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := r.Context().Value(SessionKey).(*Session)
+
+		user, err := s.Store.Users.FindByID(session.UserID())
+		if err != nil {
+			http.Error(w, ErrUnauthorized, http.StatusUnauthorized)
+			return
+		}
+
+		if !user.EmailVerified {
+			http.Error(w, ErrEmailNotVerified, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,600 @@
+package api
+
+import (
+	"backend/db"
+	"backend/types"
+	"backend/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ErrInvalidBankAccount     = "Bank account needs an account holder, a 9 digit routing number and a 4 to 17 digit account number"
+	ErrNoPayoutDestination    = "Register a bank account to withdraw to first"
+	ErrWithdrawalMinimum      = "Withdrawal amount is below the minimum"
+	ErrWithdrawalCurrency     = "Withdrawal must be in the currency of the balance"
+	ErrInsufficientBalance    = "Withdrawal is more than the balance available to withdraw; earnings from recent sales are held for a few days first"
+	ErrWithdrawalNotFound     = "Withdrawal not found"
+	ErrWithdrawalNotPending   = "Withdrawal has already been approved or rejected"
+	ErrInvalidWithdrawalState = "Status must be one of: pending, approved, paid, failed"
+	ErrPayoutFailed           = "The payout provider couldn't pay out the withdrawal, so it failed"
+	ErrPayoutsUnavailable     = "Withdrawals are turned off, since no payout provider is set up"
+)
+
+// The smallest withdrawal, in the minor units of the balance's currency
+const MIN_WITHDRAWAL_AMOUNT int64 = 1000
+
+/*
+How long the earnings of a sale are held before they can be withdrawn,
+so a sale that turns out to be fraudulent can be clawed back
+*/
+const PAYOUT_HOLD_PERIOD = 7 * 24 * time.Hour
+
+// the entries of a sale, which are held for PAYOUT_HOLD_PERIOD
+var heldEntryTypes = []types.JournalEntryType{types.EntrySale, types.EntryProcessorFee, types.EntryPlatformFee}
+
+var (
+	routingNumberPattern = regexp.MustCompile(`^\d{9}$`)
+	accountNumberPattern = regexp.MustCompile(`^\d{4,17}$`)
+)
+
+// Sent to POST /account/withdrawals
+type WithdrawalRequest struct {
+	Amount types.Money `json:"amount"`
+}
+
+// Sent to POST /admin/withdrawals/{withdrawalID}/reject
+type WithdrawalRejection struct {
+	Reason string `json:"reason"`
+}
+
+// Returned by GET /account/withdrawals
+type WithdrawalsSummary struct {
+	Balance     types.Money        `json:"balance"`
+	Held        types.Money        `json:"held"`      // earnings of recent sales that can't be withdrawn yet
+	Available   types.Money        `json:"available"` // what can be withdrawn now
+	Withdrawals []types.Withdrawal `json:"withdrawals"`
+}
+
+/*
+This middleware only lets requests through to the <next> handler if the
+server has a payout provider, and returns a 503 status code otherwise, so
+nothing is withdrawn that can't be paid out
+*/
+func (s *Server) RequirePayouts(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Payouts == nil {
+			http.Error(w, ErrPayoutsUnavailable, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+/*
+Returns how much of <user>'s balance is held, which is what their sales
+in the last PAYOUT_HOLD_PERIOD added to it, and how much is left to withdraw
+*/
+func (s *Server) availableBalance(user types.User) (held, available types.Money, err error) {
+	earned, err := s.Store.Ledger.SumSince(types.SellerAccount(user.UserID), time.Now().Add(-PAYOUT_HOLD_PERIOD), heldEntryTypes)
+	if err != nil {
+		return held, available, err
+	}
+
+	held = types.NewMoney(max(earned.Amount, 0), user.Balance.Currency)
+	available = types.NewMoney(max(user.Balance.Amount-held.Amount, 0), user.Balance.Currency)
+	return held, available, nil
+}
+
+/*
+Registers the bank account the user's withdrawals are paid out to,
+replacing the one they had. Withdrawals that were already requested are
+still paid out to the account they were requested with
+
+200 - the registered destination
+400 - the bank account is invalid
+401 - not logged in
+403 - not a seller
+500 - the payout provider or the database failed
+*/
+func (s *Server) HandlePayoutDestinationPUT(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	var account BankAccount
+	if err := util.ReadJSONReq[BankAccount](r, &account); err != nil {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+
+	account.AccountHolder = strings.TrimSpace(account.AccountHolder)
+	if account.AccountHolder == "" || !routingNumberPattern.MatchString(account.RoutingNumber) ||
+		!accountNumberPattern.MatchString(account.AccountNumber) {
+		http.Error(w, ErrInvalidBankAccount, http.StatusBadRequest)
+		return
+	}
+
+	destination, err := s.Payouts.RegisterDestination(account)
+	if err != nil {
+		log.Printf("Failed to register the payout destination of %s: %s\n", session.UserID().Hex(), err.Error())
+		http.Error(w, "Failed to register bank account", http.StatusInternalServerError)
+		return
+	}
+
+	err = s.Store.Users.Update(session.UserID(), bson.M{"payoutDestination": destination})
+	if err != nil {
+		http.Error(w, "Failed to save bank account", http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(destination)
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Returns the user's balance, how much of it can be withdrawn, and their
+withdrawals, newest first
+
+200 - the balance and withdrawals
+401 - not logged in
+500 - the database failed
+*/
+func (s *Server) HandleWithdrawalsGET(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	user, err := s.Store.Users.FindByID(session.UserID())
+	if err != nil {
+		http.Error(w, "Failed to fetch account", http.StatusInternalServerError)
+		return
+	}
+
+	held, available, err := s.availableBalance(user)
+	if err != nil {
+		http.Error(w, "Failed to fetch balance", http.StatusInternalServerError)
+		return
+	}
+
+	withdrawals, err := s.Store.Withdrawals.FindByUser(user.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch withdrawals", http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(WithdrawalsSummary{
+		Balance:     user.Balance,
+		Held:        held,
+		Available:   available,
+		Withdrawals: append([]types.Withdrawal{}, withdrawals...),
+	})
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Requests a withdrawal of the amount in the body to the user's payout
+destination. The amount is taken out of the balance right away, and the
+withdrawal waits for an admin to approve it
+
+201 - the pending withdrawal
+400 - the amount is invalid, below MIN_WITHDRAWAL_AMOUNT or in another currency, or there's no payout destination
+401 - not logged in
+403 - not a seller
+409 - the amount is more than what's available to withdraw
+500 - the database failed
+*/
+func (s *Server) HandleWithdrawalsPOST(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+
+	var input WithdrawalRequest
+	if err := util.ReadJSONReq[WithdrawalRequest](r, &input); err != nil {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.Store.Users.FindByID(session.UserID())
+	if err != nil {
+		http.Error(w, "Failed to fetch account", http.StatusInternalServerError)
+		return
+	}
+	if user.PayoutDestination == nil {
+		http.Error(w, ErrNoPayoutDestination, http.StatusBadRequest)
+		return
+	}
+	if input.Amount.Currency != user.Balance.Currency {
+		http.Error(w, ErrWithdrawalCurrency, http.StatusBadRequest)
+		return
+	}
+	if input.Amount.Amount < MIN_WITHDRAWAL_AMOUNT {
+		http.Error(w, ErrWithdrawalMinimum, http.StatusBadRequest)
+		return
+	}
+
+	held, _, err := s.availableBalance(user)
+	if err != nil {
+		http.Error(w, "Failed to fetch balance", http.StatusInternalServerError)
+		return
+	}
+
+	// checked again as the amount is taken, in case another withdrawal took it first
+	err = s.Store.Users.TakeFromBalance(user.UserID, input.Amount, held)
+	if err == db.ErrNotFound {
+		http.Error(w, ErrInsufficientBalance, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update balance", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	withdrawal := types.Withdrawal{
+		WithdrawalID: primitive.NewObjectID(),
+		UserID:       user.UserID,
+		Amount:       input.Amount,
+		Status:       types.WithdrawalPending,
+		Destination:  *user.PayoutDestination,
+		RequestedAt:  now,
+		UpdatedAt:    now,
+	}
+
+	// posted directly, since the balance was already taken from above
+	_, err = s.Store.Ledger.Insert(types.JournalEntry{
+		Key:      withdrawalEntryKey(withdrawal.WithdrawalID, types.EntryPayout),
+		Type:     types.EntryPayout,
+		From:     types.SellerAccount(user.UserID),
+		To:       types.AccountPayouts,
+		Amount:   input.Amount,
+		PostedAt: now,
+	})
+	if err != nil {
+		if err := s.Store.Users.AddToBalance(user.UserID, input.Amount, withdrawalEntryKey(withdrawal.WithdrawalID, types.EntryPayoutReversal)); err != nil {
+			log.Printf("Failed to give %s back to %s: %s\n", input.Amount, user.UserID.Hex(), err.Error())
+		}
+		http.Error(w, "Failed to request withdrawal", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := s.Store.Withdrawals.Insert(withdrawal); err != nil {
+		if err := s.reversePayout(withdrawal); err != nil {
+			log.Printf("Failed to reverse withdrawal %s: %s\n", withdrawal.WithdrawalID.Hex(), err.Error())
+		}
+		http.Error(w, "Failed to request withdrawal", http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(withdrawal)
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonData)
+}
+
+/*
+Returns the withdrawals with the status in the status query parameter,
+pending by default, oldest first. Only admins can call this
+
+200 - the withdrawals
+400 - the status is invalid
+500 - the database failed
+*/
+func (s *Server) HandleAdminWithdrawalsGET(w http.ResponseWriter, r *http.Request) {
+	status := types.WithdrawalStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "":
+		status = types.WithdrawalPending
+	case types.WithdrawalPending, types.WithdrawalApproved, types.WithdrawalPaid, types.WithdrawalFailed:
+	default:
+		http.Error(w, ErrInvalidWithdrawalState, http.StatusBadRequest)
+		return
+	}
+
+	withdrawals, err := s.Store.Withdrawals.FindByStatus(status)
+	if err != nil {
+		http.Error(w, "Failed to fetch withdrawals", http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(append([]types.Withdrawal{}, withdrawals...))
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Approves a pending withdrawal and sends it to the payout provider, which
+reports whether it was paid to POST /payout_webhook. Only admins can call this
+
+200 - the approved withdrawal
+400 - the withdrawal ID is invalid
+404 - there's no such withdrawal
+409 - the withdrawal isn't pending
+502 - the payout provider couldn't pay it out, so it failed and its amount went back into the balance
+500 - the database failed
+*/
+func (s *Server) HandleWithdrawalApprove(w http.ResponseWriter, r *http.Request) {
+	withdrawal, ok := s.pendingWithdrawal(w, r)
+	if !ok {
+		return
+	}
+
+	// only one admin gets to approve it, however many try at once
+	err := s.Store.Withdrawals.UpdateIfStatus(withdrawal.WithdrawalID, types.WithdrawalPending, bson.M{
+		"status":    types.WithdrawalApproved,
+		"updatedAt": time.Now(),
+	})
+	if err == db.ErrNotFound {
+		http.Error(w, ErrWithdrawalNotPending, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to approve withdrawal", http.StatusInternalServerError)
+		return
+	}
+	withdrawal.Status = types.WithdrawalApproved
+
+	payout, err := s.Payouts.CreatePayout(PayoutParams{
+		DestinationID:  withdrawal.Destination.ProviderID,
+		Amount:         withdrawal.Amount,
+		IdempotencyKey: withdrawal.WithdrawalID.Hex(),
+		Metadata:       map[string]string{"withdrawalId": withdrawal.WithdrawalID.Hex()},
+	})
+	if err != nil {
+		log.Printf("Failed to pay out withdrawal %s: %s\n", withdrawal.WithdrawalID.Hex(), err.Error())
+		if err := s.failWithdrawal(withdrawal, err.Error()); err != nil {
+			log.Printf("Failed to put back the amount of withdrawal %s: %s\n", withdrawal.WithdrawalID.Hex(), err.Error())
+		}
+		http.Error(w, ErrPayoutFailed, http.StatusBadGateway)
+		return
+	}
+
+	err = s.Store.Withdrawals.UpdateIfStatus(withdrawal.WithdrawalID, types.WithdrawalApproved, bson.M{"payoutId": payout.ID})
+	if err != nil && err != db.ErrNotFound {
+		log.Printf("Failed to save payout %s of withdrawal %s: %s\n", payout.ID, withdrawal.WithdrawalID.Hex(), err.Error())
+	}
+	if err := s.settleWithdrawal(*payout); err != nil {
+		http.Error(w, "Failed to update withdrawal", http.StatusInternalServerError)
+		return
+	}
+
+	withdrawal, err = s.Store.Withdrawals.FindByID(withdrawal.WithdrawalID)
+	if err != nil {
+		http.Error(w, "Failed to fetch withdrawal", http.StatusInternalServerError)
+		return
+	}
+	jsonData, err := json.Marshal(withdrawal)
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Rejects a pending withdrawal with the reason in the body, if any, which
+fails it and puts its amount back into the seller's balance. Only admins
+can call this
+
+200 - the failed withdrawal
+400 - the withdrawal ID is invalid
+404 - there's no such withdrawal
+409 - the withdrawal isn't pending
+500 - the database failed
+*/
+func (s *Server) HandleWithdrawalReject(w http.ResponseWriter, r *http.Request) {
+	withdrawal, ok := s.pendingWithdrawal(w, r)
+	if !ok {
+		return
+	}
+
+	// the reason is optional, so an empty body is fine
+	var rejection WithdrawalRejection
+	if err := util.ReadJSONReq[WithdrawalRejection](r, &rejection); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Could not decode request body into JSON", http.StatusBadRequest)
+		return
+	}
+	reason := strings.TrimSpace(rejection.Reason)
+	if reason == "" {
+		reason = "Rejected by an admin"
+	}
+
+	err := s.failWithdrawal(withdrawal, reason)
+	if err == db.ErrNotFound {
+		http.Error(w, ErrWithdrawalNotPending, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reject withdrawal", http.StatusInternalServerError)
+		return
+	}
+
+	withdrawal, err = s.Store.Withdrawals.FindByID(withdrawal.WithdrawalID)
+	if err != nil {
+		http.Error(w, "Failed to fetch withdrawal", http.StatusInternalServerError)
+		return
+	}
+	jsonData, err := json.Marshal(withdrawal)
+	if err != nil {
+		http.Error(w, "Failed to encode into JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
+
+/*
+Returns the withdrawal named by the withdrawalID path value if it's
+pending. Otherwise responds with the error and returns false
+*/
+func (s *Server) pendingWithdrawal(w http.ResponseWriter, r *http.Request) (types.Withdrawal, bool) {
+	withdrawalID, err := primitive.ObjectIDFromHex(r.PathValue("withdrawalID"))
+	if err != nil {
+		http.Error(w, primitive.ErrInvalidHex.Error(), http.StatusBadRequest)
+		return types.Withdrawal{}, false
+	}
+
+	withdrawal, err := s.Store.Withdrawals.FindByID(withdrawalID)
+	if err == db.ErrNotFound {
+		http.Error(w, ErrWithdrawalNotFound, http.StatusNotFound)
+		return withdrawal, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch withdrawal", http.StatusInternalServerError)
+		return withdrawal, false
+	}
+	if withdrawal.Status != types.WithdrawalPending {
+		http.Error(w, ErrWithdrawalNotPending, http.StatusConflict)
+		return withdrawal, false
+	}
+	return withdrawal, true
+}
+
+/*
+Receives the payout provider's events. Settling a withdrawal only moves it
+out of a status once, and its amount only goes back into the balance once,
+so an event that's delivered again changes nothing
+
+200 - the event was applied, or didn't need to be
+400 - the request wasn't sent by the payout provider
+500 - the event couldn't be applied, and should be delivered again
+*/
+func (s *Server) HandlePayoutWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_WEBHOOK_BODY_SIZE))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	event, err := s.Payouts.ParseWebhook(payload, r.Header)
+	if err != nil {
+		log.Printf("Rejected payout webhook request: %s\n", err.Error())
+		http.Error(w, ErrWebhookSignature, http.StatusBadRequest)
+		return
+	}
+
+	switch event.Type {
+	case PayoutPaidEvent, PayoutFailedEvent:
+		if err := s.settleWithdrawal(event.Payout); err != nil {
+			log.Printf("Failed to apply payout event %s: %s\n", event.ID, err.Error())
+			http.Error(w, "Failed to process event", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+/*
+Marks the withdrawal that <payout> was created for as paid or failed,
+whichever the payout is. A payout that's still pending, or that isn't
+for a withdrawal, changes nothing
+*/
+func (s *Server) settleWithdrawal(payout Payout) error {
+	withdrawalID, err := primitive.ObjectIDFromHex(payout.Metadata["withdrawalId"])
+	if err != nil {
+		log.Printf("Payout %s isn't for a withdrawal\n", payout.ID)
+		return nil
+	}
+
+	withdrawal, err := s.Store.Withdrawals.FindByID(withdrawalID)
+	if err == db.ErrNotFound {
+		log.Printf("Payout %s is for withdrawal %s, which doesn't exist\n", payout.ID, withdrawalID.Hex())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch payout.Status {
+	case PayoutPaid:
+		err := s.Store.Withdrawals.UpdateIfStatus(withdrawalID, types.WithdrawalApproved, bson.M{
+			"status":    types.WithdrawalPaid,
+			"updatedAt": time.Now(),
+		})
+		if err == db.ErrNotFound {
+			return nil // paid or failed already
+		}
+		return err
+	case PayoutFailed:
+		if withdrawal.Status == types.WithdrawalPending {
+			return nil // a payout is only created once it's approved
+		}
+		return s.failWithdrawal(withdrawal, payout.FailureReason)
+	}
+	return nil
+}
+
+/*
+Marks <withdrawal> as failed with <reason> if it's still in the status it
+was read with, and puts its amount back into the seller's balance. Returns
+db.ErrNotFound if its status changed since it was read.
+
+Its amount goes back after the status changes, so it can't be both paid
+out and put back. If that fails, failing it again only puts it back, and
+only once
+*/
+func (s *Server) failWithdrawal(withdrawal types.Withdrawal, reason string) error {
+	if withdrawal.Status != types.WithdrawalFailed {
+		err := s.Store.Withdrawals.UpdateIfStatus(withdrawal.WithdrawalID, withdrawal.Status, bson.M{
+			"status":        types.WithdrawalFailed,
+			"failureReason": reason,
+			"updatedAt":     time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.reversePayout(withdrawal)
+}
+
+// Puts the amount of <withdrawal> back into the seller's balance, unless it already was
+func (s *Server) reversePayout(withdrawal types.Withdrawal) error {
+	return s.postEntry(types.JournalEntry{
+		Key:    withdrawalEntryKey(withdrawal.WithdrawalID, types.EntryPayoutReversal),
+		Type:   types.EntryPayoutReversal,
+		From:   types.AccountPayouts,
+		To:     types.SellerAccount(withdrawal.UserID),
+		Amount: withdrawal.Amount,
+	})
+}
+
+// Returns the key of the entry of <entryType> for the withdrawal with <withdrawalID>
+func withdrawalEntryKey(withdrawalID primitive.ObjectID, entryType types.JournalEntryType) string {
+	return fmt.Sprintf("withdrawal/%s/%s", withdrawalID.Hex(), entryType)
+}
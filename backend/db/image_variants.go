@@ -0,0 +1,47 @@
+package db
+
+import (
+	"backend/types"
+	"backend/util"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Saves <data> in <images> along with a resized variant for each of
+types.IMAGE_SIZE_PIXELS that the image is larger than, and returns the
+ID of the original.
+
+Images that can't be decoded as a JPEG, PNG or WebP are saved without variants,
+so they're served at their original size whatever size is asked for
+*/
+func SaveImageWithVariants(images ImageStore, data []byte) (primitive.ObjectID, error) {
+	imageID, err := images.Save(data, http.DetectContentType(data))
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	img, format, err := util.DecodeImage(data)
+	if err != nil {
+		return imageID, nil
+	}
+
+	for size, pixels := range types.IMAGE_SIZE_PIXELS {
+		resized, ok := util.ResizeImage(img, pixels)
+		if !ok {
+			continue
+		}
+
+		encoded, contentType, err := util.EncodeImage(resized, format)
+		if err == nil {
+			_, err = images.SaveVariant(imageID, size, encoded, contentType)
+		}
+		if err != nil {
+			images.Delete(imageID)
+			return primitive.NilObjectID, err
+		}
+	}
+
+	return imageID, nil
+}
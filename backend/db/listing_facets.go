@@ -0,0 +1,190 @@
+package db
+
+import (
+	"backend/types"
+	"cmp"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+The lower bounds of the price buckets that listings are counted in. Each
+bucket runs up to the next bound, and the last one has no upper bound.
+In cents of types.DEFAULT_CURRENCY
+*/
+var PRICE_BUCKETS = []int64{0, 10000, 25000, 50000, 100000, 250000, 500000, 1000000}
+
+// How many listings have a value of a facet, like how many are Chests
+type FacetCount struct {
+	Value string `bson:"_id" json:"value"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// How many listings cost at least Min and less than Max, or any more than Min if Max is nil
+type PriceBucketCount struct {
+	Min   types.Money  `json:"min"`
+	Max   *types.Money `json:"max,omitempty"`
+	Count int          `json:"count"`
+}
+
+/*
+How many listings match a query for each value of each filter.
+
+Each facet is counted with every filter of the query except its own, so
+picking a type doesn't hide the counts of the other types. Values are
+sorted by count, most first, and values with no listings are left out,
+but every price bucket is included even when it's empty
+*/
+type ListingFacets struct {
+	Types      []FacetCount       `json:"types"`
+	Styles     []FacetCount       `json:"styles"`
+	Conditions []FacetCount       `json:"conditions"`
+	Materials  []FacetCount       `json:"materials"`
+	Prices     []PriceBucketCount `json:"prices"`
+}
+
+// the query that each facet is counted with
+func (q ListingQuery) facetQueries() (typeQuery, styleQuery, conditionQuery, materialQuery, priceQuery ListingQuery) {
+	typeQuery, styleQuery, conditionQuery, materialQuery, priceQuery = q, q, q, q, q
+	typeQuery.Types = nil
+	styleQuery.Styles = nil
+	conditionQuery.Conditions = nil
+	materialQuery.Materials = nil
+	priceQuery.MinCost, priceQuery.MaxCost = nil, nil
+	return
+}
+
+/*
+Returns the aggregation pipeline that counts the facets of <q>. Each facet
+has its own sub-pipeline in a single $facet stage, so the listings
+collection is only read once
+*/
+func (q ListingQuery) mongoFacetPipeline() bson.A {
+	typeQuery, styleQuery, conditionQuery, materialQuery, priceQuery := q.facetQueries()
+
+	countBy := func(query ListingQuery, field string) bson.A {
+		return bson.A{
+			bson.M{"$match": query.mongoFilter()},
+			bson.M{"$group": bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}},
+		}
+	}
+
+	return bson.A{
+		bson.M{"$facet": bson.M{
+			"types":      countBy(typeQuery, "type"),
+			"styles":     countBy(styleQuery, "style"),
+			"conditions": countBy(conditionQuery, "condition"),
+			"materials":  countBy(materialQuery, "material"),
+			"prices": bson.A{
+				bson.M{"$match": priceQuery.mongoFilter()},
+				bson.M{"$bucket": bson.M{
+					"groupBy":    "$cost.amount",
+					"boundaries": PRICE_BUCKETS,
+					// $bucket puts costs past the last boundary in the default bucket, which is the open ended one
+					"default": PRICE_BUCKETS[len(PRICE_BUCKETS)-1],
+					"output":  bson.M{"count": bson.M{"$sum": 1}},
+				}},
+			},
+		}},
+	}
+}
+
+// what a bucket from the $bucket stage decodes into
+type priceBucket struct {
+	Min   int64 `bson:"_id"`
+	Count int   `bson:"count"`
+}
+
+/*
+Returns the facets from the counts of the values and price buckets,
+in the order ListingFacets promises, whichever store counted them
+*/
+func newListingFacets(typeCounts, styleCounts, conditionCounts, materialCounts []FacetCount, prices []priceBucket) ListingFacets {
+	facets := ListingFacets{
+		Types:      sortFacetCounts(typeCounts),
+		Styles:     sortFacetCounts(styleCounts),
+		Conditions: sortFacetCounts(conditionCounts),
+		Materials:  sortFacetCounts(materialCounts),
+		Prices:     make([]PriceBucketCount, len(PRICE_BUCKETS)),
+	}
+
+	for i, lower := range PRICE_BUCKETS {
+		facets.Prices[i].Min = types.Cents(lower)
+		if i+1 < len(PRICE_BUCKETS) {
+			upper := types.Cents(PRICE_BUCKETS[i+1])
+			facets.Prices[i].Max = &upper
+		}
+	}
+	for _, bucket := range prices {
+		if i := slices.Index(PRICE_BUCKETS, bucket.Min); i >= 0 {
+			facets.Prices[i].Count += bucket.Count
+		}
+	}
+	return facets
+}
+
+// Sorts by count, most first, and then by value, and never returns nil
+func sortFacetCounts(counts []FacetCount) []FacetCount {
+	counts = slices.DeleteFunc(counts, func(c FacetCount) bool { return c.Count == 0 })
+	slices.SortFunc(counts, func(a, b FacetCount) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return cmp.Compare(a.Value, b.Value)
+	})
+	if counts == nil {
+		counts = []FacetCount{}
+	}
+	return counts
+}
+
+// Returns the lower bound of the price bucket that <cost> cents falls in
+func priceBucketOf(cost int64) int64 {
+	i, found := slices.BinarySearch(PRICE_BUCKETS, cost)
+	if !found {
+		i--
+	}
+	return PRICE_BUCKETS[max(i, 0)]
+}
+
+/*
+Counts the facets of <query> over <listings> the same way the Mongo
+pipeline does, for the stores that keep listings in memory
+*/
+func countListingFacets(query ListingQuery, listings []types.FurnitureListing) ListingFacets {
+	typeQuery, styleQuery, conditionQuery, materialQuery, priceQuery := query.facetQueries()
+
+	countBy := func(query ListingQuery, value func(types.FurnitureListing) string) []FacetCount {
+		counts := []FacetCount{}
+		indexes := make(map[string]int)
+		for _, listing := range listings {
+			if !query.matches(listing) {
+				continue
+			}
+			v := value(listing)
+			if i, exists := indexes[v]; exists {
+				counts[i].Count++
+				continue
+			}
+			indexes[v] = len(counts)
+			counts = append(counts, FacetCount{Value: v, Count: 1})
+		}
+		return counts
+	}
+
+	var prices []priceBucket
+	for _, listing := range listings {
+		if priceQuery.matches(listing) {
+			prices = append(prices, priceBucket{Min: priceBucketOf(listing.Cost.Amount), Count: 1})
+		}
+	}
+
+	return newListingFacets(
+		countBy(typeQuery, func(l types.FurnitureListing) string { return string(l.Type) }),
+		countBy(styleQuery, func(l types.FurnitureListing) string { return string(l.Style) }),
+		countBy(conditionQuery, func(l types.FurnitureListing) string { return string(l.Condition) }),
+		countBy(materialQuery, func(l types.FurnitureListing) string { return string(l.Material) }),
+		prices,
+	)
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"backend/types"
+	"cmp"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newest, oldest, price_asc, price_desc
+type ListingSort string
+
+const (
+	SortNewest    ListingSort = "newest"
+	SortOldest    ListingSort = "oldest"
+	SortPriceLow  ListingSort = "price_asc"
+	SortPriceHigh ListingSort = "price_desc"
+)
+
+func (s ListingSort) IsValid() bool {
+	return s == SortNewest || s == SortOldest || s == SortPriceLow || s == SortPriceHigh
+}
+
+/*
+The filters, order and page of a market query. A filter that is left
+empty or nil matches every listing, and each filter with several values
+matches a listing that has any one of them. Costs are compared by amount,
+since every listing is priced in types.DEFAULT_CURRENCY
+*/
+type ListingQuery struct {
+	Types      []types.FurnitureType
+	Styles     []types.FurnitureStyle
+	Conditions []types.FurnitureCondition
+	Materials  []types.FurnitureMaterial
+	MinCost    *types.Money
+	MaxCost    *types.Money
+	Bought     *bool
+
+	Sort  ListingSort    // SortNewest if empty
+	After *ListingCursor // only listings that come after it in Sort order; nil for the first page
+	Limit int            // no limit if 0
+}
+
+/*
+The position of a listing in a sorted query, so the next page can start
+right after it. The ListingID breaks ties between listings with the same cost
+*/
+type ListingCursor struct {
+	Cost      types.Money
+	ListingID primitive.ObjectID
+}
+
+// Returns the position of <listing> to continue a query after it
+func CursorAfter(listing types.FurnitureListing) ListingCursor {
+	return ListingCursor{Cost: listing.Cost, ListingID: listing.ListingID}
+}
+
+func (q ListingQuery) sort() ListingSort {
+	if q.Sort == "" {
+		return SortNewest
+	}
+	return q.Sort
+}
+
+// Returns the filters of the query without the cursor, as a Mongo filter
+func (q ListingQuery) mongoFilter() bson.M {
+	filter := bson.M{}
+	if len(q.Types) > 0 {
+		filter["type"] = bson.M{"$in": q.Types}
+	}
+	if len(q.Styles) > 0 {
+		filter["style"] = bson.M{"$in": q.Styles}
+	}
+	if len(q.Conditions) > 0 {
+		filter["condition"] = bson.M{"$in": q.Conditions}
+	}
+	if len(q.Materials) > 0 {
+		filter["material"] = bson.M{"$in": q.Materials}
+	}
+
+	cost := bson.M{}
+	if q.MinCost != nil {
+		cost["$gte"] = q.MinCost.Amount
+	}
+	if q.MaxCost != nil {
+		cost["$lte"] = q.MaxCost.Amount
+	}
+	if len(cost) > 0 {
+		filter["cost.amount"] = cost
+	}
+
+	if q.Bought != nil {
+		filter["bought"] = *q.Bought
+	}
+	return filter
+}
+
+/*
+Returns the filter that only matches listings after the cursor. Listings
+with the same cost are ordered by _id in the same direction as the cost
+*/
+func (q ListingQuery) mongoCursorFilter() bson.M {
+	after := q.After
+	switch q.sort() {
+	case SortOldest:
+		return bson.M{"_id": bson.M{"$gt": after.ListingID}}
+	case SortPriceLow:
+		return bson.M{"$or": bson.A{
+			bson.M{"cost.amount": bson.M{"$gt": after.Cost.Amount}},
+			bson.M{"cost.amount": after.Cost.Amount, "_id": bson.M{"$gt": after.ListingID}},
+		}}
+	case SortPriceHigh:
+		return bson.M{"$or": bson.A{
+			bson.M{"cost.amount": bson.M{"$lt": after.Cost.Amount}},
+			bson.M{"cost.amount": after.Cost.Amount, "_id": bson.M{"$lt": after.ListingID}},
+		}}
+	default:
+		return bson.M{"_id": bson.M{"$lt": after.ListingID}}
+	}
+}
+
+func (q ListingQuery) mongoSort() bson.D {
+	switch q.sort() {
+	case SortOldest:
+		return bson.D{{Key: "_id", Value: 1}}
+	case SortPriceLow:
+		return bson.D{{Key: "cost.amount", Value: 1}, {Key: "_id", Value: 1}}
+	case SortPriceHigh:
+		return bson.D{{Key: "cost.amount", Value: -1}, {Key: "_id", Value: -1}}
+	default:
+		return bson.D{{Key: "_id", Value: -1}}
+	}
+}
+
+// Returns true if <listing> passes the query's filters, ignoring the cursor
+func (q ListingQuery) matches(listing types.FurnitureListing) bool {
+	if len(q.Types) > 0 && !slices.Contains(q.Types, listing.Type) {
+		return false
+	}
+	if len(q.Styles) > 0 && !slices.Contains(q.Styles, listing.Style) {
+		return false
+	}
+	if len(q.Conditions) > 0 && !slices.Contains(q.Conditions, listing.Condition) {
+		return false
+	}
+	if len(q.Materials) > 0 && !slices.Contains(q.Materials, listing.Material) {
+		return false
+	}
+	if q.MinCost != nil && listing.Cost.Amount < q.MinCost.Amount {
+		return false
+	}
+	if q.MaxCost != nil && listing.Cost.Amount > q.MaxCost.Amount {
+		return false
+	}
+	if q.Bought != nil && listing.Bought != *q.Bought {
+		return false
+	}
+	return true
+}
+
+/*
+Compares two listings in the query's sort order, returning a negative
+number if <a> comes first, like the cmp functions that slices.SortFunc takes
+*/
+func (q ListingQuery) compare(a, b types.FurnitureListing) int {
+	byID := compareIDs(a.ListingID, b.ListingID)
+	byCost := cmp.Compare(a.Cost.Amount, b.Cost.Amount)
+
+	switch q.sort() {
+	case SortOldest:
+		return byID
+	case SortPriceLow:
+		if byCost != 0 {
+			return byCost
+		}
+		return byID
+	case SortPriceHigh:
+		if byCost != 0 {
+			return -byCost
+		}
+		return -byID
+	default:
+		return -byID
+	}
+}
+
+func compareIDs(a, b primitive.ObjectID) int {
+	return slices.Compare(a[:], b[:])
+}
@@ -0,0 +1,837 @@
+package db
+
+import (
+	"backend/search"
+	"backend/types"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Returns a Store that keeps every document in process memory.
+
+It behaves like the Mongo store as far as the handlers can tell, so
+the API can be exercised in tests without a running database
+*/
+func NewMemoryStore() *Store {
+	return &Store{
+		Users:     &MemoryUserStore{docs: newMemoryCollection(userID)},
+		Listings:  &MemoryListingStore{docs: newMemoryCollection(listingID)},
+		Receipts:  &MemoryReceiptStore{docs: newMemoryCollection(orderID)},
+		Addresses: &MemoryAddressStore{docs: newMemoryCollection(addressID)},
+
+		PasswordResets: &MemoryPasswordResetStore{docs: newMemoryCollection(resetID)},
+		Images:         &MemoryImageStore{docs: newMemoryCollection(imageID)},
+		Events:         &MemoryEventStore{events: make(map[string]types.ProcessedEvent)},
+		Ledger:         &MemoryLedgerStore{docs: newMemoryCollection(entryID)},
+		Withdrawals:    &MemoryWithdrawalStore{docs: newMemoryCollection(withdrawalID)},
+	}
+}
+
+/*
+A goroutine safe, insertion ordered set of documents keyed by their ObjectID.
+<id> returns a pointer to the ObjectID field of a document, which is used to
+read the key and to assign a new one on insert when it's the zero value
+*/
+type memoryCollection[T any] struct {
+	mu    sync.RWMutex
+	order []primitive.ObjectID
+	docs  map[primitive.ObjectID]T
+	id    func(*T) *primitive.ObjectID
+}
+
+func newMemoryCollection[T any](id func(*T) *primitive.ObjectID) *memoryCollection[T] {
+	return &memoryCollection[T]{
+		docs: make(map[primitive.ObjectID]T),
+		id:   id,
+	}
+}
+
+func userID(u *types.User) *primitive.ObjectID                { return &u.UserID }
+func listingID(l *types.FurnitureListing) *primitive.ObjectID { return &l.ListingID }
+func orderID(r *types.Receipt) *primitive.ObjectID            { return &r.OrderID }
+func addressID(a *types.ShippingAddress) *primitive.ObjectID  { return &a.AddressID }
+func resetID(r *types.PasswordReset) *primitive.ObjectID      { return &r.ResetID }
+func imageID(i *types.Image) *primitive.ObjectID              { return &i.ImageID }
+func entryID(e *types.JournalEntry) *primitive.ObjectID       { return &e.EntryID }
+func withdrawalID(w *types.Withdrawal) *primitive.ObjectID    { return &w.WithdrawalID }
+
+func (c *memoryCollection[T]) insert(doc T) primitive.ObjectID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.id(&doc)
+	if id.IsZero() {
+		*id = primitive.NewObjectID()
+	}
+	if _, exists := c.docs[*id]; !exists {
+		c.order = append(c.order, *id)
+	}
+	c.docs[*id] = doc
+
+	return *id
+}
+
+// inserts <doc> only if <match> returns false for every stored document, and returns true if it did
+func (c *memoryCollection[T]) insertUnless(doc T, match func(T) bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, stored := range c.docs {
+		if match(stored) {
+			return false
+		}
+	}
+
+	id := c.id(&doc)
+	if id.IsZero() {
+		*id = primitive.NewObjectID()
+	}
+	c.order = append(c.order, *id)
+	c.docs[*id] = doc
+	return true
+}
+
+func (c *memoryCollection[T]) get(id primitive.ObjectID) (T, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	doc, exists := c.docs[id]
+	if !exists {
+		return doc, ErrNotFound
+	}
+	return doc, nil
+}
+
+// returns every document that <match> returns true for, in insertion order
+func (c *memoryCollection[T]) filter(match func(T) bool) []T {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var docs []T
+	for _, id := range c.order {
+		if doc := c.docs[id]; match(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+/*
+Applies <changes> to the document the same way $set would, by merging the
+bson encoding of <changes> over the bson encoding of the stored document
+*/
+func (c *memoryCollection[T]) update(id primitive.ObjectID, changes any) error {
+	return c.updateIf(id, func(T) bool { return true }, changes)
+}
+
+// Like update, but only if <match> returns true for the stored document
+func (c *memoryCollection[T]) updateIf(id primitive.ObjectID, match func(T) bool, changes any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc, exists := c.docs[id]
+	if !exists || !match(doc) {
+		return ErrNotFound
+	}
+
+	updated, err := applySet(doc, changes)
+	if err != nil {
+		return err
+	}
+	c.docs[id] = updated
+
+	return nil
+}
+
+/*
+Like updateIf, but for several documents at once. Nothing is updated
+unless every document exists and <match> returns true for all of them
+*/
+func (c *memoryCollection[T]) updateAllIf(ids []primitive.ObjectID, match func(T) bool, changes any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	updated := make(map[primitive.ObjectID]T, len(ids))
+	for _, id := range ids {
+		doc, exists := c.docs[id]
+		if !exists || !match(doc) {
+			return ErrNotFound
+		}
+
+		var err error
+		if updated[id], err = applySet(doc, changes); err != nil {
+			return err
+		}
+	}
+	for id, doc := range updated {
+		c.docs[id] = doc
+	}
+
+	return nil
+}
+
+// Applies <changes> to every document that <match> returns true for, and returns how many there were
+func (c *memoryCollection[T]) updateWhere(match func(T) bool, changes any) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for id, doc := range c.docs {
+		if !match(doc) {
+			continue
+		}
+		updated, err := applySet(doc, changes)
+		if err != nil {
+			return count, err
+		}
+		c.docs[id] = updated
+		count++
+	}
+
+	return count, nil
+}
+
+/*
+Replaces the document with what <change> returns for it, only if <match>
+returns true for it, reading and writing it under one lock like $inc does.
+The document is left as it was if <change> returns an error
+*/
+func (c *memoryCollection[T]) modifyIf(id primitive.ObjectID, match func(T) bool, change func(T) (T, error)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc, exists := c.docs[id]
+	if !exists || !match(doc) {
+		return ErrNotFound
+	}
+
+	changed, err := change(doc)
+	if err != nil {
+		return err
+	}
+	c.docs[id] = changed
+
+	return nil
+}
+
+func (c *memoryCollection[T]) delete(id primitive.ObjectID) {
+	c.deleteIf(id, func(T) bool { return true })
+}
+
+// Deletes the document only if <match> returns true for it; returns ErrNotFound otherwise
+func (c *memoryCollection[T]) deleteIf(id primitive.ObjectID, match func(T) bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc, exists := c.docs[id]
+	if !exists || !match(doc) {
+		return ErrNotFound
+	}
+	delete(c.docs, id)
+	for i, orderedID := range c.order {
+		if orderedID == id {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+/*
+Deletes the first document that <match> returns true for and returns it.
+Finding and deleting happen under one lock, like FindOneAndDelete
+*/
+func (c *memoryCollection[T]) take(match func(T) bool) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, id := range c.order {
+		if doc := c.docs[id]; match(doc) {
+			delete(c.docs, id)
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			return doc, nil
+		}
+	}
+
+	var doc T
+	return doc, ErrNotFound
+}
+
+func applySet[T any](doc T, changes any) (T, error) {
+	var updated T
+
+	current, err := toBSON(doc)
+	if err != nil {
+		return updated, err
+	}
+	set, err := toBSON(changes)
+	if err != nil {
+		return updated, err
+	}
+	for field, val := range set {
+		current[field] = val
+	}
+
+	data, err := bson.Marshal(current)
+	if err != nil {
+		return updated, err
+	}
+	err = bson.Unmarshal(data, &updated)
+	return updated, err
+}
+
+func toBSON(v any) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	return m, err
+}
+
+/*----------------------------users----------------------------*/
+
+type MemoryUserStore struct {
+	docs *memoryCollection[types.User]
+}
+
+func (m *MemoryUserStore) FindByID(userID primitive.ObjectID) (types.User, error) {
+	return m.docs.get(userID)
+}
+
+func (m *MemoryUserStore) FindByUsername(username string) (types.User, error) {
+	users := m.docs.filter(func(u types.User) bool { return u.Username == username })
+	if len(users) == 0 {
+		return types.User{}, ErrNotFound
+	}
+	return users[0], nil
+}
+
+func (m *MemoryUserStore) FindByEmail(email string) (types.User, error) {
+	users := m.docs.filter(func(u types.User) bool { return u.Email == email })
+	if len(users) == 0 {
+		return types.User{}, ErrNotFound
+	}
+	return users[0], nil
+}
+
+func (m *MemoryUserStore) IsFieldUnique(fieldName, val string) bool {
+	users := m.docs.filter(func(u types.User) bool {
+		doc, err := toBSON(u)
+		return err == nil && doc[fieldName] == val
+	})
+	return len(users) == 0
+}
+
+func (m *MemoryUserStore) Insert(user types.User) (primitive.ObjectID, error) {
+	return m.docs.insert(user), nil
+}
+
+func (m *MemoryUserStore) Update(userID primitive.ObjectID, changes any) error {
+	return m.docs.update(userID, changes)
+}
+
+func (m *MemoryUserStore) AddToBalance(userID primitive.ObjectID, amount types.Money, key string) error {
+	return m.docs.modifyIf(
+		userID,
+		func(u types.User) bool {
+			return u.Balance.Currency == "" || u.Balance.Currency == amount.Currency
+		},
+		func(u types.User) (types.User, error) {
+			if slices.Contains(u.BalanceKeys, key) {
+				return u, nil
+			}
+			u.Balance = u.Balance.Add(amount)
+			u.BalanceKeys = append(slices.Clone(u.BalanceKeys), key)
+			if len(u.BalanceKeys) > BALANCE_KEYS_KEPT {
+				u.BalanceKeys = u.BalanceKeys[len(u.BalanceKeys)-BALANCE_KEYS_KEPT:]
+			}
+			return u, nil
+		},
+	)
+}
+
+func (m *MemoryUserStore) TakeFromBalance(userID primitive.ObjectID, amount, keep types.Money) error {
+	return m.docs.modifyIf(
+		userID,
+		func(u types.User) bool {
+			return u.Balance.Currency == amount.Currency && u.Balance.Amount-amount.Amount >= keep.Amount
+		},
+		func(u types.User) (types.User, error) {
+			u.Balance = u.Balance.Sub(amount)
+			return u, nil
+		},
+	)
+}
+
+func (m *MemoryUserStore) UseTOTPStep(userID primitive.ObjectID, step int64) error {
+	return m.docs.modifyIf(
+		userID,
+		func(u types.User) bool { return u.TOTPLastStep < step },
+		func(u types.User) (types.User, error) {
+			u.TOTPLastStep = step
+			return u, nil
+		},
+	)
+}
+
+func (m *MemoryUserStore) UseRecoveryCode(userID primitive.ObjectID, hashed string) error {
+	return m.docs.modifyIf(
+		userID,
+		func(u types.User) bool { return slices.Contains(u.RecoveryCodes, hashed) },
+		func(u types.User) (types.User, error) {
+			// a new slice, so the user that was read isn't changed
+			u.RecoveryCodes = slices.DeleteFunc(slices.Clone(u.RecoveryCodes), func(c string) bool { return c == hashed })
+			return u, nil
+		},
+	)
+}
+
+func (m *MemoryUserStore) GetSubscribers() ([]types.User, error) {
+	return m.docs.filter(func(u types.User) bool { return u.Subscribed }), nil
+}
+
+/*---------------------------listings---------------------------*/
+
+type MemoryListingStore struct {
+	docs *memoryCollection[types.FurnitureListing]
+}
+
+func (m *MemoryListingStore) FindByID(listingID primitive.ObjectID) (types.FurnitureListing, error) {
+	return m.docs.get(listingID)
+}
+
+func (m *MemoryListingStore) FindByIDs(listingIDs []primitive.ObjectID) ([]types.FurnitureListing, error) {
+	wanted := make(map[primitive.ObjectID]bool, len(listingIDs))
+	for _, id := range listingIDs {
+		wanted[id] = true
+	}
+	return m.docs.filter(func(l types.FurnitureListing) bool { return wanted[l.ListingID] }), nil
+}
+
+func (m *MemoryListingStore) FindByUser(userID primitive.ObjectID) ([]types.FurnitureListing, error) {
+	return m.docs.filter(func(l types.FurnitureListing) bool { return l.UserID == userID }), nil
+}
+
+func (m *MemoryListingStore) FindAll() ([]types.FurnitureListing, error) {
+	return m.docs.filter(func(types.FurnitureListing) bool { return true }), nil
+}
+
+func (m *MemoryListingStore) Query(query ListingQuery) ([]types.FurnitureListing, error) {
+	listings := m.docs.filter(query.matches)
+	slices.SortFunc(listings, query.compare)
+
+	if query.After != nil {
+		after := types.FurnitureListing{Cost: query.After.Cost, ListingID: query.After.ListingID}
+		start, _ := slices.BinarySearchFunc(listings, after, query.compare)
+		// BinarySearchFunc finds where the cursor's listing is or would be, so skip past it
+		if start < len(listings) && query.compare(listings[start], after) == 0 {
+			start++
+		}
+		listings = listings[start:]
+	}
+
+	if query.Limit > 0 && len(listings) > query.Limit {
+		listings = listings[:query.Limit]
+	}
+	return listings, nil
+}
+
+// without a text index, the listings that match the filters are ranked like the search package ranks them
+func (m *MemoryListingStore) Search(query ListingQuery, words []string, limit int) ([]types.FurnitureListing, error) {
+	listings := m.docs.filter(query.matches)
+	docs := make([]search.Document, len(listings))
+	for i, listing := range listings {
+		docs[i] = search.Document{Title: listing.Title, Description: listing.Description}
+	}
+
+	found := []types.FurnitureListing{}
+	for _, result := range search.Rank(strings.Join(words, " "), docs) {
+		if len(found) == limit {
+			break
+		}
+		found = append(found, listings[result.Index])
+	}
+	return found, nil
+}
+
+func (m *MemoryListingStore) Facets(query ListingQuery) (ListingFacets, error) {
+	listings, _ := m.FindAll()
+	return countListingFacets(query, listings), nil
+}
+
+/*
+ObjectIDs start with their creation timestamp, so the greatest
+ID is the most recent listing, just like sorting by _id in Mongo
+*/
+func (m *MemoryListingStore) FindMostRecent() (types.FurnitureListing, error) {
+	var mostRecent types.FurnitureListing
+	listings, _ := m.FindAll()
+	if len(listings) == 0 {
+		return mostRecent, ErrNotFound
+	}
+
+	for _, listing := range listings {
+		if listing.ListingID.Hex() > mostRecent.ListingID.Hex() {
+			mostRecent = listing
+		}
+	}
+	return mostRecent, nil
+}
+
+func (m *MemoryListingStore) Insert(listing types.FurnitureListing) (primitive.ObjectID, error) {
+	return m.docs.insert(listing), nil
+}
+
+func (m *MemoryListingStore) Update(listingID primitive.ObjectID, changes any) error {
+	return m.docs.update(listingID, changes)
+}
+
+func (m *MemoryListingStore) UpdateUnsold(listingID, userID primitive.ObjectID, changes any) error {
+	return m.docs.updateIf(listingID, func(l types.FurnitureListing) bool {
+		return l.UserID == userID && !l.Bought && !l.IsHeld(time.Now())
+	}, changes)
+}
+
+func (m *MemoryListingStore) DeleteUnsold(listingID, userID primitive.ObjectID) error {
+	return m.docs.deleteIf(listingID, func(l types.FurnitureListing) bool {
+		return l.UserID == userID && !l.Bought && !l.IsHeld(time.Now())
+	})
+}
+
+func (m *MemoryListingStore) Hold(listingIDs []primitive.ObjectID, hold types.ListingHold, now time.Time) error {
+	err := m.docs.updateAllIf(listingIDs, func(l types.FurnitureListing) bool {
+		return !l.Bought && !l.IsHeld(now)
+	}, bson.M{"hold": hold})
+	if err == ErrNotFound {
+		return ErrListingUnavailable
+	}
+	return err
+}
+
+func (m *MemoryListingStore) ReleaseHold(holdID string, userID primitive.ObjectID) (int, error) {
+	return m.docs.updateWhere(func(l types.FurnitureListing) bool {
+		return l.Hold != nil && l.Hold.HoldID == holdID && l.Hold.UserID == userID
+	}, bson.M{"hold": nil})
+}
+
+func (m *MemoryListingStore) SellHeld(listingID primitive.ObjectID, holdID string) error {
+	return m.docs.updateIf(listingID, func(l types.FurnitureListing) bool {
+		if l.Bought {
+			return l.BoughtWith == holdID
+		}
+		return l.Hold != nil && l.Hold.HoldID == holdID
+	}, bson.M{"bought": true, "boughtWith": holdID, "hold": nil})
+}
+
+/*---------------------------receipts---------------------------*/
+
+type MemoryReceiptStore struct {
+	docs *memoryCollection[types.Receipt]
+}
+
+func (m *MemoryReceiptStore) FindByID(orderID, userID primitive.ObjectID) (types.Receipt, error) {
+	receipt, err := m.docs.get(orderID)
+	if err != nil || receipt.UserID != userID {
+		return types.Receipt{}, ErrNotFound
+	}
+	return receipt, nil
+}
+
+func (m *MemoryReceiptStore) FindByUser(userID primitive.ObjectID) ([]types.Receipt, error) {
+	return m.docs.filter(func(r types.Receipt) bool { return r.UserID == userID }), nil
+}
+
+func (m *MemoryReceiptStore) Insert(receipt types.Receipt) (primitive.ObjectID, error) {
+	return m.docs.insert(receipt), nil
+}
+
+func (m *MemoryReceiptStore) InsertForCheckout(receipt types.Receipt) error {
+	m.docs.insertUnless(receipt, func(r types.Receipt) bool { return r.CheckoutID == receipt.CheckoutID })
+	return nil
+}
+
+// returns the index of the sub-order with <subOrderID> sold by <sellerID>, or -1 if the receipt doesn't have it
+func subOrderIndex(receipt types.Receipt, subOrderID, sellerID primitive.ObjectID) int {
+	return slices.IndexFunc(receipt.SubOrders, func(o types.SubOrder) bool {
+		return o.SubOrderID == subOrderID && o.SellerID == sellerID
+	})
+}
+
+// the receipt that has the sub-order with <subOrderID>
+func (m *MemoryReceiptStore) findBySubOrder(subOrderID primitive.ObjectID) (types.Receipt, bool) {
+	receipts := m.docs.filter(func(r types.Receipt) bool {
+		return slices.ContainsFunc(r.SubOrders, func(o types.SubOrder) bool { return o.SubOrderID == subOrderID })
+	})
+	if len(receipts) == 0 {
+		return types.Receipt{}, false
+	}
+	return receipts[0], true
+}
+
+func (m *MemoryReceiptStore) FindSale(subOrderID, sellerID primitive.ObjectID) (types.Receipt, error) {
+	receipt, exists := m.findBySubOrder(subOrderID)
+	if !exists || subOrderIndex(receipt, subOrderID, sellerID) == -1 {
+		return types.Receipt{}, ErrNotFound
+	}
+	return receipt, nil
+}
+
+func (m *MemoryReceiptStore) FindBySeller(sellerID primitive.ObjectID) ([]types.Receipt, error) {
+	return m.docs.filter(func(r types.Receipt) bool {
+		return slices.ContainsFunc(r.SubOrders, func(o types.SubOrder) bool { return o.SellerID == sellerID })
+	}), nil
+}
+
+func (m *MemoryReceiptStore) UpdateStatus(subOrderID, sellerID primitive.ObjectID, from types.OrderStatus, change types.OrderStatusChange, changes any) error {
+	receipt, exists := m.findBySubOrder(subOrderID)
+	if !exists {
+		return ErrNotFound
+	}
+
+	return m.docs.modifyIf(
+		receipt.OrderID,
+		func(r types.Receipt) bool {
+			i := subOrderIndex(r, subOrderID, sellerID)
+			return i != -1 && r.SubOrders[i].Status == from
+		},
+		func(r types.Receipt) (types.Receipt, error) {
+			i := subOrderIndex(r, subOrderID, sellerID)
+			updated, err := applySet(r.SubOrders[i], changes)
+			if err != nil {
+				return r, err
+			}
+			updated.Status = change.Status
+			updated.StatusHistory = append(updated.StatusHistory, change)
+
+			// the sub-orders are copied so the receipt that was read isn't changed
+			r.SubOrders = slices.Clone(r.SubOrders)
+			r.SubOrders[i] = updated
+			return r, nil
+		},
+	)
+}
+
+/*----------------------shipping addresses----------------------*/
+
+type MemoryAddressStore struct {
+	docs *memoryCollection[types.ShippingAddress]
+}
+
+func (m *MemoryAddressStore) FindByUser(userID primitive.ObjectID) ([]types.ShippingAddress, error) {
+	return m.docs.filter(func(a types.ShippingAddress) bool { return a.UserID == userID }), nil
+}
+
+func (m *MemoryAddressStore) Insert(address types.ShippingAddress) (primitive.ObjectID, error) {
+	return m.docs.insert(address), nil
+}
+
+func (m *MemoryAddressStore) Update(addressID primitive.ObjectID, changes any) error {
+	return m.docs.update(addressID, changes)
+}
+
+func (m *MemoryAddressStore) Delete(addressID, userID primitive.ObjectID) error {
+	address, err := m.docs.get(addressID)
+	if err != nil || address.UserID != userID {
+		return ErrNotFound
+	}
+	m.docs.delete(addressID)
+	return nil
+}
+
+func (m *MemoryAddressStore) ClearDefault(userID primitive.ObjectID) error {
+	defaults := m.docs.filter(func(a types.ShippingAddress) bool {
+		return a.UserID == userID && a.Default
+	})
+	for _, address := range defaults {
+		if err := m.docs.update(address.AddressID, bson.M{"default": false}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*-----------------------password resets------------------------*/
+
+type MemoryPasswordResetStore struct {
+	docs *memoryCollection[types.PasswordReset]
+}
+
+func (m *MemoryPasswordResetStore) Insert(reset types.PasswordReset) (primitive.ObjectID, error) {
+	return m.docs.insert(reset), nil
+}
+
+func (m *MemoryPasswordResetStore) Consume(tokenHash string, now time.Time) (types.PasswordReset, error) {
+	return m.docs.take(func(r types.PasswordReset) bool {
+		return r.TokenHash == tokenHash && now.Before(r.ExpiresAt)
+	})
+}
+
+func (m *MemoryPasswordResetStore) DeleteByUser(userID primitive.ObjectID) error {
+	resets := m.docs.filter(func(r types.PasswordReset) bool { return r.UserID == userID })
+	for _, reset := range resets {
+		m.docs.delete(reset.ResetID)
+	}
+	return nil
+}
+
+/*----------------------------images----------------------------*/
+
+type MemoryImageStore struct {
+	docs *memoryCollection[types.Image]
+}
+
+func (m *MemoryImageStore) Save(data []byte, contentType string) (primitive.ObjectID, error) {
+	return m.SaveVariant(primitive.NilObjectID, types.ImageOriginal, data, contentType)
+}
+
+func (m *MemoryImageStore) SaveVariant(parentID primitive.ObjectID, size types.ImageSize, data []byte, contentType string) (primitive.ObjectID, error) {
+	return m.docs.insert(types.Image{
+		ParentID:    parentID,
+		Size:        size,
+		ContentType: contentType,
+		Hash:        hashImage(data),
+		Data:        data,
+		UploadedAt:  time.Now().UTC().Truncate(time.Millisecond),
+	}), nil
+}
+
+func (m *MemoryImageStore) Get(imageID primitive.ObjectID) (types.Image, error) {
+	return m.docs.get(imageID)
+}
+
+func (m *MemoryImageStore) GetVariant(parentID primitive.ObjectID, size types.ImageSize) (types.Image, error) {
+	variants := m.docs.filter(func(i types.Image) bool {
+		return i.ParentID == parentID && i.Size == size
+	})
+	if len(variants) == 0 {
+		return types.Image{}, ErrNotFound
+	}
+	return variants[0], nil
+}
+
+func (m *MemoryImageStore) Delete(imageID primitive.ObjectID) error {
+	variants := m.docs.filter(func(i types.Image) bool { return i.ParentID == imageID })
+	for _, variant := range variants {
+		m.docs.delete(variant.ImageID)
+	}
+	return m.docs.deleteIf(imageID, func(types.Image) bool { return true })
+}
+
+/*----------------------------events----------------------------*/
+
+// keyed by the event IDs, which are strings, so it can't use a memoryCollection
+type MemoryEventStore struct {
+	mu     sync.Mutex
+	events map[string]types.ProcessedEvent
+}
+
+func (m *MemoryEventStore) IsProcessed(eventID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, exists := m.events[eventID]
+	return exists, nil
+}
+
+func (m *MemoryEventStore) Record(event types.ProcessedEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.events[event.EventID]; exists {
+		return ErrEventProcessed
+	}
+	m.events[event.EventID] = event
+	return nil
+}
+
+/*----------------------------ledger----------------------------*/
+
+type MemoryLedgerStore struct {
+	mu   sync.Mutex // held from checking an entry's key until it's inserted
+	docs *memoryCollection[types.JournalEntry]
+}
+
+func (m *MemoryLedgerStore) Insert(entry types.JournalEntry) (primitive.ObjectID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	posted := m.docs.filter(func(e types.JournalEntry) bool { return e.Key == entry.Key })
+	if len(posted) > 0 {
+		return primitive.NilObjectID, ErrEntryPosted
+	}
+	return m.docs.insert(entry), nil
+}
+
+func (m *MemoryLedgerStore) FindByAccount(account types.LedgerAccount, after primitive.ObjectID, limit int) ([]types.JournalEntry, error) {
+	entries := m.docs.filter(func(e types.JournalEntry) bool {
+		return (e.From == account || e.To == account) && (after.IsZero() || compareIDs(e.EntryID, after) < 0)
+	})
+	slices.Reverse(entries)
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (m *MemoryLedgerStore) Balance(account types.LedgerAccount) (types.Money, error) {
+	var balance types.Money
+	for _, entry := range m.docs.filter(func(e types.JournalEntry) bool { return e.From == account || e.To == account }) {
+		if entry.Amount.Currency != balance.Currency && balance.Currency != "" {
+			return types.Money{}, types.ErrCurrencyMismatch
+		}
+		balance = balance.Add(entry.AmountFor(account))
+	}
+	return balance, nil
+}
+
+func (m *MemoryLedgerStore) SumSince(account types.LedgerAccount, since time.Time, entryTypes []types.JournalEntryType) (types.Money, error) {
+	var sum types.Money
+	entries := m.docs.filter(func(e types.JournalEntry) bool {
+		return (e.From == account || e.To == account) && !e.PostedAt.Before(since) && slices.Contains(entryTypes, e.Type)
+	})
+	for _, entry := range entries {
+		if entry.Amount.Currency != sum.Currency && sum.Currency != "" {
+			return types.Money{}, types.ErrCurrencyMismatch
+		}
+		sum = sum.Add(entry.AmountFor(account))
+	}
+	return sum, nil
+}
+
+/*-------------------------withdrawals--------------------------*/
+
+type MemoryWithdrawalStore struct {
+	docs *memoryCollection[types.Withdrawal]
+}
+
+func (m *MemoryWithdrawalStore) Insert(withdrawal types.Withdrawal) (primitive.ObjectID, error) {
+	return m.docs.insert(withdrawal), nil
+}
+
+func (m *MemoryWithdrawalStore) FindByID(withdrawalID primitive.ObjectID) (types.Withdrawal, error) {
+	return m.docs.get(withdrawalID)
+}
+
+func (m *MemoryWithdrawalStore) FindByUser(userID primitive.ObjectID) ([]types.Withdrawal, error) {
+	withdrawals := m.docs.filter(func(w types.Withdrawal) bool { return w.UserID == userID })
+	slices.Reverse(withdrawals)
+	return withdrawals, nil
+}
+
+func (m *MemoryWithdrawalStore) FindByStatus(status types.WithdrawalStatus) ([]types.Withdrawal, error) {
+	return m.docs.filter(func(w types.Withdrawal) bool { return w.Status == status }), nil
+}
+
+func (m *MemoryWithdrawalStore) UpdateIfStatus(withdrawalID primitive.ObjectID, status types.WithdrawalStatus, changes any) error {
+	return m.docs.updateIf(withdrawalID, func(w types.Withdrawal) bool { return w.Status == status }, changes)
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// a listing saved before images were moved into the image store
+type embeddedImagesListing struct {
+	ListingID primitive.ObjectID `bson:"_id"`
+	Images    [][]byte           `bson:"images"`
+}
+
+/*
+Moves the images that older listings kept in their "images" field into
+<images>, resizing them like new uploads, and replaces the field with
+the IDs of the saved images.
+
+Each listing is updated on its own once all of its images are saved,
+so running it again after a failure only moves the listings that are
+left. Returns how many listings were moved
+*/
+func MigrateListingImages(images ImageStore) (int, error) {
+	collection := GetCollection("listings")
+	cursor, err := collection.Find(context.Background(), bson.M{"images": bson.M{"$exists": true}})
+	if err != nil {
+		return 0, err
+	}
+
+	var listings []embeddedImagesListing
+	if err = cursor.All(context.Background(), &listings); err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, listing := range listings {
+		imageIDs := []primitive.ObjectID{}
+		for _, data := range listing.Images {
+			imageID, err := SaveImageWithVariants(images, data)
+			if err != nil {
+				return migrated, err
+			}
+			imageIDs = append(imageIDs, imageID)
+		}
+
+		_, err := collection.UpdateByID(context.Background(), listing.ListingID, bson.M{
+			"$set":   bson.M{"imageIds": imageIDs},
+			"$unset": bson.M{"images": ""},
+		})
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
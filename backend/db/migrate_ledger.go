@@ -0,0 +1,60 @@
+package db
+
+import (
+	"backend/types"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Posts the balances that sellers had before the ledger was kept to <ledger>
+as opening balances, so every seller's entries add up to their balance.
+
+Sellers that already have entries are skipped, since their balances have
+only changed through the ledger since. Returns how many opening balances
+were posted
+*/
+func MigrateOpeningBalances(ledger LedgerStore) (int, error) {
+	users, err := findMany[types.User]("users", bson.M{"balance.amount": bson.M{"$nin": bson.A{0, nil}}})
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, user := range users {
+		account := types.SellerAccount(user.UserID)
+		entries, err := ledger.FindByAccount(account, primitive.NilObjectID, 1)
+		if err != nil {
+			return migrated, err
+		}
+		if len(entries) > 0 {
+			continue
+		}
+
+		entry := types.JournalEntry{
+			Key:      "opening_balance/" + user.UserID.Hex(),
+			Type:     types.EntryOpeningBalance,
+			From:     types.AccountOpeningBalances,
+			To:       account,
+			Amount:   user.Balance,
+			PostedAt: time.Now(),
+		}
+		if entry.Amount.IsNegative() {
+			entry.From, entry.To = entry.To, entry.From
+			entry.Amount.Amount = -entry.Amount.Amount
+		}
+
+		_, err = ledger.Insert(entry)
+		if err == ErrEntryPosted {
+			continue
+		}
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
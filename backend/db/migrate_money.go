@@ -0,0 +1,51 @@
+package db
+
+import (
+	"backend/types"
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// the collections and fields that held plain numbers of dollars before they were types.Money
+var moneyFields = []struct {
+	Collection string
+	Field      string
+}{
+	{"listings", "cost"},
+	{"receipts", "totalCost"},
+	{"users", "balance"},
+}
+
+/*
+Rewrites the prices, totals and balances that older documents saved as
+plain numbers of dollars, whether doubles, ints or Decimal128s, as
+{amount, currency} in cents of types.DEFAULT_CURRENCY. Amounts are rounded
+to the nearest cent in the database, where doubles are read as decimals
+first so 0.29 doesn't turn into 28 cents.
+
+Only documents that still hold a number are updated, so running it again
+after a failure only migrates the ones that are left. Returns how many
+documents were migrated
+*/
+func MigrateMoney() (int, error) {
+	migrated := 0
+	for _, money := range moneyFields {
+		field := "$" + money.Field
+		res, err := GetCollection(money.Collection).UpdateMany(
+			context.Background(),
+			bson.M{money.Field: bson.M{"$type": bson.A{"double", "int", "long", "decimal"}}},
+			bson.A{bson.M{"$set": bson.M{money.Field: bson.M{
+				"amount": bson.M{"$toLong": bson.M{"$round": bson.A{
+					bson.M{"$multiply": bson.A{bson.M{"$toDecimal": field}, 100}}, 0,
+				}}},
+				"currency": types.DEFAULT_CURRENCY,
+			}}}},
+		)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += int(res.ModifiedCount)
+	}
+	return migrated, nil
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"backend/types"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// a receipt as it was saved before orders were split into sub-orders
+type flatReceipt struct {
+	OrderID           primitive.ObjectID        `bson:"_id"`
+	TotalCost         types.Money               `bson:"totalCost"`
+	Items             []types.ProductItem       `bson:"items"`
+	DatePurchased     time.Time                 `bson:"datePurchased"`
+	EstimatedDelivery time.Time                 `bson:"estimatedDelivery"`
+	TrackingNumber    string                    `bson:"trackingNumber"`
+	Status            types.OrderStatus         `bson:"status"`
+	StatusHistory     []types.OrderStatusChange `bson:"statusHistory"`
+}
+
+/*
+Splits the items of each receipt into a sub-order for each of their
+sellers, in the order the items were bought. Every sub-order takes the
+receipt's status and shipping, or the paid status as of when it was
+purchased if it never had one, since none of those have been shipped
+through the site. Receipts from before items had prices give the whole
+total to their sub-order if they only have one.
+
+Only receipts without sub-orders are updated, so running it again after a
+failure only migrates the ones that are left. Returns how many receipts
+were migrated
+*/
+func MigrateSubOrders() (int, error) {
+	collection := GetCollection("receipts")
+
+	cursor, err := collection.Find(context.Background(), bson.M{"subOrders": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, err
+	}
+	var receipts []flatReceipt
+	if err := cursor.All(context.Background(), &receipts); err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, receipt := range receipts {
+		if receipt.Status == "" {
+			receipt.Status = types.OrderPaid
+			receipt.StatusHistory = []types.OrderStatusChange{{Status: types.OrderPaid, At: receipt.DatePurchased}}
+		}
+
+		subOrders := []types.SubOrder{}
+		bySeller := make(map[primitive.ObjectID]int)
+		for _, item := range receipt.Items {
+			i, exists := bySeller[item.SellerID]
+			if !exists {
+				i = len(subOrders)
+				bySeller[item.SellerID] = i
+				subOrders = append(subOrders, types.SubOrder{
+					SubOrderID:        primitive.NewObjectID(),
+					SellerID:          item.SellerID,
+					EstimatedDelivery: receipt.EstimatedDelivery,
+					TrackingNumber:    receipt.TrackingNumber,
+					Status:            receipt.Status,
+					StatusHistory:     receipt.StatusHistory,
+				})
+			}
+			subOrders[i].Items = append(subOrders[i].Items, item)
+			subOrders[i].Subtotal = subOrders[i].Subtotal.Add(item.Price)
+		}
+		if len(subOrders) == 1 && subOrders[0].Subtotal.IsZero() {
+			subOrders[0].Subtotal = receipt.TotalCost
+		}
+
+		res, err := collection.UpdateOne(
+			context.Background(),
+			bson.M{"_id": receipt.OrderID, "subOrders": bson.M{"$exists": false}},
+			bson.M{
+				"$set": bson.M{"subOrders": subOrders},
+				"$unset": bson.M{
+					"items":             "",
+					"estimatedDelivery": "",
+					"trackingNumber":    "",
+					"status":            "",
+					"statusHistory":     "",
+				},
+			},
+		)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += int(res.ModifiedCount)
+	}
+	return migrated, nil
+}
@@ -10,6 +10,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -18,34 +19,63 @@ const DATABASE_NAME string = "AntiqueFurnitureProject"
 const DATABASE_CONTEXT_TIMEOUT time.Duration = 10 * time.Second
 
 var (
-	once     sync.Once
+	mu       sync.Mutex
 	dbClient *mongo.Client
 )
 
-// connect with mongoDB
+/*
+connect with mongoDB; does nothing if already connected, so it's
+safe to call again after Close to reconnect
+*/
 func Init() (*mongo.Client, error) {
-	var err error = nil
+	mu.Lock()
+	defer mu.Unlock()
+
+	if dbClient != nil {
+		return dbClient, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONTEXT_TIMEOUT)
+	defer cancel()
+
+	clientOptions := options.Client().ApplyURI(connectionString)
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		panic(err)
+	}
+	dbClient = client
 
-	once.Do(func() {
-		ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONTEXT_TIMEOUT)
-		defer cancel()
+	log.Println("\x1b[34mConnected to database.\x1b[0m")
+	return dbClient, nil
+}
 
-		clientOptions := options.Client().ApplyURI(connectionString)
-		dbClient, err = mongo.Connect(ctx, clientOptions)
-		if err != nil {
-			panic(err)
-		}
+/*
+Returns nil if the database can be reached within <timeout>. Init
+must be called first
+*/
+func Ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-		log.Println("\x1b[34mConnected to database.\x1b[0m")
-	})
-	return dbClient, err
+	return dbClient.Ping(ctx, nil)
 }
 
 func GetCollection(collection string) *mongo.Collection {
 	return dbClient.Database(DATABASE_NAME).Collection(collection)
 }
 
+// Returns the GridFS bucket named <name>, which stores files in "<name>.files" and "<name>.chunks"
+func GetBucket(name string) (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(
+		dbClient.Database(DATABASE_NAME),
+		options.GridFSBucket().SetName(name),
+	)
+}
+
 func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+
 	if dbClient != nil {
 		err := dbClient.Disconnect(context.Background())
 		dbClient = nil
@@ -0,0 +1,914 @@
+package db
+
+import (
+	"backend/types"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Returns a Store backed by the MongoDB collections.
+Init must be called before any of the stores are used
+*/
+func NewMongoStore() *Store {
+	return &Store{
+		Users:     MongoUserStore{},
+		Listings:  MongoListingStore{},
+		Receipts:  MongoReceiptStore{},
+		Addresses: MongoAddressStore{},
+
+		PasswordResets: MongoPasswordResetStore{},
+		Images:         MongoImageStore{},
+		Events:         MongoEventStore{},
+		Ledger:         MongoLedgerStore{},
+		Withdrawals:    MongoWithdrawalStore{},
+	}
+}
+
+// converts mongo.ErrNoDocuments into ErrNotFound
+func notFound(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+func findOne[T any](collection string, filter any, opts ...*options.FindOneOptions) (T, error) {
+	var doc T
+	err := GetCollection(collection).FindOne(context.Background(), filter, opts...).Decode(&doc)
+	return doc, notFound(err)
+}
+
+func findMany[T any](collection string, filter any) ([]T, error) {
+	cursor, err := GetCollection(collection).Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []T
+	if err = cursor.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// Like findMany, but sorted by _id, oldest first if <order> is 1 or newest first if it's -1
+func findSorted[T any](collection string, filter any, order int) ([]T, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: order}})
+	cursor, err := GetCollection(collection).Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []T
+	if err = cursor.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func insertOne(collection string, doc any) (primitive.ObjectID, error) {
+	res, err := GetCollection(collection).InsertOne(context.Background(), doc)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+func updateByID(collection string, id primitive.ObjectID, changes any) error {
+	res, err := GetCollection(collection).UpdateByID(
+		context.Background(),
+		id,
+		bson.M{"$set": changes},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+/*----------------------------users----------------------------*/
+
+type MongoUserStore struct{}
+
+func (MongoUserStore) FindByID(userID primitive.ObjectID) (types.User, error) {
+	return findOne[types.User]("users", bson.M{"_id": userID})
+}
+
+func (MongoUserStore) FindByUsername(username string) (types.User, error) {
+	return findOne[types.User]("users", bson.M{"username": username})
+}
+
+func (MongoUserStore) FindByEmail(email string) (types.User, error) {
+	return findOne[types.User]("users", bson.M{"email": email})
+}
+
+func (MongoUserStore) IsFieldUnique(fieldName, val string) bool {
+	return CheckFieldUniqueness(fieldName, val)
+}
+
+func (MongoUserStore) Insert(user types.User) (primitive.ObjectID, error) {
+	res, err := InsertIntoUsersCollection(user)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+func (MongoUserStore) Update(userID primitive.ObjectID, changes any) error {
+	return updateByID("users", userID, changes)
+}
+
+/*
+$inc adds to the stored amount, so a sale never overwrites another one's
+credit, and the key is checked and pushed in the same update, so a change
+is only added once
+*/
+func (MongoUserStore) AddToBalance(userID primitive.ObjectID, amount types.Money, key string) error {
+	res, err := GetCollection("users").UpdateOne(
+		context.Background(),
+		bson.M{
+			"_id":              userID,
+			"balance.currency": bson.M{"$in": bson.A{amount.Currency, "", nil}},
+			"balanceKeys":      bson.M{"$ne": key},
+		},
+		bson.M{
+			"$inc":  bson.M{"balance.amount": amount.Amount},
+			"$set":  bson.M{"balance.currency": amount.Currency},
+			"$push": bson.M{"balanceKeys": bson.M{"$each": bson.A{key}, "$slice": -BALANCE_KEYS_KEPT}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+
+	// it didn't match either because the change was already added, or there's nothing to add it to
+	added, err := GetCollection("users").CountDocuments(context.Background(), bson.M{"_id": userID, "balanceKeys": key})
+	if err != nil {
+		return err
+	}
+	if added == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (MongoUserStore) TakeFromBalance(userID primitive.ObjectID, amount, keep types.Money) error {
+	res, err := GetCollection("users").UpdateOne(
+		context.Background(),
+		bson.M{
+			"_id":              userID,
+			"balance.currency": amount.Currency,
+			"balance.amount":   bson.M{"$gte": amount.Amount + keep.Amount},
+		},
+		bson.M{"$inc": bson.M{"balance.amount": -amount.Amount}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (MongoUserStore) UseTOTPStep(userID primitive.ObjectID, step int64) error {
+	res, err := GetCollection("users").UpdateOne(
+		context.Background(),
+		bson.M{
+			"_id": userID,
+			// totpLastStep isn't saved until a code has been used
+			"$or": bson.A{
+				bson.M{"totpLastStep": bson.M{"$lt": step}},
+				bson.M{"totpLastStep": bson.M{"$exists": false}},
+			},
+		},
+		bson.M{"$set": bson.M{"totpLastStep": step}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (MongoUserStore) UseRecoveryCode(userID primitive.ObjectID, hashed string) error {
+	res, err := GetCollection("users").UpdateOne(
+		context.Background(),
+		bson.M{"_id": userID, "recoveryCodes": hashed},
+		bson.M{"$pull": bson.M{"recoveryCodes": hashed}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (MongoUserStore) GetSubscribers() ([]types.User, error) {
+	return GetSubscribers()
+}
+
+/*---------------------------listings---------------------------*/
+
+type MongoListingStore struct{}
+
+func (MongoListingStore) FindByID(listingID primitive.ObjectID) (types.FurnitureListing, error) {
+	var listing types.FurnitureListing
+	res, err := FindByIDInListingsCollection(listingID.Hex())
+	if err != nil {
+		return listing, notFound(err)
+	}
+	err = res.Decode(&listing)
+	return listing, err
+}
+
+func (MongoListingStore) FindByIDs(listingIDs []primitive.ObjectID) ([]types.FurnitureListing, error) {
+	return findMany[types.FurnitureListing]("listings", bson.M{"_id": bson.M{"$in": listingIDs}})
+}
+
+func (MongoListingStore) FindByUser(userID primitive.ObjectID) ([]types.FurnitureListing, error) {
+	return findMany[types.FurnitureListing]("listings", bson.M{"userid": userID})
+}
+
+func (MongoListingStore) FindAll() ([]types.FurnitureListing, error) {
+	return findMany[types.FurnitureListing]("listings", bson.D{})
+}
+
+func (MongoListingStore) Query(query ListingQuery) ([]types.FurnitureListing, error) {
+	filter := query.mongoFilter()
+	if query.After != nil {
+		filter = bson.M{"$and": bson.A{filter, query.mongoCursorFilter()}}
+	}
+
+	opts := options.Find().SetSort(query.mongoSort())
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+
+	cursor, err := GetCollection("listings").Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	listings := []types.FurnitureListing{}
+	if err = cursor.All(context.Background(), &listings); err != nil {
+		return nil, err
+	}
+	return listings, nil
+}
+
+// ranked by the text index on the title and description, so only the top <limit> are read
+func (MongoListingStore) Search(query ListingQuery, words []string, limit int) ([]types.FurnitureListing, error) {
+	filter := query.mongoFilter()
+	filter["$text"] = bson.M{"$search": strings.Join(words, " ")}
+	score := bson.M{"score": bson.M{"$meta": "textScore"}}
+	opts := options.Find().SetProjection(score).SetSort(score).SetLimit(int64(limit))
+
+	cursor, err := GetCollection("listings").Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	listings := []types.FurnitureListing{}
+	if err = cursor.All(context.Background(), &listings); err != nil {
+		return nil, err
+	}
+	return listings, nil
+}
+
+func (MongoListingStore) Facets(query ListingQuery) (ListingFacets, error) {
+	cursor, err := GetCollection("listings").Aggregate(context.Background(), query.mongoFacetPipeline())
+	if err != nil {
+		return ListingFacets{}, err
+	}
+
+	// $facet always outputs exactly one document
+	var results []struct {
+		Types      []FacetCount  `bson:"types"`
+		Styles     []FacetCount  `bson:"styles"`
+		Conditions []FacetCount  `bson:"conditions"`
+		Materials  []FacetCount  `bson:"materials"`
+		Prices     []priceBucket `bson:"prices"`
+	}
+	if err = cursor.All(context.Background(), &results); err != nil {
+		return ListingFacets{}, err
+	}
+	if len(results) == 0 {
+		return newListingFacets(nil, nil, nil, nil, nil), nil
+	}
+
+	counts := results[0]
+	return newListingFacets(counts.Types, counts.Styles, counts.Conditions, counts.Materials, counts.Prices), nil
+}
+
+func (MongoListingStore) FindMostRecent() (types.FurnitureListing, error) {
+	opts := options.FindOne().SetSort(map[string]int{"_id": -1})
+	return findOne[types.FurnitureListing]("listings", bson.M{}, opts)
+}
+
+func (MongoListingStore) Insert(listing types.FurnitureListing) (primitive.ObjectID, error) {
+	return insertOne("listings", listing)
+}
+
+func (MongoListingStore) Update(listingID primitive.ObjectID, changes any) error {
+	return updateByID("listings", listingID, changes)
+}
+
+func (MongoListingStore) UpdateUnsold(listingID, userID primitive.ObjectID, changes any) error {
+	res, err := GetCollection("listings").UpdateOne(
+		context.Background(),
+		bson.M{"_id": listingID, "userid": userID, "bought": false, "$or": notHeld(time.Now())},
+		bson.M{"$set": changes},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (MongoListingStore) DeleteUnsold(listingID, userID primitive.ObjectID) error {
+	res, err := GetCollection("listings").DeleteOne(
+		context.Background(),
+		bson.M{"_id": listingID, "userid": userID, "bought": false, "$or": notHeld(time.Now())},
+	)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Matches listings that have no hold, or a hold that expired at <now>
+func notHeld(now time.Time) bson.A {
+	return bson.A{
+		bson.M{"hold": nil},
+		bson.M{"hold.expiresAt": bson.M{"$lte": now}},
+	}
+}
+
+/*
+Holds the listings one at a time, since each update is atomic on its own
+and multi-document transactions need a replica set. If one of them can't
+be held, the ones already held are released before returning, so two
+checkouts racing for the same listings can't both end up holding any
+*/
+func (m MongoListingStore) Hold(listingIDs []primitive.ObjectID, hold types.ListingHold, now time.Time) error {
+	for _, listingID := range listingIDs {
+		res, err := GetCollection("listings").UpdateOne(
+			context.Background(),
+			bson.M{"_id": listingID, "bought": false, "$or": notHeld(now)},
+			bson.M{"$set": bson.M{"hold": hold}},
+		)
+		if err == nil && res.MatchedCount == 0 {
+			err = ErrListingUnavailable
+		}
+		if err != nil {
+			if _, releaseErr := m.ReleaseHold(hold.HoldID, hold.UserID); releaseErr != nil {
+				log.Printf("Failed to release hold %s: %s\n", hold.HoldID, releaseErr.Error())
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (MongoListingStore) ReleaseHold(holdID string, userID primitive.ObjectID) (int, error) {
+	res, err := GetCollection("listings").UpdateMany(
+		context.Background(),
+		bson.M{"hold.holdId": holdID, "hold.userid": userID},
+		bson.M{"$unset": bson.M{"hold": ""}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+
+func (MongoListingStore) SellHeld(listingID primitive.ObjectID, holdID string) error {
+	res, err := GetCollection("listings").UpdateOne(
+		context.Background(),
+		bson.M{"_id": listingID, "$or": bson.A{
+			bson.M{"bought": false, "hold.holdId": holdID},
+			bson.M{"bought": true, "boughtWith": holdID},
+		}},
+		bson.M{"$set": bson.M{"bought": true, "boughtWith": holdID}, "$unset": bson.M{"hold": ""}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+/*---------------------------receipts---------------------------*/
+
+type MongoReceiptStore struct{}
+
+func (MongoReceiptStore) FindByID(orderID, userID primitive.ObjectID) (types.Receipt, error) {
+	return findOne[types.Receipt]("receipts", bson.M{"_id": orderID, "userid": userID})
+}
+
+func (MongoReceiptStore) FindByUser(userID primitive.ObjectID) ([]types.Receipt, error) {
+	return findMany[types.Receipt]("receipts", bson.M{"userid": userID})
+}
+
+func (MongoReceiptStore) Insert(receipt types.Receipt) (primitive.ObjectID, error) {
+	return insertOne("receipts", receipt)
+}
+
+/*
+Only sets the receipt's fields when the upsert inserts it, and the unique
+index on checkoutId keeps two at the same time from both inserting
+*/
+func (MongoReceiptStore) InsertForCheckout(receipt types.Receipt) error {
+	doc, err := toBSON(receipt)
+	if err != nil {
+		return err
+	}
+
+	_, err = GetCollection("receipts").UpdateOne(
+		context.Background(),
+		bson.M{"checkoutId": receipt.CheckoutID},
+		bson.M{"$setOnInsert": doc},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (MongoReceiptStore) FindSale(subOrderID, sellerID primitive.ObjectID) (types.Receipt, error) {
+	return findOne[types.Receipt]("receipts", bson.M{
+		"subOrders": bson.M{"$elemMatch": bson.M{"subOrderId": subOrderID, "sellerid": sellerID}},
+	})
+}
+
+func (MongoReceiptStore) FindBySeller(sellerID primitive.ObjectID) ([]types.Receipt, error) {
+	return findMany[types.Receipt]("receipts", bson.M{"subOrders.sellerid": sellerID})
+}
+
+func (MongoReceiptStore) UpdateStatus(subOrderID, sellerID primitive.ObjectID, from types.OrderStatus, change types.OrderStatusChange, changes any) error {
+	changed, err := toBSON(changes)
+	if err != nil {
+		return err
+	}
+	// $ is the sub-order matched by the filter
+	set := bson.M{"subOrders.$.status": change.Status}
+	for field, val := range changed {
+		set["subOrders.$."+field] = val
+	}
+
+	res, err := GetCollection("receipts").UpdateOne(
+		context.Background(),
+		bson.M{"subOrders": bson.M{"$elemMatch": bson.M{"subOrderId": subOrderID, "sellerid": sellerID, "status": from}}},
+		bson.M{"$set": set, "$push": bson.M{"subOrders.$.statusHistory": change}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+/*----------------------shipping addresses----------------------*/
+
+type MongoAddressStore struct{}
+
+func (MongoAddressStore) FindByUser(userID primitive.ObjectID) ([]types.ShippingAddress, error) {
+	return findMany[types.ShippingAddress]("shippingAddresses", bson.M{"userid": userID})
+}
+
+func (MongoAddressStore) Insert(address types.ShippingAddress) (primitive.ObjectID, error) {
+	return insertOne("shippingAddresses", address)
+}
+
+func (MongoAddressStore) Update(addressID primitive.ObjectID, changes any) error {
+	return updateByID("shippingAddresses", addressID, changes)
+}
+
+func (MongoAddressStore) Delete(addressID, userID primitive.ObjectID) error {
+	res, err := GetCollection("shippingAddresses").DeleteOne(
+		context.Background(),
+		bson.M{"_id": addressID, "userid": userID},
+	)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (MongoAddressStore) ClearDefault(userID primitive.ObjectID) error {
+	_, err := GetCollection("shippingAddresses").UpdateMany(
+		context.Background(),
+		bson.M{"userid": userID, "default": true},
+		bson.M{"$set": bson.M{"default": false}},
+	)
+	return err
+}
+
+/*-----------------------password resets------------------------*/
+
+type MongoPasswordResetStore struct{}
+
+func (MongoPasswordResetStore) Insert(reset types.PasswordReset) (primitive.ObjectID, error) {
+	return insertOne("passwordResets", reset)
+}
+
+func (MongoPasswordResetStore) Consume(tokenHash string, now time.Time) (types.PasswordReset, error) {
+	var reset types.PasswordReset
+	err := GetCollection("passwordResets").FindOneAndDelete(
+		context.Background(),
+		bson.M{"tokenHash": tokenHash, "expiresAt": bson.M{"$gt": now}},
+	).Decode(&reset)
+	return reset, notFound(err)
+}
+
+func (MongoPasswordResetStore) DeleteByUser(userID primitive.ObjectID) error {
+	_, err := GetCollection("passwordResets").DeleteMany(context.Background(), bson.M{"userid": userID})
+	return err
+}
+
+/*----------------------------images----------------------------*/
+
+// the GridFS bucket that listing images are saved in
+const IMAGES_BUCKET = "images"
+
+// saved as the metadata of each image file in GridFS
+type imageMetadata struct {
+	ContentType string             `bson:"contentType"`
+	Hash        string             `bson:"sha256"`
+	ParentID    primitive.ObjectID `bson:"parent,omitempty"`
+	Size        types.ImageSize    `bson:"size,omitempty"`
+}
+
+/*
+Keeps images in GridFS, so images larger than the 16MB document
+limit can be stored and listings stay small
+*/
+type MongoImageStore struct{}
+
+func (s MongoImageStore) Save(data []byte, contentType string) (primitive.ObjectID, error) {
+	return s.SaveVariant(primitive.NilObjectID, types.ImageOriginal, data, contentType)
+}
+
+func (MongoImageStore) SaveVariant(parentID primitive.ObjectID, size types.ImageSize, data []byte, contentType string) (primitive.ObjectID, error) {
+	bucket, err := GetBucket(IMAGES_BUCKET)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	imageID := primitive.NewObjectID()
+	opts := options.GridFSUpload().SetMetadata(imageMetadata{
+		ContentType: contentType,
+		Hash:        hashImage(data),
+		ParentID:    parentID,
+		Size:        size,
+	})
+
+	err = bucket.UploadFromStreamWithID(imageID, imageID.Hex(), bytes.NewReader(data), opts)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return imageID, nil
+}
+
+func (MongoImageStore) Get(imageID primitive.ObjectID) (types.Image, error) {
+	bucket, err := GetBucket(IMAGES_BUCKET)
+	if err != nil {
+		return types.Image{}, err
+	}
+
+	stream, err := bucket.OpenDownloadStream(imageID)
+	if err == gridfs.ErrFileNotFound {
+		return types.Image{}, ErrNotFound
+	}
+	if err != nil {
+		return types.Image{}, err
+	}
+	defer stream.Close()
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return types.Image{}, err
+	}
+
+	file := stream.GetFile()
+	var metadata imageMetadata
+	if err := bson.Unmarshal(file.Metadata, &metadata); err != nil {
+		return types.Image{}, err
+	}
+	if metadata.Size == "" {
+		metadata.Size = types.ImageOriginal
+	}
+
+	return types.Image{
+		ImageID:     imageID,
+		ParentID:    metadata.ParentID,
+		Size:        metadata.Size,
+		ContentType: metadata.ContentType,
+		Hash:        metadata.Hash,
+		Data:        data,
+		UploadedAt:  file.UploadDate,
+	}, nil
+}
+
+func (s MongoImageStore) GetVariant(parentID primitive.ObjectID, size types.ImageSize) (types.Image, error) {
+	var file gridfs.File
+	err := GetCollection(IMAGES_BUCKET+".files").FindOne(
+		context.Background(),
+		bson.M{"metadata.parent": parentID, "metadata.size": size},
+		options.FindOne().SetProjection(bson.M{"_id": 1}),
+	).Decode(&file)
+	if err != nil {
+		return types.Image{}, notFound(err)
+	}
+
+	return s.Get(file.ID.(primitive.ObjectID))
+}
+
+func (MongoImageStore) Delete(imageID primitive.ObjectID) error {
+	bucket, err := GetBucket(IMAGES_BUCKET)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := bucket.Find(bson.M{"metadata.parent": imageID})
+	if err != nil {
+		return err
+	}
+	var variants []gridfs.File
+	if err = cursor.All(context.Background(), &variants); err != nil {
+		return err
+	}
+	for _, variant := range variants {
+		if err := bucket.Delete(variant.ID); err != nil && err != gridfs.ErrFileNotFound {
+			return err
+		}
+	}
+
+	err = bucket.Delete(imageID)
+	if err == gridfs.ErrFileNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+/*----------------------------events----------------------------*/
+
+/*
+How long an applied event is remembered. Stripe stops retrying an event
+after 3 days, so anything older can't be delivered again
+*/
+const PROCESSED_EVENT_TTL = 30 * 24 * time.Hour
+
+type MongoEventStore struct{}
+
+func (MongoEventStore) IsProcessed(eventID string) (bool, error) {
+	count, err := GetCollection("processed_events").CountDocuments(context.Background(), bson.M{"_id": eventID})
+	return count > 0, err
+}
+
+// the event ID is the _id, so the unique index on _id rejects a second record
+func (MongoEventStore) Record(event types.ProcessedEvent) error {
+	_, err := GetCollection("processed_events").InsertOne(context.Background(), event)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrEventProcessed
+	}
+	return err
+}
+
+/*----------------------------ledger----------------------------*/
+
+type MongoLedgerStore struct{}
+
+// the unique index on key rejects an entry that was already posted
+func (MongoLedgerStore) Insert(entry types.JournalEntry) (primitive.ObjectID, error) {
+	entryID, err := insertOne("ledger", entry)
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, ErrEntryPosted
+	}
+	return entryID, err
+}
+
+func (MongoLedgerStore) FindByAccount(account types.LedgerAccount, after primitive.ObjectID, limit int) ([]types.JournalEntry, error) {
+	filter := bson.M{"$or": bson.A{bson.M{"from": account}, bson.M{"to": account}}}
+	if !after.IsZero() {
+		filter["_id"] = bson.M{"$lt": after}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := GetCollection("ledger").Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []types.JournalEntry
+	if err = cursor.All(context.Background(), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (MongoLedgerStore) Balance(account types.LedgerAccount) (types.Money, error) {
+	return sumEntries(account, bson.M{})
+}
+
+func (MongoLedgerStore) SumSince(account types.LedgerAccount, since time.Time, entryTypes []types.JournalEntryType) (types.Money, error) {
+	return sumEntries(account, bson.M{"postedAt": bson.M{"$gte": since}, "type": bson.M{"$in": entryTypes}})
+}
+
+/*
+Adds up the entries of <account> that also match <filter>. Returns
+types.ErrCurrencyMismatch if they're in more than one currency
+*/
+func sumEntries(account types.LedgerAccount, filter bson.M) (types.Money, error) {
+	filter["$or"] = bson.A{bson.M{"from": account}, bson.M{"to": account}}
+	cursor, err := GetCollection("ledger").Aggregate(context.Background(), bson.A{
+		bson.M{"$match": filter},
+		bson.M{"$group": bson.M{
+			"_id": "$amount.currency",
+			// what came in minus what went out
+			"amount": bson.M{"$sum": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{"$to", account}}, "$amount.amount", bson.M{"$multiply": bson.A{"$amount.amount", -1}},
+			}}},
+		}},
+	})
+	if err != nil {
+		return types.Money{}, err
+	}
+
+	var balances []struct {
+		Currency types.Currency `bson:"_id"`
+		Amount   int64          `bson:"amount"`
+	}
+	if err = cursor.All(context.Background(), &balances); err != nil {
+		return types.Money{}, err
+	}
+
+	switch len(balances) {
+	case 0:
+		return types.Money{}, nil
+	case 1:
+		return types.NewMoney(balances[0].Amount, balances[0].Currency), nil
+	default:
+		return types.Money{}, types.ErrCurrencyMismatch
+	}
+}
+
+/*-------------------------withdrawals--------------------------*/
+
+type MongoWithdrawalStore struct{}
+
+func (MongoWithdrawalStore) Insert(withdrawal types.Withdrawal) (primitive.ObjectID, error) {
+	return insertOne("withdrawals", withdrawal)
+}
+
+func (MongoWithdrawalStore) FindByID(withdrawalID primitive.ObjectID) (types.Withdrawal, error) {
+	return findOne[types.Withdrawal]("withdrawals", bson.M{"_id": withdrawalID})
+}
+
+func (MongoWithdrawalStore) FindByUser(userID primitive.ObjectID) ([]types.Withdrawal, error) {
+	return findSorted[types.Withdrawal]("withdrawals", bson.M{"userid": userID}, -1)
+}
+
+func (MongoWithdrawalStore) FindByStatus(status types.WithdrawalStatus) ([]types.Withdrawal, error) {
+	return findSorted[types.Withdrawal]("withdrawals", bson.M{"status": status}, 1)
+}
+
+func (MongoWithdrawalStore) UpdateIfStatus(withdrawalID primitive.ObjectID, status types.WithdrawalStatus, changes any) error {
+	res, err := GetCollection("withdrawals").UpdateOne(
+		context.Background(),
+		bson.M{"_id": withdrawalID, "status": status},
+		bson.M{"$set": changes},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+/*
+Creates the indexes that the stores rely on. Init must be
+called first
+*/
+func CreateIndexes() error {
+	_, err := GetCollection(IMAGES_BUCKET+".files").Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			// used to find the variants of an image
+			Keys: bson.D{{Key: "metadata.parent", Value: 1}, {Key: "metadata.size", Value: 1}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// the market hides bought listings by default, then sorts by date or by price
+	_, err = GetCollection("listings").Indexes().CreateMany(
+		context.Background(),
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "bought", Value: 1}, {Key: "_id", Value: -1}}},
+			{Keys: bson.D{{Key: "bought", Value: 1}, {Key: "cost.amount", Value: 1}, {Key: "_id", Value: 1}}},
+			// used to search, with a word in the title counting like search.TITLE_WEIGHT of them in the description
+			{
+				Keys:    bson.D{{Key: "title", Value: "text"}, {Key: "description", Value: "text"}},
+				Options: options.Index().SetName("listing_text").SetWeights(bson.M{"title": 2, "description": 1}),
+			},
+			// used to release and sell the listings of a checkout; most listings are never held
+			{Keys: bson.M{"hold.holdId": 1}, Options: options.Index().SetSparse(true)},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = GetCollection("ledger").Indexes().CreateMany(
+		context.Background(),
+		[]mongo.IndexModel{
+			{Keys: bson.M{"key": 1}, Options: options.Index().SetUnique(true)},
+			// an account's entries are read newest first
+			{Keys: bson.D{{Key: "from", Value: 1}, {Key: "_id", Value: -1}}},
+			{Keys: bson.D{{Key: "to", Value: 1}, {Key: "_id", Value: -1}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// sellers list the orders they have sub-orders in and move each sub-order by its ID, and checkouts save their receipt once
+	_, err = GetCollection("receipts").Indexes().CreateMany(
+		context.Background(),
+		[]mongo.IndexModel{
+			{Keys: bson.M{"subOrders.sellerid": 1}},
+			{Keys: bson.M{"subOrders.subOrderId": 1}},
+			// one receipt per checkout; receipts from before they saved their checkout don't have one
+			{
+				Keys: bson.M{"checkoutId": 1},
+				Options: options.Index().SetUnique(true).SetPartialFilterExpression(
+					bson.M{"checkoutId": bson.M{"$exists": true}},
+				),
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// sellers list their own withdrawals, and admins list the ones waiting on them
+	_, err = GetCollection("withdrawals").Indexes().CreateMany(
+		context.Background(),
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "_id", Value: -1}}},
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = GetCollection("processed_events").Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			Keys:    bson.M{"processedAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(PROCESSED_EVENT_TTL.Seconds())),
+		},
+	)
+	return err
+}
@@ -0,0 +1,320 @@
+package db
+
+import (
+	"backend/types"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Returned by every store when the requested document does not exist,
+so handlers don't need to know which backend they are talking to
+*/
+var ErrNotFound = errors.New("document not found")
+
+// Returned by ListingStore.Hold when a listing has been bought or is held by another checkout
+var ErrListingUnavailable = errors.New("listing is bought or held")
+
+/*
+How many keys of the changes to a user's balance are kept on the user, so
+those changes aren't added again. A change is retried within moments of
+failing, long before that many others are added to the same balance
+*/
+const BALANCE_KEYS_KEPT = 1000
+
+// Returned by EventStore.Record when the event has already been recorded
+var ErrEventProcessed = errors.New("event already processed")
+
+// Returned by LedgerStore.Insert when an entry with the same key has already been posted
+var ErrEntryPosted = errors.New("journal entry already posted")
+
+/*
+Repository for the "users" collection
+*/
+type UserStore interface {
+	FindByID(userID primitive.ObjectID) (types.User, error)
+	FindByUsername(username string) (types.User, error)
+	FindByEmail(email string) (types.User, error)
+
+	// Returns true if no user has <val> stored under the bson field <fieldName>
+	IsFieldUnique(fieldName, val string) bool
+
+	Insert(user types.User) (primitive.ObjectID, error)
+
+	/*
+		Applies <changes> to the user with $set semantics, so <changes> can be
+		any struct or map that marshals into bson. Returns ErrNotFound if no
+		user has the provided userID
+	*/
+	Update(userID primitive.ObjectID, changes any) error
+
+	/*
+		Adds <amount> to the user's balance, or takes it away if it's negative,
+		in one operation, so balances changed at the same time both count. The
+		change is recorded under <key> in the same operation, and adding with a
+		key that's one of the last BALANCE_KEYS_KEPT does nothing, so a change
+		that's retried, or made by two requests at once, only counts once.
+		Returns ErrNotFound if no user has the provided userID, or their balance
+		is in another currency
+	*/
+	AddToBalance(userID primitive.ObjectID, amount types.Money, key string) error
+
+	/*
+		Takes <amount> out of the user's balance only if at least <keep> is left
+		in it afterwards, checking and updating in one operation, so withdrawals
+		requested at the same time can't overdraw it. Returns ErrNotFound if no
+		user has the provided userID, their balance is in another currency, or
+		it's too low
+	*/
+	TakeFromBalance(userID primitive.ObjectID, amount, keep types.Money) error
+
+	/*
+		Saves <step> as the period of the last TOTP code the user logged in with,
+		only if it's later than the saved one, checking and updating in one
+		operation, so a code can't be used by two logins at the same time.
+		Returns ErrNotFound otherwise
+	*/
+	UseTOTPStep(userID primitive.ObjectID, step int64) error
+
+	/*
+		Removes <hashed> from the user's recovery codes only if it's still one
+		of them, checking and updating in one operation, so each recovery code
+		is only used once. Returns ErrNotFound otherwise
+	*/
+	UseRecoveryCode(userID primitive.ObjectID, hashed string) error
+
+	GetSubscribers() ([]types.User, error)
+}
+
+/*
+Repository for the "listings" collection
+*/
+type ListingStore interface {
+	FindByID(listingID primitive.ObjectID) (types.FurnitureListing, error)
+	FindByIDs(listingIDs []primitive.ObjectID) ([]types.FurnitureListing, error)
+	FindByUser(userID primitive.ObjectID) ([]types.FurnitureListing, error)
+	FindAll() ([]types.FurnitureListing, error)
+
+	// Returns the listings that match <query>, in its sort order
+	Query(query ListingQuery) ([]types.FurnitureListing, error)
+
+	/*
+		Returns up to <limit> of the listings that match <query>'s filters and
+		have any of <words> in their title or description, the most relevant
+		first by the store's own text search. <query>'s sort and page are ignored
+	*/
+	Search(query ListingQuery, words []string, limit int) ([]types.FurnitureListing, error)
+
+	// Counts the listings that match <query> by each of its filters, ignoring its sort and page
+	Facets(query ListingQuery) (ListingFacets, error)
+
+	FindMostRecent() (types.FurnitureListing, error)
+	Insert(listing types.FurnitureListing) (primitive.ObjectID, error)
+
+	// Same $set semantics as UserStore.Update
+	Update(listingID primitive.ObjectID, changes any) error
+
+	/*
+		Applies <changes> only if the listing belongs to <userID>, hasn't been bought
+		and isn't held by a checkout, checking and updating in one operation.
+		Returns ErrNotFound otherwise
+	*/
+	UpdateUnsold(listingID, userID primitive.ObjectID, changes any) error
+
+	// Deletes the listing under the same conditions as UpdateUnsold
+	DeleteUnsold(listingID, userID primitive.ObjectID) error
+
+	/*
+		Holds every listing in <listingIDs> with <hold>, as long as none of them have
+		been bought or are held by another hold that hasn't expired at <now>. Either
+		every listing is held or none are, and ErrListingUnavailable is returned
+		if any of them can't be. A listing that doesn't exist can't be held either
+	*/
+	Hold(listingIDs []primitive.ObjectID, hold types.ListingHold, now time.Time) error
+
+	// Releases every listing held by <userID>'s hold with <holdID>, and returns how many were released
+	ReleaseHold(holdID string, userID primitive.ObjectID) (int, error)
+
+	/*
+		Marks the listing as bought with <holdID> and releases its hold, only if
+		it's held by the hold with <holdID>, even an expired one, and hasn't been
+		bought. A listing that was already bought with <holdID> counts as sold
+		again, so an event that failed part way can be applied again. Returns
+		ErrNotFound otherwise, so a listing is only sold to one checkout
+	*/
+	SellHeld(listingID primitive.ObjectID, holdID string) error
+}
+
+/*
+Repository for the "receipts" collection
+*/
+type ReceiptStore interface {
+	// Returns the receipt only if it belongs to the buyer with <userID>
+	FindByID(orderID, userID primitive.ObjectID) (types.Receipt, error)
+	FindByUser(userID primitive.ObjectID) ([]types.Receipt, error)
+	Insert(receipt types.Receipt) (primitive.ObjectID, error)
+
+	/*
+		Inserts the receipt unless one with the same CheckoutID was already
+		inserted, checking and inserting in one operation, so a checkout only
+		ever has one receipt however many times its event is applied
+	*/
+	InsertForCheckout(receipt types.Receipt) error
+
+	// Returns the receipt that has the sub-order with <subOrderID>, only if it was sold by <sellerID>
+	FindSale(subOrderID, sellerID primitive.ObjectID) (types.Receipt, error)
+
+	// Returns the receipts of every order that the seller with <sellerID> has a sub-order in
+	FindBySeller(sellerID primitive.ObjectID) ([]types.Receipt, error)
+
+	/*
+		Moves the sub-order to <change.Status>, appends <change> to its history
+		and applies <changes> to it with $set semantics, only if its status is
+		<from> and it was sold by <sellerID>, checking and updating in one
+		operation, so it only moves out of a status once. Returns ErrNotFound
+		otherwise
+	*/
+	UpdateStatus(subOrderID, sellerID primitive.ObjectID, from types.OrderStatus, change types.OrderStatusChange, changes any) error
+}
+
+/*
+Repository for the "shippingAddresses" collection
+*/
+type AddressStore interface {
+	FindByUser(userID primitive.ObjectID) ([]types.ShippingAddress, error)
+	Insert(address types.ShippingAddress) (primitive.ObjectID, error)
+
+	// Same $set semantics as UserStore.Update
+	Update(addressID primitive.ObjectID, changes any) error
+
+	// Deletes the address only if it belongs to the user with <userID>
+	Delete(addressID, userID primitive.ObjectID) error
+
+	// Unsets the default flag on the user's current default address, if any
+	ClearDefault(userID primitive.ObjectID) error
+}
+
+/*
+Repository for the "passwordResets" collection
+*/
+type PasswordResetStore interface {
+	Insert(reset types.PasswordReset) (primitive.ObjectID, error)
+
+	/*
+		Finds the reset with <tokenHash> that hasn't expired at <now> and deletes it
+		in the same operation, so a token can only ever be used once. Returns
+		ErrNotFound if there is no such reset
+	*/
+	Consume(tokenHash string, now time.Time) (types.PasswordReset, error)
+
+	// Deletes every reset requested for the user with <userID>
+	DeleteByUser(userID primitive.ObjectID) error
+}
+
+/*
+Where listing images are kept, apart from the listings themselves
+*/
+type ImageStore interface {
+	Save(data []byte, contentType string) (primitive.ObjectID, error)
+
+	// Saves the <size> variant of the image with <parentID>
+	SaveVariant(parentID primitive.ObjectID, size types.ImageSize, data []byte, contentType string) (primitive.ObjectID, error)
+
+	// Returns ErrNotFound if there is no image with <imageID>
+	Get(imageID primitive.ObjectID) (types.Image, error)
+
+	// Returns ErrNotFound if the image with <parentID> has no <size> variant
+	GetVariant(parentID primitive.ObjectID, size types.ImageSize) (types.Image, error)
+
+	// Deletes the image with <imageID> along with its variants
+	Delete(imageID primitive.ObjectID) error
+}
+
+// Returns the hex sha256 of an image, which is saved with it to use as its ETag
+func hashImage(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+Repository for the "processed_events" collection, which records the
+webhook events that have been applied so each one is only applied once
+*/
+type EventStore interface {
+	// Returns true if the event with <eventID> was recorded as applied
+	IsProcessed(eventID string) (bool, error)
+
+	/*
+		Records that <event> was applied, so deliveries of it after that are
+		skipped. Returns ErrEventProcessed if an event with the same EventID was
+		already recorded, checking and recording in one operation
+	*/
+	Record(event types.ProcessedEvent) error
+}
+
+/*
+Repository for the "ledger" collection, the append-only journal of every
+movement of money between the buyers, sellers and the platform
+*/
+type LedgerStore interface {
+	/*
+		Appends <entry> to the journal. Returns ErrEntryPosted if an entry with
+		the same Key was already posted, checking and appending in one operation
+	*/
+	Insert(entry types.JournalEntry) (primitive.ObjectID, error)
+
+	/*
+		Returns up to <limit> of the entries that moved money into or out of
+		<account>, newest first, starting after the entry with <after>, or
+		from the newest if <after> is the zero value
+	*/
+	FindByAccount(account types.LedgerAccount, after primitive.ObjectID, limit int) ([]types.JournalEntry, error)
+
+	// Adds up every entry of <account>, which is what it holds
+	Balance(account types.LedgerAccount) (types.Money, error)
+
+	// Adds up the entries of <account> of one of <entryTypes> that were posted at or after <since>
+	SumSince(account types.LedgerAccount, since time.Time, entryTypes []types.JournalEntryType) (types.Money, error)
+}
+
+/*
+Repository for the "withdrawals" collection
+*/
+type WithdrawalStore interface {
+	Insert(withdrawal types.Withdrawal) (primitive.ObjectID, error)
+	FindByID(withdrawalID primitive.ObjectID) (types.Withdrawal, error)
+
+	// Returns the withdrawals of the user with <userID>, newest first
+	FindByUser(userID primitive.ObjectID) ([]types.Withdrawal, error)
+
+	// Returns the withdrawals with <status>, oldest first
+	FindByStatus(status types.WithdrawalStatus) ([]types.Withdrawal, error)
+
+	/*
+		Applies <changes> with $set semantics only if the withdrawal's status is
+		<status>, checking and updating in one operation, so it only moves out of
+		a status once. Returns ErrNotFound otherwise
+	*/
+	UpdateIfStatus(withdrawalID primitive.ObjectID, status types.WithdrawalStatus, changes any) error
+}
+
+/*
+The set of repositories the server is constructed with. Use
+NewMongoStore for the real database and NewMemoryStore for tests
+*/
+type Store struct {
+	Users     UserStore
+	Listings  ListingStore
+	Receipts  ReceiptStore
+	Addresses AddressStore
+
+	PasswordResets PasswordResetStore
+	Images         ImageStore
+	Events         EventStore
+	Ledger         LedgerStore
+	Withdrawals    WithdrawalStore
+}
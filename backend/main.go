@@ -3,11 +3,60 @@ package main
 import (
 	"backend/api"
 	"backend/db"
+	"log"
 )
 
 // entry point
 func main() {
 	db.Init()
-	server := api.NewServer(":3000")
+
+	if err := db.CreateIndexes(); err != nil {
+		log.Fatal("Failed to create indexes: ", err)
+	}
+
+	// listings saved before images had their own store still embed them
+	migrated, err := db.MigrateListingImages(db.MongoImageStore{})
+	if err != nil {
+		log.Fatal("Failed to migrate listing images: ", err)
+	}
+	if migrated > 0 {
+		log.Printf("Moved the images of %d listings into the image store\n", migrated)
+	}
+
+	// prices, totals and balances used to be saved as floats of dollars
+	migrated, err = db.MigrateMoney()
+	if err != nil {
+		log.Fatal("Failed to migrate money amounts: ", err)
+	}
+	if migrated > 0 {
+		log.Printf("Converted the money amounts of %d documents into cents\n", migrated)
+	}
+
+	// balances from before the ledger was kept are posted as where each seller's entries start
+	migrated, err = db.MigrateOpeningBalances(db.MongoLedgerStore{})
+	if err != nil {
+		log.Fatal("Failed to post opening balances: ", err)
+	}
+	if migrated > 0 {
+		log.Printf("Posted the opening balances of %d sellers to the ledger\n", migrated)
+	}
+
+	// receipts saved before orders were split hold every seller's items together
+	migrated, err = db.MigrateSubOrders()
+	if err != nil {
+		log.Fatal("Failed to split orders into sub-orders: ", err)
+	}
+	if migrated > 0 {
+		log.Printf("Split %d orders into sub-orders\n", migrated)
+	}
+
+	// keep sessions in the database so they survive restarts
+	sessionStore, err := api.NewMongoSessionStore(db.GetCollection("sessions"))
+	if err != nil {
+		log.Fatal("Failed to create session store: ", err)
+	}
+	api.GetSessionManager().SetStore(sessionStore)
+
+	server := api.NewServer(":3000", db.NewMongoStore())
 	server.Start()
 }
@@ -0,0 +1,137 @@
+package search
+
+import (
+	"math"
+	"sort"
+)
+
+/*
+Parameters of the BM25 ranking function. K1 is how quickly repeating a
+word stops adding to the score, and B is how much a long text is scored
+down for having more chances to contain a word
+*/
+const (
+	BM25_K1 = 1.2
+	BM25_B  = 0.75
+
+	// a word in the title counts this many times as much as one in the description
+	TITLE_WEIGHT = 2.0
+)
+
+// A listing to search, by the text that's searched
+type Document struct {
+	Title       string
+	Description string
+}
+
+// A Document that matched a search
+type Result struct {
+	Index   int     // position of the document in the slice given to Rank
+	Score   float64 // BM25 relevance; only comparable between results of the same search
+	Title   string  // the title, HTML escaped, with the matching words wrapped in <mark>
+	Snippet string  // the best part of the description, highlighted the same way
+}
+
+// a Document split into tokens
+type indexedDocument struct {
+	title       []token
+	description []token
+}
+
+/*
+Scores each of <docs> against <query> with BM25F, which is BM25 with
+each field weighted on its own, and returns the ones that match any word
+of the query, most relevant first.
+
+Words are compared by their stems, and names from SYNONYMS match each
+other. Document frequencies are counted over <docs>, so a word that's in
+every document scores less than one that's only in a few
+*/
+func Rank(query string, docs []Document) []Result {
+	queryTerms := uniqueTerms(withSynonyms(tokenize(query)))
+	if len(queryTerms) == 0 || len(docs) == 0 {
+		return []Result{}
+	}
+
+	indexed := make([]indexedDocument, len(docs))
+	var titleLength, descriptionLength float64
+	documentFrequency := map[string]int{}
+	for i, doc := range docs {
+		indexed[i] = indexedDocument{
+			title:       withSynonyms(tokenize(doc.Title)),
+			description: withSynonyms(tokenize(doc.Description)),
+		}
+		titleLength += float64(len(indexed[i].title))
+		descriptionLength += float64(len(indexed[i].description))
+
+		seen := map[string]bool{}
+		for _, t := range append(indexed[i].title, indexed[i].description...) {
+			if queryTerms[t.term] && !seen[t.term] {
+				seen[t.term] = true
+				documentFrequency[t.term]++
+			}
+		}
+	}
+	averageTitleLength := math.Max(titleLength/float64(len(docs)), 1)
+	averageDescriptionLength := math.Max(descriptionLength/float64(len(docs)), 1)
+
+	n := float64(len(docs))
+	results := []Result{}
+	for i, doc := range indexed {
+		titleFrequency := termFrequencies(doc.title, queryTerms)
+		descriptionFrequency := termFrequencies(doc.description, queryTerms)
+
+		score := 0.0
+		for term := range queryTerms {
+			df := float64(documentFrequency[term])
+			if df == 0 {
+				continue
+			}
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+			// each field's frequency is normalized by its own length before they're added up
+			tf := TITLE_WEIGHT*titleFrequency[term]/normalizedLength(len(doc.title), averageTitleLength) +
+				descriptionFrequency[term]/normalizedLength(len(doc.description), averageDescriptionLength)
+			score += idf * tf / (BM25_K1 + tf)
+		}
+		if score == 0 {
+			continue
+		}
+
+		results = append(results, Result{
+			Index:   i,
+			Score:   score,
+			Title:   highlight(docs[i].Title, matchingSpans(doc.title, queryTerms), 0, len(docs[i].Title)),
+			Snippet: snippet(docs[i].Description, matchingSpans(doc.description, queryTerms)),
+		})
+	}
+
+	// ties keep the order of <docs>
+	sort.SliceStable(results, func(a, b int) bool {
+		return results[a].Score > results[b].Score
+	})
+	return results
+}
+
+func uniqueTerms(tokens []token) map[string]bool {
+	unique := make(map[string]bool, len(tokens))
+	for _, t := range tokens {
+		unique[t.term] = true
+	}
+	return unique
+}
+
+// Returns how many times each of <queryTerms> is in <tokens>
+func termFrequencies(tokens []token, queryTerms map[string]bool) map[string]float64 {
+	frequencies := map[string]float64{}
+	for _, t := range tokens {
+		if queryTerms[t.term] {
+			frequencies[t.term]++
+		}
+	}
+	return frequencies
+}
+
+func normalizedLength(length int, averageLength float64) float64 {
+	return 1 - BM25_B + BM25_B*float64(length)/averageLength
+}
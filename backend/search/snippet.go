@@ -0,0 +1,130 @@
+package search
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// the most characters of a description that a snippet shows
+const SNIPPET_LENGTH = 160
+
+// a range of bytes of a text to highlight
+type span struct {
+	start int
+	end   int
+}
+
+/*
+Returns where <tokens> match any of <queryTerms>, in order, with
+overlapping matches merged, like a synonym and the words it covers
+*/
+func matchingSpans(tokens []token, queryTerms map[string]bool) []span {
+	var spans []span
+	for _, t := range tokens {
+		if queryTerms[t.term] {
+			spans = append(spans, span{start: t.start, end: t.end})
+		}
+	}
+	sort.Slice(spans, func(a, b int) bool { return spans[a].start < spans[b].start })
+
+	var merged []span
+	for _, s := range spans {
+		if last := len(merged) - 1; last >= 0 && s.start <= merged[last].end {
+			merged[last].end = max(merged[last].end, s.end)
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+/*
+Returns text[from:to] HTML escaped, with each of <spans> inside it
+wrapped in <mark>, so the result is safe to render as HTML
+*/
+func highlight(text string, spans []span, from, to int) string {
+	var b strings.Builder
+	at := from
+	for _, s := range spans {
+		if s.start < from || s.end > to {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[at:s.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[s.start:s.end]))
+		b.WriteString("</mark>")
+		at = s.end
+	}
+	b.WriteString(html.EscapeString(text[at:to]))
+	return b.String()
+}
+
+/*
+Returns up to SNIPPET_LENGTH characters of <text> around the part with the
+most matches, highlighted. An ellipsis marks where the text was cut
+*/
+func snippet(text string, spans []span) string {
+	if len(text) <= SNIPPET_LENGTH {
+		return highlight(text, spans, 0, len(text))
+	}
+
+	// start a little before the first match of the window with the most matches
+	from := 0
+	best := 0
+	for i, s := range spans {
+		count := 0
+		for _, other := range spans[i:] {
+			if other.end-s.start > SNIPPET_LENGTH {
+				break
+			}
+			count++
+		}
+		if count > best {
+			best = count
+			from = max(0, s.start-SNIPPET_LENGTH/5)
+		}
+	}
+	from = min(from, len(text)-SNIPPET_LENGTH)
+	to := from + SNIPPET_LENGTH
+
+	// don't cut words in half
+	from = wordStart(text, from)
+	to = wordEnd(text, to)
+
+	snippet := highlight(text, spans, from, to)
+	if from > 0 {
+		snippet = "…" + strings.TrimLeftFunc(snippet, unicode.IsSpace)
+	}
+	if to < len(text) {
+		snippet = strings.TrimRightFunc(snippet, unicode.IsSpace) + "…"
+	}
+	return snippet
+}
+
+// Moves <i> forward to the start of the next word, unless it's already at the start of one
+func wordStart(text string, i int) int {
+	if i == 0 || isSpace(text[i-1]) {
+		return i
+	}
+	for i < len(text) && !isSpace(text[i]) {
+		i++
+	}
+	return i
+}
+
+// Moves <i> back to the end of the previous word, unless it's already at the end of one
+func wordEnd(text string, i int) int {
+	if i >= len(text) || isSpace(text[i]) {
+		return min(i, len(text))
+	}
+	for i > 0 && !isSpace(text[i-1]) {
+		i--
+	}
+	return i
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\t' || b == '\r'
+}
@@ -0,0 +1,254 @@
+package search
+
+/*
+Reduces an English word to its stem with the Porter stemming algorithm,
+so "tables", "tabled" and "table" all become "tabl". <word> must be in
+lower case. Words of two letters or fewer, and words with anything but
+the letters a to z, are returned as they are
+
+See https://tartarus.org/martin/PorterStemmer/def.txt
+*/
+func Stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	s := stemmer{b: []byte(word)}
+	s.step1a()
+	s.step1b()
+	s.step1c()
+	s.step2()
+	s.step3()
+	s.step4()
+	s.step5()
+	return string(s.b)
+}
+
+type stemmer struct {
+	b []byte
+}
+
+// Returns true if the letter at <i> is a consonant. Y is a consonant unless it follows one
+func (s *stemmer) isConsonant(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !s.isConsonant(i-1)
+	}
+	return true
+}
+
+/*
+Returns the number of vowel-consonant sequences in the first <n> letters,
+which the algorithm calls m. Any word is [C](VC){m}[V]
+*/
+func (s *stemmer) measure(n int) int {
+	m := 0
+	i := 0
+	for i < n && s.isConsonant(i) {
+		i++
+	}
+	for i < n {
+		for i < n && !s.isConsonant(i) {
+			i++
+		}
+		if i >= n {
+			break
+		}
+		for i < n && s.isConsonant(i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+// Returns true if the first <n> letters contain a vowel
+func (s *stemmer) hasVowel(n int) bool {
+	for i := 0; i < n; i++ {
+		if !s.isConsonant(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the first <n> letters end with a double consonant, like "tt"
+func (s *stemmer) endsDoubleConsonant(n int) bool {
+	return n >= 2 && s.b[n-1] == s.b[n-2] && s.isConsonant(n-1)
+}
+
+/*
+Returns true if the first <n> letters end consonant-vowel-consonant, where
+the last consonant isn't w, x or y, like "hop" but not "snow"
+*/
+func (s *stemmer) endsCVC(n int) bool {
+	if n < 3 || !s.isConsonant(n-1) || s.isConsonant(n-2) || !s.isConsonant(n-3) {
+		return false
+	}
+	last := s.b[n-1]
+	return last != 'w' && last != 'x' && last != 'y'
+}
+
+func (s *stemmer) hasSuffix(suffix string) bool {
+	return len(s.b) >= len(suffix) && string(s.b[len(s.b)-len(suffix):]) == suffix
+}
+
+// Replaces <suffix>, which the word must end with, by <replacement>
+func (s *stemmer) replace(suffix, replacement string) {
+	s.b = append(s.b[:len(s.b)-len(suffix)], replacement...)
+}
+
+type rule struct {
+	suffix      string
+	replacement string
+}
+
+/*
+Finds the longest of <rules> that the word ends with and applies it if
+the stem left before the suffix has a measure greater than <minMeasure>.
+Once a suffix matches, no shorter one is tried, even if it isn't applied
+*/
+func (s *stemmer) applyLongest(rules []rule, minMeasure int) {
+	for _, r := range rules {
+		if s.hasSuffix(r.suffix) {
+			if s.measure(len(s.b)-len(r.suffix)) > minMeasure {
+				s.replace(r.suffix, r.replacement)
+			}
+			return
+		}
+	}
+}
+
+// plurals
+func (s *stemmer) step1a() {
+	switch {
+	case s.hasSuffix("sses"):
+		s.replace("sses", "ss")
+	case s.hasSuffix("ies"):
+		s.replace("ies", "i")
+	case s.hasSuffix("ss"):
+	case s.hasSuffix("s"):
+		s.replace("s", "")
+	}
+}
+
+// past participles and -ing
+func (s *stemmer) step1b() {
+	if s.hasSuffix("eed") {
+		if s.measure(len(s.b)-3) > 0 {
+			s.replace("eed", "ee")
+		}
+		return
+	}
+
+	removed := false
+	for _, suffix := range []string{"ed", "ing"} {
+		if s.hasSuffix(suffix) && s.hasVowel(len(s.b)-len(suffix)) {
+			s.replace(suffix, "")
+			removed = true
+			break
+		}
+	}
+	if !removed {
+		return
+	}
+
+	n := len(s.b)
+	switch {
+	case s.hasSuffix("at"), s.hasSuffix("bl"), s.hasSuffix("iz"):
+		s.b = append(s.b, 'e')
+	case s.endsDoubleConsonant(n) && s.b[n-1] != 'l' && s.b[n-1] != 's' && s.b[n-1] != 'z':
+		s.b = s.b[:n-1]
+	case s.measure(n) == 1 && s.endsCVC(n):
+		s.b = append(s.b, 'e')
+	}
+}
+
+func (s *stemmer) step1c() {
+	if s.hasSuffix("y") && s.hasVowel(len(s.b)-1) {
+		s.replace("y", "i")
+	}
+}
+
+// longest suffixes first, so applyLongest finds the longest match
+var step2Rules = []rule{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	{"logi", "log"},
+}
+
+var step3Rules = []rule{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+var step4Rules = []rule{
+	{"al", ""}, {"ance", ""}, {"ence", ""}, {"er", ""}, {"ic", ""},
+	{"able", ""}, {"ible", ""}, {"ant", ""}, {"ement", ""}, {"ment", ""},
+	{"ent", ""}, {"ou", ""}, {"ism", ""}, {"ate", ""}, {"iti", ""},
+	{"ous", ""}, {"ive", ""}, {"ize", ""},
+}
+
+func init() {
+	for _, rules := range [][]rule{step2Rules, step3Rules, step4Rules} {
+		sortLongestFirst(rules)
+	}
+}
+
+// orders <rules> by suffix length, longest first, keeping the order of equal lengths
+func sortLongestFirst(rules []rule) {
+	for i := 1; i < len(rules); i++ {
+		for j := i; j > 0 && len(rules[j].suffix) > len(rules[j-1].suffix); j-- {
+			rules[j], rules[j-1] = rules[j-1], rules[j]
+		}
+	}
+}
+
+// double suffixes, like -ization into -ize
+func (s *stemmer) step2() {
+	s.applyLongest(step2Rules, 0)
+}
+
+// -ic-, -full, -ness and the like
+func (s *stemmer) step3() {
+	s.applyLongest(step3Rules, 0)
+}
+
+// removes -ant, -ence and the like from longer stems
+func (s *stemmer) step4() {
+	// -ion only counts as a suffix after s or t, as in "adoption"
+	if s.hasSuffix("ion") {
+		n := len(s.b) - 3
+		if n > 0 && (s.b[n-1] == 's' || s.b[n-1] == 't') && s.measure(n) > 1 {
+			s.b = s.b[:n]
+		}
+		return
+	}
+	s.applyLongest(step4Rules, 1)
+}
+
+// a final -e, and -ll into -l
+func (s *stemmer) step5() {
+	if s.hasSuffix("e") {
+		n := len(s.b) - 1
+		m := s.measure(n)
+		if m > 1 || (m == 1 && !s.endsCVC(n)) {
+			s.b = s.b[:n]
+		}
+	}
+
+	n := len(s.b)
+	if s.hasSuffix("ll") && s.measure(n) > 1 {
+		s.b = s.b[:n-1]
+	}
+}
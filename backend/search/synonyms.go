@@ -0,0 +1,118 @@
+package search
+
+import "strings"
+
+/*
+Names that antique dealers and buyers use for the same piece of furniture
+or wood. Searching for any name in a group finds listings that use any
+of the others
+*/
+var SYNONYMS = [][]string{
+	{"nightstand", "night stand", "bedside table", "night table", "bedside cabinet"},
+	{"highboy", "high chest", "tallboy", "high chest of drawers"},
+	{"lowboy", "dressing table"},
+	{"dresser", "chest of drawers", "bureau", "commode"},
+	{"armoire", "wardrobe", "clothes press", "kas"},
+	{"sideboard", "buffet", "credenza", "server"},
+	{"secretary", "secretary desk", "secretaire", "escritoire", "fall front desk"},
+	{"settee", "loveseat", "love seat", "canape"},
+	{"sofa", "couch", "davenport", "chesterfield"},
+	{"china cabinet", "hutch", "breakfront", "vitrine", "display cabinet"},
+	{"blanket chest", "hope chest", "trunk", "coffer"},
+	{"rocking chair", "rocker"},
+	{"four poster", "four poster bed", "tester bed", "canopy bed"},
+	{"ottoman", "footstool", "foot stool", "tabouret"},
+	{"tiger maple", "curly maple", "flame maple", "fiddleback maple"},
+	{"drop leaf table", "gateleg table", "gate leg table", "pembroke table"},
+}
+
+// one of the names in a SYNONYMS group, as stemmed terms
+type synonymPhrase struct {
+	terms []string
+	group string // the term added for every name in the group
+}
+
+// phrases keyed by their first term, so only the phrases that can start at a token are checked
+var synonymPhrases = map[string][]synonymPhrase{}
+
+// the words of every name in a group, in lower case, keyed by the group's term
+var synonymWords = map[string][]string{}
+
+func init() {
+	for _, group := range SYNONYMS {
+		// "~" can't be part of a token, so group terms never collide with words
+		groupTerm := "~" + strings.Join(terms(tokenize(group[0])), "_")
+		for _, name := range group {
+			synonymWords[groupTerm] = append(synonymWords[groupTerm], strings.Fields(name)...)
+			phraseTerms := terms(tokenize(name))
+			first := phraseTerms[0]
+			synonymPhrases[first] = append(synonymPhrases[first], synonymPhrase{
+				terms: phraseTerms,
+				group: groupTerm,
+			})
+		}
+	}
+}
+
+/*
+Returns <tokens> with a group term added for each name from SYNONYMS that
+they contain, covering all of the name's words. The words themselves are
+kept, so "bedside table" still matches a search for "table"
+*/
+func withSynonyms(tokens []token) []token {
+	expanded := append([]token{}, tokens...)
+	for i, t := range tokens {
+		// "four poster" and "four poster bed" both start here, but the group should only be added once
+		added := map[string]bool{}
+		for _, phrase := range synonymPhrases[t.term] {
+			end := i + len(phrase.terms)
+			if end > len(tokens) || added[phrase.group] || !matchesTerms(tokens[i:end], phrase.terms) {
+				continue
+			}
+			added[phrase.group] = true
+			expanded = append(expanded, token{
+				term:  phrase.group,
+				start: t.start,
+				end:   tokens[end-1].end,
+			})
+		}
+	}
+	return expanded
+}
+
+func matchesTerms(tokens []token, terms []string) bool {
+	for i, t := range tokens {
+		if t.term != terms[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Returns the words of <query> in lower case, and the words of every name
+from SYNONYMS that it has a name of, so a database's own text search can
+find the documents Rank could match. Stop words are left out
+*/
+func Words(query string) []string {
+	tokens := tokenize(query)
+
+	seen := map[string]bool{}
+	words := []string{}
+	add := func(word string) {
+		if !seen[word] && !stopWords[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	for _, t := range tokens {
+		add(strings.ToLower(query[t.start:t.end]))
+	}
+	// withSynonyms adds the group terms after the tokens themselves
+	for _, t := range withSynonyms(tokens)[len(tokens):] {
+		for _, word := range synonymWords[t.term] {
+			add(word)
+		}
+	}
+	return words
+}
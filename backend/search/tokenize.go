@@ -0,0 +1,54 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// A word of a text, stemmed, with where it is in the text
+type token struct {
+	term  string
+	start int // byte offset of the first letter
+	end   int // byte offset just past the last letter
+}
+
+// words too common to say anything about a listing
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "from": true, "has": true,
+	"have": true, "in": true, "is": true, "it": true, "its": true, "of": true,
+	"on": true, "or": true, "s": true, "that": true, "the": true, "this": true,
+	"to": true, "was": true, "with": true,
+}
+
+/*
+Splits <text> into its words, which are runs of letters and digits, and
+returns each one in lower case and stemmed. Stop words are left out
+*/
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text + " " {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordRune && start == -1 {
+			start = i
+		}
+		if !isWordRune && start != -1 {
+			word := strings.ToLower(text[start:i])
+			if !stopWords[word] {
+				tokens = append(tokens, token{term: Stem(word), start: start, end: i})
+			}
+			start = -1
+		}
+	}
+	return tokens
+}
+
+// Returns the terms of <tokens>, in the same order
+func terms(tokens []token) []string {
+	terms := make([]string, len(tokens))
+	for i, t := range tokens {
+		terms[i] = t.term
+	}
+	return terms
+}
@@ -13,18 +13,20 @@ import (
 
 	// "backend/util"
 	"bytes"
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/stripe/stripe-go/v76/webhook"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func trimSpaceAndNewline(s string) string {
@@ -32,9 +34,7 @@ func trimSpaceAndNewline(s string) string {
 }
 
 func TestHandleSignup(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	server := api.NewServer(":3000")
+	server := newTestServer(t)
 	server.Use("POST /signup", server.HandleSignup)
 
 	tests := []struct {
@@ -44,13 +44,13 @@ func TestHandleSignup(t *testing.T) {
 		expectedResMsg     string
 		expectedStatusCode int
 	}{
-		// { // test valid signup; if this test fails, it's bc the payload is already in the db; use different data
-		// 	name:               "Test 1",
-		// 	method:             "POST",
-		// 	payload:            `{"username": "testuser1", "password": "testpassword1", "confirm": "testpassword1", "email": "test@gmail.com"}`,
-		// 	expectedResMsg:     "success",
-		// 	expectedStatusCode: http.StatusOK,
-		// },
+		{ // test valid signup
+			name:               "Test 1",
+			method:             "POST",
+			payload:            `{"username": "newuser1", "password": "testpassword1", "confirm": "testpassword1", "email": "newuser1@gmail.com"}`,
+			expectedResMsg:     "success",
+			expectedStatusCode: http.StatusOK,
+		},
 		{ // test invalid method
 			name:               "Test 2",
 			method:             "GET",
@@ -117,16 +117,10 @@ func TestHandleSignup(t *testing.T) {
 }
 
 /*
-When running this test, make sure to run
-TestHandleSignup so that the mock data gets added.
-This test uses the the mock data from that test
-
-If you don't this test will not work properly
+This test logs in as testuser1, which is seeded into the test store
 */
 func TestHandleLogin(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	server := api.NewServer(":3000")
+	server := newTestServer(t)
 	server.Use("POST /login", server.HandleLogin)
 
 	tests := []struct {
@@ -136,7 +130,7 @@ func TestHandleLogin(t *testing.T) {
 		expectedResMsg     string
 		expectedStatusCode int
 	}{
-		{ // test valid login (TestHandleSignup should be ran first to test this first case)
+		{ // test valid login
 			name:               "Test 1",
 			method:             "POST",
 			payload:            `{"username": "testuser1", "password": "testpassword1"}`,
@@ -242,7 +236,7 @@ func TestHandleLogout(t *testing.T) {
 		},
 	}
 
-	server := api.NewServer(":3000")
+	server := newTestServer(t)
 	server.Use("POST /logout", server.HandleLogout, api.AuthMiddleware)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -277,14 +271,9 @@ func TestHandleLogout(t *testing.T) {
 /*
 This test is to see if the server is setting the cookie
 for the session in the response header when logging in
-
-This test should be run after TestHandleSignup is called, to ensure
-the tested user is added first
 */
 func TestLoginCookie(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	server := api.NewServer(":3000")
+	server := newTestServer(t)
 	server.Use("POST /login", server.HandleLogin)
 
 	payload := `{"username": "testuser1", "password": "testpassword1"}`
@@ -327,7 +316,7 @@ func TestHandleListFurniture(t *testing.T) {
 		Title:       "Oak nightstand double drawers",
 		Description: "Fit all your personal belongings",
 		Type:        types.Nightstand,
-		Cost:        1000,
+		Cost:        types.Cents(100000),
 		Style:       types.Federal,
 		Condition:   types.Good,
 		Material:    types.Oak,
@@ -374,7 +363,7 @@ func TestHandleListFurniture(t *testing.T) {
 		Title:       "Cherry Farm Table Sheraton Style",
 		Description: "Selling my lovely Cherry Farm Table",
 		Type:        types.Table,
-		Cost:        2700,
+		Cost:        types.Cents(270000),
 		Style:       types.Sheraton,
 		Condition:   "Great",
 		Material:    types.Cherry,
@@ -412,24 +401,7 @@ func TestHandleListFurniture(t *testing.T) {
 
 	/*-----------------Create fake logged in user-----------------*/
 
-	const TEST_SESS_ID string = "testtest-test-test-test-testtesttest"
-	sessionManager := api.GetSessionManager()
-	session, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: TEST_SESS_ID,
-	})
-
-	if err != nil {
-		t.Fatalf("Err creating simulated session: %s\n", err.Error())
-	}
-
-	// userID from the test account
-	TEST_OBJID, err := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// when logging in, the userid gets saved into the session store
-	session.Store["userid"] = TEST_OBJID
+	session := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
 
 	/*-------------------------------------------------------------*/
 
@@ -489,9 +461,7 @@ func TestHandleListFurniture(t *testing.T) {
 		},
 	}
 
-	db.Init()
-	defer db.Close()
-	server := api.NewServer(":3000")
+	server := newTestServer(t)
 	server.Use("POST /list_furniture", server.HandleListFurniture, api.AuthMiddleware)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -523,7 +493,11 @@ func TestHandleListFurniture(t *testing.T) {
 			}
 
 			// find the document in the listings collection with the listingID and userID
-			listingResDB, err := db.FindByIDInListingsCollection(res)
+			listingID, err := primitive.ObjectIDFromHex(res)
+			var actualListing types.FurnitureListing
+			if err == nil {
+				actualListing, err = server.Store.Listings.FindByID(listingID)
+			}
 
 			// compare expected message
 			if tc.expectedMessage != "" && res != tc.expectedMessage {
@@ -540,30 +514,23 @@ func TestHandleListFurniture(t *testing.T) {
 				bc the other test cases, which tests for errors, will return above
 			*/
 
-			var actualListing types.FurnitureListing
-			decodeErr := listingResDB.Decode(&actualListing)
-			if decodeErr != nil {
-				t.Fatalf("Failed to decode resultDB into struct: %v\n", decodeErr)
-			}
-
 			/*
 				use the userID and the listingID returned from the response recorder
 				to validate that the listing was added to the DB
 			*/
 
-			var objectID primitive.ObjectID = actualListing.UserID
-			listingObjectID, err := primitive.ObjectIDFromHex(res)
-			if err != nil {
-				t.Fatal("Hex string is not a valid objectID")
+			if actualListing.UserID != TESTACC_ID {
+				t.Fatalf("Expected document with userID: %s, and listingID: %s; got userID: %s\n",
+					TESTACC_ID.Hex(), listingID.Hex(), actualListing.UserID.Hex())
 			}
 
-			listingsColletion := db.GetCollection("listings")
-			result := listingsColletion.FindOne(context.Background(), bson.M{
-				"userid": objectID,
-				"_id":    listingObjectID,
-			})
-			if result.Err() == mongo.ErrNoDocuments {
-				t.Fatalf("Expected document with userID: %s, and listingID: %s; got nothing\n", objectID.Hex(), listingObjectID.Hex())
+			if len(actualListing.ImageIDs) != 2 {
+				t.Fatalf("Expected 2 images saved with the listing, got: %d\n", len(actualListing.ImageIDs))
+			}
+			for _, imageID := range actualListing.ImageIDs {
+				if _, err := server.Store.Images.Get(imageID); err != nil {
+					t.Fatalf("Image %s was not saved in the image store: %s\n", imageID.Hex(), err.Error())
+				}
 			}
 
 		})
@@ -578,21 +545,21 @@ func TestValidateListFormFields(t *testing.T) {
 		Title:       "something",
 		Description: "something",
 		Type:        types.Bed,
-		Cost:        34.99,
+		Cost:        types.Cents(3499),
 		Style:       "English",
 		Condition:   "Great",
 		Material:    types.Pine,
-		// Images:      []string{"1", "2"},
+		Uploads:     [][]byte{{1}, {2}},
 	}
 
 	payload2 := types.FurnitureListing{
 		Title:       "",
 		Description: "something",
 		Type:        types.Bed,
-		Cost:        34.99,
+		Cost:        types.Cents(3499),
 		Style:       "English",
 		Material:    types.Pine,
-		// Images:      []string{"1", "2"},
+		Uploads:     [][]byte{{1}, {2}},
 	}
 
 	payload3 := types.FurnitureListing{}
@@ -640,32 +607,234 @@ func TestValidateListFormFields(t *testing.T) {
 }
 
 func TestHandleGetFurnitures(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("GET /get_furnitures", server.HandleGetFurnitures)
+
+	// TEST_LISTING is a 7500 Federal chest that hasn't been bought
+	listings := []types.FurnitureListing{
+		{Title: "Oak Bed", Cost: types.Cents(120000), Type: types.Bed, Style: types.Victorian, Condition: types.Good, Material: types.Oak},
+		{Title: "Walnut Desk", Cost: types.Cents(90000), Type: types.Desk, Style: types.English, Condition: types.Excellent, Material: types.Walnut},
+		{Title: "Cherry Table", Cost: types.Cents(270000), Type: types.Table, Style: types.Sheraton, Condition: types.Good, Material: types.Cherry},
+		{Title: "Sold Chair", Cost: types.Cents(30000), Type: types.Chair, Style: types.Victorian, Condition: types.Worn, Material: types.Oak, Bought: true},
+	}
+	for i, listing := range listings {
+		// a second apart, so sorting by date is predictable
+		listing.ListingID = primitive.NewObjectIDFromTimestamp(time.Now().Add(time.Duration(i+1) * time.Second))
+		listing.UserID = BOB_ID
+		if _, err := server.Store.Listings.Insert(listing); err != nil {
+			t.Fatal(err)
+		}
+	}
+
 	tests := []struct {
 		name               string
 		method             string
+		query              string
 		expectedStatusCode int
 		expectedMessage    string
+		expectedTitles     []string // of every page together
 	}{
-		{ // valid
+		{ // every listing that hasn't been bought, newest first
 			name:               "Test 1",
 			method:             "GET",
 			expectedStatusCode: http.StatusOK,
+			expectedTitles:     []string{"Cherry Table", "Walnut Desk", "Oak Bed", "Tiger Maple Highboy"},
 		},
-		{ // valid
+		{
 			name:               "Test 2",
 			method:             "POST",
 			expectedStatusCode: http.StatusMethodNotAllowed,
 			expectedMessage:    api.ErrMethodNotAllowed,
 		},
+		{ // filters, with both ways of giving several values
+			name:               "Test 3",
+			method:             "GET",
+			query:              "type=Bed,Desk&type=Table&condition=Good&sort=price_asc",
+			expectedStatusCode: http.StatusOK,
+			expectedTitles:     []string{"Oak Bed", "Cherry Table"},
+		},
+		{ // price range, sorted by price, over several pages
+			name:               "Test 4",
+			method:             "GET",
+			query:              "min_price=900&max_price=7500&sort=price_desc&limit=1",
+			expectedStatusCode: http.StatusOK,
+			expectedTitles:     []string{"Tiger Maple Highboy", "Cherry Table", "Oak Bed", "Walnut Desk"},
+		},
+		{
+			name:               "Test 5",
+			method:             "GET",
+			query:              "bought=true&material=Oak",
+			expectedStatusCode: http.StatusOK,
+			expectedTitles:     []string{"Sold Chair"},
+		},
+		{
+			name:               "Test 6",
+			method:             "GET",
+			query:              "bought=any&sort=oldest&limit=2",
+			expectedStatusCode: http.StatusOK,
+			expectedTitles:     []string{"Tiger Maple Highboy", "Oak Bed", "Walnut Desk", "Cherry Table", "Sold Chair"},
+		},
+		{
+			name:               "Test 7",
+			method:             "GET",
+			query:              "min_price=500&max_price=100",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    api.ErrInvalidPriceRange,
+		},
+		{
+			name:               "Test 8",
+			method:             "GET",
+			query:              "sort=popular",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    api.ErrInvalidSort,
+		},
+		{
+			name:               "Test 9",
+			method:             "GET",
+			query:              "limit=1000",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    api.ErrInvalidLimit,
+		},
+		{
+			name:               "Test 10",
+			method:             "GET",
+			query:              "cursor=notacursor",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    api.ErrInvalidCursor,
+		},
+		{
+			name:               "Test 11",
+			method:             "GET",
+			query:              "bought=maybe",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    api.ErrInvalidBought,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var titles []string
+			query := tc.query
+			for {
+				r := httptest.NewRequest(tc.method, "/get_furnitures?"+query, nil)
+				w := httptest.NewRecorder()
+
+				server.Mux.ServeHTTP(w, r)
+
+				statusCode := w.Code
+				if statusCode != tc.expectedStatusCode {
+					t.Fatalf("Expected status code: %d, got: %d\n", tc.expectedStatusCode, statusCode)
+				}
+
+				if tc.expectedMessage != "" {
+					message := strings.TrimSpace(w.Body.String())
+					if message != tc.expectedMessage {
+						t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMessage, message)
+					}
+				}
+				if statusCode != http.StatusOK {
+					return
+				}
+
+				var page api.ListingsPage
+				if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+					t.Fatal(err)
+				}
+				for _, listing := range page.Listings {
+					titles = append(titles, listing.Title)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+
+				// the cursor only continues the query it came from
+				values, _ := url.ParseQuery(tc.query)
+				values.Set("cursor", page.NextCursor)
+				query = values.Encode()
+			}
+
+			if strings.Join(titles, ", ") != strings.Join(tc.expectedTitles, ", ") {
+				t.Fatalf("Expected listings: %v, got: %v\n", tc.expectedTitles, titles)
+			}
+		})
+	}
+
+	// a cursor can't be used with a different sort than the one it was made for
+	r := httptest.NewRequest("GET", "/get_furnitures?limit=1", nil)
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, r)
+	var page api.ListingsPage
+	json.Unmarshal(w.Body.Bytes(), &page)
+
+	r = httptest.NewRequest("GET", "/get_furnitures?sort=price_asc&cursor="+page.NextCursor, nil)
+	w = httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a cursor from another sort to be rejected, got: %d\n", w.Code)
+	}
+}
+
+func TestHandleGetFurnitureFacets(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("GET /get_furnitures/facets", server.HandleGetFurnitureFacets)
+
+	// TEST_LISTING is a 7500 Federal chest in Original Finish tiger maple that hasn't been bought
+	listings := []types.FurnitureListing{
+		{Title: "Oak Bed", Cost: types.Cents(120000), Type: types.Bed, Style: types.Victorian, Condition: types.Good, Material: types.Oak},
+		{Title: "Walnut Desk", Cost: types.Cents(9000), Type: types.Desk, Style: types.English, Condition: types.Excellent, Material: types.Walnut},
+		{Title: "Oak Table", Cost: types.Cents(270000), Type: types.Table, Style: types.Victorian, Condition: types.Good, Material: types.Oak},
+		{Title: "Sold Chair", Cost: types.Cents(30000), Type: types.Chair, Style: types.Victorian, Condition: types.Worn, Material: types.Oak, Bought: true},
+	}
+	for _, listing := range listings {
+		listing.UserID = BOB_ID
+		if _, err := server.Store.Listings.Insert(listing); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedMessage    string
+		expectedTypes      string
+		expectedMaterials  string
+		expectedPrices     []int // count of each of db.PRICE_BUCKETS
+	}{
+		{ // listings that have been bought aren't counted
+			name:               "Test 1",
+			expectedStatusCode: http.StatusOK,
+			expectedTypes:      "[{Bed 1} {Chest 1} {Desk 1} {Table 1}]",
+			expectedMaterials:  "[{Oak 2} {Tiger Maple 1} {Walnut 1}]",
+			expectedPrices:     []int{1, 0, 0, 0, 1, 1, 1, 0},
+		},
+		{ // the type facet still counts every type when one is picked
+			name:               "Test 2",
+			query:              "type=Bed&style=Victorian",
+			expectedStatusCode: http.StatusOK,
+			expectedTypes:      "[{Bed 1} {Table 1}]",
+			expectedMaterials:  "[{Oak 1}]",
+			expectedPrices:     []int{0, 0, 0, 0, 1, 0, 0, 0},
+		},
+		{
+			name:               "Test 3",
+			query:              "bought=any&max_price=1000",
+			expectedStatusCode: http.StatusOK,
+			expectedTypes:      "[{Chair 1} {Desk 1}]",
+			expectedMaterials:  "[{Oak 1} {Walnut 1}]",
+			expectedPrices:     []int{1, 0, 1, 0, 1, 1, 1, 0},
+		},
+		{
+			name:               "Test 4",
+			query:              "min_price=abc",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    api.ErrInvalidPriceRange,
+		},
 	}
 
-	db.Init()
-	defer db.Close()
-	server := api.NewServer(":3000")
-	server.Use("GET /get_furnitures", server.HandleGetFurnitures)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			r := httptest.NewRequest(tc.method, "/get_furnitures", nil)
+			r := httptest.NewRequest("GET", "/get_furnitures/facets?"+tc.query, nil)
 			w := httptest.NewRecorder()
 
 			server.Mux.ServeHTTP(w, r)
@@ -674,12 +843,31 @@ func TestHandleGetFurnitures(t *testing.T) {
 			if statusCode != tc.expectedStatusCode {
 				t.Fatalf("Expected status code: %d, got: %d\n", tc.expectedStatusCode, statusCode)
 			}
-
-			if tc.expectedMessage != "" {
+			if statusCode != http.StatusOK {
 				message := strings.TrimSpace(w.Body.String())
 				if message != tc.expectedMessage {
 					t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMessage, message)
 				}
+				return
+			}
+
+			var facets db.ListingFacets
+			if err := json.Unmarshal(w.Body.Bytes(), &facets); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fmt.Sprint(facets.Types); got != tc.expectedTypes {
+				t.Fatalf("Expected types: %s, got: %s\n", tc.expectedTypes, got)
+			}
+			if got := fmt.Sprint(facets.Materials); got != tc.expectedMaterials {
+				t.Fatalf("Expected materials: %s, got: %s\n", tc.expectedMaterials, got)
+			}
+			var prices []int
+			for _, bucket := range facets.Prices {
+				prices = append(prices, bucket.Count)
+			}
+			if fmt.Sprint(prices) != fmt.Sprint(tc.expectedPrices) {
+				t.Fatalf("Expected prices: %v, got: %v\n", tc.expectedPrices, prices)
 			}
 		})
 	}
@@ -692,11 +880,11 @@ func TestHandleGetFurniture(t *testing.T) {
 		payload            string
 		expectedStatusCode int
 	}{
-		{ // invalid ID
+		{ // missing ID; doesn't match the route
 			name:               "Test 1",
 			method:             "GET",
 			payload:            "",
-			expectedStatusCode: http.StatusBadRequest,
+			expectedStatusCode: http.StatusNotFound,
 		},
 		{ // valid
 			name:               "Test 2",
@@ -724,13 +912,11 @@ func TestHandleGetFurniture(t *testing.T) {
 		},
 	}
 
-	db.Init()
-	defer db.Close()
-	server := api.NewServer(":3000")
-	server.Use("GET /get_furniture", server.HandleGetFurniture)
+	server := newTestServer(t)
+	server.Use("GET /get_furniture/{listingID}", server.HandleGetFurniture)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			var target string = fmt.Sprintf("/get_furniture?listingid=%s", tc.payload)
+			var target string = fmt.Sprintf("/get_furniture/%s", tc.payload)
 			r := httptest.NewRequest(tc.method, target, nil)
 			w := httptest.NewRecorder()
 
@@ -745,29 +931,14 @@ func TestHandleGetFurniture(t *testing.T) {
 }
 
 func TestHandleAccountGET(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	usersCollection := db.GetCollection("users")
-	sessionManager := api.GetSessionManager()
+	server := newTestServer(t)
 
 	/*-----------------Fake logged in user 1-----------------*/
 
-	session1, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "testtest-test-test-test-testtesttest",
-	})
-	if err != nil {
-		t.Fatal("Failed to generate session1")
-	}
-
-	objID1, _ := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	session1.Store["userid"] = objID1
+	session1 := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
 
 	// prepare expected data
-	var testuser1ExpectedData types.User
-	err = usersCollection.FindOne(context.Background(), bson.M{
-		"_id": objID1,
-	}).Decode(&testuser1ExpectedData)
-
+	testuser1ExpectedData, err := server.Store.Users.FindByID(TESTACC_ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -779,22 +950,10 @@ func TestHandleAccountGET(t *testing.T) {
 
 	/*----------------Fake logged in user 2------------------*/
 
-	session2, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "bobbobbo-bobb-bobb-bobb-bobbobbobbob",
-	})
-	if err != nil {
-		t.Fatal("Failed to generate session1")
-	}
-
-	objID2, _ := primitive.ObjectIDFromHex("65a5a07f062510f606cbd0ae")
-	session2.Store["userid"] = objID2
+	session2 := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
 
 	// prepare expected data
-	var testuser2ExpectedData types.User
-	err = usersCollection.FindOne(context.Background(), bson.M{
-		"_id": objID2,
-	}).Decode(&testuser2ExpectedData)
-
+	testuser2ExpectedData, err := server.Store.Users.FindByID(BOB_ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -836,7 +995,6 @@ func TestHandleAccountGET(t *testing.T) {
 		},
 	}
 
-	server := api.NewServer(":3000")
 	server.Use("/account", server.HandleAccountGET, api.AuthMiddleware)
 
 	for _, tc := range tests {
@@ -870,22 +1028,12 @@ because the data will stay the same, which is to be expected. But, that's
 not what we're testing for, ofc.
 */
 func TestHandleAccountPUT(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	// usersCollection := db.GetCollection("users")
-	sessionManager := api.GetSessionManager()
+	server := newTestServer(t)
 
 	/*---------------fake logged in user1------------------*/
 
-	session1, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "testtest-test-test-test-testtesttest",
-	})
-	if err != nil {
-		t.Fatal("Failed to generate session1")
-	}
-
-	objID1, _ := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	session1.Store["userid"] = objID1
+	session1 := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	objID1 := TESTACC_ID
 
 	// change payload before you run the test
 	accountEdit1 := api.AccountEdit{
@@ -918,7 +1066,6 @@ func TestHandleAccountPUT(t *testing.T) {
 		},
 	}
 
-	server := api.NewServer(":3000")
 	server.Use("PUT /account", server.HandleAccountPUT, api.AuthMiddleware)
 
 	for _, tc := range tests {
@@ -944,12 +1091,7 @@ func TestHandleAccountPUT(t *testing.T) {
 
 			/*----------------check db to see if the changes went through--------------*/
 
-			usersCollection := db.GetCollection("users")
-			var user types.User
-			err := usersCollection.FindOne(context.Background(), bson.M{
-				"_id": tc.userID,
-			}).Decode(&user)
-
+			user, err := server.Store.Users.FindByID(tc.userID)
 			if err != nil {
 				t.Fatal("Failed to find user document for test")
 			}
@@ -1010,19 +1152,7 @@ will take from the platform account the funds and transfer it to their bank
 */
 func TestHandleCheckout(t *testing.T) {
 	// creating fake loggedIn user with test account
-	sessionManager := api.GetSessionManager()
-	session1, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "testtest-test-test-test-testtesttest",
-	})
-	if err != nil {
-		t.Fatal("Failed to create a fake session")
-	}
-
-	USER_ID, err := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	if err != nil {
-		t.Fatal("Failed to generate objectID for fake session")
-	}
-	session1.Store["userid"] = USER_ID
+	session1 := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
 
 	// mock checkout input data
 	checkoutInfo := api.CheckoutInfo{
@@ -1031,7 +1161,7 @@ func TestHandleCheckout(t *testing.T) {
 		},
 		Payment: api.PaymentInfo{
 			PaymentMethod: "Credit",
-			Amount:        7500,
+			Amount:        types.Cents(750000),
 			Currency:      "usd",
 		},
 	}
@@ -1041,6 +1171,22 @@ func TestHandleCheckout(t *testing.T) {
 		t.Fatal("Failed to encode checkoutInfo into JSON")
 	}
 
+	// returns the checkout payload with <listingIDs> in the cart instead
+	withCart := func(listingIDs ...primitive.ObjectID) string {
+		info := checkoutInfo
+		info.ShoppingCart = []string{}
+		for _, listingID := range listingIDs {
+			info.ShoppingCart = append(info.ShoppingCart, listingID.Hex())
+		}
+		jsonData, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(jsonData)
+	}
+	soldID, heldID, expiredHoldID := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	dollarID, euroID := primitive.NewObjectID(), primitive.NewObjectID()
+
 	tests := []struct {
 		name               string
 		method             string
@@ -1065,7 +1211,7 @@ func TestHandleCheckout(t *testing.T) {
 			expectedStatusCode: http.StatusMethodNotAllowed,
 			expectedMsg:        api.ErrMethodNotAllowed,
 		},
-		{ // valid [*This test doesn't pass yet]
+		{ // valid
 			name:               "Test 3",
 			method:             "POST",
 			sessionid:          session1.SessionID,
@@ -1073,12 +1219,79 @@ func TestHandleCheckout(t *testing.T) {
 			expectedStatusCode: http.StatusOK,
 			expectedMsg:        "",
 		},
+		{ // already bought
+			name:               "Test 4",
+			method:             "POST",
+			sessionid:          session1.SessionID,
+			payload:            withCart(soldID),
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrListingSold,
+		},
+		{ // another buyer is checking it out
+			name:               "Test 5",
+			method:             "POST",
+			sessionid:          session1.SessionID,
+			payload:            withCart(heldID),
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrListingHeld,
+		},
+		{ // doesn't exist
+			name:               "Test 6",
+			method:             "POST",
+			sessionid:          session1.SessionID,
+			payload:            withCart(primitive.NewObjectID()),
+			expectedStatusCode: http.StatusNotFound,
+			expectedMsg:        api.ErrListingNotFound,
+		},
+		{
+			name:               "Test 7",
+			method:             "POST",
+			sessionid:          session1.SessionID,
+			payload:            withCart(),
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrCheckoutEmptyCart,
+		},
+		{ // a hold that expired doesn't stop anyone
+			name:               "Test 8",
+			method:             "POST",
+			sessionid:          session1.SessionID,
+			payload:            withCart(expiredHoldID, expiredHoldID),
+			expectedStatusCode: http.StatusOK,
+			expectedMsg:        "",
+		},
+		{ // priced in euros, but the buyer is paying in dollars
+			name:               "Test 9",
+			method:             "POST",
+			sessionid:          session1.SessionID,
+			payload:            withCart(euroID),
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrCheckoutCurrency,
+		},
+		{ // one buyer can't be charged in two currencies
+			name:               "Test 10",
+			method:             "POST",
+			sessionid:          session1.SessionID,
+			payload:            withCart(dollarID, euroID),
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrCheckoutCurrency,
+		},
 	}
 
-	db.Init()
-	defer db.Close()
-	server := api.NewServer(":3000")
-	go server.Start()
+	server := newTestServer(t)
+	server.Use("POST /checkout", server.HandleCheckout, api.AuthMiddleware)
+
+	expired := time.Now().Add(-time.Minute)
+	for _, listing := range []types.FurnitureListing{
+		{ListingID: soldID, Title: "Sold Chair", Cost: types.Cents(10000), UserID: BOB_ID, Bought: true},
+		{ListingID: heldID, Title: "Held Chair", Cost: types.Cents(10000), UserID: BOB_ID, Hold: &types.ListingHold{HoldID: "cs_test_held", UserID: JOHNSMITH_ID, ExpiresAt: time.Now().Add(time.Hour)}},
+		{ListingID: expiredHoldID, Title: "Expired Chair", Cost: types.Cents(10000), UserID: BOB_ID, Hold: &types.ListingHold{HoldID: "cs_test_expired", UserID: JOHNSMITH_ID, ExpiresAt: expired}},
+		{ListingID: dollarID, Title: "Dollar Chair", Cost: types.Cents(10000), UserID: BOB_ID},
+		{ListingID: euroID, Title: "Euro Chair", Cost: types.NewMoney(10000, types.EUR), UserID: BOB_ID},
+	} {
+		if _, err := server.Store.Listings.Insert(listing); err != nil {
+			t.Fatal(err)
+		}
+	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1100,75 +1313,956 @@ func TestHandleCheckout(t *testing.T) {
 			if res != tc.expectedMsg && tc.expectedMsg != "" {
 				t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMsg, res)
 			}
+			if tc.expectedStatusCode == http.StatusOK && !strings.HasPrefix(res, "http://localhost:3000/fake_checkout/cs_fake_") {
+				t.Fatalf("Expected the URL of a fake checkout, got: %s\n", res)
+			}
 		})
 	}
-
-	for {
-		time.Sleep(time.Second)
-	}
 }
 
-func TestHandleAddressGET(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	sessionManager := api.GetSessionManager()
-
-	/*-----------Fake logged in user 1-------------*/
-
-	session1, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "testtest-test-test-test-testtesttest",
-	})
-	if err != nil {
-		t.Fatal("Failed to create session for testuser1")
-	}
-	userID1, _ := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	session1.Store["userid"] = userID1
+/*
+Checks out <listingIDs> as <session>'s user through HandleCheckout, and
+returns the ID of the fake checkout that was started
+*/
+func startCheckout(t *testing.T, server *api.Server, session *api.Session, listingIDs ...primitive.ObjectID) string {
+	t.Helper()
 
-	// generating expected msg
-	var expectedAddresses1 []types.ShippingAddress
-	usersCollection := db.GetCollection("shippingAddresses")
-	cursor, err := usersCollection.Find(
-		context.Background(),
-		bson.M{"userid": userID1},
-	)
-	if err != nil {
-		t.Fatal("Failed to find documents")
+	info := api.CheckoutInfo{Payment: api.PaymentInfo{PaymentMethod: "Credit", Currency: "usd"}}
+	for _, listingID := range listingIDs {
+		info.ShoppingCart = append(info.ShoppingCart, listingID.Hex())
 	}
-	err = cursor.All(context.Background(), &expectedAddresses1)
+	payload, err := json.Marshal(info)
 	if err != nil {
-		t.Fatal(err.Error())
+		t.Fatal(err)
 	}
 
-	jsonData1, err := json.Marshal(expectedAddresses1)
-	if err != nil {
-		t.Fatal("Failed to marshal expectedAddresses1")
+	r := httptest.NewRequest("POST", "/checkout", bytes.NewReader(payload))
+	r.AddCookie(&http.Cookie{
+		Name:  api.SESSIONID_COOKIE_NAME,
+		Value: session.SessionID,
+	})
+	w := httptest.NewRecorder()
+	api.AuthMiddleware(server.HandleCheckout).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to start checkout, got: %d %s\n", w.Code, w.Body.String())
 	}
 
-	expectedMsg1 := string(jsonData1)
+	checkoutURL := w.Body.String()
+	return checkoutURL[strings.LastIndex(checkoutURL, "/")+1:]
+}
 
-	/*-----------------test cases------------------*/
+func TestHandlePaymentWebhook(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+	payments := fakePayments(server)
+
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
 
 	tests := []struct {
-		name               string
-		sessionID          string
-		expectedStatusCode int
-		expectedMsg        string
+		name             string
+		simulate         func(checkoutID string) (*api.PaymentEvent, error)
+		loseHold         bool // another checkout holds the listing by the time the buyer pays
+		logOut           bool // the buyer logs out before they pay
+		expectedBought   bool
+		expectedHeld     bool
+		expectedRefunds  []types.Money
+		expectedReceipts int
 	}{
-		{ // valid
-			name:               "Test 1",
-			sessionID:          session1.SessionID,
-			expectedStatusCode: http.StatusOK,
-			expectedMsg:        expectedMsg1,
+		{ // paid
+			name:             "Test 1",
+			simulate:         payments.SimulateCompleted,
+			expectedBought:   true,
+			expectedReceipts: 1,
 		},
-		{ // unauthorized
-			name:               "Test 2",
-			sessionID:          "notloggedin",
-			expectedStatusCode: http.StatusUnauthorized,
-			expectedMsg:        api.ErrUnauthorized,
+		{ // paid after the hold ran out and someone else started checking it out, so it's refunded instead
+			name:            "Test 2",
+			simulate:        payments.SimulateCompleted,
+			loseHold:        true,
+			expectedHeld:    true,
+			expectedRefunds: []types.Money{types.Cents(12550)},
+		},
+		{ // not paid in time
+			name:     "Test 3",
+			simulate: payments.SimulateExpired,
+		},
+		{ // the payment was declined
+			name:     "Test 4",
+			simulate: payments.SimulateFailed,
+		},
+		{ // the order is still the buyer's without their session
+			name:             "Test 5",
+			simulate:         payments.SimulateCompleted,
+			logOut:           true,
+			expectedBought:   true,
+			expectedReceipts: 1,
+		},
+	}
+
+	// returns the seller's balance
+	balance := func() types.Money {
+		seller, err := server.Store.Users.FindByID(TESTACC_ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seller.Balance
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			listingID, err := server.Store.Listings.Insert(types.FurnitureListing{Title: "Chair", Cost: types.Cents(12550), UserID: TESTACC_ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkoutID := startCheckout(t, server, buyer, listingID)
+
+			if tc.loseHold {
+				err := server.Store.Listings.Update(listingID, bson.M{"hold": types.ListingHold{HoldID: "cs_fake_other", UserID: JOHNSMITH_ID, ExpiresAt: time.Now().Add(time.Hour)}})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tc.logOut {
+				api.GetSessionManager().DeleteSession(buyer.SessionID)
+			}
+
+			event, err := tc.simulate(checkoutID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			balanceBefore := balance()
+			receiptsBefore, _ := server.Store.Receipts.FindByUser(BOB_ID)
+
+			// the provider can deliver the same event more than once, but it's only applied once
+			for _, expectedMsg := range []string{"success", "already processed"} {
+				w := httptest.NewRecorder()
+				server.Mux.ServeHTTP(w, payments.WebhookRequest(event))
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected status code: %d, got: %d\n", http.StatusOK, w.Code)
+				}
+				if msg := strings.TrimSpace(w.Body.String()); msg != expectedMsg {
+					t.Fatalf("Expected msg: %s, got: %s\n", expectedMsg, msg)
+				}
+			}
+
+			listing, _ := server.Store.Listings.FindByID(listingID)
+			if listing.Bought != tc.expectedBought || (listing.Hold != nil) != tc.expectedHeld {
+				t.Fatalf("Expected bought: %v and held: %v, got: %v and %+v\n", tc.expectedBought, tc.expectedHeld, listing.Bought, listing.Hold)
+			}
+			if refunds := payments.Refunds(checkoutID); !reflect.DeepEqual(refunds, tc.expectedRefunds) {
+				t.Fatalf("Expected refunds: %v, got: %v\n", tc.expectedRefunds, refunds)
+			}
+			if credited := balance().Cmp(balanceBefore) > 0; credited != tc.expectedBought {
+				t.Fatalf("Expected the seller to be credited: %v, got: %v\n", tc.expectedBought, credited)
+			}
+
+			receipts, _ := server.Store.Receipts.FindByUser(BOB_ID)
+			if len(receipts)-len(receiptsBefore) != tc.expectedReceipts {
+				t.Fatalf("Expected %d new receipts, got: %d\n", tc.expectedReceipts, len(receipts)-len(receiptsBefore))
+			}
+			if tc.expectedReceipts > 0 && receipts[len(receipts)-1].ShippingAddress != api.FAKE_SHIPPING_ADDRESS {
+				t.Fatalf("Expected the receipt to ship to: %+v, got: %+v\n", api.FAKE_SHIPPING_ADDRESS, receipts[len(receipts)-1].ShippingAddress)
+			}
+		})
+	}
+
+	// the provider never reported this event
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, httptest.NewRequest("POST", "/checkout_webhook", strings.NewReader(`{"id": "evt_fake_forged", "type": "payment.completed"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status code: %d, got: %d\n", http.StatusBadRequest, w.Code)
+	}
+}
+
+// Fails to insert the next <failures> receipts, like a database that's briefly unreachable
+type failingReceiptStore struct {
+	db.ReceiptStore
+	failures int
+}
+
+func (f *failingReceiptStore) InsertForCheckout(receipt types.Receipt) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("connection refused")
+	}
+	return f.ReceiptStore.InsertForCheckout(receipt)
+}
+
+// Fails to add to the next <failures> balances, like a database that's briefly unreachable
+type failingUserStore struct {
+	db.UserStore
+	failures int
+}
+
+func (f *failingUserStore) AddToBalance(userID primitive.ObjectID, amount types.Money, key string) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("connection refused")
+	}
+	return f.UserStore.AddToBalance(userID, amount, key)
+}
+
+/*
+An event that fails part way is applied again when it's delivered again,
+and finishes the order the same as if it never failed
+*/
+func TestHandlePaymentWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(server *api.Server) // makes the first delivery fail part way
+	}{
+		{ // before the receipt is saved
+			name: "Test 1",
+			fail: func(server *api.Server) {
+				server.Store.Receipts = &failingReceiptStore{ReceiptStore: server.Store.Receipts, failures: 1}
+			},
+		},
+		{ // after the sale is posted, but before the seller's balance is credited for it
+			name: "Test 2",
+			fail: func(server *api.Server) {
+				server.Store.Users = &failingUserStore{UserStore: server.Store.Users, failures: 1}
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newTestServer(t)
+			server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+			payments := fakePayments(server)
+			buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+			var cart []primitive.ObjectID
+			for _, listing := range []types.FurnitureListing{
+				{Title: "Desk", Cost: types.Cents(10000), UserID: TESTACC_ID},
+				{Title: "Stool", Cost: types.Cents(2550), UserID: TESTACC_ID},
+			} {
+				listingID, err := server.Store.Listings.Insert(listing)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cart = append(cart, listingID)
+			}
+
+			checkoutID := startCheckout(t, server, buyer, cart...)
+			event, err := payments.SimulateCompleted(checkoutID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seller, _ := server.Store.Users.FindByID(TESTACC_ID)
+			balanceBefore := seller.Balance
+
+			tc.fail(server)
+			for _, expectedCode := range []int{http.StatusInternalServerError, http.StatusOK} {
+				w := httptest.NewRecorder()
+				server.Mux.ServeHTTP(w, payments.WebhookRequest(event))
+				if w.Code != expectedCode {
+					t.Fatalf("Expected status code: %d, got: %d %s\n", expectedCode, w.Code, w.Body.String())
+				}
+			}
+
+			if refunds := payments.Refunds(checkoutID); len(refunds) != 0 {
+				t.Fatalf("Expected no refunds for listings the checkout bought, got: %v\n", refunds)
+			}
+			receipts, _ := server.Store.Receipts.FindByUser(BOB_ID)
+			var found int
+			for _, receipt := range receipts {
+				if receipt.CheckoutID == checkoutID {
+					found++
+					if len(receipt.Items()) != 2 {
+						t.Fatalf("Expected a receipt for both listings, got: %+v\n", receipt.Items())
+					}
+				}
+			}
+			if found != 1 {
+				t.Fatalf("Expected one receipt for the checkout, got: %d\n", found)
+			}
+
+			// the seller is paid for each listing once
+			var payouts types.Money
+			for _, split := range api.SplitItems([]types.Money{types.Cents(10000), types.Cents(2550)}, types.Cents(12550)) {
+				payouts = payouts.Add(split.Payout)
+			}
+			seller, _ = server.Store.Users.FindByID(TESTACC_ID)
+			if credited := seller.Balance.Sub(balanceBefore); credited != payouts {
+				t.Fatalf("Expected the seller to be credited: %s, got: %s\n", payouts, credited)
+			}
+		})
+	}
+}
+
+// Stops the server part way through saving a receipt, like a process that's killed
+type interruptedReceiptStore struct {
+	db.ReceiptStore
+}
+
+func (interruptedReceiptStore) InsertForCheckout(receipt types.Receipt) error {
+	panic("killed")
+}
+
+/*
+An event whose server stopped while applying it isn't recorded as
+processed, so it's applied when it's delivered again
+*/
+func TestHandlePaymentWebhookInterrupted(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+	payments := fakePayments(server)
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	listingID, err := server.Store.Listings.Insert(types.FurnitureListing{Title: "Desk", Cost: types.Cents(10000), UserID: TESTACC_ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkoutID := startCheckout(t, server, buyer, listingID)
+	event, err := payments.SimulateCompleted(checkoutID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipts := server.Store.Receipts
+	server.Store.Receipts = interruptedReceiptStore{ReceiptStore: receipts}
+	func() {
+		defer func() { recover() }()
+		server.Mux.ServeHTTP(httptest.NewRecorder(), payments.WebhookRequest(event))
+	}()
+	server.Store.Receipts = receipts
+
+	for _, expectedMsg := range []string{"success", "already processed"} {
+		w := httptest.NewRecorder()
+		server.Mux.ServeHTTP(w, payments.WebhookRequest(event))
+		if w.Code != http.StatusOK || w.Body.String() != expectedMsg {
+			t.Fatalf("Expected: %d %s, got: %d %s\n", http.StatusOK, expectedMsg, w.Code, w.Body.String())
+		}
+	}
+
+	found, _ := server.Store.Receipts.FindByUser(BOB_ID)
+	if len(found) == 0 || found[len(found)-1].CheckoutID != checkoutID {
+		t.Fatalf("Expected a receipt for the checkout, got: %+v\n", found)
+	}
+	if listing, _ := server.Store.Listings.FindByID(listingID); !listing.Bought {
+		t.Fatalf("Expected the listing to be bought, got: %+v\n", listing)
+	}
+}
+
+/*
+A listing deleted before its checkout is paid is refunded at the price the
+checkout charged for it, even though it can't be looked up anymore
+*/
+func TestHandlePaymentWebhookListingDeleted(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+	payments := fakePayments(server)
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	keptID, err := server.Store.Listings.Insert(types.FurnitureListing{Title: "Desk", Cost: types.Cents(10000), UserID: TESTACC_ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletedID, err := server.Store.Listings.Insert(types.FurnitureListing{Title: "Lamp", Cost: types.Cents(4550), UserID: TESTACC_ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkoutID := startCheckout(t, server, buyer, keptID, deletedID)
+
+	// the hold runs out and the seller deletes the listing before the buyer pays
+	if err := server.Store.Listings.Update(deletedID, bson.M{"hold": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Store.Listings.DeleteUnsold(deletedID, TESTACC_ID); err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := payments.SimulateCompleted(checkoutID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, payments.WebhookRequest(event))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code: %d, got: %d %s\n", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	expectedRefunds := []types.Money{types.Cents(4550)}
+	if refunds := payments.Refunds(checkoutID); !reflect.DeepEqual(refunds, expectedRefunds) {
+		t.Fatalf("Expected refunds: %v, got: %v\n", expectedRefunds, refunds)
+	}
+	if listing, _ := server.Store.Listings.FindByID(keptID); !listing.Bought {
+		t.Fatalf("Expected the kept listing to be bought, got: %+v\n", listing)
+	}
+}
+
+/*
+Deliveries of the same event at the same time can all apply it, but the
+seller is only credited for each listing once
+*/
+func TestHandlePaymentWebhookConcurrent(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+	payments := fakePayments(server)
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	listingID, err := server.Store.Listings.Insert(types.FurnitureListing{Title: "Desk", Cost: types.Cents(10000), UserID: TESTACC_ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := payments.SimulateCompleted(startCheckout(t, server, buyer, listingID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seller, _ := server.Store.Users.FindByID(TESTACC_ID)
+	balanceBefore := seller.Balance
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			server.Mux.ServeHTTP(w, payments.WebhookRequest(event))
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status code: %d, got: %d %s\n", http.StatusOK, w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	seller, _ = server.Store.Users.FindByID(TESTACC_ID)
+	if credited := seller.Balance.Sub(balanceBefore); credited != types.Cents(9196) {
+		t.Fatalf("Expected the seller to be credited: %s, got: %s\n", types.Cents(9196), credited)
+	}
+	balance, err := server.Store.Ledger.Balance(types.SellerAccount(TESTACC_ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != seller.Balance {
+		t.Fatalf("Expected the ledger to add up to the balance: %s, got: %s\n", seller.Balance, balance)
+	}
+}
+
+func TestHandlePaymentWebhookPayouts(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+	payments := fakePayments(server)
+
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	// one cart with listings from two sellers
+	var cart []primitive.ObjectID
+	for _, listing := range []types.FurnitureListing{
+		{Title: "Desk", Cost: types.Cents(10000), UserID: TESTACC_ID},
+		{Title: "Lamp", Cost: types.Cents(5000), UserID: JOHNSMITH_ID},
+		{Title: "Stool", Cost: types.Cents(2550), UserID: TESTACC_ID},
+	} {
+		listingID, err := server.Store.Listings.Insert(listing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cart = append(cart, listingID)
+	}
+
+	// returns each user's balance in cents
+	balances := func() map[primitive.ObjectID]int64 {
+		balances := make(map[primitive.ObjectID]int64)
+		for _, userID := range []primitive.ObjectID{TESTACC_ID, JOHNSMITH_ID, BOB_ID} {
+			user, err := server.Store.Users.FindByID(userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			balances[userID] = user.Balance.Amount
+		}
+		return balances
+	}
+
+	checkoutID := startCheckout(t, server, buyer, cart...)
+	event, err := payments.SimulateCompleted(checkoutID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Checkout.AmountTotal != types.Cents(17550) {
+		t.Fatalf("Expected the checkout to charge 175.50, got: %s\n", event.Checkout.AmountTotal)
+	}
+
+	before := balances()
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, payments.WebhookRequest(event))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+	after := balances()
+
+	// the payouts of the desk and stool go to TESTACC, and the lamp's to JOHNSMITH
+	expected := map[primitive.ObjectID]int64{TESTACC_ID: 9208 + 2348, JOHNSMITH_ID: 4603, BOB_ID: 0}
+	for userID, credit := range expected {
+		if after[userID]-before[userID] != credit {
+			t.Fatalf("Expected user %s to be credited %d cents, got: %d\n", userID.Hex(), credit, after[userID]-before[userID])
+		}
+	}
+
+	receipts, _ := server.Store.Receipts.FindByUser(BOB_ID)
+	receipt := receipts[len(receipts)-1]
+	if items := receipt.Items(); len(items) != 3 || items[1].SellerID != TESTACC_ID || items[2].SellerID != JOHNSMITH_ID {
+		t.Fatalf("Expected a receipt for the 3 listings with their sellers, got: %+v\n", receipt.Items())
+	}
+
+	// each seller gets a sub-order of their own listings
+	subOrders := receipt.SubOrders
+	if len(subOrders) != 2 || subOrders[0].SellerID != TESTACC_ID || subOrders[1].SellerID != JOHNSMITH_ID {
+		t.Fatalf("Expected a sub-order for TESTACC then JOHNSMITH, got: %+v\n", subOrders)
+	}
+	if len(subOrders[0].Items) != 2 || subOrders[0].Subtotal != types.Cents(12550) || len(subOrders[1].Items) != 1 || subOrders[1].Subtotal != types.Cents(5000) {
+		t.Fatalf("Expected sub-orders of 125.50 and 50.00, got: %+v\n", subOrders)
+	}
+
+	/*
+		The ledger accounts for every cent: the sellers' entries add up to what
+		they were credited, the fee of 539 cents went to the processor, the
+		platform kept the rest, and nothing is left in clearing
+	*/
+	expectedAccounts := map[types.LedgerAccount]int64{
+		types.SellerAccount(TESTACC_ID):   10516244 + 9208 + 2348, // with their opening balance
+		types.SellerAccount(JOHNSMITH_ID): 4603,
+		types.AccountProcessorFees:        539,
+		types.AccountPlatformRevenue:      17550 - 539 - 9208 - 2348 - 4603,
+		types.AccountClearing:             0,
+		types.AccountBuyers:               -17550,
+	}
+	for account, expectedBalance := range expectedAccounts {
+		balance, err := server.Store.Ledger.Balance(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Amount != expectedBalance {
+			t.Fatalf("Expected account %s to hold %d cents, got: %s\n", account, expectedBalance, balance)
+		}
+	}
+}
+
+func TestHandleBalanceTransactions(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+	server.Use("GET /account/balance/transactions", server.HandleBalanceTransactions, api.AuthMiddleware)
+	payments := fakePayments(server)
+
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+
+	// a fee of 320 cents, 484 for the platform, and a payout of 9196
+	listingID, err := server.Store.Listings.Insert(types.FurnitureListing{Title: "Desk", Cost: types.Cents(10000), UserID: TESTACC_ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := payments.SimulateCompleted(startCheckout(t, server, buyer, listingID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, payments.WebhookRequest(event))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+
+	tests := []struct {
+		name                 string
+		sessionid            string
+		query                string
+		expectedStatusCode   int
+		expectedMsg          string
+		expectedTransactions string // type and amount of each, newest first
+		expectedNextPage     bool
+	}{
+		{
+			name:                 "Test 1",
+			sessionid:            seller.SessionID,
+			query:                "",
+			expectedStatusCode:   http.StatusOK,
+			expectedTransactions: "[platform_fee -4.84 processor_fee -3.20 sale 100.00 opening_balance 105162.44]",
+		},
+		{
+			name:                 "Test 2",
+			sessionid:            seller.SessionID,
+			query:                "?limit=2",
+			expectedStatusCode:   http.StatusOK,
+			expectedTransactions: "[platform_fee -4.84 processor_fee -3.20]",
+			expectedNextPage:     true,
+		},
+		{ // the buyer hasn't sold anything
+			name:                 "Test 3",
+			sessionid:            buyer.SessionID,
+			query:                "",
+			expectedStatusCode:   http.StatusOK,
+			expectedTransactions: "[]",
+		},
+		{
+			name:               "Test 4",
+			sessionid:          seller.SessionID,
+			query:              "?limit=0",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrInvalidLimit,
+		},
+		{
+			name:               "Test 5",
+			sessionid:          seller.SessionID,
+			query:              "?cursor=not-a-cursor",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrInvalidCursor,
+		},
+		{
+			name:               "Test 6",
+			sessionid:          "unauthorized",
+			query:              "",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedMsg:        api.ErrUnauthorized,
+		},
+	}
+
+	// returns the page of the seller's transactions at <query>
+	getPage := func(t *testing.T, sessionid, query string) (*httptest.ResponseRecorder, api.BalanceTransactionsPage) {
+		r := httptest.NewRequest("GET", "/account/balance/transactions"+query, nil)
+		r.AddCookie(&http.Cookie{
+			Name:  api.SESSIONID_COOKIE_NAME,
+			Value: sessionid,
+		})
+		w := httptest.NewRecorder()
+		server.Mux.ServeHTTP(w, r)
+
+		var page api.BalanceTransactionsPage
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, page
+	}
+
+	// returns the type and amount of each transaction
+	summarize := func(page api.BalanceTransactionsPage) string {
+		var summary []string
+		for _, transaction := range page.Transactions {
+			summary = append(summary, string(transaction.Type), transaction.Amount.Decimal())
+		}
+		return fmt.Sprint(summary)
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w, page := getPage(t, tc.sessionid, tc.query)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected code: %d, got: %d\n", tc.expectedStatusCode, w.Code)
+			}
+			if msg := strings.TrimSpace(w.Body.String()); tc.expectedMsg != "" && msg != tc.expectedMsg {
+				t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMsg, msg)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			if got := summarize(page); got != tc.expectedTransactions {
+				t.Fatalf("Expected transactions: %s, got: %s\n", tc.expectedTransactions, got)
+			}
+			if (page.NextCursor != "") != tc.expectedNextPage {
+				t.Fatalf("Expected a next page: %v, got cursor: %q\n", tc.expectedNextPage, page.NextCursor)
+			}
+		})
+	}
+
+	// the next page picks up where the first left off, and the balance includes the payout
+	_, first := getPage(t, seller.SessionID, "?limit=2")
+	_, next := getPage(t, seller.SessionID, "?limit=2&cursor="+first.NextCursor)
+	if got := summarize(next); got != "[sale 100.00 opening_balance 105162.44]" || next.NextCursor != "" {
+		t.Fatalf("Expected the last transactions on the next page, got: %s %q\n", got, next.NextCursor)
+	}
+	if next.Balance != types.Cents(10516244+9196) {
+		t.Fatalf("Expected a balance of: %s, got: %s\n", types.Cents(10516244+9196), next.Balance)
+	}
+}
+
+func TestHandleCheckoutCancel(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /checkout/{sessionID}/cancel", server.HandleCheckoutCancel, api.AuthMiddleware)
+	payments := fakePayments(server)
+
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+	otherBuyer := fakeLogin(t, TEST_SESSION_ID, JOHNSMITH_ID)
+
+	paidID, err := server.Store.Listings.Insert(types.FurnitureListing{Title: "Paid Chair", Cost: types.Cents(10000), UserID: TESTACC_ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	openCheckout := startCheckout(t, server, buyer, TEST_LISTING)
+	paidCheckout := startCheckout(t, server, buyer, paidID)
+	if _, err := payments.SimulateCompleted(paidCheckout); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		sessionid          string
+		checkoutID         string
+		expectedStatusCode int
+		expectedMsg        string
+	}{
+		{ // someone else's checkout
+			name:               "Test 1",
+			sessionid:          otherBuyer.SessionID,
+			checkoutID:         openCheckout,
+			expectedStatusCode: http.StatusNotFound,
+			expectedMsg:        api.ErrCheckoutNotFound,
+		},
+		{ // doesn't exist
+			name:               "Test 2",
+			sessionid:          buyer.SessionID,
+			checkoutID:         "cs_fake_nothing",
+			expectedStatusCode: http.StatusNotFound,
+			expectedMsg:        api.ErrCheckoutNotFound,
+		},
+		{ // already paid
+			name:               "Test 3",
+			sessionid:          buyer.SessionID,
+			checkoutID:         paidCheckout,
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrCheckoutComplete,
+		},
+		{
+			name:               "Test 4",
+			sessionid:          buyer.SessionID,
+			checkoutID:         openCheckout,
+			expectedStatusCode: http.StatusOK,
+			expectedMsg:        "success",
+		},
+		{ // canceling twice is fine
+			name:               "Test 5",
+			sessionid:          buyer.SessionID,
+			checkoutID:         openCheckout,
+			expectedStatusCode: http.StatusOK,
+			expectedMsg:        "success",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/checkout/"+tc.checkoutID+"/cancel", nil)
+			r.AddCookie(&http.Cookie{
+				Name:  api.SESSIONID_COOKIE_NAME,
+				Value: tc.sessionid,
+			})
+			w := httptest.NewRecorder()
+
+			server.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected status code: %d, got: %d\n", tc.expectedStatusCode, w.Code)
+			}
+			if msg := strings.TrimSpace(w.Body.String()); msg != tc.expectedMsg {
+				t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMsg, msg)
+			}
+		})
+	}
+
+	listing, _ := server.Store.Listings.FindByID(TEST_LISTING)
+	if listing.Hold != nil {
+		t.Fatalf("Expected the canceled checkout's listing to be released, got: %+v\n", listing.Hold)
+	}
+	checkout, _ := payments.GetCheckout(openCheckout)
+	if checkout.Status != api.CheckoutExpired {
+		t.Fatalf("Expected the canceled checkout to be expired, got: %s\n", checkout.Status)
+	}
+	paid, _ := server.Store.Listings.FindByID(paidID)
+	if paid.Hold == nil {
+		t.Fatal("Expected the paid checkout's listing to stay held until its event is applied")
+	}
+}
+
+// Returns the body of a Stripe event of <eventType> for a checkout session with <paymentStatus>
+func stripeEventPayload(t *testing.T, eventType string, paymentStatus string) []byte {
+	t.Helper()
+
+	event := map[string]any{
+		"id":   "evt_test_" + primitive.NewObjectID().Hex(),
+		"type": eventType,
+		"data": map[string]any{
+			"object": map[string]any{
+				"id":             "cs_test_paid",
+				"object":         "checkout.session",
+				"status":         "complete",
+				"payment_status": paymentStatus,
+				"amount_total":   760000,
+				"currency":       "usd",
+				"metadata": map[string]string{
+					"userID": BOB_ID.Hex(),
+				},
+				"shipping_details": map[string]any{
+					"address": map[string]string{"state": "RI", "city": "Providence", "line1": "105 Wizard Avenue", "postal_code": "02907"},
+				},
+			},
+		},
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestStripeProviderParseWebhook(t *testing.T) {
+	paid := stripeEventPayload(t, "checkout.session.completed", "paid")
+
+	// returns the headers Stripe sends <payload> with, signed with <secret> at <signedAt>
+	signed := func(payload []byte, secret string, signedAt time.Time) http.Header {
+		return signedWebhookRequest(payload, secret, signedAt).Header
+	}
+
+	tests := []struct {
+		name         string
+		payload      []byte
+		header       http.Header
+		tolerance    time.Duration // the provider's WebhookTolerance, or the default if 0
+		expectedErr  error
+		expectedType api.PaymentEventType
+	}{
+		{ // not signed
+			name:        "Test 1",
+			payload:     paid,
+			header:      http.Header{},
+			expectedErr: api.ErrInvalidWebhook,
+		},
+		{ // signed with another secret
+			name:        "Test 2",
+			payload:     paid,
+			header:      signed(paid, "whsec_someone_else", time.Now()),
+			expectedErr: api.ErrInvalidWebhook,
+		},
+		{ // signed longer ago than the default tolerance of 5 minutes
+			name:        "Test 3",
+			payload:     paid,
+			header:      signed(paid, TEST_WEBHOOK_SECRET, time.Now().Add(-10*time.Minute)),
+			expectedErr: api.ErrInvalidWebhook,
+		},
+		{ // the payload was changed after it was signed
+			name:        "Test 4",
+			payload:     bytes.Replace(paid, []byte(`"amount_total":760000`), []byte(`"amount_total":1`), 1),
+			header:      signed(paid, TEST_WEBHOOK_SECRET, time.Now()),
+			expectedErr: api.ErrInvalidWebhook,
+		},
+		{
+			name:         "Test 5",
+			payload:      paid,
+			header:       signed(paid, TEST_WEBHOOK_SECRET, time.Now()),
+			expectedType: api.PaymentCompleted,
+		},
+		{ // the payment is still processing, so it's not completed yet
+			name:         "Test 6",
+			payload:      stripeEventPayload(t, "checkout.session.completed", "unpaid"),
+			expectedType: "checkout.session.completed",
+		},
+		{
+			name:         "Test 7",
+			payload:      stripeEventPayload(t, "checkout.session.async_payment_succeeded", "paid"),
+			expectedType: api.PaymentCompleted,
+		},
+		{
+			name:         "Test 8",
+			payload:      stripeEventPayload(t, "checkout.session.async_payment_failed", "unpaid"),
+			expectedType: api.PaymentFailed,
+		},
+		{ // within a longer tolerance
+			name:         "Test 9",
+			payload:      stripeEventPayload(t, "checkout.session.expired", "unpaid"),
+			tolerance:    time.Hour,
+			expectedType: api.PaymentExpired,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tolerance := tc.tolerance
+			if tolerance == 0 {
+				tolerance = webhook.DefaultTolerance
+			}
+			provider := api.NewStripeProvider("", TEST_WEBHOOK_SECRET, tolerance)
+
+			header := tc.header
+			if header == nil {
+				header = signed(tc.payload, TEST_WEBHOOK_SECRET, time.Now().Add(-tolerance/2))
+			}
+
+			event, err := provider.ParseWebhook(tc.payload, header)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected error: %v, got: %v\n", tc.expectedErr, err)
+			}
+			if tc.expectedErr != nil {
+				return
+			}
+
+			if event.Type != tc.expectedType {
+				t.Fatalf("Expected type: %s, got: %s\n", tc.expectedType, event.Type)
+			}
+			checkout := event.Checkout
+			if checkout.ID != "cs_test_paid" || checkout.AmountTotal != types.Cents(760000) || checkout.Metadata["userID"] != BOB_ID.Hex() || checkout.ShippingAddress.Street != "105 Wizard Avenue" {
+				t.Fatalf("Expected the checkout session from the event, got: %+v\n", checkout)
+			}
+		})
+	}
+
+	// without a secret nothing can be verified, so nothing is accepted
+	server := newTestServer(t)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+	server.Payments = api.NewStripeProvider("", "", webhook.DefaultTolerance)
+
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, signedWebhookRequest(paid, "", time.Now()))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status code: %d, got: %d\n", http.StatusInternalServerError, w.Code)
+	}
+	if msg := strings.TrimSpace(w.Body.String()); msg != api.ErrWebhookNotConfigured {
+		t.Fatalf("Expected msg: %s, got: %s\n", api.ErrWebhookNotConfigured, msg)
+	}
+}
+
+func TestHandleAddressGET(t *testing.T) {
+	server := newTestServer(t)
+
+	/*-----------Fake logged in user 1-------------*/
+
+	session1 := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	userID1 := TESTACC_ID
+
+	// generating expected msg
+	expectedAddresses1, err := server.Store.Addresses.FindByUser(userID1)
+	if err != nil {
+		t.Fatal("Failed to find documents")
+	}
+
+	jsonData1, err := json.Marshal(expectedAddresses1)
+	if err != nil {
+		t.Fatal("Failed to marshal expectedAddresses1")
+	}
+
+	expectedMsg1 := string(jsonData1)
+
+	/*-----------------test cases------------------*/
+
+	tests := []struct {
+		name               string
+		sessionID          string
+		expectedStatusCode int
+		expectedMsg        string
+	}{
+		{ // valid
+			name:               "Test 1",
+			sessionID:          session1.SessionID,
+			expectedStatusCode: http.StatusOK,
+			expectedMsg:        expectedMsg1,
+		},
+		{ // unauthorized
+			name:               "Test 2",
+			sessionID:          "notloggedin",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedMsg:        api.ErrUnauthorized,
 		},
 	}
 
-	server := api.NewServer(":3000")
 	server.Use("GET /account/address", server.HandleAddressGET, api.AuthMiddleware)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1196,20 +2290,12 @@ func TestHandleAddressGET(t *testing.T) {
 }
 
 func TestHandleAddressPOST(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	sessionManager := api.GetSessionManager()
+	server := newTestServer(t)
 
 	/*-----------Fake logged in user 1-------------*/
 
-	session1, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "testtest-test-test-test-testtesttest",
-	})
-	if err != nil {
-		t.Fatal("Failed to create session for testuser1")
-	}
-	userID1, _ := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	session1.Store["userid"] = userID1
+	session1 := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	userID1 := TESTACC_ID
 
 	// addressID1, _ := primitive.ObjectIDFromHex("abcdefabcdefabcdefabcde1")
 	var testInputAddress1 types.ShippingAddress = types.ShippingAddress{
@@ -1250,7 +2336,6 @@ func TestHandleAddressPOST(t *testing.T) {
 		},
 	}
 
-	server := api.NewServer(":3000")
 	server.Use("POST /account/address", server.HandleAddressPOST, api.AuthMiddleware)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1273,6 +2358,18 @@ func TestHandleAddressPOST(t *testing.T) {
 			if res != tc.expectedMsg {
 				t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMsg, res)
 			}
+
+			// the new address should now belong to the user
+			addresses, _ := server.Store.Addresses.FindByUser(userID1)
+			found := false
+			for _, address := range addresses {
+				if address.Street == testInputAddress1.Street {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("Expected address with street: %s to be saved\n", testInputAddress1.Street)
+			}
 		})
 	}
 }
@@ -1285,20 +2382,12 @@ The AddressID should stay the same to make this test
 simpler by just checking for changes in the same document
 */
 func TestHandleAddressPUT(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	sessionManager := api.GetSessionManager()
+	server := newTestServer(t)
 
 	/*-----------Fake logged in user 1-------------*/
 
-	session1, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "testtest-test-test-test-testtesttest",
-	})
-	if err != nil {
-		t.Fatal("Failed to create session for testuser1")
-	}
-	userID1, _ := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	session1.Store["userid"] = userID1
+	session1 := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	userID1 := TESTACC_ID
 
 	/*-----------------test cases------------------*/
 
@@ -1368,7 +2457,6 @@ func TestHandleAddressPUT(t *testing.T) {
 		},
 	}
 
-	server := api.NewServer(":3000")
 	server.Use("PUT /account/address", server.HandleAddressPUT, api.AuthMiddleware)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1404,7 +2492,18 @@ func TestHandleAddressPUT(t *testing.T) {
 				t.Fatal("Failed to unmarshal payload into <inputChanges>")
 			}
 
-			shippingAddrCollection := db.GetCollection("shippingAddresses")
+			id, _ := primitive.ObjectIDFromHex(inputChanges.AddressID)
+			addresses, _ := server.Store.Addresses.FindByUser(userID1)
+			var address types.ShippingAddress
+			for _, a := range addresses {
+				if a.AddressID == id {
+					address = a
+				}
+			}
+			stored, err := bson.Marshal(address)
+			if err != nil {
+				t.Fatal(err)
+			}
 
 			inputKey := reflect.TypeOf(inputChanges.Changes)
 			inputValue := reflect.ValueOf(inputChanges.Changes)
@@ -1426,12 +2525,8 @@ func TestHandleAddressPUT(t *testing.T) {
 					*/
 					field.Name = strings.ToLower(string(cleanedStr1[0])) + cleanedStr1[1:]
 
-					id, _ := primitive.ObjectIDFromHex(inputChanges.AddressID)
-					res := shippingAddrCollection.FindOne(
-						context.Background(),
-						bson.M{"_id": id, field.Name: value.String()},
-					)
-					if res.Err() != nil {
+					storedValue, err := bson.Raw(stored).LookupErr(field.Name)
+					if err != nil || storedValue.StringValue() != value.String() {
 						t.Fatal("Failed to find document; failed to confirm changes")
 					}
 				}
@@ -1442,24 +2537,15 @@ func TestHandleAddressPUT(t *testing.T) {
 }
 
 func TestHandleAddressDELETE(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	sessionManager := api.GetSessionManager()
+	server := newTestServer(t)
 	/*-----------Fake logged in user 1-------------*/
 
-	session1, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "testtest-test-test-test-testtesttest",
-	})
-	if err != nil {
-		t.Fatal("Failed to create session for testuser1")
-	}
-	userID1, _ := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	session1.Store["userid"] = userID1
+	session1 := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	userID1 := TESTACC_ID
 
 	/*----------------------tests--------------------*/
 
 	// create a dummy address document to delete
-	shippingAddrColl := db.GetCollection("shippingAddresses")
 	mockAddr := types.ShippingAddress{
 		UserID:  userID1,
 		State:   "RI",
@@ -1468,11 +2554,22 @@ func TestHandleAddressDELETE(t *testing.T) {
 		ZipCode: "02905",
 		Default: false,
 	}
-	res, err := shippingAddrColl.InsertOne(context.Background(), mockAddr)
+	mockAddrID, err := server.Store.Addresses.Insert(mockAddr)
 	if err != nil {
 		t.Fatal("Failed to insert mock document")
 	}
 
+	// returns true if the user still has an address with <id>
+	addressExists := func(id primitive.ObjectID) bool {
+		addresses, _ := server.Store.Addresses.FindByUser(userID1)
+		for _, address := range addresses {
+			if address.AddressID == id {
+				return true
+			}
+		}
+		return false
+	}
+
 	tests := []struct {
 		name               string
 		sessionID          string
@@ -1485,7 +2582,7 @@ func TestHandleAddressDELETE(t *testing.T) {
 			name:               "Test 1",
 			sessionID:          session1.SessionID,
 			method:             "DELETE",
-			shippAddrID:        res.InsertedID.(primitive.ObjectID).Hex(),
+			shippAddrID:        mockAddrID.Hex(),
 			expectedStatusCode: http.StatusOK,
 			expectedMsg:        "success",
 		},
@@ -1507,7 +2604,6 @@ func TestHandleAddressDELETE(t *testing.T) {
 		},
 	}
 
-	server := api.NewServer(":3000")
 	server.Use("DELETE /account/address/{addressID}", server.HandleAddressDELETE, api.AuthMiddleware)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1523,14 +2619,8 @@ func TestHandleAddressDELETE(t *testing.T) {
 				Ensure mock document was inserted for valid request tests
 			*/
 			id, _ := primitive.ObjectIDFromHex(tc.shippAddrID)
-			if tc.expectedMsg == "success" {
-				res := shippingAddrColl.FindOne(
-					context.Background(),
-					bson.M{"_id": id},
-				)
-				if res.Err() != nil {
-					t.Fatal("Document did not get insert into DB properly")
-				}
+			if tc.expectedMsg == "success" && !addressExists(id) {
+				t.Fatal("Document did not get insert into DB properly")
 			}
 
 			server.Mux.ServeHTTP(w, r)
@@ -1546,34 +2636,19 @@ func TestHandleAddressDELETE(t *testing.T) {
 
 			/*------------check to verify document was deleted-----------*/
 
-			if w.Code == http.StatusOK && resMsg == "success" {
-				res := shippingAddrColl.FindOne(
-					context.Background(),
-					bson.M{"_id": id},
-				)
-
-				if res.Err() != mongo.ErrNoDocuments {
-					t.Fatal("Documented not deleted")
-				}
+			if w.Code == http.StatusOK && resMsg == "success" && addressExists(id) {
+				t.Fatal("Documented not deleted")
 			}
 		})
 	}
 }
 
 func TestHandlePurchaseHistory(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	sessionManager := api.GetSessionManager()
+	server := newTestServer(t)
 	/*-----------Fake logged in user 1-------------*/
 
-	session1, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "testtest-test-test-test-testtesttest",
-	})
-	if err != nil {
-		t.Fatal("Failed to create session for testuser1")
-	}
-	userID1, _ := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	session1.Store["userid"] = userID1
+	session1 := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	userID1 := TESTACC_ID
 
 	/*----------------------tests--------------------*/
 
@@ -1589,7 +2664,6 @@ func TestHandlePurchaseHistory(t *testing.T) {
 		},
 	}
 
-	server := api.NewServer(":3000")
 	server.Use("GET /account/purchase_history", server.HandlePurchaseHistory, api.AuthMiddleware)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1610,25 +2684,31 @@ func TestHandlePurchaseHistory(t *testing.T) {
 			if reflect.TypeOf(w.Body.String()).Kind() != reflect.String {
 				t.Fatal("Expected return msg to be a string")
 			}
+
+			// every receipt returned should belong to the buyer
+			var receipts []types.Receipt
+			if err := json.Unmarshal(w.Body.Bytes(), &receipts); err != nil {
+				t.Fatalf("Error decoding resulting string: %s\n", err.Error())
+			}
+			if len(receipts) == 0 {
+				t.Fatal("Expected the seeded receipt to be returned")
+			}
+			for _, receipt := range receipts {
+				if receipt.UserID != userID1 {
+					t.Fatalf("Expected receipt of UserID: %s, got: %s\n", userID1.Hex(), receipt.UserID.Hex())
+				}
+			}
 		})
 	}
 }
 
 func TestHandleGETUserFurnitureListings(t *testing.T) {
-	db.Init()
-	defer db.Close()
-	sessionManager := api.GetSessionManager()
+	server := newTestServer(t)
 
 	/*-----------Fake logged in user 1-------------*/
 
-	session1, err := sessionManager.CreateSession(api.SessionTemplate{
-		SessionID: "testtest-test-test-test-testtesttest",
-	})
-	if err != nil {
-		t.Fatal("Failed to create session for testuser1")
-	}
-	userID1, _ := primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
-	session1.Store["userid"] = userID1
+	session1 := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	userID1 := TESTACC_ID
 
 	/*----------------------tests--------------------*/
 
@@ -1646,7 +2726,6 @@ func TestHandleGETUserFurnitureListings(t *testing.T) {
 		},
 	}
 
-	server := api.NewServer(":3000")
 	server.Use("GET /account/furniture_listings", server.HandleGETUserFurnitureListings, api.AuthMiddleware)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1681,3 +2760,263 @@ func TestHandleGETUserFurnitureListings(t *testing.T) {
 	}
 
 }
+
+func TestHandleListingPUT(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("PUT /listings/{listingID}", server.HandleListingPUT, api.AuthMiddleware)
+
+	owner := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	other := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	sold := types.FurnitureListing{
+		Title: "Sold Chair", Description: "Already bought", Cost: types.Cents(10000), Type: types.Chair,
+		Style: types.Victorian, Condition: types.Good, Material: types.Oak,
+		ImageIDs: []primitive.ObjectID{primitive.NewObjectID()}, UserID: TESTACC_ID, Bought: true,
+	}
+	soldID, err := server.Store.Listings.Insert(sold)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	held := sold
+	held.Bought = false
+	held.Hold = &types.ListingHold{HoldID: "cs_test_held", UserID: BOB_ID, ExpiresAt: time.Now().Add(time.Hour)}
+	heldID, err := server.Store.Listings.Insert(held)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		sessionID          string
+		listingID          string
+		payload            string
+		expectedStatusCode int
+		expectedMsg        string
+	}{
+		{ // valid partial update
+			name:               "Test 1",
+			sessionID:          owner.SessionID,
+			listingID:          TEST_LISTING.Hex(),
+			payload:            `{"title": "Tiger Maple Highboy, circa 1800", "cost": 6800}`,
+			expectedStatusCode: http.StatusOK,
+			expectedMsg:        "success",
+		},
+		{ // not the owner
+			name:               "Test 2",
+			sessionID:          other.SessionID,
+			listingID:          TEST_LISTING.Hex(),
+			payload:            `{"cost": 1}`,
+			expectedStatusCode: http.StatusForbidden,
+			expectedMsg:        api.ErrNotListingOwner,
+		},
+		{ // fields sent empty fail validation
+			name:               "Test 3",
+			sessionID:          owner.SessionID,
+			listingID:          TEST_LISTING.Hex(),
+			payload:            `{"title": "", "cost": 0}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        `["` + api.ErrListFormNoCost + `","` + api.ErrListFormNoTitle + `"]`,
+		},
+		{ // no changes
+			name:               "Test 4",
+			sessionID:          owner.SessionID,
+			listingID:          TEST_LISTING.Hex(),
+			payload:            `{}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrListingNoChanges,
+		},
+		{ // already bought
+			name:               "Test 5",
+			sessionID:          owner.SessionID,
+			listingID:          soldID.Hex(),
+			payload:            `{"cost": 50}`,
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrListingSold,
+		},
+		{ // doesn't exist
+			name:               "Test 6",
+			sessionID:          owner.SessionID,
+			listingID:          primitive.NewObjectID().Hex(),
+			payload:            `{"cost": 50}`,
+			expectedStatusCode: http.StatusNotFound,
+			expectedMsg:        api.ErrListingNotFound,
+		},
+		{ // invalid ID
+			name:               "Test 7",
+			sessionID:          owner.SessionID,
+			listingID:          "testing-testing",
+			payload:            `{"cost": 50}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        primitive.ErrInvalidHex.Error(),
+		},
+		{ // a buyer is checking it out
+			name:               "Test 8",
+			sessionID:          owner.SessionID,
+			listingID:          heldID.Hex(),
+			payload:            `{"cost": 50}`,
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrListingHeld,
+		},
+		{ // a negative cost
+			name:               "Test 9",
+			sessionID:          owner.SessionID,
+			listingID:          TEST_LISTING.Hex(),
+			payload:            `{"cost": -50}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        `["` + api.ErrListFormInvalidCost + `"]`,
+		},
+		{ // a cost in another currency than buyers pay in
+			name:               "Test 10",
+			sessionID:          owner.SessionID,
+			listingID:          TEST_LISTING.Hex(),
+			payload:            `{"cost": "50.00 EUR"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        `["` + api.ErrListFormInvalidCost + `"]`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/listings/"+tc.listingID, strings.NewReader(tc.payload))
+			r.AddCookie(&http.Cookie{
+				Name:  api.SESSIONID_COOKIE_NAME,
+				Value: tc.sessionID,
+			})
+			w := httptest.NewRecorder()
+
+			server.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected status code: %d, got: %d\n", tc.expectedStatusCode, w.Code)
+			}
+
+			resMsg := strings.TrimSpace(w.Body.String())
+			if tc.expectedMsg != resMsg {
+				t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMsg, resMsg)
+			}
+		})
+	}
+
+	listing, _ := server.Store.Listings.FindByID(TEST_LISTING)
+	if listing.Title != "Tiger Maple Highboy, circa 1800" || listing.Cost != types.Cents(680000) {
+		t.Fatalf("Listing was not updated: %s %s\n", listing.Title, listing.Cost)
+	}
+	if listing.Description == "" || listing.Material != types.TigerMaple || len(listing.ImageIDs) == 0 {
+		t.Fatal("Fields that weren't provided were changed")
+	}
+
+	soldListing, _ := server.Store.Listings.FindByID(soldID)
+	if soldListing.Cost != sold.Cost {
+		t.Fatal("A bought listing was changed")
+	}
+}
+
+func TestHandleListingDELETE(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("DELETE /listings/{listingID}", server.HandleListingDELETE, api.AuthMiddleware)
+
+	owner := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	other := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	soldID, err := server.Store.Listings.Insert(types.FurnitureListing{
+		Title: "Sold Chair", UserID: TESTACC_ID, Bought: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	heldID, err := server.Store.Listings.Insert(types.FurnitureListing{
+		Title: "Held Chair", UserID: TESTACC_ID,
+		Hold: &types.ListingHold{HoldID: "cs_test_held", UserID: BOB_ID, ExpiresAt: time.Now().Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := server.Store.Listings.FindByID(TEST_LISTING)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		sessionID          string
+		listingID          primitive.ObjectID
+		expectedStatusCode int
+		expectedMsg        string
+		expectedDeleted    bool
+	}{
+		{ // not the owner
+			name:               "Test 1",
+			sessionID:          other.SessionID,
+			listingID:          TEST_LISTING,
+			expectedStatusCode: http.StatusForbidden,
+			expectedMsg:        api.ErrNotListingOwner,
+		},
+		{ // already bought
+			name:               "Test 2",
+			sessionID:          owner.SessionID,
+			listingID:          soldID,
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrListingSold,
+		},
+		{ // a buyer is checking it out
+			name:               "Test 3",
+			sessionID:          owner.SessionID,
+			listingID:          heldID,
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrListingHeld,
+		},
+		{ // valid
+			name:               "Test 4",
+			sessionID:          owner.SessionID,
+			listingID:          TEST_LISTING,
+			expectedStatusCode: http.StatusOK,
+			expectedMsg:        "success",
+			expectedDeleted:    true,
+		},
+		{ // already deleted
+			name:               "Test 5",
+			sessionID:          owner.SessionID,
+			listingID:          TEST_LISTING,
+			expectedStatusCode: http.StatusNotFound,
+			expectedMsg:        api.ErrListingNotFound,
+			expectedDeleted:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("DELETE", "/listings/"+tc.listingID.Hex(), nil)
+			r.AddCookie(&http.Cookie{
+				Name:  api.SESSIONID_COOKIE_NAME,
+				Value: tc.sessionID,
+			})
+			w := httptest.NewRecorder()
+
+			server.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected status code: %d, got: %d\n", tc.expectedStatusCode, w.Code)
+			}
+
+			resMsg := strings.TrimSpace(w.Body.String())
+			if tc.expectedMsg != resMsg {
+				t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMsg, resMsg)
+			}
+
+			_, err := server.Store.Listings.FindByID(tc.listingID)
+			if deleted := err == db.ErrNotFound; deleted != tc.expectedDeleted {
+				t.Fatalf("Expected listing deleted: %v, got: %v\n", tc.expectedDeleted, deleted)
+			}
+		})
+	}
+
+	// the deleted listing's images should be deleted with it
+	for _, imageID := range listing.ImageIDs {
+		if _, err := server.Store.Images.Get(imageID); err != db.ErrNotFound {
+			t.Fatalf("Expected image %s to be deleted, got: %v\n", imageID.Hex(), err)
+		}
+	}
+}
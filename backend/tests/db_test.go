@@ -2,9 +2,34 @@ package tests
 
 import (
 	"backend/db"
+	"backend/types"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+/*
+Returns the stores to run the repository tests against. The Mongo
+store is only included when a local database is reachable
+*/
+func testStores(t *testing.T) map[string]*db.Store {
+	stores := map[string]*db.Store{
+		"memory": newTestStore(t),
+	}
+
+	db.Init()
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(2 * time.Second); err == nil {
+		stores["mongo"] = db.NewMongoStore()
+	}
+
+	return stores
+}
+
 /*
 I have a sample user entry in the database for testing
 
@@ -19,7 +44,6 @@ password: "password123"
 email: "johnsmith@gmail.com"
 */
 func TestCheckFieldUniqueness(t *testing.T) {
-	db.Init()
 	tests := []struct {
 		name     string
 		field    string
@@ -82,14 +106,681 @@ func TestCheckFieldUniqueness(t *testing.T) {
 		},
 	}
 
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			isUnique := db.CheckFieldUniqueness(tc.field, tc.payload)
+	for name, store := range testStores(t) {
+		for _, tc := range tests {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				isUnique := store.Users.IsFieldUnique(tc.field, tc.payload)
+
+				if isUnique != tc.expected {
+					t.Fatalf("Expected: %v, got: %v\n", tc.expected, isUnique)
+				}
+			})
+		}
+	}
+}
+
+/*
+A reset token must only be usable once, even when two requests
+try to use it at the same time
+*/
+func TestPasswordResetConsume(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tokenHash := "consume-test-" + primitive.NewObjectID().Hex()
+			userID := primitive.NewObjectID()
+			t.Cleanup(func() { store.PasswordResets.DeleteByUser(userID) })
+
+			_, err := store.PasswordResets.Insert(types.PasswordReset{
+				TokenHash: tokenHash,
+				UserID:    userID,
+				ExpiresAt: time.Now().Add(time.Hour),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := store.PasswordResets.Consume(tokenHash, time.Now().Add(2*time.Hour)); err != db.ErrNotFound {
+				t.Fatalf("Expected an expired token to not be found, got: %v\n", err)
+			}
+
+			var wg sync.WaitGroup
+			var consumed atomic.Int32
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if reset, err := store.PasswordResets.Consume(tokenHash, time.Now()); err == nil && reset.UserID == userID {
+						consumed.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if consumed.Load() != 1 {
+				t.Fatalf("Expected the token to be consumed once, got: %d\n", consumed.Load())
+			}
+		})
+	}
+}
+
+func TestImageStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			imageID, err := store.Images.Save(TEST_IMAGE, "image/jpeg")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			image, err := store.Images.Get(imageID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if image.ImageID != imageID || image.ContentType != "image/jpeg" || string(image.Data) != string(TEST_IMAGE) {
+				t.Fatalf("Expected the saved image back, got: %+v\n", image)
+			}
+			if image.Hash == "" {
+				t.Fatal("Expected the image to have a hash")
+			}
+
+			variantID, err := store.Images.SaveVariant(imageID, types.ImageThumbnail, TEST_IMAGE[:2], "image/jpeg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			variant, err := store.Images.GetVariant(imageID, types.ImageThumbnail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if variant.ImageID != variantID || variant.ParentID != imageID || variant.Size != types.ImageThumbnail {
+				t.Fatalf("Expected the thumbnail of the image, got: %+v\n", variant)
+			}
+			if _, err := store.Images.GetVariant(imageID, types.ImageLarge); err != db.ErrNotFound {
+				t.Fatalf("Expected a missing variant to not be found, got: %v\n", err)
+			}
+
+			if err := store.Images.Delete(imageID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Images.Get(imageID); err != db.ErrNotFound {
+				t.Fatalf("Expected a deleted image to not be found, got: %v\n", err)
+			}
+			if _, err := store.Images.Get(variantID); err != db.ErrNotFound {
+				t.Fatalf("Expected the variants to be deleted with the image, got: %v\n", err)
+			}
+		})
+	}
+}
+
+func TestListingQuery(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// only the listings inserted here have this material, so the database's own listings don't match
+			material := types.FurnitureMaterial("Query Test " + primitive.NewObjectID().Hex())
+			costs := []int64{30000, 10000, 20000, 10000, 50000, 40000}
+
+			var inserted []types.FurnitureListing
+			for i, cost := range costs {
+				listing := types.FurnitureListing{
+					ListingID: primitive.NewObjectIDFromTimestamp(time.Now().Add(time.Duration(i) * time.Second)),
+					Title:     "Query listing",
+					Cost:      types.Cents(cost),
+					Type:      types.Chair,
+					Material:  material,
+					Bought:    i == len(costs)-1,
+				}
+				if _, err := store.Listings.Insert(listing); err != nil {
+					t.Fatal(err)
+				}
+				inserted = append(inserted, listing)
+			}
+			t.Cleanup(func() {
+				for _, listing := range inserted {
+					// DeleteUnsold only deletes listings that haven't been bought
+					store.Listings.Update(listing.ListingID, map[string]any{"bought": false})
+					store.Listings.DeleteUnsold(listing.ListingID, listing.UserID)
+				}
+			})
+
+			notBought := false
+			minCost, maxCost := types.Cents(15000), types.Cents(45000)
+			tests := []struct {
+				name          string
+				query         db.ListingQuery
+				expectedCosts []int64
+			}{
+				{name: "Test 1", query: db.ListingQuery{Sort: db.SortNewest}, expectedCosts: []int64{40000, 50000, 10000, 20000, 10000, 30000}},
+				{name: "Test 2", query: db.ListingQuery{Sort: db.SortOldest}, expectedCosts: []int64{30000, 10000, 20000, 10000, 50000, 40000}},
+				{name: "Test 3", query: db.ListingQuery{Sort: db.SortPriceLow}, expectedCosts: []int64{10000, 10000, 20000, 30000, 40000, 50000}},
+				{name: "Test 4", query: db.ListingQuery{Sort: db.SortPriceHigh}, expectedCosts: []int64{50000, 40000, 30000, 20000, 10000, 10000}},
+				{name: "Test 5", query: db.ListingQuery{Sort: db.SortPriceLow, Bought: &notBought}, expectedCosts: []int64{10000, 10000, 20000, 30000, 50000}},
+				{name: "Test 6", query: db.ListingQuery{Sort: db.SortPriceLow, MinCost: &minCost, MaxCost: &maxCost}, expectedCosts: []int64{20000, 30000, 40000}},
+				{name: "Test 7", query: db.ListingQuery{Types: []types.FurnitureType{types.Bed}}, expectedCosts: nil},
+			}
+
+			for _, tc := range tests {
+				t.Run(tc.name, func(t *testing.T) {
+					tc.query.Materials = []types.FurnitureMaterial{material}
+
+					// read two at a time, so ties in cost are split across pages
+					var costs []int64
+					tc.query.Limit = 2
+					for {
+						listings, err := store.Listings.Query(tc.query)
+						if err != nil {
+							t.Fatal(err)
+						}
+						for _, listing := range listings {
+							costs = append(costs, listing.Cost.Amount)
+						}
+						if len(listings) < tc.query.Limit {
+							break
+						}
+						after := db.CursorAfter(listings[len(listings)-1])
+						tc.query.After = &after
+					}
+
+					if fmt.Sprint(costs) != fmt.Sprint(tc.expectedCosts) {
+						t.Fatalf("Expected costs: %v, got: %v\n", tc.expectedCosts, costs)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestListingFacets(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// only the listings inserted here have this material, so the database's own listings don't match
+			material := types.FurnitureMaterial("Facets Test " + primitive.NewObjectID().Hex())
+			listings := []types.FurnitureListing{
+				{Cost: types.Cents(5000), Type: types.Chair, Style: types.Federal, Condition: types.Good},
+				{Cost: types.Cents(10000), Type: types.Chair, Style: types.Sheraton, Condition: types.Good},
+				{Cost: types.Cents(240000), Type: types.Table, Style: types.Federal, Condition: types.Mint},
+				{Cost: types.Cents(1200000), Type: types.Chest, Style: types.Federal, Condition: types.Restored},
+				{Cost: types.Cents(30000), Type: types.Bed, Style: types.Victorian, Condition: types.Worn, Bought: true},
+			}
+
+			var inserted []types.FurnitureListing
+			for _, listing := range listings {
+				listing.ListingID = primitive.NewObjectID()
+				listing.Material = material
+				if _, err := store.Listings.Insert(listing); err != nil {
+					t.Fatal(err)
+				}
+				inserted = append(inserted, listing)
+			}
+			t.Cleanup(func() {
+				for _, listing := range inserted {
+					store.Listings.Update(listing.ListingID, map[string]any{"bought": false})
+					store.Listings.DeleteUnsold(listing.ListingID, listing.UserID)
+				}
+			})
+
+			notBought := false
+			maxCost := types.Cents(100000)
+			tests := []struct {
+				name               string
+				query              db.ListingQuery
+				expectedTypes      string
+				expectedStyles     string
+				expectedConditions string
+				expectedPrices     []int // count of each of db.PRICE_BUCKETS
+				expectedMaterial   int   // count of the test material
+			}{
+				{
+					name:               "Test 1",
+					query:              db.ListingQuery{Bought: &notBought},
+					expectedTypes:      "[{Chair 2} {Chest 1} {Table 1}]",
+					expectedStyles:     "[{Federal 3} {Sheraton 1}]",
+					expectedConditions: "[{Good 2} {Mint 1} {Restored 1}]",
+					expectedPrices:     []int{1, 1, 0, 0, 1, 0, 0, 1},
+					expectedMaterial:   4,
+				},
+				{ // a facet isn't narrowed by its own filter
+					name:               "Test 2",
+					query:              db.ListingQuery{Bought: &notBought, Types: []types.FurnitureType{types.Chair}},
+					expectedTypes:      "[{Chair 2} {Chest 1} {Table 1}]",
+					expectedStyles:     "[{Federal 1} {Sheraton 1}]",
+					expectedConditions: "[{Good 2}]",
+					expectedPrices:     []int{1, 1, 0, 0, 0, 0, 0, 0},
+					expectedMaterial:   2,
+				},
+				{
+					name:               "Test 3",
+					query:              db.ListingQuery{MaxCost: &maxCost, Styles: []types.FurnitureStyle{types.Federal}},
+					expectedTypes:      "[{Chair 1}]",
+					expectedStyles:     "[{Federal 1} {Sheraton 1} {Victorian 1}]",
+					expectedConditions: "[{Good 1}]",
+					expectedPrices:     []int{1, 0, 0, 0, 1, 0, 0, 1},
+					expectedMaterial:   1,
+				},
+				{
+					name:               "Test 4",
+					query:              db.ListingQuery{Conditions: []types.FurnitureCondition{types.Excellent}},
+					expectedTypes:      "[]",
+					expectedStyles:     "[]",
+					expectedConditions: "[{Good 2} {Mint 1} {Restored 1} {Worn 1}]",
+					expectedPrices:     []int{0, 0, 0, 0, 0, 0, 0, 0},
+					expectedMaterial:   0,
+				},
+			}
+
+			for _, tc := range tests {
+				t.Run(tc.name, func(t *testing.T) {
+					tc.query.Materials = []types.FurnitureMaterial{material}
+
+					facets, err := store.Listings.Facets(tc.query)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if got := fmt.Sprint(facets.Types); got != tc.expectedTypes {
+						t.Fatalf("Expected types: %s, got: %s\n", tc.expectedTypes, got)
+					}
+					if got := fmt.Sprint(facets.Styles); got != tc.expectedStyles {
+						t.Fatalf("Expected styles: %s, got: %s\n", tc.expectedStyles, got)
+					}
+					if got := fmt.Sprint(facets.Conditions); got != tc.expectedConditions {
+						t.Fatalf("Expected conditions: %s, got: %s\n", tc.expectedConditions, got)
+					}
+
+					if len(facets.Prices) != len(db.PRICE_BUCKETS) {
+						t.Fatalf("Expected %d price buckets, got: %d\n", len(db.PRICE_BUCKETS), len(facets.Prices))
+					}
+					var prices []int
+					for i, bucket := range facets.Prices {
+						if bucket.Min != types.Cents(db.PRICE_BUCKETS[i]) {
+							t.Fatalf("Expected bucket %d to start at %v, got: %v\n", i, db.PRICE_BUCKETS[i], bucket.Min)
+						}
+						prices = append(prices, bucket.Count)
+					}
+					if fmt.Sprint(prices) != fmt.Sprint(tc.expectedPrices) {
+						t.Fatalf("Expected prices: %v, got: %v\n", tc.expectedPrices, prices)
+					}
+
+					// the material facet counts the database's other listings too, so only look at the test material
+					count := 0
+					for _, facet := range facets.Materials {
+						if facet.Value == string(material) {
+							count = facet.Count
+						}
+					}
+					if count != tc.expectedMaterial {
+						t.Fatalf("Expected %d listings of the test material, got: %d\n", tc.expectedMaterial, count)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestListingSearch(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if name == "mongo" {
+				if err := db.CreateIndexes(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// a word no other listing has, so listings left by other tests don't match
+			word := "searchtest" + primitive.NewObjectID().Hex()
+			sellerID := primitive.NewObjectID()
+			var listingIDs []primitive.ObjectID
+			for _, listing := range []types.FurnitureListing{
+				{Title: "Walnut Highboy " + word, Description: "Federal highboy", UserID: sellerID},
+				{Title: "Maple Tallboy", Description: "A " + word + " in maple", UserID: sellerID},
+				{Title: "Oak Chair " + word, Bought: true, UserID: sellerID},
+			} {
+				listingID, err := store.Listings.Insert(listing)
+				if err != nil {
+					t.Fatal(err)
+				}
+				listingIDs = append(listingIDs, listingID)
+			}
+			t.Cleanup(func() {
+				for _, listingID := range listingIDs {
+					store.Listings.Update(listingID, map[string]any{"bought": false})
+					store.Listings.DeleteUnsold(listingID, sellerID)
+				}
+			})
+
+			notBought := false
+			found, err := store.Listings.Search(db.ListingQuery{Bought: &notBought}, []string{word}, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the title counts for more than the description, and the bought listing is filtered out
+			if len(found) != 2 || found[0].Title != "Walnut Highboy "+word {
+				t.Fatalf("Expected the 2 listings that aren't bought, title match first, got: %+v\n", found)
+			}
+
+			if found, _ := store.Listings.Search(db.ListingQuery{}, []string{word}, 1); len(found) != 1 {
+				t.Fatalf("Expected the limit of 1 listing, got: %d\n", len(found))
+			}
+			if found, _ := store.Listings.Search(db.ListingQuery{}, []string{word + "x"}, 10); len(found) != 0 {
+				t.Fatalf("Expected no listings for a word none of them have, got: %+v\n", found)
+			}
+		})
+	}
+}
+
+func TestListingHolds(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			sellerID := primitive.NewObjectID()
+			var listingIDs []primitive.ObjectID
+			for i := 0; i < 3; i++ {
+				listingID, err := store.Listings.Insert(types.FurnitureListing{Title: "Hold listing", Cost: types.Cents(10000), UserID: sellerID})
+				if err != nil {
+					t.Fatal(err)
+				}
+				listingIDs = append(listingIDs, listingID)
+			}
+			t.Cleanup(func() {
+				for _, listingID := range listingIDs {
+					store.Listings.Update(listingID, map[string]any{"bought": false, "hold": nil})
+					store.Listings.DeleteUnsold(listingID, sellerID)
+				}
+			})
+
+			now := time.Now()
+			holdA := types.ListingHold{HoldID: "cs_test_a_" + primitive.NewObjectID().Hex(), UserID: BOB_ID, ExpiresAt: now.Add(time.Hour)}
+			holdB := types.ListingHold{HoldID: "cs_test_b_" + primitive.NewObjectID().Hex(), UserID: JOHNSMITH_ID, ExpiresAt: now.Add(time.Hour)}
 
-			if isUnique != tc.expected {
-				t.Fatalf("Expected: %v, got: %v\n", tc.expected, isUnique)
+			// returns the ID of the hold on each listing, or "" for none
+			holders := func() string {
+				var ids []string
+				for _, listingID := range listingIDs {
+					listing, err := store.Listings.FindByID(listingID)
+					if err != nil {
+						t.Fatal(err)
+					}
+					switch {
+					case listing.Bought:
+						ids = append(ids, "bought")
+					case listing.Hold == nil:
+						ids = append(ids, "")
+					default:
+						ids = append(ids, listing.Hold.HoldID)
+					}
+				}
+				return fmt.Sprint(ids)
+			}
+
+			if err := store.Listings.Hold(listingIDs[:2], holdA, now); err != nil {
+				t.Fatal(err)
+			}
+
+			// B overlaps A on the second listing, so it doesn't get the third either
+			if err := store.Listings.Hold(listingIDs[1:], holdB, now); err != db.ErrListingUnavailable {
+				t.Fatalf("Expected ErrListingUnavailable, got: %v\n", err)
+			}
+			if got, expected := holders(), fmt.Sprint([]string{holdA.HoldID, holdA.HoldID, ""}); got != expected {
+				t.Fatalf("Expected holds: %s, got: %s\n", expected, got)
+			}
+
+			// the seller can't change a listing while it's held
+			if err := store.Listings.UpdateUnsold(listingIDs[0], sellerID, map[string]any{"cost": 1}); err != db.ErrNotFound {
+				t.Fatalf("Expected a held listing to not be updated, got: %v\n", err)
+			}
+
+			// a hold can only be released by its buyer
+			if released, _ := store.Listings.ReleaseHold(holdA.HoldID, JOHNSMITH_ID); released != 0 {
+				t.Fatalf("Expected another user's hold to not be released, got: %d\n", released)
+			}
+
+			// once A expires, B can take the listings over
+			if err := store.Listings.Hold(listingIDs[1:], holdB, now.Add(2*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if got, expected := holders(), fmt.Sprint([]string{holdA.HoldID, holdB.HoldID, holdB.HoldID}); got != expected {
+				t.Fatalf("Expected holds: %s, got: %s\n", expected, got)
+			}
+
+			// only the holder can buy a listing, and only once
+			if err := store.Listings.SellHeld(listingIDs[1], holdA.HoldID); err != db.ErrNotFound {
+				t.Fatalf("Expected A to not buy B's listing, got: %v\n", err)
+			}
+			if err := store.Listings.SellHeld(listingIDs[0], holdA.HoldID); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Listings.SellHeld(listingIDs[0], holdB.HoldID); err != db.ErrNotFound {
+				t.Fatalf("Expected a listing to only be sold once, got: %v\n", err)
+			}
+
+			// selling it again to the checkout that bought it, when its event is applied again, still counts
+			if err := store.Listings.SellHeld(listingIDs[0], holdA.HoldID); err != nil {
+				t.Fatalf("Expected the listing to still be sold to A, got: %v\n", err)
+			}
+
+			if released, err := store.Listings.ReleaseHold(holdB.HoldID, JOHNSMITH_ID); err != nil || released != 2 {
+				t.Fatalf("Expected 2 listings released, got: %d, %v\n", released, err)
+			}
+			if got, expected := holders(), fmt.Sprint([]string{"bought", "", ""}); got != expected {
+				t.Fatalf("Expected holds: %s, got: %s\n", expected, got)
+			}
+
+			// a bought listing can't be held again
+			if err := store.Listings.Hold(listingIDs[:1], holdB, now); err != db.ErrListingUnavailable {
+				t.Fatalf("Expected ErrListingUnavailable, got: %v\n", err)
+			}
+
+			// when many buyers race for the same listing, exactly one of them gets it
+			var wg sync.WaitGroup
+			var won atomic.Int32
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					hold := types.ListingHold{HoldID: fmt.Sprintf("cs_test_race_%d_%s", i, primitive.NewObjectID().Hex()), UserID: BOB_ID, ExpiresAt: now.Add(time.Hour)}
+					if err := store.Listings.Hold(listingIDs[1:], hold, now); err == nil {
+						won.Add(1)
+					}
+				}(i)
+			}
+			wg.Wait()
+			if won.Load() != 1 {
+				t.Fatalf("Expected 1 buyer to hold the listings, got: %d\n", won.Load())
+			}
+		})
+	}
+}
+
+func TestEventStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			event := types.ProcessedEvent{
+				EventID:     "evt_test_" + primitive.NewObjectID().Hex(),
+				Type:        "checkout.session.completed",
+				ProcessedAt: time.Now(),
+			}
+
+			if processed, err := store.Events.IsProcessed(event.EventID); err != nil || processed {
+				t.Fatalf("Expected the event not to be processed yet, got: %v %v\n", processed, err)
+			}
+
+			// when the same event is applied by many deliveries at once, exactly one records it
+			var wg sync.WaitGroup
+			var recorded atomic.Int32
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := store.Events.Record(event); err == nil {
+						recorded.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			if recorded.Load() != 1 {
+				t.Fatalf("Expected 1 delivery to record the event, got: %d\n", recorded.Load())
+			}
+
+			if processed, err := store.Events.IsProcessed(event.EventID); err != nil || !processed {
+				t.Fatalf("Expected the event to be processed, got: %v %v\n", processed, err)
+			}
+			if err := store.Events.Record(event); err != db.ErrEventProcessed {
+				t.Fatalf("Expected ErrEventProcessed, got: %v\n", err)
+			}
+		})
+	}
+}
+
+func TestInsertReceiptForCheckout(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			buyerID := primitive.NewObjectID()
+			checkoutID := "cs_test_" + primitive.NewObjectID().Hex()
+
+			// the same checkout's event applied many times at once still saves one receipt
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := store.Receipts.InsertForCheckout(types.Receipt{UserID: buyerID, CheckoutID: checkoutID}); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			receipts, err := store.Receipts.FindByUser(buyerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(receipts) != 1 || receipts[0].CheckoutID != checkoutID {
+				t.Fatalf("Expected one receipt for the checkout, got: %+v\n", receipts)
+			}
+		})
+	}
+}
+
+func TestLedgerStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// entries are never deleted, so each run posts to accounts of its own
+			seller := types.SellerAccount(primitive.NewObjectID())
+			checkoutID := "cs_test_" + primitive.NewObjectID().Hex()
+			entries := []types.JournalEntry{
+				{Key: checkoutID + "/sale", Type: types.EntrySale, From: types.AccountClearing, To: seller, Amount: types.Cents(10000)},
+				{Key: checkoutID + "/processor_fee", Type: types.EntryProcessorFee, From: seller, To: types.AccountProcessorFees, Amount: types.Cents(320)},
+				{Key: checkoutID + "/platform_fee", Type: types.EntryPlatformFee, From: seller, To: types.AccountPlatformRevenue, Amount: types.Cents(484)},
+			}
+			for _, entry := range entries {
+				entry.CheckoutID = checkoutID
+				entry.PostedAt = time.Now()
+				if _, err := store.Ledger.Insert(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the same entry can't be posted twice
+			if _, err := store.Ledger.Insert(entries[0]); err != db.ErrEntryPosted {
+				t.Fatalf("Expected ErrEntryPosted, got: %v\n", err)
+			}
+
+			balance, err := store.Ledger.Balance(seller)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if balance != types.Cents(9196) {
+				t.Fatalf("Expected a balance of: %s, got: %s\n", types.Cents(9196), balance)
+			}
+
+			// pages of the account's entries come newest first
+			page, err := store.Ledger.FindByAccount(seller, primitive.NilObjectID, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) != 2 || page[0].Type != types.EntryPlatformFee || page[1].Type != types.EntryProcessorFee {
+				t.Fatalf("Expected the 2 newest entries, got: %+v\n", page)
+			}
+			page, err = store.Ledger.FindByAccount(seller, page[1].EntryID, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) != 1 || page[0].Type != types.EntrySale {
+				t.Fatalf("Expected the oldest entry, got: %+v\n", page)
+			}
+
+			// only the entries of the given types posted since then count
+			sum, err := store.Ledger.SumSince(seller, time.Now().Add(-time.Hour), []types.JournalEntryType{types.EntrySale, types.EntryPlatformFee})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum != types.Cents(10000-484) {
+				t.Fatalf("Expected a sum of: %s, got: %s\n", types.Cents(10000-484), sum)
+			}
+			sum, err = store.Ledger.SumSince(seller, time.Now().Add(time.Hour), []types.JournalEntryType{types.EntrySale})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sum.IsZero() {
+				t.Fatalf("Expected no entries since an hour from now, got: %s\n", sum)
+			}
+		})
+	}
+}
+
+func TestAddToBalance(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			userID, err := store.Users.Insert(types.User{
+				Username: "balance_" + primitive.NewObjectID().Hex(),
+				Balance:  types.Cents(100),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// balances changed at the same time all count, and a change retried at the same time counts once
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(2)
+				for range 2 {
+					go func() {
+						defer wg.Done()
+						if err := store.Users.AddToBalance(userID, types.Cents(1), fmt.Sprint("credit/", i)); err != nil {
+							t.Error(err)
+						}
+					}()
+				}
+			}
+			wg.Wait()
+			if err := store.Users.AddToBalance(userID, types.Cents(-25), "debit"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Users.AddToBalance(userID, types.Cents(-25), "debit"); err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := store.Users.FindByID(userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Balance != types.Cents(125) {
+				t.Fatalf("Expected a balance of: %s, got: %s\n", types.Cents(125), user.Balance)
+			}
+
+			// a withdrawal can't leave less than what's kept in the balance
+			if err := store.Users.TakeFromBalance(userID, types.Cents(100), types.Cents(26)); err != db.ErrNotFound {
+				t.Fatalf("Expected ErrNotFound for a balance that's too low, got: %v\n", err)
+			}
+			if err := store.Users.TakeFromBalance(userID, types.Cents(100), types.Cents(25)); err != nil {
+				t.Fatal(err)
+			}
+			if user, _ := store.Users.FindByID(userID); user.Balance != types.Cents(25) {
+				t.Fatalf("Expected a balance of: %s, got: %s\n", types.Cents(25), user.Balance)
+			}
+
+			if err := store.Users.AddToBalance(userID, types.NewMoney(100, types.EUR), "euros"); err != db.ErrNotFound {
+				t.Fatalf("Expected ErrNotFound for another currency, got: %v\n", err)
+			}
+			if err := store.Users.AddToBalance(primitive.NewObjectID(), types.Cents(1), "missing"); err != db.ErrNotFound {
+				t.Fatalf("Expected ErrNotFound for a missing user, got: %v\n", err)
 			}
 		})
 	}
-	db.Close()
 }
@@ -8,63 +8,90 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func TestDecimal128ToFloat64(t *testing.T) {
-	payload1, _ := primitive.ParseDecimal128("128.57")
-	payload2, _ := primitive.ParseDecimal128("7401.80")
-
+func TestDecimal128ToCents(t *testing.T) {
 	tests := []struct {
-		name     string
-		payload  primitive.Decimal128
-		expected float64
+		name        string
+		payload     string
+		expected    int64
+		expectedErr error
 	}{
 		{
 			name:     "Test 1",
-			payload:  payload1,
-			expected: 128.57,
+			payload:  "128.57",
+			expected: 12857,
 		},
 		{
 			name:     "Test 2",
-			payload:  payload2,
-			expected: 7401.80,
+			payload:  "7401.8",
+			expected: 740180,
+		},
+		{ // fractions of a cent are rounded to the nearest cent
+			name:     "Test 3",
+			payload:  "0.019",
+			expected: 2,
 		},
-	}
-
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			res := util.Decimal128ToFloat64(tc.payload)
-
-			if res != tc.expected {
-				t.Fatalf("Expected: %f, got: %f\n", tc.expected, res)
-			}
-		})
-	}
-}
-
-func TestFloat64ToDecimal128(t *testing.T) {
-	tests := []struct {
-		name     string
-		payload  float64
-		expected string
-	}{
 		{
-			name:     "Test 1",
-			payload:  10500.45,
-			expected: "10500.45",
+			name:     "Test 4",
+			payload:  "1E+3",
+			expected: 100000,
 		},
 		{
-			name:     "Test 2",
-			payload:  53025.99,
-			expected: "53025.99",
+			name:     "Test 5",
+			payload:  "-10.50",
+			expected: -1050,
+		},
+		{
+			name:        "Test 6",
+			payload:     "NaN",
+			expectedErr: util.ErrNotCents,
+		},
+		{ // too many cents for an int64
+			name:        "Test 7",
+			payload:     "1E+30",
+			expectedErr: util.ErrNotCents,
+		},
+		{ // half a cent is rounded to the even cent, like $round does
+			name:     "Test 8",
+			payload:  "0.005",
+			expected: 0,
+		},
+		{
+			name:     "Test 9",
+			payload:  "0.015",
+			expected: 2,
+		},
+		{
+			name:     "Test 10",
+			payload:  "12.345",
+			expected: 1234,
+		},
+		{
+			name:     "Test 11",
+			payload:  "-0.015",
+			expected: -2,
+		},
+		{ // past half a cent
+			name:     "Test 12",
+			payload:  "0.0051",
+			expected: 1,
+		},
+		{
+			name:     "Test 13",
+			payload:  "-7.1049",
+			expected: -710,
 		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			res := util.Float64ToDecimal128(tc.payload)
-			check, _ := primitive.ParseDecimal128(tc.expected)
+			dec, _ := primitive.ParseDecimal128(tc.payload)
+			res, err := util.Decimal128ToCents(dec)
 
-			if res != check {
-				t.Fatalf("Expected: %s, got: %s\n", tc.expected, res.String())
+			if err != tc.expectedErr {
+				t.Fatalf("Expected error: %v, got: %v\n", tc.expectedErr, err)
+			}
+			if res != tc.expected {
+				t.Fatalf("Expected: %d, got: %d\n", tc.expected, res)
 			}
 		})
 	}
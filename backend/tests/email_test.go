@@ -1,8 +1,6 @@
 package tests
 
 import (
-	"backend/api"
-	"backend/db"
 	"backend/types"
 	"testing"
 
@@ -25,7 +23,7 @@ func TestSendNewListingNotificationEmail(t *testing.T) {
 				ListingID:   primitive.NewObjectID(),
 				Title:       "Bobby",
 				Description: "Flay",
-				Cost:        500,
+				Cost:        types.Cents(50000),
 				Type:        "Chair",
 				Style:       "Boring",
 				Condition:   "Great",
@@ -36,11 +34,10 @@ func TestSendNewListingNotificationEmail(t *testing.T) {
 		},
 	}
 
-	db.Init()
-	defer db.Close()
+	server := newTestServer(t)
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			err := api.SendNewListingNotificationEmail(tc.input)
+			err := server.SendNewListingNotificationEmail(tc.input)
 			if err != nil {
 				t.Fatalf("Test: Error occurred while sending emails: %s\n", err.Error())
 			}
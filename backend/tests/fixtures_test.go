@@ -0,0 +1,286 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/db"
+	"backend/types"
+	"backend/util"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v76/webhook"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+IDs of the documents seeded by newTestStore. They match the documents
+in database_dump, so the tests read the same as when they were written
+against the local MongoDB
+*/
+var (
+	BOB_ID, _         = primitive.ObjectIDFromHex("65a5a07f062510f606cbd0ae")
+	JOHNSMITH_ID, _   = primitive.ObjectIDFromHex("65a5a26f062510f606cbd0af")
+	TESTUSER1_ID, _   = primitive.ObjectIDFromHex("65a69f20a8ae63c4ddc98038")
+	TESTACC_ID, _     = primitive.ObjectIDFromHex("65b094f4a2cb3bf5e40d42d7")
+	TEST_LISTING, _   = primitive.ObjectIDFromHex("65bf607585af14e593096ea1")
+	TEST_ADDRESS, _   = primitive.ObjectIDFromHex("65c3f9c52dd8587a26714756")
+	TEST_RECEIPT, _   = primitive.ObjectIDFromHex("65c061473e8e189ccb683b55")
+	TEST_SUB_ORDER, _ = primitive.ObjectIDFromHex("65c061473e8e189ccb683b56")
+	TEST_SESSION_ID   = "testtest-test-test-test-testtesttest"
+	BOB_SESSION_ID    = "bobbobbo-bobb-bobb-bobb-bobbobbobbob"
+	TESTUSER1_PASS    = "testpassword1"
+	TESTACC_PASSWORD  = "password123"
+	TEST_IMAGE        = []byte{0xff, 0xd8, 0xff, 0xe0} // start of a JPEG
+
+	TEST_WEBHOOK_SECRET = "whsec_test_secret"
+)
+
+var (
+	hashedPasswordsMu sync.Mutex
+	hashedPasswords   = make(map[string]string)
+)
+
+/*
+Returns an in-memory store seeded with the sample users, listing,
+address and receipt that the API tests rely on
+*/
+func newTestStore(t *testing.T) *db.Store {
+	t.Helper()
+	store := db.NewMemoryStore()
+
+	hash := func(password string) string {
+		hashedPasswordsMu.Lock()
+		defer hashedPasswordsMu.Unlock()
+
+		// bcrypt is slow on purpose, so only hash each password once per test run
+		if hashed, exists := hashedPasswords[password]; exists {
+			return hashed
+		}
+		hashed, err := util.HashPassword(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashedPasswords[password] = hashed
+		return hashed
+	}
+
+	users := []types.User{
+		{UserID: BOB_ID, Username: "bob", Email: "bob@gmail.com", Password: hash("bob"), EmailVerified: true},
+		{UserID: JOHNSMITH_ID, Username: "johnsmith", Email: "johnsmith@gmail.com", Password: hash("password123"), EmailVerified: true},
+		{UserID: TESTUSER1_ID, Username: "testuser1", Email: "test@gmail.com", Password: hash(TESTUSER1_PASS), EmailVerified: true},
+		{
+			UserID:        TESTACC_ID,
+			Username:      "testacc",
+			Email:         "testacc@gmail.com",
+			Password:      hash(TESTACC_PASSWORD),
+			Phone:         "101-111-4444",
+			Balance:       types.Cents(10516244),
+			EmailVerified: true,
+		},
+	}
+	for _, user := range users {
+		if _, err := store.Users.Insert(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// as MigrateOpeningBalances would post it, so the ledger adds up to the balance
+	_, err := store.Ledger.Insert(types.JournalEntry{
+		Key:      "opening_balance/" + TESTACC_ID.Hex(),
+		Type:     types.EntryOpeningBalance,
+		From:     types.AccountOpeningBalances,
+		To:       types.SellerAccount(TESTACC_ID),
+		Amount:   types.Cents(10516244),
+		PostedAt: time.Now().Add(-365 * 24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageID, err := store.Images.Save(TEST_IMAGE, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Listings.Insert(types.FurnitureListing{
+		ListingID:   TEST_LISTING,
+		Title:       "Tiger Maple Highboy",
+		Description: "Federal tiger maple highboy with original brasses",
+		Cost:        types.Cents(750000),
+		Type:        types.Chest,
+		Style:       types.Federal,
+		Condition:   types.OriginalFinish,
+		Material:    types.TigerMaple,
+		ImageIDs:    []primitive.ObjectID{imageID},
+		UserID:      TESTACC_ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Addresses.Insert(types.ShippingAddress{
+		AddressID: TEST_ADDRESS,
+		UserID:    TESTACC_ID,
+		State:     "RI",
+		City:      "Providence",
+		Street:    "105 Wizard Avenue",
+		ZipCode:   "02907",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Receipts.Insert(types.Receipt{
+		OrderID:       TEST_RECEIPT,
+		PaymentMethod: "Credit",
+		TotalCost:     types.Cents(750000),
+		SubOrders: []types.SubOrder{{
+			SubOrderID:    TEST_SUB_ORDER,
+			SellerID:      TESTACC_ID,
+			Items:         []types.ProductItem{{ListingID: TEST_LISTING, SellerID: TESTACC_ID}},
+			Subtotal:      types.Cents(750000),
+			Status:        types.OrderPaid,
+			StatusHistory: []types.OrderStatusChange{{Status: types.OrderPaid}},
+		}},
+		UserID: TESTACC_ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+/*
+Returns a server backed by a freshly seeded in-memory store. Emails
+are recorded by a fakeMailer instead of being sent, checkouts are paid
+through a FakePaymentProvider and withdrawals through a FakePayoutProvider
+*/
+func newTestServer(t *testing.T) *api.Server {
+	t.Helper()
+	server := api.NewServer(":3000", newTestStore(t))
+	server.Mailer = &fakeMailer{}
+	server.Payments = api.NewFakePaymentProvider("http://localhost:3000")
+	server.Payouts = api.NewFakePayoutProvider("http://localhost:3000")
+	return server
+}
+
+// Returns the payment provider of a server from newTestServer
+func fakePayments(server *api.Server) *api.FakePaymentProvider {
+	return server.Payments.(*api.FakePaymentProvider)
+}
+
+// Returns the payout provider of a server from newTestServer
+func fakePayouts(server *api.Server) *api.FakePayoutProvider {
+	return server.Payouts.(*api.FakePayoutProvider)
+}
+
+type sentEmail struct {
+	to      string
+	subject string
+	body    string
+}
+
+// A Mailer that keeps the emails it's given so tests can read them
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []sentEmail
+}
+
+func (f *fakeMailer) Send(to string, subject string, body string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sent = append(f.sent, sentEmail{to: to, subject: subject, body: body})
+	return nil
+}
+
+// Returns the emails sent to <to>, oldest first
+func (f *fakeMailer) sentTo(to string) []sentEmail {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var emails []sentEmail
+	for _, email := range f.sent {
+		if email.to == to {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+/*
+Simulates a logged in client by creating a session with <sessionID>
+that belongs to <userID> and has <roles>, or types.DEFAULT_ROLES if none
+are provided. The session is deleted when the test ends
+*/
+func fakeLogin(t *testing.T, sessionID string, userID primitive.ObjectID, roles ...types.Role) *api.Session {
+	t.Helper()
+	sessionManager := api.GetSessionManager()
+
+	if len(roles) == 0 {
+		roles = types.DEFAULT_ROLES
+	}
+
+	// when logging in, the userid and roles get saved into the session store
+	session, err := sessionManager.CreateSession(api.SessionTemplate{
+		SessionID: sessionID,
+		Values:    api.SessionValues{"userid": userID, "roles": roles},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create fake session %s: %s\n", sessionID, err.Error())
+	}
+
+	t.Cleanup(func() {
+		sessionManager.DeleteSession(session.SessionID)
+	})
+
+	return session
+}
+
+var emailedTokenPattern = regexp.MustCompile(`token=(\S+)`)
+
+/*
+Returns the token from the link in the most recent email sent to <email>,
+like an email verification or password reset link
+*/
+func emailedToken(t *testing.T, server *api.Server, email string) string {
+	t.Helper()
+
+	emails := server.Mailer.(*fakeMailer).sentTo(email)
+	if len(emails) == 0 {
+		t.Fatalf("No email was sent to %s\n", email)
+	}
+
+	match := emailedTokenPattern.FindStringSubmatch(emails[len(emails)-1].body)
+	if match == nil {
+		t.Fatal("Email does not contain a token")
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+/*
+Returns a webhook request with <payload> and a Stripe-Signature header
+signed with <secret> at <signedAt>, the way Stripe signs its requests
+*/
+func signedWebhookRequest(payload []byte, secret string, signedAt time.Time) *http.Request {
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload:   payload,
+		Secret:    secret,
+		Timestamp: signedAt,
+	})
+
+	r := httptest.NewRequest("POST", "/checkout_webhook", bytes.NewReader(payload))
+	r.Header.Set("Stripe-Signature", signed.Header)
+	return r
+}
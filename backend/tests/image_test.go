@@ -1,8 +1,19 @@
 package tests
 
 import (
+	"backend/api"
+	"backend/db"
+	"backend/types"
 	"backend/util"
+	"bytes"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func TestEncodeImageToBase64(t *testing.T) {
@@ -12,3 +23,188 @@ func TestEncodeImageToBase64(t *testing.T) {
 		t.Fatalf("Expected base64 encoded string, got empty string")
 	}
 }
+
+func TestHandleGetImage(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("GET /images/{imageID}", server.HandleGetImage)
+
+	listing, err := server.Store.Listings.FindByID(TEST_LISTING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageID := listing.ImageIDs[0]
+
+	// the ETag the first response has, sent back by Test 2
+	image, err := server.Store.Images.Get(imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := `"` + image.Hash + `"`
+
+	tests := []struct {
+		name               string
+		imageID            string
+		ifNoneMatch        string
+		expectedStatusCode int
+		expectedBody       []byte
+	}{
+		{name: "Test 1", imageID: imageID.Hex(), expectedStatusCode: http.StatusOK, expectedBody: TEST_IMAGE},
+		{name: "Test 2", imageID: imageID.Hex(), ifNoneMatch: etag, expectedStatusCode: http.StatusNotModified, expectedBody: []byte{}},
+		{name: "Test 3", imageID: primitive.NewObjectID().Hex(), expectedStatusCode: http.StatusNotFound, expectedBody: []byte(api.ErrImageNotFound + "\n")},
+		{name: "Test 4", imageID: "notanid", expectedStatusCode: http.StatusBadRequest, expectedBody: []byte(primitive.ErrInvalidHex.Error() + "\n")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/images/"+tc.imageID, nil)
+			if tc.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tc.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			server.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected status code: %d, got: %d\n", tc.expectedStatusCode, w.Code)
+			}
+			if !bytes.Equal(w.Body.Bytes(), tc.expectedBody) {
+				t.Fatalf("Expected body: %v, got: %v\n", tc.expectedBody, w.Body.Bytes())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			if contentType := w.Header().Get("Content-Type"); contentType != "image/jpeg" {
+				t.Fatalf("Expected Content-Type: image/jpeg, got: %s\n", contentType)
+			}
+			if w.Header().Get("ETag") != etag {
+				t.Fatalf("Expected ETag: %s, got: %s\n", etag, w.Header().Get("ETag"))
+			}
+			if w.Header().Get("Cache-Control") != api.IMAGE_CACHE_CONTROL {
+				t.Fatalf("Expected Cache-Control: %s, got: %s\n", api.IMAGE_CACHE_CONTROL, w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+// Listings should only reference their images, so fetching listings doesn't send every image
+func TestListingsReferenceImages(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("GET /get_furnitures", server.HandleGetFurnitures)
+
+	r := httptest.NewRequest("GET", "/get_furnitures", nil)
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, r)
+
+	res := w.Body.String()
+	if strings.Contains(res, `"images"`) {
+		t.Fatalf("Expected listings without embedded images, got: %s\n", res)
+	}
+	if !strings.Contains(res, `"imageIds"`) {
+		t.Fatalf("Expected listings with imageIds, got: %s\n", res)
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	tests := []struct {
+		name            string
+		width, height   int
+		maxSide         int
+		expectedResized bool
+		expectedWidth   int
+		expectedHeight  int
+	}{
+		{name: "Test 1", width: 800, height: 400, maxSide: 200, expectedResized: true, expectedWidth: 200, expectedHeight: 100},
+		{name: "Test 2", width: 400, height: 800, maxSide: 200, expectedResized: true, expectedWidth: 100, expectedHeight: 200},
+		{name: "Test 3", width: 150, height: 100, maxSide: 200, expectedResized: false, expectedWidth: 150, expectedHeight: 100},
+		{name: "Test 4", width: 2000, height: 1, maxSide: 200, expectedResized: true, expectedWidth: 200, expectedHeight: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(0, 0, tc.width, tc.height))
+			resized, ok := util.ResizeImage(img, tc.maxSide)
+
+			if ok != tc.expectedResized {
+				t.Fatalf("Expected resized: %v, got: %v\n", tc.expectedResized, ok)
+			}
+			if bounds := resized.Bounds(); bounds.Dx() != tc.expectedWidth || bounds.Dy() != tc.expectedHeight {
+				t.Fatalf("Expected %dx%d, got: %dx%d\n", tc.expectedWidth, tc.expectedHeight, bounds.Dx(), bounds.Dy())
+			}
+		})
+	}
+}
+
+func TestHandleGetImageSize(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("GET /images/{imageID}", server.HandleGetImage)
+
+	// 750x550, so it gets a thumbnail and a medium variant but no large one
+	data, err := os.ReadFile("../tests/test_images/tiger_maple1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageID, err := db.SaveImageWithVariants(server.Store.Images, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TEST_IMAGE can't be decoded, so it has no variants at all
+	listing, err := server.Store.Listings.FindByID(TEST_LISTING)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+		expectedMaxSide    int  // longest side of the image served
+		expectedOriginal   bool // whether the uploaded bytes are served as they are
+	}{
+		{name: "Test 1", url: "/images/" + imageID.Hex() + "?size=thumbnail", expectedStatusCode: http.StatusOK, expectedMaxSide: 200},
+		{name: "Test 2", url: "/images/" + imageID.Hex() + "?size=medium", expectedStatusCode: http.StatusOK, expectedMaxSide: 600},
+		{name: "Test 3", url: "/images/" + imageID.Hex() + "?size=large", expectedStatusCode: http.StatusOK, expectedMaxSide: 750, expectedOriginal: true},
+		{name: "Test 4", url: "/images/" + imageID.Hex() + "?size=original", expectedStatusCode: http.StatusOK, expectedMaxSide: 750, expectedOriginal: true},
+		{name: "Test 5", url: "/images/" + imageID.Hex(), expectedStatusCode: http.StatusOK, expectedMaxSide: 750, expectedOriginal: true},
+		{name: "Test 6", url: "/images/" + imageID.Hex() + "?size=huge", expectedStatusCode: http.StatusBadRequest},
+		{name: "Test 7", url: "/images/" + listing.ImageIDs[0].Hex() + "?size=thumbnail", expectedStatusCode: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.url, nil)
+			w := httptest.NewRecorder()
+			server.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected status code: %d, got: %d\n", tc.expectedStatusCode, w.Code)
+			}
+			if w.Code != http.StatusOK || tc.expectedMaxSide == 0 {
+				return
+			}
+
+			if tc.expectedOriginal != bytes.Equal(w.Body.Bytes(), data) {
+				t.Fatalf("Expected the original image to be served: %v\n", tc.expectedOriginal)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "image/jpeg" {
+				t.Fatalf("Expected Content-Type: image/jpeg, got: %s\n", contentType)
+			}
+
+			config, _, err := image.DecodeConfig(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if side := max(config.Width, config.Height); side != tc.expectedMaxSide {
+				t.Fatalf("Expected the longest side to be %d, got: %d\n", tc.expectedMaxSide, side)
+			}
+		})
+	}
+
+	// the variants are deleted with the image
+	if err := server.Store.Images.Delete(imageID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Store.Images.GetVariant(imageID, types.ImageThumbnail); err != db.ErrNotFound {
+		t.Fatalf("Expected the thumbnail to be deleted with the image, got: %v\n", err)
+	}
+}
@@ -0,0 +1,340 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/types"
+	"backend/util"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fake EXIF data with a GPS tag, which should never be kept
+var TEST_EXIF = []byte("Exif\x00\x00MM\x00*GPSLatitude=41.8240")
+
+/*
+Little endian EXIF of a photo taken with the camera turned, so it has to
+be rotated 90° clockwise, with a description that should never be kept
+*/
+var ROTATED_EXIF = []byte("II*\x00\x08\x00\x00\x00" +
+	"\x02\x00" + // two entries
+	"\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00" + // Orientation, a short of 6
+	"\x0e\x01\x02\x00\x08\x00\x00\x00\x26\x00\x00\x00" + // ImageDescription, 8 characters at 38
+	"\x00\x00\x00\x00" + // no next directory
+	"41.8240\x00")
+
+// the EXIF that should be kept of ROTATED_EXIF, with only its orientation
+var ORIENTATION_EXIF = []byte("MM\x00*\x00\x00\x00\x08" +
+	"\x00\x01" +
+	"\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00" +
+	"\x00\x00\x00\x00")
+
+type uploadFile struct {
+	name string
+	data []byte
+}
+
+// Returns a /list_furniture multipart body for <listing> with <files> as its furniture_images
+func listingForm(t *testing.T, listing types.FurnitureListing, files []uploadFile) (*bytes.Buffer, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	jsonPart, err := writer.CreateFormField("json_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewEncoder(jsonPart).Encode(listing); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		filePart, err := writer.CreateFormFile("furniture_images", file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filePart.Write(file.data)
+	}
+
+	writer.Close()
+	return &body, writer.FormDataContentType()
+}
+
+func readTestImage(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("../tests/test_images/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Returns a PNG that is <width> by <height> pixels, with a text chunk if <text> isn't empty
+func testPNG(t *testing.T, width, height int, text string) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if text == "" {
+		return buf.Bytes()
+	}
+	return withPNGChunk(buf.Bytes(), "tEXt", []byte(text))
+}
+
+// Returns <data> with a <chunkType> chunk inserted right before IEND, which is always the last 12 bytes
+func withPNGChunk(data []byte, chunkType string, chunkData []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(chunkData)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, chunkData...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	iend := len(data) - 12
+	return append(append(append([]byte{}, data[:iend]...), chunk...), data[iend:]...)
+}
+
+// Returns <data> with an APP1 segment of <exif> inserted right after the start of image marker
+func withJPEGExif(data []byte, exif []byte) []byte {
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(exif)+2))
+	segment = append(segment, exif...)
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+/*
+Returns <data> with an EXIF chunk added to the end and the EXIF flag of
+its VP8X chunk set, the way an extended WebP with metadata is laid out
+*/
+func withWebPExif(data []byte, exif []byte) []byte {
+	webp := append([]byte{}, data...)
+	webp = append(webp, "EXIF"...)
+	webp = binary.LittleEndian.AppendUint32(webp, uint32(len(exif)))
+	webp = append(webp, exif...)
+	if len(exif)%2 == 1 {
+		webp = append(webp, 0)
+	}
+	webp[20] |= 0x08 // the flags are the first byte of the VP8X data
+	binary.LittleEndian.PutUint32(webp[4:], uint32(len(webp)-8))
+	return webp
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		format      string
+		metadata    []byte // should be gone from the stripped image
+		kept        []byte // should still be in the stripped image
+		expectedErr error
+	}{
+		{name: "Test 1", data: withJPEGExif(readTestImage(t, "tiger_maple1.jpg"), TEST_EXIF), format: "jpeg", metadata: TEST_EXIF},
+		{name: "Test 2", data: testPNG(t, 300, 300, "Comment\x00taken at 41.8240"), format: "png", metadata: []byte("41.8240")},
+		{name: "Test 3", data: withWebPExif(readTestImage(t, "yellow_rose.webp"), TEST_EXIF), format: "webp", metadata: TEST_EXIF},
+		{name: "Test 4", data: readTestImage(t, "tiger_maple1.jpg")[:100], format: "jpeg", expectedErr: util.ErrMalformedImage},
+		{name: "Test 5", data: []byte("RIFF\x00\x00\x00\x00WEBPVP8X\xff\xff"), format: "webp", expectedErr: util.ErrMalformedImage},
+
+		// rotated photos keep their orientation, so they're still shown upright
+		{
+			name:     "Test 6",
+			data:     withJPEGExif(readTestImage(t, "tiger_maple1.jpg"), append([]byte("Exif\x00\x00"), ROTATED_EXIF...)),
+			format:   "jpeg",
+			metadata: []byte("41.8240"),
+			kept:     append([]byte("\xff\xe1\x00\x22Exif\x00\x00"), ORIENTATION_EXIF...),
+		},
+		{
+			name:     "Test 7",
+			data:     withPNGChunk(testPNG(t, 300, 300, ""), "eXIf", ROTATED_EXIF),
+			format:   "png",
+			metadata: []byte("41.8240"),
+			kept:     append([]byte("\x00\x00\x00\x1aeXIf"), ORIENTATION_EXIF...),
+		},
+		{
+			name:     "Test 8",
+			data:     withWebPExif(readTestImage(t, "yellow_rose.webp"), ROTATED_EXIF),
+			format:   "webp",
+			metadata: []byte("41.8240"),
+			kept:     append([]byte("EXIF\x1a\x00\x00\x00"), ORIENTATION_EXIF...),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stripped, err := util.StripImageMetadata(tc.data, tc.format)
+			if err != tc.expectedErr {
+				t.Fatalf("Expected err: %v, got: %v\n", tc.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if bytes.Contains(stripped, tc.metadata) {
+				t.Fatal("Expected the metadata to be stripped")
+			}
+			if !bytes.Contains(stripped, tc.kept) {
+				t.Fatal("Expected the orientation to be kept")
+			}
+			if tc.format == "webp" && (stripped[20]&0x08 != 0) != (tc.kept != nil) {
+				t.Fatalf("Expected the VP8X EXIF flag to be set: %v\n", tc.kept != nil)
+			}
+
+			// the image itself should be untouched
+			original, _, err := util.DecodeImage(tc.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, format, err := util.DecodeImage(stripped)
+			if err != nil {
+				t.Fatalf("Failed to decode the stripped image: %s\n", err.Error())
+			}
+			if format != tc.format || img.Bounds() != original.Bounds() {
+				t.Fatalf("Expected a %s of %v, got a %s of %v\n", tc.format, original.Bounds(), format, img.Bounds())
+			}
+		})
+	}
+}
+
+func TestHandleListFurnitureImageValidation(t *testing.T) {
+	listing := types.FurnitureListing{
+		Title:       "Cherry Farm Table Sheraton Style",
+		Description: "Selling my lovely Cherry Farm Table",
+		Type:        types.Table,
+		Cost:        types.Cents(270000),
+		Style:       types.Sheraton,
+		Condition:   types.Good,
+		Material:    types.Cherry,
+	}
+
+	jpeg := readTestImage(t, "tiger_maple1.jpg")
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+
+	var tooMany []uploadFile
+	for i := 0; i <= api.MAX_LISTING_IMAGES; i++ {
+		tooMany = append(tooMany, uploadFile{name: "table.jpg", data: jpeg})
+	}
+
+	// each one is under the per image limit, but not all together
+	almostTooLarge := append(append([]byte{}, jpeg[:2]...), make([]byte, api.MAX_IMAGE_SIZE-2)...)
+	var tooLargeTogether []uploadFile
+	for i := 0; i <= api.MAX_LISTING_UPLOAD_SIZE/api.MAX_IMAGE_SIZE; i++ {
+		tooLargeTogether = append(tooLargeTogether, uploadFile{name: "table.jpg", data: almostTooLarge})
+	}
+
+	tests := []struct {
+		name                string
+		files               []uploadFile
+		expectedStatusCode  int
+		expectedFormErrors  []string
+		expectedImageErrors []api.ImageFormError
+	}{
+		{ // accepted, with its EXIF stripped
+			name:               "Test 1",
+			files:              []uploadFile{{name: "table.jpg", data: withJPEGExif(jpeg, TEST_EXIF)}},
+			expectedStatusCode: http.StatusOK,
+		},
+		{ // a GIF named like a JPEG, and a PNG that's too small
+			name:               "Test 2",
+			files:              []uploadFile{{name: "table.jpg", data: jpeg}, {name: "sneaky.jpg", data: gif}, {name: "tiny.png", data: testPNG(t, 50, 50, "")}},
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFormErrors: []string{api.ErrListFormImageType, api.ErrListFormImageDimensions},
+			expectedImageErrors: []api.ImageFormError{
+				{Index: 1, Filename: "sneaky.jpg", Error: api.ErrListFormImageType},
+				{Index: 2, Filename: "tiny.png", Error: api.ErrListFormImageDimensions},
+			},
+		},
+		{ // a file over the per image limit
+			name:                "Test 3",
+			files:               []uploadFile{{name: "huge.jpg", data: append(almostTooLarge, 0, 0)}},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedFormErrors:  []string{api.ErrListFormImageTooLarge},
+			expectedImageErrors: []api.ImageFormError{{Index: 0, Filename: "huge.jpg", Error: api.ErrListFormImageTooLarge}},
+		},
+		{ // more images than a listing can have
+			name:               "Test 4",
+			files:              tooMany,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFormErrors: []string{api.ErrListFormTooManyImages},
+		},
+		{ // more bytes than a listing can upload
+			name:               "Test 5",
+			files:              tooLargeTogether,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	server := newTestServer(t)
+	server.Use("POST /list_furniture", server.HandleListFurniture, api.AuthMiddleware)
+	session := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body, contentType := listingForm(t, listing, tc.files)
+			r := httptest.NewRequest("POST", "/list_furniture", body)
+			r.Header.Set("Content-Type", contentType)
+			r.AddCookie(&http.Cookie{Name: api.SESSIONID_COOKIE_NAME, Value: session.SessionID})
+			w := httptest.NewRecorder()
+			server.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected status code: %d, got: %d (%s)\n", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+
+			if w.Code == http.StatusOK {
+				listingID, err := primitive.ObjectIDFromHex(w.Body.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				saved, err := server.Store.Listings.FindByID(listingID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				image, err := server.Store.Images.Get(saved.ImageIDs[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(image.Data, TEST_EXIF) {
+					t.Fatal("Expected the EXIF data to be stripped before saving")
+				}
+				return
+			}
+			if tc.expectedFormErrors == nil {
+				return
+			}
+
+			var formErrs api.ListFormErrors
+			if tc.expectedImageErrors == nil {
+				err := json.Unmarshal(w.Body.Bytes(), &formErrs.FormErrors)
+				if err != nil {
+					t.Fatalf("Expected a JSON array of form errors, got: %s\n", w.Body.String())
+				}
+			} else if err := json.Unmarshal(w.Body.Bytes(), &formErrs); err != nil {
+				t.Fatalf("Expected a JSON object of form errors, got: %s\n", w.Body.String())
+			}
+
+			gotFormErrs, _ := json.Marshal(formErrs.FormErrors)
+			expectedFormErrs, _ := json.Marshal(tc.expectedFormErrors)
+			if string(gotFormErrs) != string(expectedFormErrs) {
+				t.Fatalf("Expected form errors: %s, got: %s\n", expectedFormErrs, gotFormErrs)
+			}
+			gotImageErrs, _ := json.Marshal(formErrs.ImageErrors)
+			expectedImageErrs, _ := json.Marshal(tc.expectedImageErrors)
+			if string(gotImageErrs) != string(expectedImageErrs) {
+				t.Fatalf("Expected image errors: %s, got: %s\n", expectedImageErrs, gotImageErrs)
+			}
+		})
+	}
+}
@@ -38,7 +38,7 @@ func TestReadJSONReq(t *testing.T) {
 		Title:       "English Tiger maple queen bed",
 		Description: "My favorite bed",
 		Type:        "Bed",
-		Cost:        7500,
+		Cost:        types.Cents(750000),
 		Style:       "English",
 		Condition:   "Great",
 		Material:    "Tiger Maple",
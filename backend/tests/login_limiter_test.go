@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"backend/api"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Replaces the limiter's clock with one that only moves when the returned
+function is called, so lockouts can be tested without sleeping
+*/
+func fakeLimiterClock(limiter *api.LoginLimiter) (advance func(time.Duration)) {
+	now := time.Now()
+	limiter.SetClock(func() time.Time { return now })
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	limiter := api.NewLoginLimiter()
+	advance := fakeLimiterClock(limiter)
+	policy := api.ACCOUNT_LOGIN_POLICY
+
+	for i := 1; i <= policy.FreeAttempts; i++ {
+		limiter.RecordFailure("bob", "10.0.0.1")
+		if wait := limiter.RetryAfter("bob", "10.0.0.1"); wait != 0 {
+			t.Fatalf("Failure %d: expected no lockout, got: %v\n", i, wait)
+		}
+	}
+
+	// every failure after the free ones doubles the lockout
+	expected := policy.BaseDelay
+	for i := 0; i < 5; i++ {
+		limiter.RecordFailure("bob", "10.0.0.1")
+		if wait := limiter.RetryAfter("bob", "10.0.0.1"); wait != expected {
+			t.Fatalf("Expected lockout: %v, got: %v\n", expected, wait)
+		}
+		advance(expected)
+		expected *= 2
+	}
+
+	// the lockout is per account, so another user on another IP isn't affected
+	if wait := limiter.RetryAfter("johnsmith", "10.0.0.2"); wait != 0 {
+		t.Fatalf("Expected another account to not be locked, got: %v\n", wait)
+	}
+
+	// it never goes above the max
+	for i := 0; i < 40; i++ {
+		limiter.RecordFailure("bob", "10.0.0.1")
+	}
+	if wait := limiter.RetryAfter("bob", "10.0.0.1"); wait != policy.MaxDelay {
+		t.Fatalf("Expected lockout: %v, got: %v\n", policy.MaxDelay, wait)
+	}
+
+	// failures are forgotten after the window
+	advance(api.LOGIN_FAILURE_WINDOW)
+	limiter.RecordFailure("bob", "10.0.0.3")
+	if wait := limiter.RetryAfter("bob", "10.0.0.3"); wait != 0 {
+		t.Fatalf("Expected old failures to be forgotten, got lockout: %v\n", wait)
+	}
+}
+
+// Guessing a different username every time is still limited by IP
+func TestLoginLimiterPerIP(t *testing.T) {
+	limiter := api.NewLoginLimiter()
+	fakeLimiterClock(limiter)
+
+	for i := 0; i < api.IP_LOGIN_POLICY.FreeAttempts; i++ {
+		limiter.RecordFailure("user"+string(rune('a'+i)), "10.0.0.1")
+	}
+	if wait := limiter.RetryAfter("someone", "10.0.0.1"); wait != 0 {
+		t.Fatalf("Expected no lockout yet, got: %v\n", wait)
+	}
+
+	limiter.RecordFailure("another", "10.0.0.1")
+	if wait := limiter.RetryAfter("someone", "10.0.0.1"); wait != api.IP_LOGIN_POLICY.BaseDelay {
+		t.Fatalf("Expected the IP to be locked out for %v, got: %v\n", api.IP_LOGIN_POLICY.BaseDelay, wait)
+	}
+	if wait := limiter.RetryAfter("someone", "10.0.0.2"); wait != 0 {
+		t.Fatalf("Expected other IPs to not be locked, got: %v\n", wait)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /login", server.HandleLogin)
+	server.Use("GET /unlock_account", server.HandleUnlockAccount)
+	advance := fakeLimiterClock(server.Limiter)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		payload := `{"username": "testuser1", "password": "` + password + `"}`
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(payload))
+		w := httptest.NewRecorder()
+		server.Mux.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 1; i <= api.ACCOUNT_LOGIN_POLICY.FreeAttempts; i++ {
+		if w := login("wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Failure %d: expected code: %d, got: %d\n", i, http.StatusUnauthorized, w.Code)
+		}
+	}
+
+	w := login("wrong")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected code: %d, got: %d\n", http.StatusTooManyRequests, w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Fatalf("Expected Retry-After: 1, got: %q\n", retryAfter)
+	}
+
+	// even the right password is turned away while locked out
+	if w := login(TESTUSER1_PASS); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected code: %d, got: %d\n", http.StatusTooManyRequests, w.Code)
+	}
+
+	// keep failing until the owner is emailed
+	for i := api.ACCOUNT_LOGIN_POLICY.FreeAttempts + 1; i < api.LOGIN_UNLOCK_EMAIL_AFTER; i++ {
+		advance(api.ACCOUNT_LOGIN_POLICY.MaxDelay)
+		login("wrong")
+	}
+	if w := login(TESTUSER1_PASS); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected code: %d, got: %d\n", http.StatusTooManyRequests, w.Code)
+	}
+
+	token := emailedToken(t, server, "test@gmail.com")
+	w = httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, httptest.NewRequest("GET", "/unlock_account?token=bad", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a bad token to get code: %d, got: %d\n", http.StatusBadRequest, w.Code)
+	}
+
+	// the token expires by the limiter's clock
+	advance(api.UNLOCK_ACCOUNT_TTL + time.Second)
+	w = httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, httptest.NewRequest("GET", "/unlock_account?token="+token, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an expired token to get code: %d, got: %d\n", http.StatusBadRequest, w.Code)
+	}
+	advance(-api.UNLOCK_ACCOUNT_TTL - time.Second)
+
+	w = httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, httptest.NewRequest("GET", "/unlock_account?token="+token, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to unlock account: %d %s\n", w.Code, w.Body.String())
+	}
+
+	w = login(TESTUSER1_PASS)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code: %d, got: %d %s\n", http.StatusOK, w.Code, w.Body.String())
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == api.SESSIONID_COOKIE_NAME {
+			t.Cleanup(func() { api.GetSessionManager().DeleteSession(cookie.Value) })
+		}
+	}
+}
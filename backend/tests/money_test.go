@@ -0,0 +1,319 @@
+package tests
+
+import (
+	"backend/types"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		name          string
+		payload       string
+		currency      types.Currency
+		expected      types.Money
+		expectedError error
+	}{
+		{
+			name:     "Test 1",
+			payload:  "125.50",
+			currency: types.USD,
+			expected: types.Cents(12550),
+		},
+		{
+			name:     "Test 2",
+			payload:  "0.29",
+			currency: types.USD,
+			expected: types.Cents(29),
+		},
+		{
+			name:     "Test 3",
+			payload:  "-7",
+			currency: types.EUR,
+			expected: types.NewMoney(-700, types.EUR),
+		},
+		{
+			name:     "Test 4",
+			payload:  "1500",
+			currency: types.JPY,
+			expected: types.NewMoney(1500, types.JPY),
+		},
+		{ // a fraction of a cent
+			name:          "Test 5",
+			payload:       "10.005",
+			currency:      types.USD,
+			expectedError: types.ErrInvalidMoney,
+		},
+		{ // yen have no minor units
+			name:          "Test 6",
+			payload:       "1500.5",
+			currency:      types.JPY,
+			expectedError: types.ErrInvalidMoney,
+		},
+		{
+			name:          "Test 7",
+			payload:       "ten dollars",
+			currency:      types.USD,
+			expectedError: types.ErrInvalidMoney,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := types.ParseMoney(tc.payload, tc.currency)
+
+			if err != tc.expectedError {
+				t.Fatalf("Expected error: %v, got: %v\n", tc.expectedError, err)
+			}
+			if res != tc.expected {
+				t.Fatalf("Expected: %+v, got: %+v\n", tc.expected, res)
+			}
+		})
+	}
+}
+
+func TestMoneyMulRatio(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  types.Money
+		num      int64
+		den      int64
+		rounding types.Rounding
+		expected types.Money
+	}{
+		{ // 2.9% of 17.50 is 50.75 cents
+			name:     "Test 1",
+			payload:  types.Cents(1750),
+			num:      29,
+			den:      1000,
+			rounding: types.RoundHalfUp,
+			expected: types.Cents(51),
+		},
+		{
+			name:     "Test 2",
+			payload:  types.Cents(1750),
+			num:      29,
+			den:      1000,
+			rounding: types.RoundDown,
+			expected: types.Cents(50),
+		},
+		{ // halves round away from zero
+			name:     "Test 3",
+			payload:  types.Cents(-5),
+			num:      1,
+			den:      2,
+			rounding: types.RoundHalfUp,
+			expected: types.Cents(-3),
+		},
+		{ // and RoundDown rounds toward zero
+			name:     "Test 4",
+			payload:  types.Cents(-5),
+			num:      1,
+			den:      2,
+			rounding: types.RoundDown,
+			expected: types.Cents(-2),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := tc.payload.MulRatio(tc.num, tc.den, tc.rounding)
+
+			if res != tc.expected {
+				t.Fatalf("Expected: %s, got: %s\n", tc.expected, res)
+			}
+		})
+	}
+}
+
+func TestMoneyAllocate(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  types.Money
+		weights  []int64
+		expected []int64
+	}{
+		{ // the cent left over goes to the part that lost the most to rounding
+			name:     "Test 1",
+			payload:  types.Cents(539),
+			weights:  []int64{10000, 5000, 2550},
+			expected: []int64{307, 154, 78},
+		},
+		{ // ties go to the earliest part
+			name:     "Test 2",
+			payload:  types.Cents(100),
+			weights:  []int64{1, 1, 1},
+			expected: []int64{34, 33, 33},
+		},
+		{
+			name:     "Test 3",
+			payload:  types.Cents(-100),
+			weights:  []int64{1, 1, 1},
+			expected: []int64{-34, -33, -33},
+		},
+		{
+			name:     "Test 4",
+			payload:  types.Cents(100),
+			weights:  []int64{0, 0},
+			expected: []int64{0, 0},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := tc.payload.Allocate(tc.weights)
+
+			var amounts []int64
+			for _, part := range res {
+				amounts = append(amounts, part.Amount)
+			}
+			if fmt.Sprint(amounts) != fmt.Sprint(tc.expected) {
+				t.Fatalf("Expected: %v, got: %v\n", tc.expected, amounts)
+			}
+		})
+	}
+}
+
+func TestMoneyAddCurrencyMismatch(t *testing.T) {
+	// the zero value can be added to any currency
+	if sum := (types.Money{}).Add(types.NewMoney(500, types.EUR)); sum != types.NewMoney(500, types.EUR) {
+		t.Fatalf("Expected: 5.00 EUR, got: %s\n", sum)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected adding dollars to euros to panic")
+		}
+	}()
+	types.Cents(500).Add(types.NewMoney(500, types.EUR))
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		name         string
+		payload      types.Money
+		expectedJSON string
+	}{
+		{
+			name:         "Test 1",
+			payload:      types.Cents(12550),
+			expectedJSON: `"125.50"`,
+		},
+		{
+			name:         "Test 2",
+			payload:      types.Cents(-7),
+			expectedJSON: `"-0.07"`,
+		},
+		{
+			name:         "Test 3",
+			payload:      types.NewMoney(1500, types.JPY),
+			expectedJSON: `"1500 JPY"`,
+		},
+		{
+			name:         "Test 4",
+			payload:      types.NewMoney(990, types.EUR),
+			expectedJSON: `"9.90 EUR"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(tc.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.expectedJSON {
+				t.Fatalf("Expected JSON: %s, got: %s\n", tc.expectedJSON, data)
+			}
+
+			var res types.Money
+			if err := json.Unmarshal(data, &res); err != nil {
+				t.Fatal(err)
+			}
+			if res != tc.payload {
+				t.Fatalf("Expected: %+v, got: %+v\n", tc.payload, res)
+			}
+		})
+	}
+
+	// the listing form sends costs as JSON numbers
+	var listing types.FurnitureListing
+	if err := json.Unmarshal([]byte(`{"cost": 34.99}`), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if listing.Cost != types.Cents(3499) {
+		t.Fatalf("Expected: %s, got: %s\n", types.Cents(3499), listing.Cost)
+	}
+	if err := json.Unmarshal([]byte(`{"cost": 34.999}`), &listing); err != types.ErrInvalidMoney {
+		t.Fatalf("Expected error: %v, got: %v\n", types.ErrInvalidMoney, err)
+	}
+	if err := json.Unmarshal([]byte(`{"cost": "34.99 XYZ"}`), &listing); err != types.ErrUnknownCurrency {
+		t.Fatalf("Expected error: %v, got: %v\n", types.ErrUnknownCurrency, err)
+	}
+}
+
+/*
+Documents saved before money was types.Money hold plain numbers of dollars,
+and are read as cents of the default currency until they're migrated
+*/
+func TestMoneyBSON(t *testing.T) {
+	legacyDecimal, _ := primitive.ParseDecimal128("105162.44")
+
+	tests := []struct {
+		name     string
+		payload  any
+		expected types.Money
+	}{
+		{
+			name:     "Test 1",
+			payload:  types.NewMoney(990, types.EUR),
+			expected: types.NewMoney(990, types.EUR),
+		},
+		{
+			name:     "Test 2",
+			payload:  125.5,
+			expected: types.Cents(12550),
+		},
+		{ // 0.29 is a little under 29 cents as a double
+			name:     "Test 3",
+			payload:  0.29,
+			expected: types.Cents(29),
+		},
+		{
+			name:     "Test 4",
+			payload:  int32(7500),
+			expected: types.Cents(750000),
+		},
+		{
+			name:     "Test 5",
+			payload:  int64(7500),
+			expected: types.Cents(750000),
+		},
+		{
+			name:     "Test 6",
+			payload:  legacyDecimal,
+			expected: types.Cents(10516244),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := bson.Marshal(bson.M{"title": "Chair", "cost": tc.payload})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var listing types.FurnitureListing
+			if err := bson.Unmarshal(data, &listing); err != nil {
+				t.Fatal(err)
+			}
+			if listing.Cost != tc.expected {
+				t.Fatalf("Expected: %+v, got: %+v\n", tc.expected, listing.Cost)
+			}
+		})
+	}
+}
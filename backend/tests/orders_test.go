@@ -0,0 +1,487 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/types"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOrderStatusCanMoveTo(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     types.OrderStatus
+		to       types.OrderStatus
+		expected bool
+	}{
+		{name: "Test 1", from: types.OrderPaid, to: types.OrderPreparing, expected: true},
+		{name: "Test 2", from: types.OrderPaid, to: types.OrderCancelled, expected: true},
+		{name: "Test 3", from: types.OrderPaid, to: types.OrderShipped, expected: false},
+		{name: "Test 4", from: types.OrderPreparing, to: types.OrderShipped, expected: true},
+		{name: "Test 5", from: types.OrderShipped, to: types.OrderCancelled, expected: false},
+		{name: "Test 6", from: types.OrderShipped, to: types.OrderDelivered, expected: true},
+		{name: "Test 7", from: types.OrderDelivered, to: types.OrderRefunded, expected: true},
+		{name: "Test 8", from: types.OrderCancelled, to: types.OrderRefunded, expected: false},
+		{name: "Test 9", from: types.OrderRefunded, to: types.OrderPaid, expected: false},
+		{name: "Test 10", from: types.OrderPreparing, to: types.OrderPreparing, expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if res := tc.from.CanMoveTo(tc.to); res != tc.expected {
+				t.Fatalf("Expected %s to %s: %v, got: %v\n", tc.from, tc.to, tc.expected, res)
+			}
+		})
+	}
+}
+
+/*
+Returns a server from newTestServer with the order routes, and a function
+that sends a request to it as the session with <sessionID>
+*/
+func newOrderServer(t *testing.T) (*api.Server, func(method, url, sessionID, payload string) *httptest.ResponseRecorder) {
+	server := newTestServer(t)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+	server.Use("GET /account/sales", server.HandleSalesGET, api.RequireRole(types.RoleSeller), api.AuthMiddleware)
+	server.Use("PUT /account/sales/{subOrderID}/status", server.HandleSaleStatusPUT, api.RequireRole(types.RoleSeller), api.AuthMiddleware)
+	server.Use("GET /account/purchase_history/{orderID}", server.HandlePurchaseHistoryItem, api.AuthMiddleware)
+
+	send := func(method, url, sessionID, payload string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(payload))
+		r.AddCookie(&http.Cookie{Name: api.SESSIONID_COOKIE_NAME, Value: sessionID})
+		w := httptest.NewRecorder()
+		server.Mux.ServeHTTP(w, r)
+		return w
+	}
+	return server, send
+}
+
+/*
+Buys listings priced <costs> from the sellers in <sellerIDs> as <buyer>,
+and returns the receipt of the order
+*/
+func buyListings(t *testing.T, server *api.Server, buyer *api.Session, sellerIDs []primitive.ObjectID, costs []int64) types.Receipt {
+	t.Helper()
+	payments := fakePayments(server)
+
+	var listingIDs []primitive.ObjectID
+	for i, sellerID := range sellerIDs {
+		listingID, err := server.Store.Listings.Insert(types.FurnitureListing{Title: "Desk", Cost: types.Cents(costs[i]), UserID: sellerID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		listingIDs = append(listingIDs, listingID)
+	}
+
+	event, err := payments.SimulateCompleted(startCheckout(t, server, buyer, listingIDs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, payments.WebhookRequest(event))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+
+	receipts, err := server.Store.Receipts.FindByUser(buyer.UserID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receipts[len(receipts)-1]
+}
+
+func TestHandleSaleStatusPUT(t *testing.T) {
+	server, send := newOrderServer(t)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	// a sale of 100.00 that pays the seller 91.96
+	order := buyListings(t, server, buyer, []primitive.ObjectID{TESTACC_ID}, []int64{10000})
+	subOrder := order.SubOrders[0]
+	if subOrder.Status != types.OrderPaid || len(subOrder.StatusHistory) != 1 || !subOrder.EstimatedDelivery.IsZero() {
+		t.Fatalf("Expected a paid sub-order without an estimated delivery, got: %+v\n", subOrder)
+	}
+	if subOrder.Items[0].Price != types.Cents(10000) || subOrder.Items[0].Payout != types.Cents(9196) {
+		t.Fatalf("Expected the item's price and payout, got: %+v\n", subOrder.Items[0])
+	}
+	url := "/account/sales/" + subOrder.SubOrderID.Hex() + "/status"
+
+	// each step runs on the order as the previous one left it
+	tests := []struct {
+		name               string
+		sessionid          string
+		payload            string
+		expectedStatusCode int
+		expectedMsg        string
+		expectedStatus     types.OrderStatus
+	}{
+		{
+			name:               "Test 1",
+			sessionid:          seller.SessionID,
+			payload:            `{"status": "shipped"}`,
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrOrderTransition,
+			expectedStatus:     types.OrderPaid,
+		},
+		{
+			name:               "Test 2",
+			sessionid:          seller.SessionID,
+			payload:            `{"status": "preparing"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedStatus:     types.OrderPreparing,
+		},
+		{
+			name:               "Test 3",
+			sessionid:          seller.SessionID,
+			payload:            `{"status": "lost"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrInvalidOrderStatus,
+			expectedStatus:     types.OrderPreparing,
+		},
+		{ // the buyer didn't sell anything in it
+			name:               "Test 4",
+			sessionid:          buyer.SessionID,
+			payload:            `{"status": "shipped"}`,
+			expectedStatusCode: http.StatusNotFound,
+			expectedMsg:        api.ErrOrderNotFound,
+			expectedStatus:     types.OrderPreparing,
+		},
+		{
+			name:               "Test 5",
+			sessionid:          seller.SessionID,
+			payload:            `{"status": "shipped", "trackingNumber": "1Z999AA10123456784", "estimatedDelivery": "2030-01-02T00:00:00Z"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedStatus:     types.OrderShipped,
+		},
+		{
+			name:               "Test 6",
+			sessionid:          seller.SessionID,
+			payload:            `{"status": "cancelled"}`,
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrOrderTransition,
+			expectedStatus:     types.OrderShipped,
+		},
+		{
+			name:               "Test 7",
+			sessionid:          seller.SessionID,
+			payload:            `{"status": "delivered"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedStatus:     types.OrderDelivered,
+		},
+		{
+			name:               "Test 8",
+			sessionid:          seller.SessionID,
+			payload:            `{"status": "refunded"}`,
+			expectedStatusCode: http.StatusOK,
+			expectedStatus:     types.OrderRefunded,
+		},
+		{
+			name:               "Test 9",
+			sessionid:          seller.SessionID,
+			payload:            `{"status": "refunded"}`,
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrOrderTransition,
+			expectedStatus:     types.OrderRefunded,
+		},
+		{
+			name:               "Test 10",
+			sessionid:          "unauthorized",
+			payload:            `{"status": "paid"}`,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedMsg:        api.ErrUnauthorized,
+			expectedStatus:     types.OrderRefunded,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := send("PUT", url, tc.sessionid, tc.payload)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected code: %d, got: %d %s\n", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if msg := strings.TrimSpace(w.Body.String()); tc.expectedMsg != "" && msg != tc.expectedMsg {
+				t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMsg, msg)
+			}
+
+			saved, err := server.Store.Receipts.FindByID(order.OrderID, BOB_ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.SubOrders[0].Status != tc.expectedStatus {
+				t.Fatalf("Expected status: %s, got: %s\n", tc.expectedStatus, saved.SubOrders[0].Status)
+			}
+		})
+	}
+
+	// the buyer sees every status the sub-order had, and its shipment
+	w := send("GET", "/account/purchase_history/"+order.OrderID.Hex(), buyer.SessionID, "")
+	var receipt types.Receipt
+	if err := json.Unmarshal(w.Body.Bytes(), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	var history []types.OrderStatus
+	for _, change := range receipt.SubOrders[0].StatusHistory {
+		history = append(history, change.Status)
+	}
+	expectedHistory := []types.OrderStatus{types.OrderPaid, types.OrderPreparing, types.OrderShipped, types.OrderDelivered, types.OrderRefunded}
+	if strings.Join(statusStrings(history), ",") != strings.Join(statusStrings(expectedHistory), ",") {
+		t.Fatalf("Expected history: %v, got: %v\n", expectedHistory, history)
+	}
+	if shipped := receipt.SubOrders[0]; shipped.TrackingNumber != "1Z999AA10123456784" || shipped.EstimatedDelivery.Year() != 2030 {
+		t.Fatalf("Expected the shipment to be saved, got: %q %s\n", shipped.TrackingNumber, shipped.EstimatedDelivery)
+	}
+
+	// the buyer got their money back once, and the seller is back where they started
+	if refunds := fakePayments(server).Refunds(order.CheckoutID); len(refunds) != 1 || refunds[0] != types.Cents(10000) {
+		t.Fatalf("Expected a refund of 100.00, got: %v\n", refunds)
+	}
+	user, _ := server.Store.Users.FindByID(TESTACC_ID)
+	if user.Balance != types.Cents(10516244) {
+		t.Fatalf("Expected a balance of: %s, got: %s\n", types.Cents(10516244), user.Balance)
+	}
+	balance, err := server.Store.Ledger.Balance(types.SellerAccount(TESTACC_ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != user.Balance {
+		t.Fatalf("Expected the sale and its refund to cancel out, leaving: %s, got: %s\n", user.Balance, balance)
+	}
+}
+
+func TestOrderCancelled(t *testing.T) {
+	server, send := newOrderServer(t)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	order := buyListings(t, server, buyer, []primitive.ObjectID{TESTACC_ID}, []int64{2550})
+	w := send("PUT", "/account/sales/"+order.SubOrders[0].SubOrderID.Hex()+"/status", seller.SessionID, `{"status": "cancelled"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code: %d, got: %d %s\n", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if refunds := fakePayments(server).Refunds(order.CheckoutID); len(refunds) != 1 || refunds[0] != types.Cents(2550) {
+		t.Fatalf("Expected a refund of 25.50, got: %v\n", refunds)
+	}
+	user, _ := server.Store.Users.FindByID(TESTACC_ID)
+	if user.Balance != types.Cents(10516244) {
+		t.Fatalf("Expected a balance of: %s, got: %s\n", types.Cents(10516244), user.Balance)
+	}
+
+	// the platform covers the processor's fee, which isn't refunded
+	revenue, err := server.Store.Ledger.Balance(types.AccountPlatformRevenue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (types.Money{}).Sub(api.ProcessingFee(types.Cents(2550))); revenue != expected {
+		t.Fatalf("Expected the platform to be out the processing fee, got: %s\n", revenue)
+	}
+}
+
+/*
+Orders from before checkouts were kept, like the ones MigrateSubOrders
+splits, can't be refunded, so they can't be cancelled either
+*/
+func TestOrderWithoutCheckout(t *testing.T) {
+	server, send := newOrderServer(t)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+
+	w := send("PUT", "/account/sales/"+TEST_SUB_ORDER.Hex()+"/status", seller.SessionID, `{"status": "cancelled"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected code: %d, got: %d %s\n", http.StatusConflict, w.Code, w.Body.String())
+	}
+	if msg := strings.TrimSpace(w.Body.String()); msg != api.ErrOrderNotRefundable {
+		t.Fatalf("Expected msg: %s, got: %s\n", api.ErrOrderNotRefundable, msg)
+	}
+
+	order, err := server.Store.Receipts.FindSale(TEST_SUB_ORDER, TESTACC_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sale, _ := order.Sale(TEST_SUB_ORDER); sale.Status != types.OrderPaid || len(sale.StatusHistory) != 1 {
+		t.Fatalf("Expected the sub-order to still be: %s, got: %+v\n", types.OrderPaid, sale.StatusHistory)
+	}
+	user, _ := server.Store.Users.FindByID(TESTACC_ID)
+	if user.Balance != types.Cents(10516244) {
+		t.Fatalf("Expected a balance of: %s, got: %s\n", types.Cents(10516244), user.Balance)
+	}
+}
+
+// Fails the next <failures> refunds, like a payment provider that's briefly unreachable
+type failingRefunds struct {
+	api.PaymentProvider
+	failures int
+}
+
+func (f *failingRefunds) Refund(checkoutID string, amount types.Money, key string) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("connection refused")
+	}
+	return f.PaymentProvider.Refund(checkoutID, amount, key)
+}
+
+/*
+A sub-order whose buyer couldn't be refunded keeps its status, so the
+seller can cancel it again, which refunds the buyer once
+*/
+func TestOrderRefundFailed(t *testing.T) {
+	server, send := newOrderServer(t)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	order := buyListings(t, server, buyer, []primitive.ObjectID{TESTACC_ID}, []int64{2550})
+	subOrderID := order.SubOrders[0].SubOrderID
+	url := "/account/sales/" + subOrderID.Hex() + "/status"
+	payments := fakePayments(server)
+	server.Payments = &failingRefunds{PaymentProvider: payments, failures: 1}
+
+	w := send("PUT", url, seller.SessionID, `{"status": "cancelled"}`)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("Expected code: %d, got: %d %s\n", http.StatusBadGateway, w.Code, w.Body.String())
+	}
+	if msg := strings.TrimSpace(w.Body.String()); msg != api.ErrRefundFailed {
+		t.Fatalf("Expected msg: %s, got: %s\n", api.ErrRefundFailed, msg)
+	}
+	sale, err := server.Store.Receipts.FindSale(subOrderID, TESTACC_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := sale.SubOrders[0].Status; status != types.OrderPaid {
+		t.Fatalf("Expected the sub-order to still be: %s, got: %s\n", types.OrderPaid, status)
+	}
+	if refunds := payments.Refunds(order.CheckoutID); len(refunds) != 0 {
+		t.Fatalf("Expected no refunds, got: %v\n", refunds)
+	}
+
+	// sent again, it's refunded and cancelled, and cancelling it after that refunds nothing more
+	for _, expectedCode := range []int{http.StatusOK, http.StatusConflict} {
+		if w := send("PUT", url, seller.SessionID, `{"status": "cancelled"}`); w.Code != expectedCode {
+			t.Fatalf("Expected code: %d, got: %d %s\n", expectedCode, w.Code, w.Body.String())
+		}
+	}
+	if refunds := payments.Refunds(order.CheckoutID); len(refunds) != 1 || refunds[0] != types.Cents(2550) {
+		t.Fatalf("Expected a refund of 25.50, got: %v\n", refunds)
+	}
+	user, _ := server.Store.Users.FindByID(TESTACC_ID)
+	if user.Balance != types.Cents(10516244) {
+		t.Fatalf("Expected a balance of: %s, got: %s\n", types.Cents(10516244), user.Balance)
+	}
+}
+
+/*
+An order with listings from several sellers has a sub-order for each of
+them, which each seller sees and moves on their own
+*/
+func TestSubOrders(t *testing.T) {
+	server, send := newOrderServer(t)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	other := fakeLogin(t, "johnjohn-john-john-john-johnjohnjohn", JOHNSMITH_ID)
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	order := buyListings(t, server, buyer, []primitive.ObjectID{TESTACC_ID, JOHNSMITH_ID}, []int64{10000, 5000})
+	if len(order.SubOrders) != 2 {
+		t.Fatalf("Expected a sub-order for each seller, got: %+v\n", order.SubOrders)
+	}
+	mine, theirs := order.SubOrders[0], order.SubOrders[1]
+
+	// each seller only sees their own sub-order
+	tests := []struct {
+		name          string
+		sessionid     string
+		expectedSales []primitive.ObjectID
+	}{
+		{
+			name:          "Test 1",
+			sessionid:     seller.SessionID,
+			expectedSales: []primitive.ObjectID{TEST_SUB_ORDER, mine.SubOrderID},
+		},
+		{
+			name:          "Test 2",
+			sessionid:     other.SessionID,
+			expectedSales: []primitive.ObjectID{theirs.SubOrderID},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := send("GET", "/account/sales", tc.sessionid, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected code: %d, got: %d %s\n", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			var sales []types.Sale
+			if err := json.Unmarshal(w.Body.Bytes(), &sales); err != nil {
+				t.Fatal(err)
+			}
+			if len(sales) != len(tc.expectedSales) {
+				t.Fatalf("Expected %d sales, got: %+v\n", len(tc.expectedSales), sales)
+			}
+			for i, sale := range sales {
+				if sale.SubOrderID != tc.expectedSales[i] || len(sale.Items) != 1 {
+					t.Fatalf("Expected sub-order %s with its one item, got: %+v\n", tc.expectedSales[i].Hex(), sale)
+				}
+			}
+			if last := sales[len(sales)-1]; last.OrderID != order.OrderID || last.ShippingAddress != api.FAKE_SHIPPING_ADDRESS {
+				t.Fatalf("Expected the sale to have its order and where to ship it, got: %+v\n", last)
+			}
+		})
+	}
+
+	// a seller can't move the other seller's sub-order
+	w := send("PUT", "/account/sales/"+theirs.SubOrderID.Hex()+"/status", seller.SessionID, `{"status": "preparing"}`)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected code: %d, got: %d %s\n", http.StatusNotFound, w.Code, w.Body.String())
+	}
+
+	// cancelling one sub-order only refunds its own listing, and leaves the other one paid
+	w = send("PUT", "/account/sales/"+mine.SubOrderID.Hex()+"/status", seller.SessionID, `{"status": "cancelled"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code: %d, got: %d %s\n", http.StatusOK, w.Code, w.Body.String())
+	}
+	var sale types.Sale
+	if err := json.Unmarshal(w.Body.Bytes(), &sale); err != nil {
+		t.Fatal(err)
+	}
+	if sale.SubOrderID != mine.SubOrderID || sale.Status != types.OrderCancelled {
+		t.Fatalf("Expected the cancelled sub-order, got: %+v\n", sale)
+	}
+
+	saved, err := server.Store.Receipts.FindByID(order.OrderID, BOB_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.SubOrders[0].Status != types.OrderCancelled || saved.SubOrders[1].Status != types.OrderPaid {
+		t.Fatalf("Expected only the seller's sub-order to be cancelled, got: %+v\n", saved.SubOrders)
+	}
+	if refunds := fakePayments(server).Refunds(order.CheckoutID); len(refunds) != 1 || refunds[0] != types.Cents(10000) {
+		t.Fatalf("Expected a refund of 100.00, got: %v\n", refunds)
+	}
+	balance, err := server.Store.Ledger.Balance(types.SellerAccount(JOHNSMITH_ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != theirs.Items[0].Payout {
+		t.Fatalf("Expected the other seller to keep their payout of %s, got: %s\n", theirs.Items[0].Payout, balance)
+	}
+
+	// the other seller moves theirs on their own
+	w = send("PUT", "/account/sales/"+theirs.SubOrderID.Hex()+"/status", other.SessionID, `{"status": "preparing"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code: %d, got: %d %s\n", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func statusStrings(statuses []types.OrderStatus) []string {
+	var strs []string
+	for _, status := range statuses {
+		strs = append(strs, string(status))
+	}
+	return strs
+}
@@ -0,0 +1,176 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/types"
+	"backend/util"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postJSON(server *api.Server, url string, payload string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", url, strings.NewReader(payload))
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandleForgotPassword(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /password/forgot", server.HandleForgotPassword)
+
+	tests := []struct {
+		name               string
+		payload            string
+		expectedResMsg     string
+		expectedStatusCode int
+		expectedEmailTo    string
+	}{
+		{ // account exists
+			name:               "Test 1",
+			payload:            `{"email": "test@gmail.com"}`,
+			expectedResMsg:     "success",
+			expectedStatusCode: http.StatusOK,
+			expectedEmailTo:    "test@gmail.com",
+		},
+		{ // no account uses the email, but the response doesn't tell
+			name:               "Test 2",
+			payload:            `{"email": "nobody@gmail.com"}`,
+			expectedResMsg:     "success",
+			expectedStatusCode: http.StatusOK,
+		},
+		{ // blank email
+			name:               "Test 3",
+			payload:            `{"email": ""}`,
+			expectedResMsg:     api.ErrBlankFields,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := postJSON(server, "/password/forgot", tc.payload)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("Expected code: %v, got: %v", tc.expectedStatusCode, w.Code)
+			}
+			if res := w.Body.String(); trimSpaceAndNewline(res) != tc.expectedResMsg {
+				t.Errorf("Expected ResMsg: %v, got: %v", tc.expectedResMsg, res)
+			}
+			if tc.expectedEmailTo != "" {
+				emailedToken(t, server, tc.expectedEmailTo)
+			}
+		})
+	}
+
+	if emails := server.Mailer.(*fakeMailer).sentTo("nobody@gmail.com"); len(emails) != 0 {
+		t.Fatal("Sent a password reset email to an address without an account")
+	}
+}
+
+/*
+Resets testuser1's password and checks that the token only works once,
+the new password works, the old one doesn't, and the user is logged out
+*/
+func TestPasswordResetFlow(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /password/forgot", server.HandleForgotPassword)
+	server.Use("POST /password/reset", server.HandleResetPassword)
+
+	session := fakeLogin(t, "testuser1-reset-session", TESTUSER1_ID)
+
+	// only the newest link works
+	postJSON(server, "/password/forgot", `{"email": "test@gmail.com"}`)
+	oldToken := emailedToken(t, server, "test@gmail.com")
+	postJSON(server, "/password/forgot", `{"email": "test@gmail.com"}`)
+	token := emailedToken(t, server, "test@gmail.com")
+
+	tests := []struct {
+		name               string
+		payload            string
+		expectedResMsg     string
+		expectedStatusCode int
+	}{
+		{ // passwords don't match
+			name:               "Test 1",
+			payload:            `{"token": "` + token + `", "password": "newpassword1", "confirm": "newpassword2"}`,
+			expectedResMsg:     api.ErrPasswordMismatch,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // blank fields
+			name:               "Test 2",
+			payload:            `{"token": "` + token + `"}`,
+			expectedResMsg:     api.ErrBlankFields,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // replaced by the newer link
+			name:               "Test 3",
+			payload:            `{"token": "` + oldToken + `", "password": "newpassword1", "confirm": "newpassword1"}`,
+			expectedResMsg:     api.ErrInvalidResetToken,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // valid reset
+			name:               "Test 4",
+			payload:            `{"token": "` + token + `", "password": "newpassword1", "confirm": "newpassword1"}`,
+			expectedResMsg:     "success",
+			expectedStatusCode: http.StatusOK,
+		},
+		{ // token was already used
+			name:               "Test 5",
+			payload:            `{"token": "` + token + `", "password": "newpassword2", "confirm": "newpassword2"}`,
+			expectedResMsg:     api.ErrInvalidResetToken,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := postJSON(server, "/password/reset", tc.payload)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("Expected code: %v, got: %v", tc.expectedStatusCode, w.Code)
+			}
+			if res := w.Body.String(); trimSpaceAndNewline(res) != tc.expectedResMsg {
+				t.Errorf("Expected ResMsg: %v, got: %v", tc.expectedResMsg, res)
+			}
+		})
+	}
+
+	user, err := server.Store.Users.FindByID(TESTUSER1_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if util.CheckPassword("newpassword1", user.Password) != nil {
+		t.Fatal("Password was not changed")
+	}
+	if util.CheckPassword(TESTUSER1_PASS, user.Password) == nil {
+		t.Fatal("Old password still works")
+	}
+
+	if _, exists := api.GetSessionManager().GetSession(session.SessionID); exists {
+		t.Fatal("Expected the user's sessions to be logged out after the reset")
+	}
+}
+
+func TestExpiredPasswordResetToken(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /password/reset", server.HandleResetPassword)
+
+	const token = "expired-reset-token"
+	hash := sha256.Sum256([]byte(token))
+	server.Store.PasswordResets.Insert(types.PasswordReset{
+		TokenHash: hex.EncodeToString(hash[:]),
+		UserID:    TESTUSER1_ID,
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+
+	w := postJSON(server, "/password/reset", `{"token": "`+token+`", "password": "newpassword1", "confirm": "newpassword1"}`)
+	if w.Code != http.StatusBadRequest || trimSpaceAndNewline(w.Body.String()) != api.ErrInvalidResetToken {
+		t.Fatalf("Expected code: %d, got: %d %s\n", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/types"
+	"reflect"
+	"testing"
+)
+
+func TestItemPayouts(t *testing.T) {
+	// amounts are in cents
+	tests := []struct {
+		name          string
+		prices        []int64
+		amountCharged int64
+		expected      []int64
+	}{
+		{ // a fee of 290 + 30 cents leaves 9680, and the seller gets 95% of it
+			name:          "Test 1",
+			prices:        []int64{10000},
+			amountCharged: 10000,
+			expected:      []int64{9196},
+		},
+		{ // the fee of 539 cents is split 307, 154 and 78; the second item lost the most to rounding
+			name:          "Test 2",
+			prices:        []int64{10000, 5000, 2550},
+			amountCharged: 17550,
+			expected:      []int64{9208, 4603, 2348},
+		},
+		{ // the same items in another order are paid the same
+			name:          "Test 3",
+			prices:        []int64{2550, 10000, 5000},
+			amountCharged: 17550,
+			expected:      []int64{2348, 9208, 4603},
+		},
+		{ // the fixed fee is more than the items are worth
+			name:          "Test 4",
+			prices:        []int64{1, 1, 1},
+			amountCharged: 3,
+			expected:      []int64{0, 0, 0},
+		},
+		{
+			name:          "Test 5",
+			prices:        []int64{},
+			amountCharged: 0,
+			expected:      []int64{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			prices := make([]types.Money, len(tc.prices))
+			for i, price := range tc.prices {
+				prices[i] = types.Cents(price)
+			}
+			res := api.ItemPayouts(prices, types.Cents(tc.amountCharged))
+
+			payouts := make([]int64, len(res))
+			for i, payout := range res {
+				if payout.Currency != types.USD {
+					t.Fatalf("Expected payouts in %s, got: %s\n", types.USD, payout)
+				}
+				payouts[i] = payout.Amount
+			}
+			if !reflect.DeepEqual(payouts, tc.expected) {
+				t.Fatalf("Expected: %v, got: %v\n", tc.expected, payouts)
+			}
+
+			// the sellers never get more than what's left after the fee
+			var paid, charged int64
+			for i := range payouts {
+				paid += payouts[i]
+				charged += tc.prices[i]
+			}
+			if afterFee := max(charged-api.ProcessingFee(types.Cents(tc.amountCharged)).Amount, 0); paid > afterFee {
+				t.Fatalf("Expected at most %d cents paid out, got: %d\n", afterFee, paid)
+			}
+
+			// each price is split whole between the fee, the platform and the seller
+			for i, split := range api.SplitItems(prices, types.Cents(tc.amountCharged)) {
+				if sum := split.ProcessingFee.Add(split.PlatformFee).Add(split.Payout); sum != prices[i] {
+					t.Fatalf("Expected item %d to split into %s, got: %s\n", i, prices[i], sum)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("GET /seller_only", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("success"))
+	}, api.RequireRole(types.RoleSeller, types.RoleAdmin), api.AuthMiddleware)
+
+	buyer := fakeLogin(t, "role-buyer", BOB_ID, types.RoleBuyer)
+	seller := fakeLogin(t, "role-seller", JOHNSMITH_ID, types.RoleSeller)
+	admin := fakeLogin(t, "role-admin", TESTACC_ID, types.RoleAdmin)
+
+	tests := []struct {
+		name               string
+		sessionID          string
+		expectedResMsg     string
+		expectedStatusCode int
+	}{
+		{name: "Test 1", sessionID: buyer.SessionID, expectedResMsg: api.ErrForbidden, expectedStatusCode: http.StatusForbidden},
+		{name: "Test 2", sessionID: seller.SessionID, expectedResMsg: "success", expectedStatusCode: http.StatusOK},
+		{name: "Test 3", sessionID: admin.SessionID, expectedResMsg: "success", expectedStatusCode: http.StatusOK},
+		{name: "Test 4", sessionID: "not-logged-in", expectedResMsg: api.ErrUnauthorized, expectedStatusCode: http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/seller_only", nil)
+			r.AddCookie(&http.Cookie{Name: api.SESSIONID_COOKIE_NAME, Value: tc.sessionID})
+			w := httptest.NewRecorder()
+			server.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("Expected code: %v, got: %v", tc.expectedStatusCode, w.Code)
+			}
+			if res := w.Body.String(); trimSpaceAndNewline(res) != tc.expectedResMsg {
+				t.Errorf("Expected ResMsg: %v, got: %v", tc.expectedResMsg, res)
+			}
+		})
+	}
+}
+
+// Logging in should put the user's roles into the session
+func TestLoginSavesRoles(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /login", server.HandleLogin)
+
+	err := server.Store.Users.Update(TESTUSER1_ID, map[string]any{"roles": []types.Role{types.RoleBuyer, types.RoleAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := loginFrom(t, server, "testuser1", TESTUSER1_PASS, "")
+	session, exists := api.GetSessionManager().GetSession(cookie.Value)
+	if !exists {
+		t.Fatal("Login did not create a session")
+	}
+	t.Cleanup(func() { api.GetSessionManager().DeleteSession(session.SessionID) })
+
+	if !session.HasRole(types.RoleAdmin) || !session.HasRole(types.RoleBuyer) || session.HasRole(types.RoleSeller) {
+		t.Fatalf("Expected roles: [buyer admin], got: %v\n", session.Roles())
+	}
+}
+
+func TestHandleSetUserRoles(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("PUT /admin/users/{userID}/roles", server.HandleSetUserRoles, api.RequireRole(types.RoleAdmin), api.AuthMiddleware)
+
+	admin := fakeLogin(t, "roles-admin", TESTACC_ID, types.RoleBuyer, types.RoleSeller, types.RoleAdmin)
+	seller := fakeLogin(t, "roles-seller", JOHNSMITH_ID)
+
+	tests := []struct {
+		name               string
+		sessionID          string
+		userID             string
+		payload            string
+		expectedResMsg     string
+		expectedStatusCode int
+	}{
+		{ // only admins can change roles
+			name:               "Test 1",
+			sessionID:          seller.SessionID,
+			userID:             JOHNSMITH_ID.Hex(),
+			payload:            `{"roles": ["admin"]}`,
+			expectedResMsg:     api.ErrForbidden,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{ // unknown role
+			name:               "Test 2",
+			sessionID:          admin.SessionID,
+			userID:             JOHNSMITH_ID.Hex(),
+			payload:            `{"roles": ["owner"]}`,
+			expectedResMsg:     api.ErrInvalidRoles,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // no roles
+			name:               "Test 3",
+			sessionID:          admin.SessionID,
+			userID:             JOHNSMITH_ID.Hex(),
+			payload:            `{"roles": []}`,
+			expectedResMsg:     api.ErrInvalidRoles,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // admin removing their own admin role
+			name:               "Test 4",
+			sessionID:          admin.SessionID,
+			userID:             TESTACC_ID.Hex(),
+			payload:            `{"roles": ["buyer"]}`,
+			expectedResMsg:     api.ErrRemoveOwnAdmin,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // user doesn't exist
+			name:               "Test 5",
+			sessionID:          admin.SessionID,
+			userID:             "65a5a07f062510f606cbd000",
+			payload:            `{"roles": ["buyer"]}`,
+			expectedResMsg:     api.ErrUserNotFound,
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{ // valid change
+			name:               "Test 6",
+			sessionID:          admin.SessionID,
+			userID:             JOHNSMITH_ID.Hex(),
+			payload:            `{"roles": ["buyer"]}`,
+			expectedResMsg:     "success",
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/admin/users/"+tc.userID+"/roles", strings.NewReader(tc.payload))
+			r.AddCookie(&http.Cookie{Name: api.SESSIONID_COOKIE_NAME, Value: tc.sessionID})
+			w := httptest.NewRecorder()
+			server.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("Expected code: %v, got: %v", tc.expectedStatusCode, w.Code)
+			}
+			if res := w.Body.String(); trimSpaceAndNewline(res) != tc.expectedResMsg {
+				t.Errorf("Expected ResMsg: %v, got: %v", tc.expectedResMsg, res)
+			}
+		})
+	}
+
+	user, _ := server.Store.Users.FindByID(JOHNSMITH_ID)
+	if len(user.Roles) != 1 || user.Roles[0] != types.RoleBuyer {
+		t.Fatalf("Expected johnsmith's roles to be [buyer], got: %v\n", user.Roles)
+	}
+
+	// johnsmith's existing session loses the seller role right away
+	if seller.HasRole(types.RoleSeller) || !seller.HasRole(types.RoleBuyer) {
+		t.Fatalf("Expected johnsmith's session roles to be [buyer], got: %v\n", seller.Roles())
+	}
+}
@@ -0,0 +1,277 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/search"
+	"backend/types"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	tests := []struct {
+		name     string
+		word     string
+		expected string
+	}{
+		{name: "Test 1", word: "tables", expected: "tabl"},
+		{name: "Test 2", word: "table", expected: "tabl"},
+		{name: "Test 3", word: "caresses", expected: "caress"},
+		{name: "Test 4", word: "hopping", expected: "hop"},
+		{name: "Test 5", word: "relational", expected: "relat"},
+		{name: "Test 6", word: "adjustment", expected: "adjust"},
+		{name: "Test 7", word: "adoption", expected: "adopt"},
+		{name: "Test 8", word: "generalizations", expected: "gener"},
+		{name: "Test 9", word: "controll", expected: "control"},
+		{name: "Test 10", word: "highboys", expected: "highboi"},
+		{name: "Test 11", word: "as", expected: "as"},
+		{name: "Test 12", word: "1800s", expected: "1800s"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := search.Stem(tc.word); got != tc.expected {
+				t.Fatalf("Expected %s to stem to %s, got: %s\n", tc.word, tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{name: "Test 1", query: "Walnut TABLES", expected: "walnut tables"},
+		{ // the words of every name of a synonym, without the stop words
+			name:     "Test 2",
+			query:    "the highboy",
+			expected: "highboy high chest tallboy drawers",
+		},
+		{name: "Test 3", query: "of the", expected: ""},
+		{name: "Test 4", query: "maple maple", expected: "maple"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := strings.Join(search.Words(tc.query), " "); got != tc.expected {
+				t.Fatalf("Expected words: %q, got: %q\n", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRank(t *testing.T) {
+	docs := []search.Document{
+		{Title: "Mahogany Bedside Table", Description: "A small Sheraton bedside table with one drawer"},
+		{Title: "Oak Dining Table", Description: "Seats eight, with two leaves"},
+		{Title: "Pine Nightstand", Description: "Painted nightstand <b>as found</b>"},
+		{Title: "Walnut Chair", Description: "Pairs well with any table"},
+		{Title: "Tiger Maple Highboy", Description: "Federal curly maple high chest of drawers"},
+	}
+
+	tests := []struct {
+		name            string
+		query           string
+		expectedIndexes []int
+		expectedTitle   string // of the first result
+	}{
+		{ // synonyms, and a title match outranks a description match
+			name:            "Test 1",
+			query:           "nightstand",
+			expectedIndexes: []int{2, 0},
+			expectedTitle:   "Pine <mark>Nightstand</mark>",
+		},
+		{ // stemming, and the title counts for more than the description
+			name:            "Test 2",
+			query:           "tables",
+			expectedIndexes: []int{0, 1, 3},
+			expectedTitle:   "Mahogany Bedside <mark>Table</mark>",
+		},
+		{
+			name:            "Test 3",
+			query:           "tiger maple highboy",
+			expectedIndexes: []int{4},
+			expectedTitle:   "<mark>Tiger Maple</mark> <mark>Highboy</mark>",
+		},
+		{ // only stop words
+			name:            "Test 4",
+			query:           "the of and",
+			expectedIndexes: []int{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			results := search.Rank(tc.query, docs)
+
+			indexes := []int{}
+			for _, result := range results {
+				indexes = append(indexes, result.Index)
+			}
+			if len(indexes) != len(tc.expectedIndexes) {
+				t.Fatalf("Expected results: %v, got: %v\n", tc.expectedIndexes, indexes)
+			}
+			for i := range indexes {
+				if indexes[i] != tc.expectedIndexes[i] {
+					t.Fatalf("Expected results: %v, got: %v\n", tc.expectedIndexes, indexes)
+				}
+			}
+
+			if len(results) > 0 && results[0].Title != tc.expectedTitle {
+				t.Fatalf("Expected title: %s, got: %s\n", tc.expectedTitle, results[0].Title)
+			}
+		})
+	}
+
+	// snippets are escaped, so only the highlighting is HTML
+	results := search.Rank("found", docs)
+	if len(results) != 1 || results[0].Snippet != "Painted nightstand &lt;b&gt;as <mark>found</mark>&lt;/b&gt;" {
+		t.Fatalf("Expected an escaped snippet, got: %+v\n", results)
+	}
+}
+
+func TestRankSnippet(t *testing.T) {
+	filler := strings.Repeat("plain words here ", 20)
+	docs := []search.Document{{
+		Title:       "Chest",
+		Description: filler + "with original brasses and a dovetailed case " + filler,
+	}}
+
+	results := search.Rank("brasses", docs)
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got: %d\n", len(results))
+	}
+
+	snippet := results[0].Snippet
+	if !strings.Contains(snippet, "<mark>brasses</mark>") {
+		t.Fatalf("Expected the snippet to show the match, got: %s\n", snippet)
+	}
+	if !strings.HasPrefix(snippet, "…") || !strings.HasSuffix(snippet, "…") {
+		t.Fatalf("Expected the snippet to be cut on both ends, got: %s\n", snippet)
+	}
+	if plain := strings.NewReplacer("<mark>", "", "</mark>", "", "…", "").Replace(snippet); len(plain) > search.SNIPPET_LENGTH {
+		t.Fatalf("Expected at most %d characters, got: %d\n", search.SNIPPET_LENGTH, len(plain))
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("GET /search", server.HandleSearch)
+
+	// TEST_LISTING is a Tiger Maple Highboy for 7500
+	listings := []types.FurnitureListing{
+		{Title: "Curly Maple Tall Chest", Description: "A high chest of drawers in curly maple", Cost: types.Cents(520000), Type: types.Chest, Material: types.Maple},
+		{Title: "Cherry Nightstand", Description: "One drawer", Cost: types.Cents(45000), Type: types.Nightstand, Material: types.Cherry},
+		{Title: "Bedside Table", Description: "Mahogany, with a candle slide", Cost: types.Cents(65000), Type: types.Nightstand, Material: types.Mahogany},
+		{Title: "Sold Bedside Table", Description: "Already sold", Cost: types.Cents(50000), Type: types.Nightstand, Material: types.Oak, Bought: true},
+	}
+	for _, listing := range listings {
+		listing.UserID = BOB_ID
+		if _, err := server.Store.Listings.Insert(listing); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedMessage    string
+		expectedTitles     []string // of every page together
+	}{
+		{
+			name:               "Test 1",
+			query:              "q=tiger+maple+highboy",
+			expectedStatusCode: http.StatusOK,
+			expectedTitles:     []string{"<mark>Tiger Maple</mark> <mark>Highboy</mark>", "<mark>Curly Maple</mark> Tall Chest"},
+		},
+		{ // synonyms, without the bought listing
+			name:               "Test 2",
+			query:              "q=nightstand",
+			expectedStatusCode: http.StatusOK,
+			expectedTitles:     []string{"Cherry <mark>Nightstand</mark>", "<mark>Bedside Table</mark>"},
+		},
+		{ // filters
+			name:               "Test 3",
+			query:              "q=nightstand&max_price=500",
+			expectedStatusCode: http.StatusOK,
+			expectedTitles:     []string{"Cherry <mark>Nightstand</mark>"},
+		},
+		{ // every page
+			name:               "Test 4",
+			query:              "q=nightstand&bought=any&limit=1",
+			expectedStatusCode: http.StatusOK,
+			expectedTitles:     []string{"Cherry <mark>Nightstand</mark>", "<mark>Bedside Table</mark>", "Sold <mark>Bedside Table</mark>"},
+		},
+		{
+			name:               "Test 5",
+			query:              "q=mirror",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Test 6",
+			query:              "q=+",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    api.ErrSearchNoQuery,
+		},
+		{
+			name:               "Test 7",
+			query:              "q=chest&min_price=-1",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    api.ErrInvalidPriceRange,
+		},
+		{
+			name:               "Test 8",
+			query:              "q=" + strings.Repeat("chest+", api.MAX_SEARCH_QUERY_LENGTH),
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    api.ErrSearchQueryTooLong,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var titles []string
+			query := tc.query
+			for {
+				r := httptest.NewRequest("GET", "/search?"+query, nil)
+				w := httptest.NewRecorder()
+				server.Mux.ServeHTTP(w, r)
+
+				if w.Code != tc.expectedStatusCode {
+					t.Fatalf("Expected status code: %d, got: %d\n", tc.expectedStatusCode, w.Code)
+				}
+				if w.Code != http.StatusOK {
+					if message := strings.TrimSpace(w.Body.String()); message != tc.expectedMessage {
+						t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMessage, message)
+					}
+					return
+				}
+
+				var page api.SearchPage
+				if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+					t.Fatal(err)
+				}
+				for _, result := range page.Results {
+					titles = append(titles, result.Title)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+
+				values, _ := url.ParseQuery(tc.query)
+				values.Set("cursor", page.NextCursor)
+				query = values.Encode()
+			}
+
+			if strings.Join(titles, ", ") != strings.Join(tc.expectedTitles, ", ") {
+				t.Fatalf("Expected results: %v, got: %v\n", tc.expectedTitles, titles)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"backend/api"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Hammers the SessionManager with interleaved logins, authenticated requests,
+Stripe webhooks and logouts from many goroutines while the reaper runs.
+
+Run it with the race detector to catch unsynchronized access:
+
+	go test -race -run TestSessionManagerConcurrency ./tests
+*/
+func TestSessionManagerConcurrency(t *testing.T) {
+	const WORKERS = 4
+	const ITERATIONS = 3
+	const REQUESTS_PER_LOGIN = 8
+
+	sessionManager := api.GetSessionManager()
+	sessionManager.SetStore(api.NewMemorySessionStore())
+	t.Cleanup(func() { sessionManager.SetStore(api.NewMemorySessionStore()) })
+
+	stopReaper := sessionManager.StartReaper(time.Millisecond)
+	defer stopReaper()
+
+	server := newTestServer(t)
+	server.Use("POST /login", server.HandleLogin)
+	server.Use("POST /logout", server.HandleLogout, api.AuthMiddleware)
+	server.Use("GET /account", server.HandleAccountGET, api.AuthMiddleware)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+
+	do := func(method, target, body, sessionID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if sessionID != "" {
+			r.AddCookie(&http.Cookie{
+				Name:  api.SESSIONID_COOKIE_NAME,
+				Value: sessionID,
+			})
+		}
+		w := httptest.NewRecorder()
+		server.Mux.ServeHTTP(w, r)
+		return w
+	}
+
+	errs := make(chan error, WORKERS*ITERATIONS*(REQUESTS_PER_LOGIN+3))
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < WORKERS; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < ITERATIONS; i++ {
+				payload := fmt.Sprintf(`{"username": "testuser1", "password": "%s"}`, TESTUSER1_PASS)
+				w := do("POST", "/login", payload, "")
+				if w.Code != http.StatusOK {
+					errs <- fmt.Errorf("worker %d: login failed with %d", worker, w.Code)
+					return
+				}
+
+				var sessionID string
+				for _, cookie := range w.Result().Cookies() {
+					if cookie.Name == api.SESSIONID_COOKIE_NAME {
+						sessionID = cookie.Value
+					}
+				}
+
+				// concurrent requests from the same client share one session
+				var requests sync.WaitGroup
+				for j := 0; j < REQUESTS_PER_LOGIN; j++ {
+					requests.Add(1)
+					go func() {
+						defer requests.Done()
+						if w := do("GET", "/account", "", sessionID); w.Code != http.StatusOK {
+							errs <- fmt.Errorf("worker %d: account request failed with %d", worker, w.Code)
+						}
+					}()
+				}
+
+				// a webhook arrives while the client is still using its session
+				requests.Add(1)
+				go func() {
+					defer requests.Done()
+					event := fmt.Sprintf(`{
+						"type": "checkout.session.completed",
+						"data": {"object": {
+							"amount_total": 750000,
+							"metadata": {
+								"userID": "%s",
+								"listingIDs": "[\"%s\"]",
+								"paymentMethod": "Credit"
+							},
+							"shipping_details": {"address": {"state": "RI", "city": "Providence"}}
+						}}
+					}`, TESTUSER1_ID.Hex(), TEST_LISTING.Hex())
+					do("POST", "/checkout_webhook", event, "")
+				}()
+				requests.Wait()
+
+				if w := do("POST", "/logout", "", sessionID); w.Code != http.StatusOK {
+					errs <- fmt.Errorf("worker %d: logout failed with %d", worker, w.Code)
+				}
+				if _, exists := sessionManager.GetSession(sessionID); exists {
+					errs <- fmt.Errorf("worker %d: session %s still exists after logout", worker, sessionID)
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -2,9 +2,17 @@ package tests
 
 import (
 	"backend/api"
+	"backend/db"
+	"backend/types"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func TestGetSession(t *testing.T) {
@@ -80,3 +88,357 @@ func TestIsLoggedIn(t *testing.T) {
 		})
 	}
 }
+
+/*
+Returns a clock for the session manager that only moves when the
+returned advance function is called. The real clock is restored
+when the test ends
+*/
+func fakeSessionClock(t *testing.T) (advance func(time.Duration)) {
+	sessionManager := api.GetSessionManager()
+	now := time.Now()
+
+	sessionManager.SetClock(func() time.Time { return now })
+	t.Cleanup(func() { sessionManager.SetClock(time.Now) })
+
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestSessionExpiration(t *testing.T) {
+	advance := fakeSessionClock(t)
+	sessionManager := api.GetSessionManager()
+
+	session, err := sessionManager.CreateSession(api.SessionTemplate{SessionID: ""})
+	if err != nil {
+		t.Fatal("Failed to create new session:", err)
+	}
+
+	advance(api.CookieExpiration*time.Minute - time.Second)
+	if _, exists := sessionManager.GetSession(session.SessionID); !exists {
+		t.Fatal("Session expired before its TTL")
+	}
+
+	advance(time.Second)
+	if _, exists := sessionManager.GetSession(session.SessionID); exists {
+		t.Fatal("Session is not supposed to exist after its TTL")
+	}
+}
+
+/*
+Every authenticated request should push back the expiration, so a
+client that stays active never gets logged out
+*/
+func TestSessionSlidingRenewal(t *testing.T) {
+	advance := fakeSessionClock(t)
+	sessionManager := api.GetSessionManager()
+
+	session, err := sessionManager.CreateSession(api.SessionTemplate{SessionID: ""})
+	if err != nil {
+		t.Fatal("Failed to create new session:", err)
+	}
+	t.Cleanup(func() { sessionManager.DeleteSession(session.SessionID) })
+
+	for i := 0; i < 5; i++ {
+		advance(api.CookieExpiration * time.Minute / 2)
+
+		r := httptest.NewRequest("GET", "/account", nil)
+		r.AddCookie(&http.Cookie{
+			Name:  api.SESSIONID_COOKIE_NAME,
+			Value: session.SessionID,
+		})
+
+		w := httptest.NewRecorder()
+		handler := api.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+		handler(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected code: %d, got: %d\n", i+1, http.StatusOK, w.Code)
+		}
+		if !strings.Contains(w.Header().Get("Set-Cookie"), session.SessionID) {
+			t.Fatalf("Request %d: expected the session cookie to be renewed\n", i+1)
+		}
+	}
+
+	// once the client stops making requests, the session should expire
+	advance(api.CookieExpiration * time.Minute)
+	if _, exists := sessionManager.GetSession(session.SessionID); exists {
+		t.Fatal("Session is not supposed to exist after being idle for its TTL")
+	}
+}
+
+/*
+A request that read its session before it was revoked can't bring it
+back by renewing it
+*/
+func TestRenewRevokedSession(t *testing.T) {
+	sessionManager := api.GetSessionManager()
+
+	session, err := sessionManager.CreateSession(api.SessionTemplate{SessionID: ""})
+	if err != nil {
+		t.Fatal("Failed to create new session:", err)
+	}
+	read, exists := sessionManager.GetSession(session.SessionID)
+	if !exists {
+		t.Fatal("Session doesn't exist")
+	}
+
+	sessionManager.DeleteSession(session.SessionID)
+	if err := sessionManager.RenewSession(read); err != api.ErrSessionNotFound {
+		t.Fatalf("Expected error: %v, got: %v\n", api.ErrSessionNotFound, err)
+	}
+	if _, exists := sessionManager.GetSession(session.SessionID); exists {
+		t.Fatal("Revoked session came back after it was renewed")
+	}
+}
+
+// Revokes every session it lists, like a user logging out while they're being listed
+type revokingSessionStore struct {
+	api.SessionStore
+}
+
+func (r revokingSessionStore) ListByUser(userID primitive.ObjectID) ([]*api.Session, error) {
+	sessions, err := r.SessionStore.ListByUser(userID)
+	r.SessionStore.DeleteByUser(userID)
+	return sessions, err
+}
+
+/*
+Changing the roles of a user who logs out at the same time doesn't bring
+back the sessions they logged out of
+*/
+func TestSetRevokedSessionValue(t *testing.T) {
+	sessionManager := api.GetSessionManager()
+	store := api.NewMemorySessionStore()
+	sessionManager.SetStore(revokingSessionStore{SessionStore: store})
+	t.Cleanup(func() { sessionManager.SetStore(api.NewMemorySessionStore()) })
+
+	session := fakeLogin(t, "revoked-roles", JOHNSMITH_ID)
+
+	err := sessionManager.SetUserSessionValue(JOHNSMITH_ID, "roles", []types.Role{types.RoleBuyer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(session.SessionID); err != api.ErrSessionNotFound {
+		t.Fatalf("Expected the revoked session to stay deleted, got: %v\n", err)
+	}
+}
+
+func TestSessionReaper(t *testing.T) {
+	sessionManager := api.GetSessionManager()
+	store := api.NewMemorySessionStore()
+	sessionManager.SetStore(store)
+	t.Cleanup(func() { sessionManager.SetStore(api.NewMemorySessionStore()) })
+
+	stale, _ := sessionManager.CreateSession(api.SessionTemplate{SessionID: "stale"})
+	stale.ExpiresAt = time.Now().Add(-time.Minute)
+	fresh, _ := sessionManager.CreateSession(api.SessionTemplate{SessionID: "fresh"})
+
+	stop := sessionManager.StartReaper(10 * time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := store.Get(stale.SessionID); err == api.ErrSessionNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Reaper did not purge the expired session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := store.Get(fresh.SessionID); err != nil {
+		t.Fatal("Reaper purged a session that hasn't expired")
+	}
+}
+
+/*
+Runs against MongoDB when it's reachable, to make sure sessions
+round trip through the persistent store with their values intact
+*/
+func TestMongoSessionStore(t *testing.T) {
+	db.Init()
+	defer db.Close()
+	if err := db.Ping(2 * time.Second); err != nil {
+		t.Skip("MongoDB is not reachable")
+	}
+
+	store, err := api.NewMongoSessionStore(db.GetCollection("sessions_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := &api.Session{
+		SessionID: "mongo-session-test",
+		Store:     api.SessionValues{"userid": TESTACC_ID, "username": "testacc", "roles": types.DEFAULT_ROLES},
+		ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Millisecond),
+	}
+	if err := store.Save(session); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Delete(session.SessionID)
+
+	saved, err := store.Get(session.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Store["userid"] != TESTACC_ID || saved.Store["username"] != "testacc" {
+		t.Fatalf("Expected session values: %v, got: %v\n", session.Store, saved.Store)
+	}
+	if !saved.HasRole(types.RoleBuyer) || !saved.HasRole(types.RoleSeller) || saved.HasRole(types.RoleAdmin) {
+		t.Fatalf("Expected roles: %v, got: %v\n", types.DEFAULT_ROLES, saved.Roles())
+	}
+	if !saved.ExpiresAt.Equal(session.ExpiresAt) {
+		t.Fatalf("Expected expiration: %v, got: %v\n", session.ExpiresAt, saved.ExpiresAt)
+	}
+
+	// renewing never inserts a session that was deleted
+	store.Delete(session.SessionID)
+	if err := store.Renew(session.SessionID, time.Now(), time.Now().Add(time.Hour)); err != api.ErrSessionNotFound {
+		t.Fatalf("Expected error: %v, got: %v\n", api.ErrSessionNotFound, err)
+	}
+	if err := store.SetValue(session.SessionID, "roles", []types.Role{types.RoleBuyer}); err != api.ErrSessionNotFound {
+		t.Fatalf("Expected error: %v, got: %v\n", api.ErrSessionNotFound, err)
+	}
+	if _, err := store.Get(session.SessionID); err != api.ErrSessionNotFound {
+		t.Fatalf("Expected the deleted session to stay deleted, got: %v\n", err)
+	}
+}
+
+/*
+Logs in as <username> from a client with <userAgent> and
+returns the sessionID cookie the server set
+*/
+func loginFrom(t *testing.T, server *api.Server, username, password, userAgent string) *http.Cookie {
+	t.Helper()
+
+	payload := fmt.Sprintf(`{"username": "%s", "password": "%s"}`, username, password)
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(payload))
+	r.Header.Set("User-Agent", userAgent)
+
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to log in as %s: %d %s\n", username, w.Code, w.Body.String())
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == api.SESSIONID_COOKIE_NAME {
+			return cookie
+		}
+	}
+	t.Fatalf("Login as %s did not set the session cookie\n", username)
+	return nil
+}
+
+func TestMultiDeviceSessions(t *testing.T) {
+	sessionManager := api.GetSessionManager()
+	sessionManager.SetStore(api.NewMemorySessionStore())
+	t.Cleanup(func() { sessionManager.SetStore(api.NewMemorySessionStore()) })
+
+	server := newTestServer(t)
+	server.Use("POST /login", server.HandleLogin)
+	server.Use("GET /account/sessions", server.HandleSessionsGET, api.AuthMiddleware)
+	server.Use("DELETE /account/sessions", server.HandleSessionsDELETE, api.AuthMiddleware)
+	server.Use("DELETE /account/sessions/{id}", server.HandleSessionDELETE, api.AuthMiddleware)
+
+	const (
+		laptopUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"
+		phoneUA  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1"
+	)
+
+	send := func(method, url string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		server.Mux.ServeHTTP(w, r)
+		return w
+	}
+
+	listSessions := func(cookie *http.Cookie) []api.SessionInfo {
+		w := send("GET", "/account/sessions", cookie)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to list sessions: %d %s\n", w.Code, w.Body.String())
+		}
+		var infos []api.SessionInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+			t.Fatal(err)
+		}
+		return infos
+	}
+
+	advance := fakeSessionClock(t)
+
+	phone := loginFrom(t, server, "testuser1", TESTUSER1_PASS, phoneUA)
+	advance(time.Minute)
+	laptop := loginFrom(t, server, "testuser1", TESTUSER1_PASS, laptopUA)
+	other := loginFrom(t, server, "testacc", TESTACC_PASSWORD, laptopUA)
+	advance(time.Minute)
+
+	if laptop.Value == phone.Value {
+		t.Fatal("Logging in on a second device reused the first device's session")
+	}
+
+	// listing the sessions is activity too, so the laptop is the most recently active
+	infos := listSessions(laptop)
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 sessions, got: %d\n", len(infos))
+	}
+	if infos[0].Device != "Chrome on Windows" || infos[1].Device != "Safari on iPhone" {
+		t.Fatalf("Expected the laptop then the phone, got: %q, %q\n", infos[0].Device, infos[1].Device)
+	}
+	if !infos[0].Current || infos[1].Current {
+		t.Fatal("Expected only the laptop's session to be marked as current")
+	}
+	for _, info := range infos {
+		if strings.Contains(info.ID, laptop.Value) || strings.Contains(info.ID, phone.Value) {
+			t.Fatal("Session listing exposed a sessionID")
+		}
+		if info.IPAddress == "" || info.CreatedAt.IsZero() || info.LastSeen.IsZero() {
+			t.Fatalf("Session is missing its metadata: %+v\n", info)
+		}
+	}
+	phoneID := infos[1].ID
+
+	// another user can't revoke the phone's session
+	if w := send("DELETE", "/account/sessions/"+phoneID, other); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected code: %d, got: %d\n", http.StatusNotFound, w.Code)
+	}
+	if w := send("GET", "/account/sessions", phone); w.Code != http.StatusOK {
+		t.Fatal("Phone was logged out by another user")
+	}
+
+	// revoke the phone from the laptop
+	if w := send("DELETE", "/account/sessions/"+phoneID, laptop); w.Code != http.StatusOK {
+		t.Fatalf("Expected code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+	if w := send("GET", "/account/sessions", phone); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the revoked phone to get code: %d, got: %d\n", http.StatusUnauthorized, w.Code)
+	}
+	if infos := listSessions(laptop); len(infos) != 1 || !infos[0].Current {
+		t.Fatalf("Expected only the laptop's session to remain, got: %+v\n", infos)
+	}
+
+	// log out everywhere
+	loginFrom(t, server, "testuser1", TESTUSER1_PASS, phoneUA)
+	w := send("DELETE", "/account/sessions", laptop)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+	// AuthMiddleware sets the renewed cookie first, so the one that clears it must come last
+	cookies := w.Result().Cookies()
+	if last := cookies[len(cookies)-1]; last.Name != api.SESSIONID_COOKIE_NAME || last.Value != "" {
+		t.Fatal("Expected the session cookie to be cleared")
+	}
+
+	sessions, err := sessionManager.GetUserSessions(TESTUSER1_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("Expected every session to be deleted, %d remain\n", len(sessions))
+	}
+	if w := send("GET", "/account/sessions", other); w.Code != http.StatusOK {
+		t.Fatal("Logging out everywhere logged out another user")
+	}
+}
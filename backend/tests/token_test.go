@@ -0,0 +1,42 @@
+package tests
+
+import (
+	"backend/util"
+	"testing"
+	"time"
+)
+
+func TestSignToken(t *testing.T) {
+	secret := []byte("test-secret")
+	now := time.Now()
+
+	valid := util.SignToken(secret, "verify_email:user:a@b.com", now.Add(time.Hour))
+	expired := util.SignToken(secret, "verify_email:user:a@b.com", now.Add(-time.Second))
+	otherSecret := util.SignToken([]byte("other-secret"), "verify_email:user:a@b.com", now.Add(time.Hour))
+
+	tests := []struct {
+		name            string
+		token           string
+		expectedPayload string
+		expectedErr     error
+	}{
+		{name: "Test 1", token: valid, expectedPayload: "verify_email:user:a@b.com"},
+		{name: "Test 2", token: expired, expectedErr: util.ErrTokenExpired},
+		{name: "Test 3", token: otherSecret, expectedErr: util.ErrTokenInvalid},
+		{name: "Test 4", token: "x" + valid, expectedErr: util.ErrTokenInvalid}, // tampered payload
+		{name: "Test 5", token: valid[:len(valid)-2], expectedErr: util.ErrTokenInvalid},
+		{name: "Test 6", token: "", expectedErr: util.ErrTokenInvalid},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			payload, err := util.VerifyToken(secret, tc.token, now)
+			if err != tc.expectedErr {
+				t.Fatalf("Expected err: %v, got: %v\n", tc.expectedErr, err)
+			}
+			if payload != tc.expectedPayload {
+				t.Fatalf("Expected payload: %q, got: %q\n", tc.expectedPayload, payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"backend/util"
+	"testing"
+	"time"
+)
+
+// base32 of the ASCII secret "12345678901234567890" used by the RFC 6238 test vectors
+const RFC6238_SECRET = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+/*
+The expected codes are the last 6 digits of the SHA1
+test vectors in appendix B of RFC 6238
+*/
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		name         string
+		time         int64
+		expectedCode string
+	}{
+		{name: "Test 1", time: 59, expectedCode: "287082"},
+		{name: "Test 2", time: 1111111109, expectedCode: "081804"},
+		{name: "Test 3", time: 1111111111, expectedCode: "050471"},
+		{name: "Test 4", time: 1234567890, expectedCode: "005924"},
+		{name: "Test 5", time: 2000000000, expectedCode: "279037"},
+		{name: "Test 6", time: 20000000000, expectedCode: "353130"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, err := util.TOTPCode(RFC6238_SECRET, util.TOTPStep(time.Unix(tc.time, 0)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tc.expectedCode {
+				t.Fatalf("Expected code: %s, got: %s\n", tc.expectedCode, code)
+			}
+		})
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := util.TOTPStep(now)
+	code := func(step int64) string {
+		c, _ := util.TOTPCode(RFC6238_SECRET, step)
+		return c
+	}
+
+	tests := []struct {
+		name          string
+		code          string
+		lastStep      int64
+		expectedValid bool
+	}{
+		{name: "Test 1", code: code(step), expectedValid: true},
+		{name: "Test 2", code: code(step - 1), expectedValid: true}, // client clock is a little behind
+		{name: "Test 3", code: code(step + 1), expectedValid: true}, // client clock is a little ahead
+		{name: "Test 4", code: code(step - 2), expectedValid: false},
+		{name: "Test 5", code: code(step), lastStep: step, expectedValid: false}, // already used
+		{name: "Test 6", code: "12345", expectedValid: false},
+		{name: "Test 7", code: "", expectedValid: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, valid := util.ValidateTOTP(RFC6238_SECRET, tc.code, now, tc.lastStep); valid != tc.expectedValid {
+				t.Fatalf("Expected valid: %v, got: %v\n", tc.expectedValid, valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/util"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Enables 2FA on testuser1 and then logs in with the authenticator
+code and with a recovery code, which must only work once
+*/
+func TestTwoFactorLogin(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /login", server.HandleLogin)
+	server.Use("POST /login/2fa", server.HandleLoginTwoFactor)
+	server.Use("POST /account/2fa/setup", server.HandleTwoFactorSetup, api.AuthMiddleware)
+	server.Use("POST /account/2fa/confirm", server.HandleTwoFactorConfirm, api.AuthMiddleware)
+	server.Use("POST /account/2fa/disable", server.HandleTwoFactorDisable, api.AuthMiddleware)
+
+	session := fakeLogin(t, "testuser1-2fa-session", TESTUSER1_ID)
+	send := func(url string, payload string, cookie bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", url, strings.NewReader(payload))
+		if cookie {
+			r.AddCookie(&http.Cookie{Name: api.SESSIONID_COOKIE_NAME, Value: session.SessionID})
+		}
+		w := httptest.NewRecorder()
+		server.Mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// set up
+	w := send("/account/2fa/setup", "", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to set up 2FA: %d %s\n", w.Code, w.Body.String())
+	}
+	var setup api.TwoFactorSetup
+	if err := json.Unmarshal(w.Body.Bytes(), &setup); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(setup.URI, "otpauth://totp/") || !strings.Contains(setup.URI, "secret="+setup.Secret) {
+		t.Fatalf("Unexpected provisioning URI: %s\n", setup.URI)
+	}
+
+	// password alone still logs in until 2FA is confirmed
+	login := `{"username": "testuser1", "password": "` + TESTUSER1_PASS + `"}`
+	if w := send("/login", login, false); w.Code != http.StatusOK {
+		t.Fatalf("Expected login without 2FA to get code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+
+	// confirm
+	if w := send("/account/2fa/confirm", `{"code": "000000"}`, true); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a wrong code to get code: %d, got: %d\n", http.StatusBadRequest, w.Code)
+	}
+	step := util.TOTPStep(time.Now())
+	code, _ := util.TOTPCode(setup.Secret, step)
+	w = send("/account/2fa/confirm", `{"code": "`+code+`"}`, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to confirm 2FA: %d %s\n", w.Code, w.Body.String())
+	}
+	var recovery api.RecoveryCodes
+	if err := json.Unmarshal(w.Body.Bytes(), &recovery); err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery.Codes) != api.RECOVERY_CODE_COUNT {
+		t.Fatalf("Expected %d recovery codes, got: %d\n", api.RECOVERY_CODE_COUNT, len(recovery.Codes))
+	}
+
+	user, _ := server.Store.Users.FindByID(TESTUSER1_ID)
+	for _, hashed := range user.RecoveryCodes {
+		for _, code := range recovery.Codes {
+			if hashed == code {
+				t.Fatal("Recovery codes were saved in plain text")
+			}
+		}
+	}
+
+	// the password now only gets a challenge
+	challenge := func() string {
+		w := send("/login", login, false)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected code: %d, got: %d\n", http.StatusAccepted, w.Code)
+		}
+		if strings.Contains(w.Header().Get("Set-Cookie"), api.SESSIONID_COOKIE_NAME) {
+			t.Fatal("A session was created before the second factor was checked")
+		}
+		var res api.TwoFactorChallenge
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.TwoFactorRequired || res.Challenge == "" {
+			t.Fatalf("Expected a 2FA challenge, got: %+v\n", res)
+		}
+		return res.Challenge
+	}
+
+	// the code used to confirm can't be replayed, so use the next period's
+	nextCode, _ := util.TOTPCode(setup.Secret, step+1)
+
+	tests := []struct {
+		name               string
+		challenge          string
+		code               string
+		expectedStatusCode int
+	}{
+		{name: "Test 1", challenge: challenge(), code: "000000", expectedStatusCode: http.StatusUnauthorized},
+		{name: "Test 2", challenge: challenge(), code: code, expectedStatusCode: http.StatusUnauthorized}, // replayed
+		{name: "Test 3", challenge: "forged", code: nextCode, expectedStatusCode: http.StatusUnauthorized},
+		{name: "Test 4", challenge: challenge(), code: nextCode, expectedStatusCode: http.StatusOK},
+		{name: "Test 5", challenge: challenge(), code: recovery.Codes[3], expectedStatusCode: http.StatusOK},
+		{name: "Test 6", challenge: challenge(), code: recovery.Codes[3], expectedStatusCode: http.StatusUnauthorized}, // used up
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := send("/login/2fa", `{"challenge": "`+tc.challenge+`", "code": "`+tc.code+`"}`, false)
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected code: %d, got: %d %s\n", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			hasCookie := strings.Contains(w.Header().Get("Set-Cookie"), api.SESSIONID_COOKIE_NAME+"=")
+			if hasCookie != (tc.expectedStatusCode == http.StatusOK) {
+				t.Fatalf("Expected a session cookie: %v, got: %v\n", tc.expectedStatusCode == http.StatusOK, hasCookie)
+			}
+		})
+	}
+
+	// logins racing with the same recovery code can't both use it
+	const racing = 3
+	challenges := make([]string, racing)
+	for i := range challenges {
+		challenges[i] = challenge()
+	}
+	codes := make(chan int, racing)
+	var wg sync.WaitGroup
+	for _, c := range challenges {
+		wg.Add(1)
+		go func(c string) {
+			defer wg.Done()
+			codes <- send("/login/2fa", `{"challenge": "`+c+`", "code": "`+recovery.Codes[5]+`"}`, false).Code
+		}(c)
+	}
+	wg.Wait()
+	close(codes)
+	succeeded := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("Expected the recovery code to log in once, got: %d\n", succeeded)
+	}
+
+	// disable
+	if w := send("/account/2fa/disable", `{"password": "wrong", "code": "`+recovery.Codes[0]+`"}`, true); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong password to get code: %d, got: %d\n", http.StatusUnauthorized, w.Code)
+	}
+	if w := send("/account/2fa/disable", `{"password": "`+TESTUSER1_PASS+`", "code": "`+recovery.Codes[0]+`"}`, true); w.Code != http.StatusOK {
+		t.Fatalf("Failed to disable 2FA: %d %s\n", w.Code, w.Body.String())
+	}
+	if w := send("/login", login, false); w.Code != http.StatusOK {
+		t.Fatalf("Expected login after disabling 2FA to get code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+}
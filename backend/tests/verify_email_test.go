@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/util"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Signs up a new user, makes sure they can't subscribe until they
+click the link in the verification email, and then that they can
+*/
+func TestEmailVerificationFlow(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("POST /signup", server.HandleSignup)
+	server.Use("GET /verify_email", server.HandleVerifyEmail)
+	server.Use("POST /subscribe", server.HandleSubscribe, server.RequireVerifiedEmail, api.AuthMiddleware)
+
+	payload := `{"username": "newuser1", "password": "testpassword1", "confirm": "testpassword1", "email": "newuser1@gmail.com", "emailVerified": true}`
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, httptest.NewRequest("POST", "/signup", bytes.NewBufferString(payload)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to sign up: %d %s\n", w.Code, w.Body.String())
+	}
+
+	user, err := server.Store.Users.FindByUsername("newuser1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerified {
+		t.Fatal("A new user's email is not supposed to be verified")
+	}
+
+	session := fakeLogin(t, "newuser1-session", user.UserID)
+	subscribe := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/subscribe", nil)
+		r.AddCookie(&http.Cookie{Name: api.SESSIONID_COOKIE_NAME, Value: session.SessionID})
+		w := httptest.NewRecorder()
+		server.Mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := subscribe(); w.Code != http.StatusForbidden || trimSpaceAndNewline(w.Body.String()) != api.ErrEmailNotVerified {
+		t.Fatalf("Expected an unverified user to get code: %d, got: %d\n", http.StatusForbidden, w.Code)
+	}
+
+	token := emailedToken(t, server, "newuser1@gmail.com")
+	w = httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, httptest.NewRequest("GET", "/verify_email?token="+url.QueryEscape(token), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to verify email: %d %s\n", w.Code, w.Body.String())
+	}
+
+	if w := subscribe(); w.Code != http.StatusOK {
+		t.Fatalf("Expected a verified user to get code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+}
+
+func TestHandleVerifyEmail(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("GET /verify_email", server.HandleVerifyEmail)
+
+	// testuser1 is seeded as verified, so mark them unverified to see the flag change
+	err := server.Store.Users.Update(TESTUSER1_ID, bson.M{"emailVerified": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(payload string, expiresAt time.Time) string {
+		return util.SignToken(server.TokenSecret, payload, expiresAt)
+	}
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name               string
+		token              string
+		expectedResMsg     string
+		expectedStatusCode int
+	}{
+		{ // valid token
+			name:               "Test 1",
+			token:              sign("verify_email:"+TESTUSER1_ID.Hex()+":test@gmail.com", later),
+			expectedResMsg:     "success",
+			expectedStatusCode: http.StatusOK,
+		},
+		{ // expired token
+			name:               "Test 2",
+			token:              sign("verify_email:"+TESTUSER1_ID.Hex()+":test@gmail.com", time.Now().Add(-time.Minute)),
+			expectedResMsg:     api.ErrExpiredVerificationToken,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // signed with another secret
+			name:               "Test 3",
+			token:              util.SignToken([]byte("not the secret"), "verify_email:"+TESTUSER1_ID.Hex()+":test@gmail.com", later),
+			expectedResMsg:     api.ErrInvalidVerificationToken,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // token for another purpose
+			name:               "Test 4",
+			token:              sign("reset_password:"+TESTUSER1_ID.Hex()+":test@gmail.com", later),
+			expectedResMsg:     api.ErrInvalidVerificationToken,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // the user has changed their email since the token was sent
+			name:               "Test 5",
+			token:              sign("verify_email:"+TESTUSER1_ID.Hex()+":old@gmail.com", later),
+			expectedResMsg:     api.ErrVerificationEmailOutdated,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{ // no token
+			name:               "Test 6",
+			token:              "",
+			expectedResMsg:     api.ErrInvalidVerificationToken,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/verify_email?token="+url.QueryEscape(tc.token), nil)
+			w := httptest.NewRecorder()
+			server.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Errorf("Expected code: %v, got: %v", tc.expectedStatusCode, w.Code)
+			}
+			if res := w.Body.String(); trimSpaceAndNewline(res) != tc.expectedResMsg {
+				t.Errorf("Expected ResMsg: %v, got: %v", tc.expectedResMsg, res)
+			}
+		})
+	}
+
+	user, _ := server.Store.Users.FindByID(TESTUSER1_ID)
+	if !user.EmailVerified {
+		t.Fatal("Expected testuser1's email to be verified")
+	}
+}
+
+/*
+Changing the email address should make the user verify the new one
+*/
+func TestChangingEmailRequiresVerification(t *testing.T) {
+	server := newTestServer(t)
+	server.Use("PUT /account", server.HandleAccountPUT, api.AuthMiddleware)
+	session := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+
+	r := httptest.NewRequest("PUT", "/account", strings.NewReader(`{"newEmail": "newtestacc@gmail.com"}`))
+	r.AddCookie(&http.Cookie{Name: api.SESSIONID_COOKIE_NAME, Value: session.SessionID})
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to change email: %d %s\n", w.Code, w.Body.String())
+	}
+
+	user, _ := server.Store.Users.FindByID(TESTACC_ID)
+	if user.EmailVerified {
+		t.Fatal("Expected the new email to be unverified")
+	}
+	emailedToken(t, server, "newtestacc@gmail.com")
+}
@@ -0,0 +1,575 @@
+package tests
+
+import (
+	"backend/api"
+	"backend/types"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A bank account that passes validation
+const TEST_BANK_ACCOUNT = `{"accountHolder": "Test Acc", "routingNumber": "110000000", "accountNumber": "000123456789"}`
+
+/*
+Returns a server from newTestServer with the withdrawal routes, and a
+function that sends a request to it as the session with <sessionID>
+*/
+func newWithdrawalServer(t *testing.T) (*api.Server, func(method, url, sessionID, payload string) *httptest.ResponseRecorder) {
+	server := newTestServer(t)
+	server.Use("PUT /account/payout_destination", server.HandlePayoutDestinationPUT, server.RequirePayouts, api.RequireRole(types.RoleSeller), api.AuthMiddleware)
+	server.Use("GET /account/withdrawals", server.HandleWithdrawalsGET, api.AuthMiddleware)
+	server.Use("POST /account/withdrawals", server.HandleWithdrawalsPOST, server.RequirePayouts, api.RequireRole(types.RoleSeller), api.AuthMiddleware)
+	server.Use("GET /admin/withdrawals", server.HandleAdminWithdrawalsGET, api.RequireRole(types.RoleAdmin), api.AuthMiddleware)
+	server.Use("POST /admin/withdrawals/{withdrawalID}/approve", server.HandleWithdrawalApprove, server.RequirePayouts, api.RequireRole(types.RoleAdmin), api.AuthMiddleware)
+	server.Use("POST /admin/withdrawals/{withdrawalID}/reject", server.HandleWithdrawalReject, api.RequireRole(types.RoleAdmin), api.AuthMiddleware)
+	server.Use("POST /payout_webhook", server.HandlePayoutWebhook, server.RequirePayouts)
+	server.Use("POST /checkout_webhook", server.HandlePaymentWebhook)
+
+	send := func(method, url, sessionID, payload string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(payload))
+		r.AddCookie(&http.Cookie{Name: api.SESSIONID_COOKIE_NAME, Value: sessionID})
+		w := httptest.NewRecorder()
+		server.Mux.ServeHTTP(w, r)
+		return w
+	}
+	return server, send
+}
+
+// Delivers <event> to the server's payout webhook
+func deliverPayoutEvent(t *testing.T, server *api.Server, event *api.PayoutEvent) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, fakePayouts(server).WebhookRequest(event))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the payout event to be applied, got: %d %s\n", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlePayoutDestinationPUT(t *testing.T) {
+	server, send := newWithdrawalServer(t)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID, types.RoleBuyer)
+
+	tests := []struct {
+		name               string
+		sessionid          string
+		payload            string
+		expectedStatusCode int
+		expectedMsg        string
+	}{
+		{
+			name:               "Test 1",
+			sessionid:          seller.SessionID,
+			payload:            TEST_BANK_ACCOUNT,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Test 2",
+			sessionid:          seller.SessionID,
+			payload:            `{"accountHolder": " ", "routingNumber": "110000000", "accountNumber": "000123456789"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrInvalidBankAccount,
+		},
+		{
+			name:               "Test 3",
+			sessionid:          seller.SessionID,
+			payload:            `{"accountHolder": "Test Acc", "routingNumber": "11000000", "accountNumber": "000123456789"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrInvalidBankAccount,
+		},
+		{
+			name:               "Test 4",
+			sessionid:          seller.SessionID,
+			payload:            `{"accountHolder": "Test Acc", "routingNumber": "110000000", "accountNumber": "0001-2345"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrInvalidBankAccount,
+		},
+		{
+			name:               "Test 5",
+			sessionid:          seller.SessionID,
+			payload:            `not json`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Test 6",
+			sessionid:          buyer.SessionID,
+			payload:            TEST_BANK_ACCOUNT,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Test 7",
+			sessionid:          "unauthorized",
+			payload:            TEST_BANK_ACCOUNT,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedMsg:        api.ErrUnauthorized,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := send("PUT", "/account/payout_destination", tc.sessionid, tc.payload)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected code: %d, got: %d %s\n", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if msg := strings.TrimSpace(w.Body.String()); tc.expectedMsg != "" && msg != tc.expectedMsg {
+				t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMsg, msg)
+			}
+		})
+	}
+
+	// only the last 4 digits are kept, and the provider's ID isn't sent back
+	user, err := server.Store.Users.FindByID(TESTACC_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.PayoutDestination == nil || user.PayoutDestination.Last4 != "6789" || user.PayoutDestination.ProviderID == "" {
+		t.Fatalf("Expected the bank account to be saved, got: %+v\n", user.PayoutDestination)
+	}
+	data, _ := json.Marshal(user)
+	if strings.Contains(string(data), user.PayoutDestination.ProviderID) || strings.Contains(string(data), "000123456789") {
+		t.Fatalf("Expected only the last 4 digits to be sent back, got: %s\n", data)
+	}
+}
+
+// Without a payout provider, nothing can be withdrawn or paid out
+func TestWithdrawalsWithoutPayouts(t *testing.T) {
+	server, send := newWithdrawalServer(t)
+	server.Payouts = nil
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	admin := fakeLogin(t, "withdrawals-admin", JOHNSMITH_ID, types.RoleAdmin)
+
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		sessionid string
+		payload   string
+	}{
+		{name: "Test 1", method: "PUT", url: "/account/payout_destination", sessionid: seller.SessionID, payload: TEST_BANK_ACCOUNT},
+		{name: "Test 2", method: "POST", url: "/account/withdrawals", sessionid: seller.SessionID, payload: `{"amount": 25}`},
+		{name: "Test 3", method: "POST", url: "/admin/withdrawals/" + primitive.NewObjectID().Hex() + "/approve", sessionid: admin.SessionID},
+		{name: "Test 4", method: "POST", url: "/payout_webhook", payload: `{"id": "evt_fake_forged"}`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := send(tc.method, tc.url, tc.sessionid, tc.payload)
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("Expected code: %d, got: %d\n", http.StatusServiceUnavailable, w.Code)
+			}
+			if msg := strings.TrimSpace(w.Body.String()); msg != api.ErrPayoutsUnavailable {
+				t.Fatalf("Expected msg: %s, got: %s\n", api.ErrPayoutsUnavailable, msg)
+			}
+		})
+	}
+
+	// the balance is still shown
+	if w := send("GET", "/account/withdrawals", seller.SessionID, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+}
+
+func TestHandleWithdrawalsPOST(t *testing.T) {
+	server, send := newWithdrawalServer(t)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	noDestination := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+	buyer := fakeLogin(t, "withdrawals-buyer", JOHNSMITH_ID, types.RoleBuyer)
+
+	if w := send("PUT", "/account/payout_destination", seller.SessionID, TEST_BANK_ACCOUNT); w.Code != http.StatusOK {
+		t.Fatalf("Failed to register bank account, got: %d %s\n", w.Code, w.Body.String())
+	}
+
+	// the balance starts at 105162.44
+	tests := []struct {
+		name               string
+		sessionid          string
+		payload            string
+		expectedStatusCode int
+		expectedMsg        string
+		expectedBalance    types.Money
+	}{
+		{
+			name:               "Test 1",
+			sessionid:          seller.SessionID,
+			payload:            `{"amount": "25.00"}`,
+			expectedStatusCode: http.StatusCreated,
+			expectedBalance:    types.Cents(10516244 - 2500),
+		},
+		{
+			name:               "Test 2",
+			sessionid:          seller.SessionID,
+			payload:            `{"amount": "9.99"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrWithdrawalMinimum,
+			expectedBalance:    types.Cents(10516244 - 2500),
+		},
+		{
+			name:               "Test 3",
+			sessionid:          seller.SessionID,
+			payload:            `{"amount": "25.00 EUR"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrWithdrawalCurrency,
+			expectedBalance:    types.Cents(10516244 - 2500),
+		},
+		{
+			name:               "Test 4",
+			sessionid:          seller.SessionID,
+			payload:            `{"amount": "105137.45"}`,
+			expectedStatusCode: http.StatusConflict,
+			expectedMsg:        api.ErrInsufficientBalance,
+			expectedBalance:    types.Cents(10516244 - 2500),
+		},
+		{ // all of what's left
+			name:               "Test 5",
+			sessionid:          seller.SessionID,
+			payload:            `{"amount": "105137.44"}`,
+			expectedStatusCode: http.StatusCreated,
+			expectedBalance:    types.Cents(0),
+		},
+		{
+			name:               "Test 6",
+			sessionid:          seller.SessionID,
+			payload:            `{"amount": "25.001"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedBalance:    types.Cents(0),
+		},
+		{
+			name:               "Test 7",
+			sessionid:          noDestination.SessionID,
+			payload:            `{"amount": "25.00"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMsg:        api.ErrNoPayoutDestination,
+			expectedBalance:    types.Cents(0),
+		},
+		{
+			name:               "Test 8",
+			sessionid:          buyer.SessionID,
+			payload:            `{"amount": "25.00"}`,
+			expectedStatusCode: http.StatusForbidden,
+			expectedBalance:    types.Cents(0),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := send("POST", "/account/withdrawals", tc.sessionid, tc.payload)
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected code: %d, got: %d %s\n", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if msg := strings.TrimSpace(w.Body.String()); tc.expectedMsg != "" && msg != tc.expectedMsg {
+				t.Fatalf("Expected msg: %s, got: %s\n", tc.expectedMsg, msg)
+			}
+
+			user, _ := server.Store.Users.FindByID(TESTACC_ID)
+			if user.Balance != tc.expectedBalance {
+				t.Fatalf("Expected a balance of: %s, got: %s\n", tc.expectedBalance, user.Balance)
+			}
+		})
+	}
+
+	// each withdrawal was taken out of the seller's account in the ledger
+	balance, err := server.Store.Ledger.Balance(types.AccountPayouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != types.Cents(10516244) {
+		t.Fatalf("Expected %s to have been withdrawn, got: %s\n", types.Cents(10516244), balance)
+	}
+
+	var summary api.WithdrawalsSummary
+	w := send("GET", "/account/withdrawals", seller.SessionID, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Withdrawals) != 2 || summary.Withdrawals[0].Amount != types.Cents(10513744) ||
+		summary.Withdrawals[1].Status != types.WithdrawalPending || summary.Withdrawals[1].Destination.Last4 != "6789" {
+		t.Fatalf("Expected the 2 pending withdrawals, newest first, got: %+v\n", summary.Withdrawals)
+	}
+}
+
+/*
+The earnings of a sale are held for PAYOUT_HOLD_PERIOD, so they're in the
+balance but can't be withdrawn yet
+*/
+func TestWithdrawalHolds(t *testing.T) {
+	server, send := newWithdrawalServer(t)
+	payments := fakePayments(server)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	buyer := fakeLogin(t, BOB_SESSION_ID, BOB_ID)
+
+	if w := send("PUT", "/account/payout_destination", seller.SessionID, TEST_BANK_ACCOUNT); w.Code != http.StatusOK {
+		t.Fatalf("Failed to register bank account, got: %d %s\n", w.Code, w.Body.String())
+	}
+	err := server.Store.Users.Update(TESTACC_ID, bson.M{"balance": types.Cents(5000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a sale that pays the seller 91.96
+	listingID, err := server.Store.Listings.Insert(types.FurnitureListing{Title: "Desk", Cost: types.Cents(10000), UserID: TESTACC_ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := payments.SimulateCompleted(startCheckout(t, server, buyer, listingID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	server.Mux.ServeHTTP(w, payments.WebhookRequest(event))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code: %d, got: %d\n", http.StatusOK, w.Code)
+	}
+
+	var summary api.WithdrawalsSummary
+	w = send("GET", "/account/withdrawals", seller.SessionID, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Balance != types.Cents(14196) || summary.Held != types.Cents(9196) || summary.Available != types.Cents(5000) {
+		t.Fatalf("Expected 141.96 with 91.96 held, got: %+v\n", summary)
+	}
+
+	if w := send("POST", "/account/withdrawals", seller.SessionID, `{"amount": "50.01"}`); w.Code != http.StatusConflict {
+		t.Fatalf("Expected a held sale not to be withdrawn, got: %d %s\n", w.Code, w.Body.String())
+	}
+
+	// withdrawals requested at the same time can't take more than what's available
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := send("POST", "/account/withdrawals", seller.SessionID, `{"amount": "10.00"}`); w.Code == http.StatusCreated {
+				created.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if created.Load() != 5 {
+		t.Fatalf("Expected 5 withdrawals of 10.00 out of 50.00, got: %d\n", created.Load())
+	}
+
+	user, _ := server.Store.Users.FindByID(TESTACC_ID)
+	if user.Balance != types.Cents(9196) {
+		t.Fatalf("Expected the held 91.96 to be left, got: %s\n", user.Balance)
+	}
+}
+
+/*
+Takes withdrawals through each way they can end: paid, failed by the
+bank, returned by the bank after being paid, and rejected by an admin
+*/
+func TestWithdrawalLifecycle(t *testing.T) {
+	server, send := newWithdrawalServer(t)
+	payouts := fakePayouts(server)
+	seller := fakeLogin(t, TEST_SESSION_ID, TESTACC_ID)
+	admin := fakeLogin(t, "withdrawals-admin", JOHNSMITH_ID, types.RoleAdmin)
+
+	if w := send("PUT", "/account/payout_destination", seller.SessionID, TEST_BANK_ACCOUNT); w.Code != http.StatusOK {
+		t.Fatalf("Failed to register bank account, got: %d %s\n", w.Code, w.Body.String())
+	}
+
+	// requests a withdrawal of <amount> and returns it
+	request := func(t *testing.T, amount string) types.Withdrawal {
+		t.Helper()
+		w := send("POST", "/account/withdrawals", seller.SessionID, `{"amount": "`+amount+`"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Failed to request withdrawal, got: %d %s\n", w.Code, w.Body.String())
+		}
+		var withdrawal types.Withdrawal
+		if err := json.Unmarshal(w.Body.Bytes(), &withdrawal); err != nil {
+			t.Fatal(err)
+		}
+		return withdrawal
+	}
+
+	// approves the withdrawal with <withdrawalID> and returns it as it's saved
+	approve := func(t *testing.T, withdrawalID primitive.ObjectID) types.Withdrawal {
+		t.Helper()
+		w := send("POST", "/admin/withdrawals/"+withdrawalID.Hex()+"/approve", admin.SessionID, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to approve withdrawal, got: %d %s\n", w.Code, w.Body.String())
+		}
+		withdrawal, err := server.Store.Withdrawals.FindByID(withdrawalID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if withdrawal.Status != types.WithdrawalApproved || withdrawal.PayoutID == "" {
+			t.Fatalf("Expected the withdrawal to be sent to the provider, got: %+v\n", withdrawal)
+		}
+		return withdrawal
+	}
+
+	expectWithdrawal := func(t *testing.T, withdrawalID primitive.ObjectID, status types.WithdrawalStatus, balance int64) {
+		t.Helper()
+		withdrawal, err := server.Store.Withdrawals.FindByID(withdrawalID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if withdrawal.Status != status {
+			t.Fatalf("Expected status: %s, got: %s\n", status, withdrawal.Status)
+		}
+		user, _ := server.Store.Users.FindByID(TESTACC_ID)
+		if user.Balance != types.Cents(balance) {
+			t.Fatalf("Expected a balance of: %s, got: %s\n", types.Cents(balance), user.Balance)
+		}
+	}
+
+	t.Run("paid", func(t *testing.T) {
+		withdrawal := approve(t, request(t, "100.00").WithdrawalID)
+
+		// a seller can't approve their own withdrawal, and it can only be approved once
+		if w := send("POST", "/admin/withdrawals/"+withdrawal.WithdrawalID.Hex()+"/approve", seller.SessionID, ""); w.Code != http.StatusForbidden {
+			t.Fatalf("Expected code: %d, got: %d\n", http.StatusForbidden, w.Code)
+		}
+		if w := send("POST", "/admin/withdrawals/"+withdrawal.WithdrawalID.Hex()+"/approve", admin.SessionID, ""); w.Code != http.StatusConflict {
+			t.Fatalf("Expected code: %d, got: %d\n", http.StatusConflict, w.Code)
+		}
+		if len(payouts.Payouts()) != 1 {
+			t.Fatalf("Expected 1 payout, got: %d\n", len(payouts.Payouts()))
+		}
+
+		event, err := payouts.SimulatePaid(withdrawal.PayoutID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliverPayoutEvent(t, server, event)
+		deliverPayoutEvent(t, server, event)
+		expectWithdrawal(t, withdrawal.WithdrawalID, types.WithdrawalPaid, 10516244-10000)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		withdrawal := approve(t, request(t, "200.00").WithdrawalID)
+		expectWithdrawal(t, withdrawal.WithdrawalID, types.WithdrawalApproved, 10516244-10000-20000)
+
+		// its amount goes back into the balance once, however many times the event is delivered
+		event, err := payouts.SimulateFailed(withdrawal.PayoutID, "account_closed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliverPayoutEvent(t, server, event)
+		deliverPayoutEvent(t, server, event)
+		expectWithdrawal(t, withdrawal.WithdrawalID, types.WithdrawalFailed, 10516244-10000)
+
+		saved, _ := server.Store.Withdrawals.FindByID(withdrawal.WithdrawalID)
+		if saved.FailureReason != "account_closed" {
+			t.Fatalf("Expected failure reason: account_closed, got: %q\n", saved.FailureReason)
+		}
+	})
+
+	t.Run("returned after paid", func(t *testing.T) {
+		withdrawal := approve(t, request(t, "300.00").WithdrawalID)
+
+		paid, err := payouts.SimulatePaid(withdrawal.PayoutID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliverPayoutEvent(t, server, paid)
+		expectWithdrawal(t, withdrawal.WithdrawalID, types.WithdrawalPaid, 10516244-10000-30000)
+
+		returned, err := payouts.SimulateFailed(withdrawal.PayoutID, "could_not_process")
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliverPayoutEvent(t, server, returned)
+		expectWithdrawal(t, withdrawal.WithdrawalID, types.WithdrawalFailed, 10516244-10000)
+
+		// a paid event delivered late doesn't undo the failure
+		deliverPayoutEvent(t, server, paid)
+		expectWithdrawal(t, withdrawal.WithdrawalID, types.WithdrawalFailed, 10516244-10000)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		withdrawal := request(t, "400.00")
+		url := "/admin/withdrawals/" + withdrawal.WithdrawalID.Hex()
+
+		w := send("POST", url+"/reject", admin.SessionID, `{"reason": "Suspicious activity"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to reject withdrawal, got: %d %s\n", w.Code, w.Body.String())
+		}
+		expectWithdrawal(t, withdrawal.WithdrawalID, types.WithdrawalFailed, 10516244-10000)
+
+		if w := send("POST", url+"/reject", admin.SessionID, ""); w.Code != http.StatusConflict {
+			t.Fatalf("Expected code: %d, got: %d\n", http.StatusConflict, w.Code)
+		}
+		if w := send("POST", url+"/approve", admin.SessionID, ""); w.Code != http.StatusConflict {
+			t.Fatalf("Expected code: %d, got: %d\n", http.StatusConflict, w.Code)
+		}
+		if w := send("POST", "/admin/withdrawals/"+primitive.NewObjectID().Hex()+"/approve", admin.SessionID, ""); w.Code != http.StatusNotFound {
+			t.Fatalf("Expected code: %d, got: %d\n", http.StatusNotFound, w.Code)
+		}
+		expectWithdrawal(t, withdrawal.WithdrawalID, types.WithdrawalFailed, 10516244-10000)
+	})
+
+	// the ledger agrees with the balance, and only the paid withdrawal left the platform
+	balance, err := server.Store.Ledger.Balance(types.AccountPayouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != types.Cents(10000) {
+		t.Fatalf("Expected %s to have been paid out, got: %s\n", types.Cents(10000), balance)
+	}
+
+	tests := []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedCount      int
+	}{
+		{
+			name:               "Test 1",
+			query:              "",
+			expectedStatusCode: http.StatusOK,
+			expectedCount:      0,
+		},
+		{
+			name:               "Test 2",
+			query:              "?status=failed",
+			expectedStatusCode: http.StatusOK,
+			expectedCount:      3,
+		},
+		{
+			name:               "Test 3",
+			query:              "?status=paid",
+			expectedStatusCode: http.StatusOK,
+			expectedCount:      1,
+		},
+		{
+			name:               "Test 4",
+			query:              "?status=sent",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := send("GET", "/admin/withdrawals"+tc.query, admin.SessionID, "")
+
+			if w.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected code: %d, got: %d %s\n", tc.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var withdrawals []types.Withdrawal
+			if err := json.Unmarshal(w.Body.Bytes(), &withdrawals); err != nil {
+				t.Fatal(err)
+			}
+			if len(withdrawals) != tc.expectedCount {
+				t.Fatalf("Expected %d withdrawals, got: %d\n", tc.expectedCount, len(withdrawals))
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package types
+
+import "time"
+
+/*
+A webhook event from Stripe that has been applied, kept so a delivery of
+the same event, whether retried by Stripe or replayed, isn't applied again
+*/
+type ProcessedEvent struct {
+	EventID     string    `bson:"_id"` // Stripe's ID for the event, like evt_...
+	Type        string    `bson:"type"`
+	ProcessedAt time.Time `bson:"processedAt"`
+}
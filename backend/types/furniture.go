@@ -1,6 +1,10 @@
 package types
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 const Unknown string = "Unknown"
 
@@ -62,15 +66,35 @@ This type represents a furniture listing with all
 appropriate form details about the furniture
 */
 type FurnitureListing struct {
-	ListingID   primitive.ObjectID `bson:"_id,omitempty" json:"listingID"`
-	Title       string             `bson:"title" json:"title"`
-	Description string             `bson:"description" json:"description"`
-	Cost        float64            `bson:"cost" json:"cost"`
-	Type        FurnitureType      `bson:"type" json:"type"`
-	Style       FurnitureStyle     `bson:"style" json:"style"`
-	Condition   FurnitureCondition `bson:"condition" json:"condition"`
-	Material    FurnitureMaterial  `bson:"material" json:"material"`
-	Images      [][]byte           `bson:"images" json:"images"` // images are stored as an array of byte slices
-	UserID      primitive.ObjectID `bson:"userid" json:"userID"` // UserID of the client who created the listing; the owner of the post; the seller
-	Bought      bool               `bson:"bought" json:"bought"` // this field will be used to not render the items that have already been bought
+	ListingID   primitive.ObjectID   `bson:"_id,omitempty" json:"listingID"`
+	Title       string               `bson:"title" json:"title"`
+	Description string               `bson:"description" json:"description"`
+	Cost        Money                `bson:"cost" json:"cost"`
+	Type        FurnitureType        `bson:"type" json:"type"`
+	Style       FurnitureStyle       `bson:"style" json:"style"`
+	Condition   FurnitureCondition   `bson:"condition" json:"condition"`
+	Material    FurnitureMaterial    `bson:"material" json:"material"`
+	ImageIDs    []primitive.ObjectID `bson:"imageIds" json:"imageIds"` // IDs of the listing's images in the image store, in display order
+	UserID      primitive.ObjectID   `bson:"userid" json:"userID"`     // UserID of the client who created the listing; the owner of the post; the seller
+	Bought      bool                 `bson:"bought" json:"bought"`     // this field will be used to not render the items that have already been bought
+	Hold        *ListingHold         `bson:"hold,omitempty" json:"hold,omitempty"`
+	BoughtWith  string               `bson:"boughtWith,omitempty" json:"-"` // ID of the checkout that bought it
+
+	// images attached to a new listing request, before they're saved to the image store
+	Uploads [][]byte `bson:"-" json:"-"`
+}
+
+/*
+Reserves a listing for the checkout that a buyer is paying in, so nobody
+else can check it out until the checkout ends or the hold expires
+*/
+type ListingHold struct {
+	HoldID    string             `bson:"holdId" json:"-"` // ID of the Stripe checkout session
+	UserID    primitive.ObjectID `bson:"userid" json:"-"` // the buyer
+	ExpiresAt time.Time          `bson:"expiresAt" json:"expiresAt"`
+}
+
+// Returns true if the listing is held by a checkout that hasn't expired at <now>
+func (l FurnitureListing) IsHeld(now time.Time) bool {
+	return l.Hold != nil && now.Before(l.Hold.ExpiresAt)
 }
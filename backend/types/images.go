@@ -0,0 +1,49 @@
+package types
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// thumbnail, medium, large, original
+type ImageSize string
+
+const (
+	ImageThumbnail ImageSize = "thumbnail" // market page grid
+	ImageMedium    ImageSize = "medium"    // listing cards and the cart
+	ImageLarge     ImageSize = "large"     // the detailed listing page
+	ImageOriginal  ImageSize = "original"  // the image as it was uploaded
+)
+
+/*
+The longest side, in pixels, of each resized variant of a listing image.
+Images that are already smaller than a size don't get that variant
+*/
+var IMAGE_SIZE_PIXELS = map[ImageSize]int{
+	ImageThumbnail: 200,
+	ImageMedium:    600,
+	ImageLarge:     1200,
+}
+
+func (s ImageSize) IsValid() bool {
+	_, resized := IMAGE_SIZE_PIXELS[s]
+	return resized || s == ImageOriginal
+}
+
+/*
+A photo of a furniture listing. Images are kept apart from the listings,
+which only hold their IDs, and are served by GET /images/{imageID}.
+
+The resized variants of an image are images too, with ParentID set to
+the ID of the original and Size set to which variant they are
+*/
+type Image struct {
+	ImageID     primitive.ObjectID
+	ParentID    primitive.ObjectID // zero for originals
+	Size        ImageSize
+	ContentType string // like "image/jpeg"
+	Hash        string // hex sha256 of Data, used as the ETag
+	Data        []byte
+	UploadedAt  time.Time
+}
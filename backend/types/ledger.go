@@ -0,0 +1,94 @@
+package types
+
+import (
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// An account in the ledger that money moves into and out of
+type LedgerAccount string
+
+const (
+	// where buyers' payments come from, and where their refunds go back to
+	AccountBuyers LedgerAccount = "buyers"
+	// what the payment processor has collected for a checkout that isn't anyone's yet
+	AccountClearing LedgerAccount = "clearing"
+	// the payment processor's fees
+	AccountProcessorFees LedgerAccount = "processor_fees"
+	// the platform's share of each sale, which also covers the fees that no seller pays
+	AccountPlatformRevenue LedgerAccount = "platform_revenue"
+	// where sellers' balances go when they withdraw them
+	AccountPayouts LedgerAccount = "payouts"
+	// where the balances that sellers had before the ledger was kept came from
+	AccountOpeningBalances LedgerAccount = "opening_balances"
+)
+
+const sellerAccountPrefix = "seller:"
+
+/*
+Returns the account of what the platform owes the seller with <userID>,
+which is their balance
+*/
+func SellerAccount(userID primitive.ObjectID) LedgerAccount {
+	return LedgerAccount(sellerAccountPrefix + userID.Hex())
+}
+
+// Returns the ID of the seller whose account it is, or false if it isn't a seller's account
+func (a LedgerAccount) SellerID() (primitive.ObjectID, bool) {
+	hex, found := strings.CutPrefix(string(a), sellerAccountPrefix)
+	if !found {
+		return primitive.NilObjectID, false
+	}
+	userID, err := primitive.ObjectIDFromHex(hex)
+	return userID, err == nil
+}
+
+type JournalEntryType string
+
+const (
+	EntryPayment        JournalEntryType = "payment"         // a buyer paid for a checkout
+	EntrySale           JournalEntryType = "sale"            // a listing of the checkout was sold, and its price goes to the seller
+	EntryProcessorFee   JournalEntryType = "processor_fee"   // a share of the checkout's processing fee
+	EntryPlatformFee    JournalEntryType = "platform_fee"    // the platform's share of a sale
+	EntryRefund         JournalEntryType = "refund"          // a buyer got back what they paid for a listing
+	EntryFeeRefund      JournalEntryType = "fee_refund"      // the fees of a refunded sale were given back to its seller
+	EntryPayout         JournalEntryType = "payout"          // a seller withdrew from their balance
+	EntryPayoutReversal JournalEntryType = "payout_reversal" // a withdrawal failed, and its amount went back into the balance
+	EntryOpeningBalance JournalEntryType = "opening_balance" // a seller's balance from before the ledger was kept
+)
+
+/*
+One movement of money in the ledger, which takes Amount out of the From
+account and puts it into the To account. Every entry is both, so what
+goes into one account always comes out of another and the accounts add up
+to zero.
+
+Entries are never changed or deleted once they're posted; a mistake is
+corrected with another entry. Key is unique to the entry, like
+"cs_123/sale/<listingID>", so posting it again after a failure can't
+record it twice
+*/
+type JournalEntry struct {
+	EntryID    primitive.ObjectID `bson:"_id,omitempty" json:"entryId"`
+	Key        string             `bson:"key" json:"key"`
+	Type       JournalEntryType   `bson:"type" json:"type"`
+	From       LedgerAccount      `bson:"from" json:"from"`
+	To         LedgerAccount      `bson:"to" json:"to"`
+	Amount     Money              `bson:"amount" json:"amount"` // never negative
+	CheckoutID string             `bson:"checkoutId,omitempty" json:"checkoutId,omitempty"`
+	ListingID  primitive.ObjectID `bson:"listingId,omitempty" json:"listingId"`
+	PostedAt   time.Time          `bson:"postedAt" json:"postedAt"`
+}
+
+// Returns how much the entry added to <account>, which is negative if it took money out of it
+func (e JournalEntry) AmountFor(account LedgerAccount) Money {
+	switch account {
+	case e.To:
+		return e.Amount
+	case e.From:
+		return NewMoney(-e.Amount.Amount, e.Amount.Currency)
+	}
+	return NewMoney(0, e.Amount.Currency)
+}
@@ -0,0 +1,310 @@
+package types
+
+import (
+	"backend/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// ISO 4217 code of a currency, like USD
+type Currency string
+
+const (
+	USD Currency = "USD"
+	EUR Currency = "EUR"
+	JPY Currency = "JPY"
+)
+
+// The currency that listings are priced in and buyers pay in
+const DEFAULT_CURRENCY = USD
+
+var (
+	ErrInvalidMoney     = errors.New("amount isn't a number, or has more decimal places than its currency")
+	ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+	ErrUnknownCurrency  = errors.New("currency isn't one of the supported ones")
+)
+
+// Returns true if <c> is one of the currencies defined above
+func (c Currency) IsValid() bool {
+	return c == USD || c == EUR || c == JPY
+}
+
+// How many digits the currency has after the decimal point, like 2 for the cents of USD
+func (c Currency) MinorUnits() int {
+	if c == JPY {
+		return 0
+	}
+	return 2
+}
+
+/*
+An exact amount of money, counted in the minor units of its currency,
+like cents, so adding amounts up never loses a cent the way floats do.
+
+The zero value is zero in no currency in particular, which can be added to
+an amount in any currency. Arithmetic on amounts in two different
+currencies panics, since converting between them is never what's meant.
+
+Saved in the database as {amount, currency}, and sent as JSON as a decimal
+string like "125.50", which is followed by the currency, like "125.50 EUR",
+unless it's DEFAULT_CURRENCY. JSON numbers are read as DEFAULT_CURRENCY, and
+currencies that aren't defined below aren't read at all
+*/
+type Money struct {
+	Amount   int64    `bson:"amount"` // in minor units
+	Currency Currency `bson:"currency"`
+}
+
+func NewMoney(amount int64, currency Currency) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Returns <amount> cents of DEFAULT_CURRENCY
+func Cents(amount int64) Money {
+	return NewMoney(amount, DEFAULT_CURRENCY)
+}
+
+/*
+Parses a decimal amount in major units, like "125.50" dollars. It's
+exact, so it fails if <s> has more decimal places than <currency>
+*/
+func ParseMoney(s string, currency Currency) (Money, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return Money{}, ErrInvalidMoney
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currency.MinorUnits())), nil)
+	r.Mul(r, new(big.Rat).SetInt(scale))
+	if !r.IsInt() || !r.Num().IsInt64() {
+		return Money{}, ErrInvalidMoney
+	}
+	return NewMoney(r.Num().Int64(), currency), nil
+}
+
+// Returns the currency that <m> and <o> are both in, panicking if they're in different ones
+func (m Money) currencyWith(o Money) Currency {
+	switch {
+	case m.Currency == "":
+		return o.Currency
+	case o.Currency == "" || m.Currency == o.Currency:
+		return m.Currency
+	}
+	panic(fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency))
+}
+
+func (m Money) Add(o Money) Money {
+	return NewMoney(m.Amount+o.Amount, m.currencyWith(o))
+}
+
+func (m Money) Sub(o Money) Money {
+	return NewMoney(m.Amount-o.Amount, m.currencyWith(o))
+}
+
+// Returns a negative number if <m> is less than <o>, 0 if they're equal, or a positive number
+func (m Money) Cmp(o Money) int {
+	m.currencyWith(o)
+	switch {
+	case m.Amount < o.Amount:
+		return -1
+	case m.Amount > o.Amount:
+		return 1
+	}
+	return 0
+}
+
+func (m Money) IsZero() bool     { return m.Amount == 0 }
+func (m Money) IsNegative() bool { return m.Amount < 0 }
+
+// How an amount that falls between two minor units is rounded
+type Rounding int
+
+const (
+	RoundDown   Rounding = iota // toward zero
+	RoundHalfUp                 // to the nearest minor unit, and halves away from zero
+)
+
+/*
+Returns <m> * <num> / <den>, like m.MulRatio(29, 1000, RoundHalfUp) for
+2.9% of <m> rounded to the nearest cent
+*/
+func (m Money) MulRatio(num, den int64, rounding Rounding) Money {
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(num))
+	quotient, remainder := new(big.Int).QuoRem(product, big.NewInt(den), new(big.Int))
+
+	if rounding == RoundHalfUp {
+		// |remainder| * 2 >= |den| means the amount is at least halfway to the next minor unit
+		twice := new(big.Int).Abs(remainder)
+		twice.Mul(twice, big.NewInt(2))
+		if twice.Cmp(new(big.Int).Abs(big.NewInt(den))) >= 0 {
+			if product.Sign()*big.NewInt(den).Sign() < 0 {
+				quotient.Sub(quotient, big.NewInt(1))
+			} else {
+				quotient.Add(quotient, big.NewInt(1))
+			}
+		}
+	}
+	return NewMoney(quotient.Int64(), m.Currency)
+}
+
+/*
+Splits <m> into parts proportional to <weights> that add up to <m>
+exactly. Each part is rounded toward zero, and the minor units left over
+go to the parts that lost the most to rounding, earliest first. Every part
+is zero if the weights add up to zero or less
+*/
+func (m Money) Allocate(weights []int64) []Money {
+	if m.IsNegative() {
+		parts := NewMoney(-m.Amount, m.Currency).Allocate(weights)
+		for i := range parts {
+			parts[i].Amount = -parts[i].Amount
+		}
+		return parts
+	}
+
+	parts := make([]Money, len(weights))
+	for i := range parts {
+		parts[i] = NewMoney(0, m.Currency)
+	}
+
+	var totalWeight int64
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+	if totalWeight <= 0 {
+		return parts
+	}
+
+	remainders := make([]int64, len(weights))
+	leftover := m.Amount
+	for i, weight := range weights {
+		parts[i].Amount = m.Amount * weight / totalWeight
+		remainders[i] = m.Amount * weight % totalWeight
+		leftover -= parts[i].Amount
+	}
+
+	for ; leftover > 0; leftover-- {
+		largest := 0
+		for i := range remainders {
+			if remainders[i] > remainders[largest] {
+				largest = i
+			}
+		}
+		parts[largest].Amount++
+		remainders[largest] = math.MinInt64
+	}
+	return parts
+}
+
+// Returns the amount in major units, like "125.50", without its currency
+func (m Money) Decimal() string {
+	minorUnits := m.currency().MinorUnits()
+	if minorUnits == 0 {
+		return fmt.Sprintf("%d", m.Amount)
+	}
+
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	scale := int64(math.Pow10(minorUnits))
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, minorUnits, amount%scale)
+}
+
+// Returns the amount with its currency, like "125.50 USD"
+func (m Money) String() string {
+	return m.Decimal() + " " + string(m.currency())
+}
+
+// the zero value is shown in DEFAULT_CURRENCY
+func (m Money) currency() Currency {
+	if m.Currency == "" {
+		return DEFAULT_CURRENCY
+	}
+	return m.Currency
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	if m.currency() == DEFAULT_CURRENCY {
+		return json.Marshal(m.Decimal())
+	}
+	return json.Marshal(m.String())
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// a JSON number, like the cost sent by the listing form
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return ErrInvalidMoney
+		}
+		s = n.String()
+	}
+
+	currency := DEFAULT_CURRENCY
+	if amount, code, found := strings.Cut(strings.TrimSpace(s), " "); found {
+		s, currency = amount, Currency(strings.ToUpper(code))
+	}
+	if !currency.IsValid() {
+		return ErrUnknownCurrency
+	}
+
+	money, err := ParseMoney(s, currency)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+/*
+Reads {amount, currency} documents, and the plain numbers of dollars that
+prices, totals and balances were saved as before they were Money, so
+documents that haven't been migrated yet can still be read
+*/
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bsoncore.Value{Type: t, Data: data}
+	scale := math.Pow10(DEFAULT_CURRENCY.MinorUnits())
+
+	switch t {
+	case bson.TypeEmbeddedDocument:
+		var doc struct {
+			Amount   int64    `bson:"amount"`
+			Currency Currency `bson:"currency"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		*m = NewMoney(doc.Amount, doc.Currency)
+	case bson.TypeDouble:
+		*m = NewMoney(int64(math.Round(value.Double()*scale)), DEFAULT_CURRENCY)
+	case bson.TypeInt32:
+		*m = NewMoney(int64(value.Int32())*int64(scale), DEFAULT_CURRENCY)
+	case bson.TypeInt64:
+		*m = NewMoney(value.Int64()*int64(scale), DEFAULT_CURRENCY)
+	case bson.TypeDecimal128:
+		cents, err := util.Decimal128ToCents(value.Decimal128())
+		if err != nil {
+			return err
+		}
+		*m = NewMoney(cents, DEFAULT_CURRENCY)
+	case bson.TypeNull, bson.TypeUndefined:
+		*m = Money{}
+	default:
+		return fmt.Errorf("can't read money from a BSON %s", t)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package types
+
+import (
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+The shipping address collected by Stripe at checkout, which
+gets saved onto the receipt of the order
+*/
+type ReceiptAddress struct {
+	State   string `bson:"state" json:"state"`
+	City    string `bson:"city" json:"city"`
+	Street  string `bson:"street" json:"street"`
+	ZipCode string `bson:"zipCode" json:"zipCode"`
+}
+
+type ProductItem struct {
+	// ID of the furniture listing
+	ListingID primitive.ObjectID `bson:"listingid" json:"listingId"`
+	// ID of the user who posted the furniture listing; the seller
+	SellerID primitive.ObjectID `bson:"sellerid" json:"sellerId"`
+	// what the buyer paid for it, and what its seller was paid; both are zero on receipts from before they were saved
+	Price  Money `bson:"price" json:"price"`
+	Payout Money `bson:"payout" json:"-"`
+}
+
+type OrderStatus string
+
+/*
+A sub-order is paid when it's created, then its seller prepares it, ships
+it, and it's delivered. It can be cancelled until it's shipped, and refunded
+once it's delivered; the buyer gets their money back either way
+*/
+const (
+	OrderPaid      OrderStatus = "paid"
+	OrderPreparing OrderStatus = "preparing"
+	OrderShipped   OrderStatus = "shipped"
+	OrderDelivered OrderStatus = "delivered"
+	OrderCancelled OrderStatus = "cancelled"
+	OrderRefunded  OrderStatus = "refunded"
+)
+
+// the statuses a sub-order can move to from each status; cancelled and refunded ones are final
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPaid:      {OrderPreparing, OrderCancelled},
+	OrderPreparing: {OrderShipped, OrderCancelled},
+	OrderShipped:   {OrderDelivered},
+	OrderDelivered: {OrderRefunded},
+}
+
+// Returns true if <s> is one of the statuses defined above
+func (s OrderStatus) IsValid() bool {
+	_, hasNext := orderTransitions[s]
+	return hasNext || s == OrderCancelled || s == OrderRefunded
+}
+
+// Returns true if a sub-order with status <s> can move to <next>
+func (s OrderStatus) CanMoveTo(next OrderStatus) bool {
+	return slices.Contains(orderTransitions[s], next)
+}
+
+// When a sub-order moved to a status
+type OrderStatusChange struct {
+	Status OrderStatus `bson:"status" json:"status"`
+	At     time.Time   `bson:"at" json:"at"`
+}
+
+/*
+The part of an order sold by one seller, which they prepare and ship on
+their own, so each seller's items move through the statuses separately
+*/
+type SubOrder struct {
+	SubOrderID        primitive.ObjectID `bson:"subOrderId" json:"subOrderId"`
+	SellerID          primitive.ObjectID `bson:"sellerid" json:"sellerId"`
+	Items             []ProductItem      `bson:"items" json:"items"`
+	Subtotal          Money              `bson:"subtotal" json:"subtotal"`                   // what the buyer paid for its items
+	EstimatedDelivery time.Time          `bson:"estimatedDelivery" json:"estimatedDelivery"` // given by the seller when they ship it
+	TrackingNumber    string             `bson:"trackingNumber,omitempty" json:"trackingNumber,omitempty"`
+
+	Status        OrderStatus         `bson:"status" json:"status"`
+	StatusHistory []OrderStatusChange `bson:"statusHistory" json:"statusHistory"` // every status it has had, oldest first
+}
+
+/*
+Type used to save into the receipts collection after a successful
+checkout; this is what the client sees in their purchase history.
+The order is split into a sub-order for each seller it has items from
+*/
+type Receipt struct {
+	OrderID         primitive.ObjectID `bson:"_id,omitempty" json:"orderId"` // generated by mongo
+	ShippingAddress ReceiptAddress     `bson:"shippingAddress" json:"shippingAddress"`
+	PaymentMethod   string             `bson:"paymentMethod" json:"paymentMethod"`
+	TotalCost       Money              `bson:"totalCost" json:"totalCost"`
+	SubOrders       []SubOrder         `bson:"subOrders" json:"subOrders"`
+	UserID          primitive.ObjectID `bson:"userid" json:"userId"` // ID of buyer
+	DatePurchased   time.Time          `bson:"datePurchased" json:"datePurchased"`
+	CheckoutID      string             `bson:"checkoutId,omitempty" json:"-"` // the payment provider's checkout it was paid with
+}
+
+// Returns the items of every sub-order, one sub-order after another
+func (r Receipt) Items() []ProductItem {
+	var items []ProductItem
+	for _, subOrder := range r.SubOrders {
+		items = append(items, subOrder.Items...)
+	}
+	return items
+}
+
+/*
+What a seller sees of an order they sold items in: only their own
+sub-order, and where to ship it
+*/
+type Sale struct {
+	OrderID         primitive.ObjectID `json:"orderId"`
+	ShippingAddress ReceiptAddress     `json:"shippingAddress"`
+	DatePurchased   time.Time          `json:"datePurchased"`
+	SubOrder
+}
+
+// Returns the sale of the sub-order with <subOrderID>, or false if the order doesn't have it
+func (r Receipt) Sale(subOrderID primitive.ObjectID) (Sale, bool) {
+	for _, subOrder := range r.SubOrders {
+		if subOrder.SubOrderID == subOrderID {
+			return Sale{
+				OrderID:         r.OrderID,
+				ShippingAddress: r.ShippingAddress,
+				DatePurchased:   r.DatePurchased,
+				SubOrder:        subOrder,
+			}, true
+		}
+	}
+	return Sale{}, false
+}
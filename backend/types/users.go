@@ -1,39 +1,71 @@
 package types
 
 import (
-	"backend/util"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+/*
+What a user is allowed to do. A user can have several roles
+*/
+type Role string
+
+const (
+	RoleBuyer  Role = "buyer"  // can check out furniture
+	RoleSeller Role = "seller" // can list furniture for sale
+	RoleAdmin  Role = "admin"  // can manage other users
+)
+
+// roles given to every new account, and to accounts saved before roles existed
+var DEFAULT_ROLES = []Role{RoleBuyer, RoleSeller}
+
+// Returns true if <role> is one of the roles defined above
+func (r Role) IsValid() bool {
+	return r == RoleBuyer || r == RoleSeller || r == RoleAdmin
+}
+
 /*
 Type used to save into users collections and to
 represent client signup and login info, and account info
 */
 type User struct {
-	UserID      primitive.ObjectID   `bson:"_id,omitempty"`
-	Username    string               `bson:"username" json:"username"`
-	Email       string               `bson:"email" json:"email"`
-	Password    string               `bson:"password" json:"password"`
-	ConfirmPass string               `bson:"-" json:"confirm"`
-	Phone       string               `bson:"phone" json:"phone"`
-	SessionID   string               `bson:"sessionid"`
-	Balance     primitive.Decimal128 `bson:"balance" json:"balance"` // The amount of money from sales in the user's account
-	Subscribed  bool                 `bson:"subscribed" json:"subscribed"`
+	UserID      primitive.ObjectID `bson:"_id,omitempty"`
+	Username    string             `bson:"username" json:"username"`
+	Email       string             `bson:"email" json:"email"`
+	Password    string             `bson:"password" json:"password"`
+	ConfirmPass string             `bson:"-" json:"confirm"`
+	Phone       string             `bson:"phone" json:"phone"`
+	Balance     Money              `bson:"balance" json:"balance"`         // The amount of money from sales in the user's account
+	BalanceKeys []string           `bson:"balanceKeys,omitempty" json:"-"` // keys of the last changes added to Balance, so none is added twice
+	Subscribed  bool               `bson:"subscribed" json:"subscribed"`
+	Roles       []Role             `bson:"roles" json:"roles"`
+
+	// where the user's withdrawals are paid out to, once they've registered one
+	PayoutDestination *PayoutDestination `bson:"payoutDestination,omitempty" json:"payoutDestination,omitempty"`
+
+	// set once the user clicks the link emailed to them after signing up or changing their email
+	EmailVerified bool `bson:"emailVerified" json:"emailVerified"`
+
+	/*
+		Two-factor authentication. TOTPSecret is saved when the user starts
+		setting it up, but it's only asked for at login once TOTPEnabled is set
+	*/
+	TOTPEnabled   bool     `bson:"totpEnabled" json:"totpEnabled"`
+	TOTPSecret    string   `bson:"totpSecret,omitempty" json:"-"`
+	TOTPLastStep  int64    `bson:"totpLastStep,omitempty" json:"-"`  // period of the last code used, so it can't be replayed
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty" json:"-"` // bcrypt hashes of the unused recovery codes
 }
 
 /*
-Provide a negative number to subtract; positive to add
-Returns the updated balance
+Returns the user's roles, or DEFAULT_ROLES if the
+account was saved before it had any
 */
-func (u *User) UpdateBalance(amountToAdd float64) (updatedBalance float64) {
-	currBalance := util.Decimal128ToFloat64(u.Balance)
-	newTotal := currBalance + amountToAdd
-
-	dec128 := util.Float64ToDecimal128(newTotal)
-	u.Balance = dec128
-
-	return newTotal
+func (u User) GetRoles() []Role {
+	if len(u.Roles) == 0 {
+		return DEFAULT_ROLES
+	}
+	return u.Roles
 }
 
 /*
@@ -53,4 +85,16 @@ type ShippingAddress struct {
 	Default   bool               `bson:"default" json:"default"`
 }
 
+/*
+A password reset requested through POST /password/forgot. Only the sha256
+hash of the token emailed to the user is saved, so the token can't be
+read back from the database
+*/
+type PasswordReset struct {
+	ResetID   primitive.ObjectID `bson:"_id,omitempty"`
+	TokenHash string             `bson:"tokenHash"`
+	UserID    primitive.ObjectID `bson:"userid"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
 // todo: need to define inputs and outputs for /account
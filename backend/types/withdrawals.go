@@ -0,0 +1,51 @@
+package types
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+The bank account a seller's withdrawals are paid out to. Only what's
+needed to show it back to the seller is saved; the account details
+themselves are kept by the payout provider under ProviderID
+*/
+type PayoutDestination struct {
+	ProviderID    string    `bson:"providerId" json:"-"`
+	AccountHolder string    `bson:"accountHolder" json:"accountHolder"`
+	Last4         string    `bson:"last4" json:"last4"` // the last 4 digits of the account number
+	RegisteredAt  time.Time `bson:"registeredAt" json:"registeredAt"`
+}
+
+type WithdrawalStatus string
+
+/*
+A withdrawal starts out pending, and an admin either approves it, which
+sends it to the payout provider, or rejects it, which fails it. An approved
+withdrawal is paid or failed once the provider reports what happened to it.
+The amount of a failed withdrawal goes back into the seller's balance
+*/
+const (
+	WithdrawalPending  WithdrawalStatus = "pending"
+	WithdrawalApproved WithdrawalStatus = "approved"
+	WithdrawalPaid     WithdrawalStatus = "paid"
+	WithdrawalFailed   WithdrawalStatus = "failed"
+)
+
+/*
+A seller's request to have <Amount> of their balance paid out to their
+payout destination. The amount is taken out of the balance as soon as
+it's requested, so it can't be withdrawn or spent twice
+*/
+type Withdrawal struct {
+	WithdrawalID  primitive.ObjectID `bson:"_id,omitempty" json:"withdrawalId"`
+	UserID        primitive.ObjectID `bson:"userid" json:"userId"`
+	Amount        Money              `bson:"amount" json:"amount"`
+	Status        WithdrawalStatus   `bson:"status" json:"status"`
+	Destination   PayoutDestination  `bson:"destination" json:"destination"` // where it's paid out to, as it was when it was requested
+	PayoutID      string             `bson:"payoutId,omitempty" json:"-"`    // the payout provider's ID for it, once it's approved
+	FailureReason string             `bson:"failureReason,omitempty" json:"failureReason,omitempty"`
+	RequestedAt   time.Time          `bson:"requestedAt" json:"requestedAt"`
+	UpdatedAt     time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
@@ -1,26 +1,52 @@
 package util
 
 import (
-	"fmt"
-	"strconv"
+	"errors"
+	"math/big"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+var ErrNotCents = errors.New("decimal is not a number of cents that fits in an int64")
+
 /*
-Converts Decimal128 to Float64 and returns the float
+Converts an amount of dollars in a Decimal128 into cents. Fractions of a
+cent are rounded half to even, like the $round MigrateMoney converts saved
+amounts with
 */
-func Decimal128ToFloat64(dec primitive.Decimal128) float64 {
-	f, _ := strconv.ParseFloat(dec.String(), 64)
-	return f
+func Decimal128ToCents(dec primitive.Decimal128) (int64, error) {
+	digits, exp, err := dec.BigInt()
+	if err != nil {
+		return 0, ErrNotCents
+	}
+	if digits.Sign() == 0 {
+		return 0, nil
+	}
+
+	// the amount is digits * 10^exp dollars, which is digits * 10^(exp+2) cents
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(exp+2))), nil)
+	if exp+2 >= 0 {
+		digits.Mul(digits, scale)
+	} else {
+		var rem big.Int
+		digits.QuoRem(digits, scale, &rem)
+
+		// round away from zero past half a cent, and at half a cent when that makes it even
+		half := rem.CmpAbs(new(big.Int).Rsh(scale, 1))
+		if half > 0 || (half == 0 && digits.Bit(0) == 1) {
+			digits.Add(digits, big.NewInt(int64(rem.Sign())))
+		}
+	}
+
+	if !digits.IsInt64() {
+		return 0, ErrNotCents
+	}
+	return digits.Int64(), nil
 }
 
-/*
-Converts a Float64 into a primitive.Decimal128 with 2 decimal places
-and returns the Decimal128
-*/
-func Float64ToDecimal128(f float64) primitive.Decimal128 {
-	str := fmt.Sprintf("%.2f", f)
-	dec, _ := primitive.ParseDecimal128(str)
-	return dec
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
 }
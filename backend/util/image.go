@@ -1,10 +1,24 @@
 package util
 
 import (
+	"bytes"
 	"encoding/base64"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
 	"os"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // registers the WebP decoder with image.Decode
 )
 
+// quality of the JPEGs that resized images are encoded as
+const RESIZED_JPEG_QUALITY = 85
+
+var ErrUnsupportedImage = errors.New("image is not a JPEG, PNG or WebP")
+
 func EncodeImageToBase64(filepath string) (string, error) {
 	// convert image file to binary data
 	binData, err := os.ReadFile(filepath)
@@ -17,3 +31,92 @@ func EncodeImageToBase64(filepath string) (string, error) {
 
 	return base64Encoded, nil
 }
+
+/*
+Returns the format of an image from its first bytes, which is "jpeg",
+"png" or "webp", or an empty string for anything else. Only the file
+signature is checked, so it says nothing about the rest of the file
+*/
+func SniffImageFormat(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return "jpeg"
+	case "image/png":
+		return "png"
+	case "image/webp":
+		return "webp"
+	}
+	return ""
+}
+
+/*
+Reads the dimensions and format of a JPEG, PNG or WebP image from its
+header, without decoding the whole image
+*/
+func DecodeImageConfig(data []byte) (image.Config, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == image.ErrFormat {
+		return image.Config{}, "", ErrUnsupportedImage
+	}
+	return config, format, err
+}
+
+/*
+Decodes a JPEG, PNG or WebP image and returns it with its
+format, which is "jpeg", "png" or "webp"
+*/
+func DecodeImage(data []byte) (image.Image, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err == image.ErrFormat {
+		return nil, "", ErrUnsupportedImage
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return img, format, nil
+}
+
+/*
+Scales <img> down so its longest side is <maxSide> pixels, keeping its
+aspect ratio. The second return value is false if the image already fits,
+in which case it isn't resized
+*/
+func ResizeImage(img image.Image, maxSide int) (image.Image, bool) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSide && height <= maxSide {
+		return img, false
+	}
+
+	if width >= height {
+		height = max(1, height*maxSide/width)
+		width = maxSide
+	} else {
+		width = max(1, width*maxSide/height)
+		height = maxSide
+	}
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+	return resized, true
+}
+
+/*
+Encodes <img> in <format>, and returns the encoded image with its
+Content-Type. PNGs stay PNGs so they keep their transparency, and
+everything else is encoded as a JPEG
+*/
+func EncodeImage(img image.Image, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if format == "png" {
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/png", nil
+	}
+
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: RESIZED_JPEG_QUALITY}); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/jpeg", nil
+}
@@ -0,0 +1,273 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var ErrMalformedImage = errors.New("image file is malformed")
+
+/*
+Removes the metadata that cameras and editors embed in an image, like
+EXIF, which can hold the GPS location a photo was taken at, XMP and text
+comments, without re-encoding it, so the image itself is left untouched.
+<format> is the format from SniffImageFormat.
+
+Everything that affects how the image looks, like ICC color profiles,
+is kept. That includes the EXIF Orientation tag, which says how a photo
+taken with the camera turned should be rotated, so the EXIF is replaced
+with one that only holds it. Returns ErrMalformedImage if the file
+structure can't be read
+*/
+func StripImageMetadata(data []byte, format string) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		return stripJPEGMetadata(data)
+	case "png":
+		return stripPNGMetadata(data)
+	case "webp":
+		return stripWebPMetadata(data)
+	}
+	return nil, ErrUnsupportedImage
+}
+
+const (
+	jpegSOI  = 0xD8 // start of image
+	jpegEOI  = 0xD9 // end of image
+	jpegSOS  = 0xDA // start of scan, which the compressed image data follows
+	jpegAPP1 = 0xE1 // EXIF and XMP
+	jpegAPPD = 0xED // Photoshop IPTC
+	jpegCOM  = 0xFE // text comment
+)
+
+// what an EXIF APP1 segment starts with, before the EXIF itself
+var jpegExifHeader = []byte("Exif\x00\x00")
+
+const (
+	exifOrientationTag = 0x0112
+	exifTypeShort      = 3
+)
+
+/*
+EXIF is saved as a TIFF header, with the byte order and the offset of
+the first directory, then directories of 12 byte entries made of a tag,
+a type, a count and the value, or its offset if it's over 4 bytes.
+
+Returns an EXIF block holding only the Orientation tag of <exif>, or nil
+if it has none, it's unreadable or the image is already upright
+*/
+func orientationExif(exif []byte) []byte {
+	if len(exif) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	if order.Uint16(exif[2:]) != 42 {
+		return nil
+	}
+
+	dir := int64(order.Uint32(exif[4:]))
+	if dir+2 > int64(len(exif)) {
+		return nil
+	}
+	entries := int64(order.Uint16(exif[dir:]))
+	for entry := dir + 2; entry < dir+2+entries*12 && entry+12 <= int64(len(exif)); entry += 12 {
+		if order.Uint16(exif[entry:]) != exifOrientationTag {
+			continue
+		}
+		orientation := order.Uint16(exif[entry+8:])
+		if order.Uint16(exif[entry+2:]) != exifTypeShort || orientation < 2 || orientation > 8 {
+			return nil
+		}
+
+		kept := []byte("MM\x00\x2A")
+		kept = binary.BigEndian.AppendUint32(kept, 8) // the directory right after the header
+		kept = binary.BigEndian.AppendUint16(kept, 1) // with one entry
+		kept = binary.BigEndian.AppendUint16(kept, exifOrientationTag)
+		kept = binary.BigEndian.AppendUint16(kept, exifTypeShort)
+		kept = binary.BigEndian.AppendUint32(kept, 1)
+		kept = binary.BigEndian.AppendUint16(kept, orientation)
+		kept = binary.BigEndian.AppendUint16(kept, 0) // padding the value to 4 bytes
+		return binary.BigEndian.AppendUint32(kept, 0) // and no next directory
+	}
+	return nil
+}
+
+/*
+A JPEG is a list of segments that each start with 0xFF, a marker byte
+and, for the segments before the image data, a 2 byte big endian length
+that includes itself. Everything from the start of scan onward is the
+image data, which is copied as it is
+*/
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil, ErrMalformedImage
+	}
+
+	stripped := make([]byte, 0, len(data))
+	stripped = append(stripped, data[:2]...)
+
+	i := 2
+	for {
+		if i+2 > len(data) || data[i] != 0xFF {
+			return nil, ErrMalformedImage
+		}
+		marker := data[i+1]
+
+		// markers can be padded with any number of 0xFF bytes
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == jpegSOS || marker == jpegEOI {
+			return append(stripped, data[i:]...), nil
+		}
+
+		if i+4 > len(data) {
+			return nil, ErrMalformedImage
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, ErrMalformedImage
+		}
+
+		switch {
+		case marker == jpegAPP1 && bytes.HasPrefix(data[i+4:end], jpegExifHeader):
+			if exif := orientationExif(data[i+4+len(jpegExifHeader) : end]); exif != nil {
+				stripped = append(stripped, 0xFF, jpegAPP1)
+				stripped = binary.BigEndian.AppendUint16(stripped, uint16(2+len(jpegExifHeader)+len(exif)))
+				stripped = append(stripped, jpegExifHeader...)
+				stripped = append(stripped, exif...)
+			}
+		case marker != jpegAPP1 && marker != jpegAPPD && marker != jpegCOM:
+			stripped = append(stripped, data[i:end]...)
+		}
+		i = end
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// PNG chunks that only hold metadata
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true, // EXIF
+	"tEXt": true, // text, like comments or the software used
+	"zTXt": true, // compressed text
+	"iTXt": true, // international text, which is where XMP is kept
+	"tIME": true, // last modified time
+}
+
+/*
+After its signature, a PNG is a list of chunks, each made of a 4 byte
+big endian length, a 4 byte type, the data and a 4 byte CRC, up to the
+IEND chunk
+*/
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrMalformedImage
+	}
+
+	stripped := make([]byte, 0, len(data))
+	stripped = append(stripped, pngSignature...)
+
+	i := len(pngSignature)
+	for {
+		if i+8 > len(data) {
+			return nil, ErrMalformedImage
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		chunkType := string(data[i+4 : i+8])
+		end := i + 12 + length
+		if end > len(data) {
+			return nil, ErrMalformedImage
+		}
+
+		if chunkType == "eXIf" {
+			if exif := orientationExif(data[i+8 : end-4]); exif != nil {
+				start := len(stripped)
+				stripped = binary.BigEndian.AppendUint32(stripped, uint32(len(exif)))
+				stripped = append(stripped, chunkType...)
+				stripped = append(stripped, exif...)
+				stripped = binary.BigEndian.AppendUint32(stripped, crc32.ChecksumIEEE(stripped[start+4:]))
+			}
+		} else if !pngMetadataChunks[chunkType] {
+			stripped = append(stripped, data[i:end]...)
+		}
+		if chunkType == "IEND" {
+			return stripped, nil
+		}
+		i = end
+	}
+}
+
+const (
+	webpVP8XExifFlag = 0x08
+	webpVP8XXMPFlag  = 0x04
+)
+
+/*
+A WebP is a RIFF file: "RIFF", the 4 byte little endian size of the
+rest of the file, "WEBP", then chunks made of a 4 byte type, a 4 byte
+little endian size and the data, padded to an even length.
+
+Extended WebPs start with a VP8X chunk whose flags say whether EXIF or
+XMP chunks follow, so those flags are cleared along with the chunks, and
+the EXIF flag is set again if an orientation is kept
+*/
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrMalformedImage
+	}
+
+	stripped := make([]byte, 0, len(data))
+	stripped = append(stripped, data[:12]...)
+	flags := -1 // where the VP8X flags are in <stripped>
+
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, ErrMalformedImage
+		}
+		chunkType := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if end > len(data) {
+			return nil, ErrMalformedImage
+		}
+
+		switch chunkType {
+		case "EXIF":
+			// some writers keep the JPEG header in front of the EXIF
+			exif := orientationExif(bytes.TrimPrefix(data[i+8:i+8+size], jpegExifHeader))
+			if exif != nil && flags >= 0 {
+				stripped = append(stripped, chunkType...)
+				stripped = binary.LittleEndian.AppendUint32(stripped, uint32(len(exif)))
+				stripped = append(stripped, exif...)
+				stripped[flags] |= webpVP8XExifFlag
+			}
+		case "XMP ":
+		case "VP8X":
+			start := len(stripped)
+			stripped = append(stripped, data[i:end]...)
+			if size > 0 {
+				flags = start + 8
+				stripped[flags] &^= webpVP8XExifFlag | webpVP8XXMPFlag
+			}
+		default:
+			stripped = append(stripped, data[i:end]...)
+		}
+		i = end
+	}
+
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, nil
+}
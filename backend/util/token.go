@@ -0,0 +1,70 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTokenInvalid = errors.New("token is invalid")
+	ErrTokenExpired = errors.New("token has expired")
+)
+
+/*
+Returns a URL safe token that carries <payload> and its expiration,
+signed with HMAC-SHA256 using <secret>. The payload is readable by
+anyone holding the token, so it must not contain anything secret
+*/
+func SignToken(secret []byte, payload string, expiresAt time.Time) string {
+	body := payload + "|" + strconv.FormatInt(expiresAt.Unix(), 10)
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(body))
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(secret, encoded))
+}
+
+/*
+Returns the payload of a token created by SignToken. Returns ErrTokenInvalid
+if the token was not signed with <secret> or was tampered with, and
+ErrTokenExpired if it expired before <now>
+*/
+func VerifyToken(secret []byte, token string, now time.Time) (string, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return "", ErrTokenInvalid
+	}
+
+	decodedSignature, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(decodedSignature, tokenSignature(secret, encoded)) {
+		return "", ErrTokenInvalid
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrTokenInvalid
+	}
+
+	separator := strings.LastIndex(string(body), "|")
+	if separator == -1 {
+		return "", ErrTokenInvalid
+	}
+	expiresAt, err := strconv.ParseInt(string(body[separator+1:]), 10, 64)
+	if err != nil {
+		return "", ErrTokenInvalid
+	}
+	if !now.Before(time.Unix(expiresAt, 0)) {
+		return "", ErrTokenExpired
+	}
+
+	return string(body[:separator]), nil
+}
+
+func tokenSignature(secret []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -1,6 +1,6 @@
 import { useShoppingCartContext } from "../contexts/shoppingCartContext"
 import { FurnitureListing } from "../pages/Market"
-import { convertBase64ToImage } from "../util/image"
+import { getImageURL } from "../util/image"
 
 type Props = FurnitureListing
 
@@ -8,7 +8,7 @@ export default function CartItem(item: Props) {
 
   const { cart, setCart }  = useShoppingCartContext()
 
-  const imgURL = convertBase64ToImage(item.images[0])
+  const imgURL = getImageURL(item.imageIds[0], "medium")
 
   function removeFromCart() {
     const updatedCart = { ...cart }
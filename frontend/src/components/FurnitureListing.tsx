@@ -1,6 +1,6 @@
 import { useEffect, useState } from "react"
 import { useNavigate } from "react-router-dom"
-import { convertBase64ToImage } from "../util/image"
+import { getImageURL } from "../util/image"
 
 type Props = {
   listingID: string,
@@ -11,7 +11,7 @@ type Props = {
   style: string,
   condition: string,
   material: string,
-  images: string[],
+  imageIds: string[],
   userID: string,
   bought: string,
 }
@@ -29,8 +29,8 @@ export default function FurnitureListing(data: Props) {
   }
 
   useEffect(() => {
-    data.images.forEach((imageData) => {
-      const imageURL = convertBase64ToImage(imageData)
+    data.imageIds.forEach((imageId) => {
+      const imageURL = getImageURL(imageId, "thumbnail")
       setImageURLs([ ...imageURLs, imageURL ])
     })
 
@@ -1,5 +1,5 @@
 import { FurnitureListing } from "../pages/Market";
-import { convertBase64ToImage } from "../util/image";
+import { getImageURL } from "../util/image";
 import ImageSlider from "./ImageSlider";
 
 
@@ -12,7 +12,7 @@ type Props = {
 
 export default function HistoryDetail({ data, datePurchased, itemNumber }: Props) {
 
-  const iamgeURLs = data.images.map((url) => convertBase64ToImage(url))
+  const iamgeURLs = data.imageIds.map((imageId) => getImageURL(imageId, "medium"))
 
   return (
     <div className="history-detail_wrapper">
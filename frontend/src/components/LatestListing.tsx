@@ -1,6 +1,6 @@
 import { useState } from "react"
 import { FurnitureListing } from "../pages/Market"
-import { convertBase64ToImage } from "../util/image"
+import { getImageURL } from "../util/image"
 import ImageSlider from "./ImageSlider"
 import { Link } from "react-router-dom"
 
@@ -9,13 +9,13 @@ type Props = {
 }
 
 export default function LatestListing({ listing }: Props) {
-  // const [imageURL, setImageURL] = useState<string>(convertBase64ToImage(listing.images[0]))
+  // const [imageURL, setImageURL] = useState<string>(getImageURL(listing.imageIds[0]))
 
   return (
     <div className="latest-listing_wrapper">
       <h2>Latest Furniture Listed</h2>
       <Link to={`/market/${listing.listingID}`}>Go to listing</Link>
-      <ImageSlider imageURLs={listing.images.map((url) => convertBase64ToImage(url))}/>
+      <ImageSlider imageURLs={listing.imageIds.map((imageId) => getImageURL(imageId, "medium"))}/>
       {/* <img src={imageURL} alt="image of most recent furniture listing" /> */}
     </div>
   )
@@ -30,6 +30,24 @@ type SearchCategories = {
 }
 
 
+type FacetCount = {
+  value: string,
+  count: number,
+}
+
+/**
+ * Counts from GET /get_furnitures/facets of how many listings
+ * match each option of the filters
+ */
+type ListingFacets = {
+  types: FacetCount[],
+  styles: FacetCount[],
+  conditions: FacetCount[],
+  materials: FacetCount[],
+  prices: { min: string, max?: string, count: number }[],
+}
+
+
 type Props = {
   dataSet: FurnitureListing[]
   setDataSet: React.Dispatch<React.SetStateAction<FurnitureListing[]>>
@@ -63,6 +81,20 @@ function createSearchCategories(words: string[]): SearchCategories {
   return categories
 }
 
+// the select values are lowercase, but the backend filters by the enum values in types/furniture.go
+function titleCase(value: string): string {
+  return value.replace(/\b\w/g, c => c.toUpperCase())
+}
+
+// shows how many listings an option would match, like "Bed (3)"
+function withCount(label: string, counts?: FacetCount[]): string {
+  if (!counts) {
+    return label
+  }
+  const facet = counts.find(f => f.value.toLowerCase() === label.toLowerCase())
+  return `${label} (${facet ? facet.count : 0})`
+}
+
 const defaultPriceRange: PriceRange = {
   priceMin: 0,
   priceMax: MAX_PRICE_RANGE/2
@@ -89,6 +121,30 @@ export default function MarketFilter({ dataSet, setDataSet }: Props) {
   const styleRef = useRef<HTMLSelectElement>(null)
   const priceMinRef = useRef(null)
   const priceMaxRef = useRef(null)
+  const [facets, setFacets] = useState<ListingFacets>()
+
+  // recount whenever a filter changes, since each count depends on the other filters
+  useEffect(() => {
+    const params = new URLSearchParams()
+    const filters: [string, string][] = [
+      ["type", searchQuery.type],
+      ["material", searchQuery.material],
+      ["condition", searchQuery.condition],
+      ["style", searchQuery.style],
+    ]
+    filters.forEach(([key, value]) => {
+      if (value != "All") {
+        params.set(key, titleCase(value))
+      }
+    })
+
+    fetch(`http://localhost:3000/get_furnitures/facets?${params}`)
+      .then(res => res.json())
+      .then((data: ListingFacets) => setFacets(data))
+      .catch((err: any) => {
+        console.log("Error caught:", err)
+      })
+  }, [searchQuery.type, searchQuery.material, searchQuery.condition, searchQuery.style])
 
 
   function clearFilter(e: React.MouseEvent<HTMLButtonElement, MouseEvent>) {
@@ -212,12 +268,12 @@ export default function MarketFilter({ dataSet, setDataSet }: Props) {
               (e) => setSearchQuery({...searchQuery, type: e.currentTarget.value})
             } name="" id="">
               <option value="All">All</option>
-              <option value="bed">Bed</option>
-              <option value="table">Table</option>
-              <option value="chair">Chair</option>
-              <option value="nightstand">Nightstand</option>
-              <option value="desk">Desk</option>
-              <option value="lamp">Lamp</option>
+              <option value="bed">{withCount("Bed", facets?.types)}</option>
+              <option value="table">{withCount("Table", facets?.types)}</option>
+              <option value="chair">{withCount("Chair", facets?.types)}</option>
+              <option value="nightstand">{withCount("Nightstand", facets?.types)}</option>
+              <option value="desk">{withCount("Desk", facets?.types)}</option>
+              <option value="lamp">{withCount("Lamp", facets?.types)}</option>
             </select>
           </div>
 
@@ -227,14 +283,14 @@ export default function MarketFilter({ dataSet, setDataSet }: Props) {
               e => setSearchQuery({...searchQuery, material: e.currentTarget.value})
             } name="" id="">
               <option value="All">All</option>
-              <option value="tiger maple">Tiger Maple</option>
-              <option value="walnut">Walnut</option>
-              <option value="oak">Oak</option>
-              <option value="cherry">Cherry</option>
-              <option value="mahagony">Mahagony</option>
-              <option value="maple">Maple</option>
-              <option value="rosewood">Rosewood</option>
-              <option value="birch">Birch</option>
+              <option value="tiger maple">{withCount("Tiger Maple", facets?.materials)}</option>
+              <option value="walnut">{withCount("Walnut", facets?.materials)}</option>
+              <option value="oak">{withCount("Oak", facets?.materials)}</option>
+              <option value="cherry">{withCount("Cherry", facets?.materials)}</option>
+              <option value="mahogany">{withCount("Mahogany", facets?.materials)}</option>
+              <option value="maple">{withCount("Maple", facets?.materials)}</option>
+              <option value="rosewood">{withCount("Rosewood", facets?.materials)}</option>
+              <option value="birch">{withCount("Birch", facets?.materials)}</option>
             </select>
           </div>
 
@@ -244,12 +300,12 @@ export default function MarketFilter({ dataSet, setDataSet }: Props) {
               e => setSearchQuery({...searchQuery, condition: e.currentTarget.value})
             }  name="" id="">
               <option value="All">All</option>
-              <option value="mint">Mint</option>
-              <option value="excellent">Excellent</option>
-              <option value="good">Good</option>
-              <option value="worn">Worn</option>
-              <option value="restored">Restored</option>
-              <option value="original Finish">Original Finish</option>
+              <option value="mint">{withCount("Mint", facets?.conditions)}</option>
+              <option value="excellent">{withCount("Excellent", facets?.conditions)}</option>
+              <option value="good">{withCount("Good", facets?.conditions)}</option>
+              <option value="worn">{withCount("Worn", facets?.conditions)}</option>
+              <option value="restored">{withCount("Restored", facets?.conditions)}</option>
+              <option value="original Finish">{withCount("Original Finish", facets?.conditions)}</option>
             </select>
           </div>
 
@@ -259,12 +315,12 @@ export default function MarketFilter({ dataSet, setDataSet }: Props) {
               e => setSearchQuery({...searchQuery, style: e.currentTarget.value})
             }  name="" id="">
               <option value="All">All</option>
-              <option value="Victorian">Victorian</option>
-              <option value="English">English</option>
-              <option value="Baroque">Baroque</option>
-              <option value="Federal">Federal</option>
-              <option value="Rococo">Rococo</option>
-              <option value="Sheraton">Sheraton</option>
+              <option value="Victorian">{withCount("Victorian", facets?.styles)}</option>
+              <option value="English">{withCount("English", facets?.styles)}</option>
+              <option value="Baroque">{withCount("Baroque", facets?.styles)}</option>
+              <option value="Federal">{withCount("Federal", facets?.styles)}</option>
+              <option value="Rococo">{withCount("Rococo", facets?.styles)}</option>
+              <option value="Sheraton">{withCount("Sheraton", facets?.styles)}</option>
             </select>
           </div>
         </div>
@@ -1,8 +1,8 @@
 import { FurnitureListing } from "../pages/Market";
-import { convertBase64ToImage } from "../util/image";
+import { getImageURL } from "../util/image";
 
 export default function YourListing(listing: FurnitureListing) {
-  const imageURL = convertBase64ToImage(listing.images[0])
+  const imageURL = getImageURL(listing.imageIds[0], "medium")
 
   return (
     <div className="your-listing_wrapper">
@@ -3,7 +3,7 @@ import Navbar from "../components/Navbar";
 import { useEffect, useState } from "react";
 import { FurnitureListing } from "./Market";
 import { useShoppingCartContext } from "../contexts/shoppingCartContext";
-import { convertBase64ToImage } from "../util/image";
+import { getImageURL } from "../util/image";
 import ImageSlider from "../components/ImageSlider";
 
 export default function DetailedListing() {
@@ -33,7 +33,7 @@ export default function DetailedListing() {
     })
     .then((data: FurnitureListing) => {
       setListingData(data)
-      const urls = data.images.map(imageBase64 => convertBase64ToImage(imageBase64));
+      const urls = data.imageIds.map(imageId => getImageURL(imageId, "large"));
       setImageURLs(urls)
       console.log("detailed listing:", data)
     })
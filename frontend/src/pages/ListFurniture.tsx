@@ -259,7 +259,7 @@ export default function ListFurniture() {
                   type="file"
                   name="images"
                   id="images" 
-                  accept="image/jpeg,image/png"
+                  accept="image/jpeg,image/png,image/webp"
                   onChange={handleFileChange}
                   multiple
                 />
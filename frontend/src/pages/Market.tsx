@@ -17,36 +17,55 @@ export type FurnitureListing = {
   style: string,
   condition: string,
   material: string,
-  images: string[],
+  imageIds: string[],
   userID: string,
   bought: string,
 }
 
 
+/**
+ * One page of listings from GET /get_furnitures. nextCursor is
+ * only there when there are more listings to load
+ */
+export type ListingsPage = {
+  listings: FurnitureListing[],
+  nextCursor?: string,
+}
+
+
 export default function Market({ isLoggedIn }: Props) {
   const [data, setData] = useState<FurnitureListing[]>([])
   const [filteredData, setFilteredData] = useState<FurnitureListing[]>([])
+  const [nextCursor, setNextCursor] = useState<string | undefined>()
 
-  useEffect(() => {
+  function fetchListings(cursor?: string) {
     console.log("FETCHING FURNITURE LISTINGS");
 
-    fetch("http://localhost:3000/get_furnitures", {
+    const url = cursor
+      ? `http://localhost:3000/get_furnitures?cursor=${encodeURIComponent(cursor)}`
+      : "http://localhost:3000/get_furnitures"
+
+    fetch(url, {
       method: "GET",
       headers: {
         "Content-Type": "application/json"
       },
     })
       .then(res => res.json())
-      .then((data: FurnitureListing[]) => {
-        // console.log(data);
-        setData(data)
-        setFilteredData(data)
+      .then((page: ListingsPage) => {
+        // each page is added after the ones already loaded
+        const listings = cursor ? [ ...data, ...page.listings ] : page.listings
+        setData(listings)
+        setFilteredData(listings)
+        setNextCursor(page.nextCursor)
       })
       .catch((err: any) => {
         console.log("Error caught:", err)
       })
+  }
 
-
+  useEffect(() => {
+    fetchListings()
   }, [])
   
   return (
@@ -62,6 +81,10 @@ export default function Market({ isLoggedIn }: Props) {
               ))
             }
           </div>
+          {
+            nextCursor &&
+            <button className="load-more-btn" onClick={() => fetchListings(nextCursor)}>Load more</button>
+          }
         </section>
       </main>
     </>
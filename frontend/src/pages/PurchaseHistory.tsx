@@ -10,15 +10,25 @@ export type ProductItem = {
   sellerId: string
 }
 
+// the part of an order sold by one seller
+export type SubOrder = {
+  subOrderId: string,
+  sellerId: string,
+  items: ProductItem[],
+  subtotal: string,
+  estimatedDelivery: string,
+  trackingNumber?: string,
+  status: string,
+}
+
 export type OrderItem = {
   orderId: string,
   shippingAddress: ShippingAddress[],
   paymentMethod: string,
-  totalCost: number,
-  items: ProductItem[],
+  totalCost: string,
+  subOrders: SubOrder[],
   userId: string,
   datePurchased: string,
-  estimatedDelivery: string,
 }
 
 
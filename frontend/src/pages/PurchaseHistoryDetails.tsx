@@ -70,7 +70,7 @@ export default function PurchaseHistoryDetails() {
         }
 
         const order: OrderItem = await res.json()
-        const orderItems: FurnitureListing[] = await fetchOrderItems(order.items)
+        const orderItems: FurnitureListing[] = await fetchOrderItems(order.subOrders.flatMap((subOrder) => subOrder.items))
         setOrder(order)
         setOrderItems(orderItems)
 
@@ -32,7 +32,7 @@ export default function ShoppingCart() {
       shoppingCart: cartItems,
       paymentInfo: {
         paymentMethod: "credit",
-        amount: total,
+        amount: total.toFixed(2),
         currency: "usd"
       },
     }
@@ -58,7 +58,8 @@ export default function ShoppingCart() {
     })
     .catch((err: Error) => {
       console.error(err)
-      alert("You must be logged in to checkout.")
+      // e.g. an item was just bought or is being checked out by someone else
+      alert(err.message)
     })
 
   }
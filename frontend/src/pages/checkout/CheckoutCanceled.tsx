@@ -1,6 +1,25 @@
-import { Link } from "react-router-dom";
+import { useEffect } from "react";
+import { Link, useSearchParams } from "react-router-dom";
 
 export default function CheckoutCanceled() {
+  const [searchParams] = useSearchParams()
+
+  // release the listings held for the checkout right away, instead of when it expires
+  useEffect(() => {
+    const sessionID = searchParams.get("session_id")
+    if (!sessionID) {
+      return
+    }
+
+    fetch(`http://localhost:3000/checkout/${encodeURIComponent(sessionID)}/cancel`, {
+      method: "POST",
+      credentials: "include"
+    })
+    .catch((err: Error) => {
+      console.error(err)
+    })
+  }, [searchParams])
+
   return (
     <div className="checkout-canceled_page">
       <div>
@@ -9,4 +28,4 @@ export default function CheckoutCanceled() {
       </div>
     </div>
   )
-}
\ No newline at end of file
+}
@@ -1,17 +1,13 @@
 /**
- * Converts Base64 encoded string of an image 
- * to a BLOB and returns the URL of the image BLOB
+ * The sizes that the backend serves listing images at,
+ * from the smallest to the image as it was uploaded
  */
-export function convertBase64ToImage(base64Data: string): string {
-    const binaryStr = atob(base64Data)
+export type ImageSize = "thumbnail" | "medium" | "large" | "original"
 
-    const byteArray = new Uint8Array(binaryStr.length)
-    for (let i = 0; i < binaryStr.length; i++) {
-        byteArray[i] = binaryStr.charCodeAt(i)
-    }
-
-    const blob = new Blob([byteArray], { type: "image/png" })
-    const url = URL.createObjectURL(blob)
-
-    return url
-}
\ No newline at end of file
+/**
+ * Returns the URL that the image with the given ID is served
+ * from at the given size, so it can be used as an img src
+ */
+export function getImageURL(imageId: string, size: ImageSize = "original"): string {
+    return `http://localhost:3000/images/${imageId}?size=${size}`
+}